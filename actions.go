@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	componentButton   = "button"
+	maxComponents     = 5
+	maxComponentLabel = 80
+	maxComponentValue = 256
+
+	actionVia         = "action"
+	actionTimeout     = 5 * time.Second
+	maxActionResponse = 64 << 10
+	maxActionPost     = 4000
+)
+
+var actionNamePattern = regexp.MustCompile(`^[a-z0-9_.-]{1,64}$`)
+
+var (
+	errActionNotFound    = errors.New("action not found")
+	errComponentNotFound = errors.New("component not found")
+	errActionFailed      = errors.New("action failed")
+)
+
+var (
+	actionInvocations = newCounterVec("chat_action_invocations_total", "Action button presses, by kind of action and result.", "kind", "result")
+	actionClient      = &http.Client{Timeout: actionTimeout}
+)
+
+// Component is an interactive element of a chat message. The only type is
+// button: pressing it invokes the registered action Action with Value.
+type Component struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Label  string `json:"label"`
+	Action string `json:"action"`
+	Value  string `json:"value,omitempty"`
+}
+
+func checkComponents(chat *Chat) error {
+	if len(chat.Components) > maxComponents {
+		return fmt.Errorf("%w: a message has at most %d components", errInvalidRequest, maxComponents)
+	}
+	seen := map[string]bool{}
+	for _, c := range chat.Components {
+		if c.Type != componentButton {
+			return fmt.Errorf("%w: component type must be button", errInvalidRequest)
+		}
+		if !componentIDPattern.MatchString(c.ID) {
+			return fmt.Errorf("%w: component id %q must be 1-32 letters, digits, '_' or '-'", errInvalidRequest, c.ID)
+		}
+		if seen[c.ID] {
+			return fmt.Errorf("%w: component id %q is used twice", errInvalidRequest, c.ID)
+		}
+		seen[c.ID] = true
+		if c.Label == "" || !utf8.ValidString(c.Label) || utf8.RuneCountInString(c.Label) > maxComponentLabel {
+			return fmt.Errorf("%w: button labels are 1-%d characters", errInvalidRequest, maxComponentLabel)
+		}
+		if !actionNamePattern.MatchString(c.Action) {
+			return fmt.Errorf("%w: action must be 1-64 lowercase letters, digits, '_', '.' or '-'", errInvalidRequest)
+		}
+		if len(c.Value) > maxComponentValue || !utf8.ValidString(c.Value) {
+			return fmt.Errorf("%w: button values are limited to %d bytes of UTF-8", errInvalidRequest, maxComponentValue)
+		}
+	}
+	return nil
+}
+
+// ActionInvocation is a press of a button, as handed to its action.
+type ActionInvocation struct {
+	Action    string    `json:"action"`
+	Room      string    `json:"room"`
+	MessageID string    `json:"message_id"`
+	Component string    `json:"component"`
+	Value     string    `json:"value,omitempty"`
+	UserID    string    `json:"user_id"`
+	Time      time.Time `json:"time"`
+}
+
+// ActionResponse is what an action answers. Reply goes back to the user who
+// pressed the button only; Post is sent into the room from the action.
+type ActionResponse struct {
+	Reply string `json:"reply,omitempty"`
+	Post  string `json:"post,omitempty"`
+}
+
+type actionHandler interface {
+	Invoke(ctx context.Context, inv ActionInvocation) (ActionResponse, error)
+}
+
+type actionFunc func(ctx context.Context, inv ActionInvocation) (ActionResponse, error)
+
+func (f actionFunc) Invoke(ctx context.Context, inv ActionInvocation) (ActionResponse, error) {
+	return f(ctx, inv)
+}
+
+// acknowledgeAction is the built-in "ack" action, for alerts and the like:
+// it notes in the room who acknowledged the message.
+func acknowledgeAction(ctx context.Context, inv ActionInvocation) (ActionResponse, error) {
+	return ActionResponse{Post: inv.UserID + " acknowledged " + inv.MessageID}, nil
+}
+
+// WebhookAction is an action an admin registered: each press is POSTed to
+// URL as an ActionInvocation, signed with the action's secret in
+// X-Signature, hex HMAC-SHA256 of the X-Timestamp, a newline and the body.
+// The endpoint may answer with an ActionResponse.
+type WebhookAction struct {
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	CreatedAt time.Time `json:"created_at"`
+	secret    []byte
+}
+
+func (a *WebhookAction) Invoke(ctx context.Context, inv ActionInvocation) (ActionResponse, error) {
+	body, err := json.Marshal(inv)
+	if err != nil {
+		return ActionResponse{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.URL, bytes.NewReader(body))
+	if err != nil {
+		return ActionResponse{}, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, a.secret)
+	fmt.Fprintf(mac, "%s\n%s", timestamp, body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := actionClient.Do(req)
+	if err != nil {
+		return ActionResponse{}, withDetails(errActionFailed, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return ActionResponse{}, withDetails(errActionFailed, "the action answered "+resp.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxActionResponse))
+	if err != nil {
+		return ActionResponse{}, withDetails(errActionFailed, err.Error())
+	}
+	out := ActionResponse{}
+	if len(bytes.TrimSpace(raw)) > 0 && json.Unmarshal(raw, &out) != nil {
+		return ActionResponse{}, withDetails(errActionFailed, "the action's answer is not an action response")
+	}
+	return out, nil
+}
+
+// actionRegistry maps action names to their handlers: built-in ones
+// registered at startup and webhooks admins register at runtime.
+type actionRegistry struct {
+	mu       sync.RWMutex
+	builtin  map[string]actionHandler
+	webhooks map[string]*WebhookAction
+}
+
+func newActionRegistry() *actionRegistry {
+	ar := &actionRegistry{builtin: make(map[string]actionHandler), webhooks: make(map[string]*WebhookAction)}
+	ar.Register("ack", actionFunc(acknowledgeAction))
+	return ar
+}
+
+// Register adds a built-in action, which webhooks can't replace.
+func (ar *actionRegistry) Register(name string, h actionHandler) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	ar.builtin[name] = h
+}
+
+// Lookup returns the handler of the action name and whether it is built in.
+func (ar *actionRegistry) Lookup(name string) (actionHandler, bool, bool) {
+	ar.mu.RLock()
+	defer ar.mu.RUnlock()
+	if h, ok := ar.builtin[name]; ok {
+		return h, true, true
+	}
+	if a, ok := ar.webhooks[name]; ok {
+		return a, false, true
+	}
+	return nil, false, false
+}
+
+// Put registers or replaces the webhook action a and returns its new secret.
+func (ar *actionRegistry) Put(a *WebhookAction) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(raw)
+	a.secret = []byte(secret)
+
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	if _, ok := ar.builtin[a.Name]; ok {
+		return "", fmt.Errorf("%w: %s is a built-in action", errForbidden, a.Name)
+	}
+	ar.webhooks[a.Name] = a
+	return secret, nil
+}
+
+func (ar *actionRegistry) Remove(name string) bool {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	_, ok := ar.webhooks[name]
+	delete(ar.webhooks, name)
+	return ok
+}
+
+type ActionList struct {
+	Builtin  []string        `json:"builtin"`
+	Webhooks []WebhookAction `json:"webhooks"`
+}
+
+func (ar *actionRegistry) List() ActionList {
+	ar.mu.RLock()
+	defer ar.mu.RUnlock()
+	list := ActionList{Builtin: slices.Sorted(maps.Keys(ar.builtin)), Webhooks: make([]WebhookAction, 0, len(ar.webhooks))}
+	for _, name := range slices.Sorted(maps.Keys(ar.webhooks)) {
+		list.Webhooks = append(list.Webhooks, *ar.webhooks[name])
+	}
+	return list
+}
+
+type putActionRequest struct {
+	URL string `json:"url"`
+}
+
+// putActionHandler registers a webhook action, or replaces one and its
+// secret. The secret is only ever in this answer.
+func putActionHandler(actions *actionRegistry, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !actionNamePattern.MatchString(name) {
+			writeError(w, r, fmt.Errorf("%w: action names are 1-64 lowercase letters, digits, '_', '.' or '-'", errInvalidRequest))
+			return
+		}
+		req := putActionRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+		if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			writeError(w, r, fmt.Errorf("%w: url must be an absolute http or https URL", errInvalidRequest))
+			return
+		}
+
+		action := &WebhookAction{Name: name, URL: req.URL, CreatedAt: time.Now().UTC()}
+		secret, err := actions.Put(action)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record(auditActor(r), "action.put", "", "name="+name+" url="+req.URL)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			WebhookAction
+			Secret string `json:"secret"`
+		}{*action, secret})
+	}
+}
+
+func deleteActionHandler(actions *actionRegistry, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !actions.Remove(name) {
+			writeError(w, r, errActionNotFound)
+			return
+		}
+		audit.Record(auditActor(r), "action.delete", "", "name="+name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func listActionsHandler(actions *actionRegistry) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(actions.List())
+	}
+}
+
+// invokeActionHandler presses a button of a message for the caller. The
+// action's reply comes back in the answer; what it posts goes into the room
+// from "action:<name>".
+func invokeActionHandler(broker *Broker, rooms *roomRegistry, actions *actionRegistry) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromRequest(r)
+		if user == "" {
+			writeError(w, r, errUnauthenticated)
+			return
+		}
+		env, ok := broker.Message(r.PathValue("id"))
+		if !ok || env.Event != "" {
+			writeError(w, r, errMessageNotFound)
+			return
+		}
+		if !rooms.CanAccess(env.Room, user) {
+			writeError(w, r, errNotMember)
+			return
+		}
+		chat := Chat{}
+		if err := json.Unmarshal(env.Data, &chat); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		i := slices.IndexFunc(chat.Components, func(c Component) bool { return c.ID == r.PathValue("component") })
+		if i < 0 {
+			writeError(w, r, errComponentNotFound)
+			return
+		}
+		component := chat.Components[i]
+		handler, builtin, ok := actions.Lookup(component.Action)
+		if !ok {
+			writeError(w, r, errActionNotFound)
+			return
+		}
+		kind := "webhook"
+		if builtin {
+			kind = "builtin"
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), actionTimeout)
+		defer cancel()
+		resp, err := handler.Invoke(ctx, ActionInvocation{
+			Action:    component.Action,
+			Room:      env.Room,
+			MessageID: env.ID,
+			Component: component.ID,
+			Value:     component.Value,
+			UserID:    user,
+			Time:      time.Now().UTC(),
+		})
+		if err != nil {
+			actionInvocations.With(kind, "failed").Add(1)
+			if !errors.Is(err, errActionFailed) {
+				log.Printf("Action %s: %v", component.Action, err)
+				err = errActionFailed
+			}
+			writeError(w, r, err)
+			return
+		}
+		actionInvocations.With(kind, "invoked").Add(1)
+
+		if post := strings.TrimSpace(resp.Post); post != "" {
+			if len(post) > maxActionPost {
+				post = strings.ToValidUTF8(post[:maxActionPost], "")
+			}
+			if err := postActionMessage(broker, rooms, env.Room, component.Action, post); err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ActionResponse{Reply: resp.Reply})
+	}
+}
+
+func postActionMessage(broker *Broker, rooms *roomRegistry, room, action, message string) error {
+	if err := broker.Admit(); err != nil {
+		return err
+	}
+	chat := Chat{Room: room, UserID: "action:" + action, Message: message, Via: actionVia}
+	if err := rooms.Moderate(room, &chat); err != nil {
+		return err
+	}
+	chatRaw, err := json.Marshal(chat)
+	if err != nil {
+		return err
+	}
+	_, err = broker.Publish(room, chatRaw)
+	return err
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type announcementRequest struct {
+	Message string `json:"message"`
+}
+
+type Announcement struct {
+	Message string `json:"message"`
+}
+
+func listRoomsHandler(rooms *roomRegistry) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rooms.List())
+	}
+}
+
+func listSubscribersHandler(broker *Broker) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(broker.Subscribers(r.URL.Query().Get("room")))
+	}
+}
+
+// announceHandler publishes an "announcement" event into a room. Unlike chat
+// messages it bypasses room modes and moderation.
+func announceHandler(broker *Broker, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room := r.PathValue("room")
+
+		req := announcementRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+		if req.Message == "" {
+			writeError(w, r, fmt.Errorf("%w: message required", errInvalidRequest))
+			return
+		}
+
+		announcementRaw, err := json.Marshal(Announcement{Message: req.Message})
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		env, err := broker.PublishEvent(room, "announcement", announcementRaw)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record(auditActor(r), "room.announce", room, req.Message)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(env)
+	}
+}
+
+func kickUserHandler(broker *Broker, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.PathValue("user")
+		kicked := broker.Kick(user)
+		audit.Record(auditActor(r), "user.kick", "", "user="+user+" streams="+strconv.Itoa(kicked))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"kicked": kicked})
+	}
+}
+
+// writeHistory writes the history of room as newline-delimited JSON
+// envelopes: everything persisted when there is a store, the in-memory
+// history otherwise.
+func writeHistory(ctx context.Context, w io.Writer, tiers *tieredHistory, room string) error {
+	enc := json.NewEncoder(w)
+	return tiers.Export(ctx, room, func(env Envelope) error {
+		return enc.Encode(env)
+	})
+}
+
+func exportHistoryHandler(tiers *tieredHistory) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room := r.PathValue("room")
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", room+".ndjson"))
+		writeHistory(r.Context(), w, tiers, room)
+	}
+}
+
+type Export struct {
+	Name string `json:"name"`
+	Room string `json:"room"`
+	URL  string `json:"url"`
+}
+
+// createExportHandler writes a room's history into the blob store and returns
+// where to fetch it, presigned if the store supports it.
+func createExportHandler(tiers *tieredHistory, blobs BlobStore, presignTTL time.Duration, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room := r.PathValue("room")
+
+		buf := &bytes.Buffer{}
+		if err := writeHistory(r.Context(), buf, tiers, room); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		ID, err := newAttachmentID()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		export := Export{Name: fmt.Sprintf("%d-%s.ndjson", time.Now().Unix(), ID), Room: room}
+		if err := blobs.Put(r.Context(), "exports/"+export.Name, "application/x-ndjson", buf); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		export.URL = absoluteURL(r, "/admin/exports/"+export.Name)
+		if presigner, ok := blobs.(blobPresigner); ok {
+			signed, err := presigner.PresignGet(r.Context(), "exports/"+export.Name, presignTTL)
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			export.URL = signed
+		}
+		audit.Record("admin", "room.export", room, export.Name)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(export)
+	}
+}
+
+func downloadExportHandler(blobs BlobStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, contentType, err := blobs.Get(r.Context(), "exports/"+r.PathValue("name"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer body.Close()
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", r.PathValue("name")))
+		io.Copy(w, body)
+	}
+}
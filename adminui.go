@@ -0,0 +1,38 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed adminui
+var adminUIFiles embed.FS
+
+// adminUIHandler serves the admin web UI under /admin/ui/. The page holds no
+// data of its own: it asks for the admin or moderator token and calls the
+// admin API with it, so it can do no more than the token can. Without an
+// admin token the admin API is disabled and so is the UI.
+func adminUIHandler(adminToken string) func(w http.ResponseWriter, r *http.Request) {
+	files, _ := fs.Sub(adminUIFiles, "adminui")
+	server := http.StripPrefix("/admin/ui/", http.FileServerFS(files))
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			writeError(w, r, errAdminDisabled)
+			return
+		}
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'; base-uri 'none'; form-action 'none'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		w.Header().Set("Cache-Control", "no-cache")
+		server.ServeHTTP(w, r)
+	}
+}
+
+// whoamiHandler tells the admin UI which role its token has, so it only
+// offers what that role may do.
+func whoamiHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"role": auditActor(r)})
+}
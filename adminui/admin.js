@@ -0,0 +1,310 @@
+'use strict';
+
+// The admin UI keeps its token in sessionStorage and sends it as a bearer
+// token with every admin API call. Everything it shows comes from those
+// calls; the server decides what the token may do.
+
+const refreshInterval = 5000;
+const chartPoints = 60;
+const charts = [
+  { metric: 'chat_live_streams', label: 'Live streams' },
+  { metric: 'chat_subscribers', label: 'Subscribers' },
+  { metric: 'chat_api_requests_total', label: 'API requests/s', rate: true },
+  { metric: 'chat_delivery_queue_saturation', label: 'Delivery queue saturation' },
+  { metric: 'chat_subscriber_buffer_fill', label: 'Subscriber buffer fill' },
+  { metric: 'chat_dropped_events_total', label: 'Dropped events/s', rate: true },
+];
+
+const $ = (id) => document.getElementById(id);
+let role = '';
+let timer = null;
+
+function token() {
+  return sessionStorage.getItem('adminToken') || '';
+}
+
+async function api(method, path, body) {
+  const opts = { method, headers: { Authorization: 'Bearer ' + token() } };
+  if (body !== undefined) {
+    opts.headers['Content-Type'] = 'application/json';
+    opts.body = typeof body === 'string' ? body : JSON.stringify(body);
+  }
+  const resp = await fetch(path, opts);
+  if (!resp.ok) {
+    let message = resp.status + ' ' + resp.statusText;
+    try {
+      const err = await resp.json();
+      message = err.message || message;
+    } catch (_) {}
+    throw new Error(message);
+  }
+  const type = resp.headers.get('Content-Type') || '';
+  return type.startsWith('application/json') ? resp.json() : resp.text();
+}
+
+function showStatus(err) {
+  $('status').textContent = err ? String(err.message || err) : '';
+}
+
+function cell(row, value) {
+  const td = document.createElement('td');
+  td.textContent = value == null ? '' : String(value);
+  row.appendChild(td);
+  return td;
+}
+
+function action(row, label, fn) {
+  const td = row.lastElementChild && row.lastElementChild.dataset.actions ? row.lastElementChild : cell(row, '');
+  td.dataset.actions = 'true';
+  const button = document.createElement('button');
+  button.textContent = label;
+  button.addEventListener('click', async () => {
+    try {
+      await fn();
+      showStatus();
+      refresh();
+    } catch (err) {
+      showStatus(err);
+    }
+  });
+  td.appendChild(button);
+}
+
+function fill(tbody, items, render) {
+  tbody.replaceChildren();
+  for (const item of items || []) {
+    const row = document.createElement('tr');
+    render(row, item);
+    tbody.appendChild(row);
+  }
+}
+
+const enc = encodeURIComponent;
+
+async function loadSubscribers() {
+  const room = $('subscriberRoom').value.trim();
+  const subscribers = await api('GET', '/admin/subscribers' + (room ? '?room=' + enc(room) : ''));
+  fill($('subscribers'), subscribers, (row, s) => {
+    cell(row, s.id);
+    cell(row, s.user_id);
+    cell(row, (s.rooms || []).join(', '));
+    cell(row, [s.origin && s.origin.country, s.origin && s.origin.region].filter(Boolean).join(' / '));
+    cell(row, s.dropped);
+    if (s.user_id) {
+      action(row, 'Kick', () => api('POST', '/admin/users/' + enc(s.user_id) + '/kick'));
+      action(row, 'Ban', () => api('PUT', '/admin/bans/' + enc(s.user_id), {}));
+    }
+  });
+}
+
+async function loadRooms() {
+  const rooms = await api('GET', '/admin/rooms');
+  fill($('rooms'), rooms, (row, r) => {
+    cell(row, r.name);
+    cell(row, r.owner);
+    cell(row, r.mode);
+    cell(row, [r.private && 'private', r.public_stream && 'public stream', r.encrypted && 'encrypted', r.moderation && 'moderated']
+      .filter(Boolean).join(', '));
+    action(row, 'Subscribers', async () => { $('subscriberRoom').value = r.name; });
+    if (role === 'admin') {
+      action(row, 'Export', () => exportHistory(r.name));
+    }
+  });
+}
+
+async function exportHistory(room) {
+  const resp = await fetch('/admin/rooms/' + enc(room) + '/history', { headers: { Authorization: 'Bearer ' + token() } });
+  if (!resp.ok) {
+    throw new Error('export failed: ' + resp.status);
+  }
+  const link = document.createElement('a');
+  link.href = URL.createObjectURL(await resp.blob());
+  link.download = room + '.ndjson';
+  link.click();
+  URL.revokeObjectURL(link.href);
+}
+
+async function loadBans() {
+  const bans = await api('GET', '/admin/bans');
+  fill($('bans'), bans, (row, b) => {
+    cell(row, b.user_id);
+    cell(row, b.reason);
+    cell(row, new Date(b.since).toLocaleString());
+    action(row, 'Unban', () => api('DELETE', '/admin/bans/' + enc(b.user_id)));
+  });
+}
+
+async function loadSpam() {
+  const report = await api('GET', '/admin/spam');
+  fill($('spam'), report.users, (row, u) => {
+    cell(row, u.user_id);
+    cell(row, u.score.toFixed(2));
+    cell(row, u.muted ? 'yes' : 'no');
+    if (u.muted) {
+      action(row, 'Unmute', () => api('POST', '/admin/spam/' + enc(u.user_id) + '/unmute'));
+    } else {
+      action(row, 'Mute', () => api('POST', '/admin/spam/' + enc(u.user_id) + '/mute'));
+    }
+  });
+}
+
+async function loadLoad() {
+  $('load').textContent = JSON.stringify(await api('GET', '/admin/load'), null, 2);
+}
+
+// Metrics are read from the Prometheus text exposition and summed over
+// labels; counters are charted as a rate between refreshes.
+const series = new Map();
+
+function parseMetrics(text) {
+  const values = new Map();
+  for (const line of text.split('\n')) {
+    if (!line || line.startsWith('#')) {
+      continue;
+    }
+    const match = line.match(/^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[^}]*\})?\s+(\S+)/);
+    if (match) {
+      values.set(match[1], (values.get(match[1]) || 0) + Number(match[3]));
+    }
+  }
+  return values;
+}
+
+function drawChart(chart, points) {
+  let box = document.querySelector('.chart[data-metric="' + chart.metric + '"]');
+  if (!box) {
+    box = document.createElement('div');
+    box.className = 'chart';
+    box.dataset.metric = chart.metric;
+    box.append(document.createElement('span'), document.createElement('strong'), document.createElement('canvas'));
+    box.querySelector('span').textContent = chart.label;
+    $('charts').appendChild(box);
+  }
+  const last = points.length ? points[points.length - 1] : 0;
+  box.querySelector('strong').textContent = Number.isInteger(last) ? String(last) : last.toFixed(2);
+
+  const canvas = box.querySelector('canvas');
+  canvas.width = canvas.clientWidth || 240;
+  canvas.height = 60;
+  const ctx = canvas.getContext('2d');
+  ctx.clearRect(0, 0, canvas.width, canvas.height);
+  const peak = Math.max(...points, 1e-9);
+  ctx.strokeStyle = '#2962ff';
+  ctx.beginPath();
+  points.forEach((value, i) => {
+    const x = (i / (chartPoints - 1)) * canvas.width;
+    const y = canvas.height - (value / peak) * (canvas.height - 4) - 2;
+    i === 0 ? ctx.moveTo(x, y) : ctx.lineTo(x, y);
+  });
+  ctx.stroke();
+}
+
+async function loadMetrics() {
+  const resp = await fetch('/metrics');
+  const values = parseMetrics(await resp.text());
+  const now = Date.now();
+  for (const chart of charts) {
+    const state = series.get(chart.metric) || { points: [] };
+    const value = values.get(chart.metric) || 0;
+    let point = value;
+    if (chart.rate) {
+      point = state.last === undefined ? 0 : Math.max(0, (value - state.last) / ((now - state.at) / 1000));
+      state.last = value;
+      state.at = now;
+    }
+    state.points.push(point);
+    state.points = state.points.slice(-chartPoints);
+    series.set(chart.metric, state);
+    drawChart(chart, state.points);
+  }
+}
+
+async function refresh() {
+  const loaders = [loadSubscribers, loadRooms, loadBans, loadSpam, loadMetrics];
+  if (role === 'admin') {
+    loaders.push(loadLoad);
+  }
+  const results = await Promise.allSettled(loaders.map((load) => load()));
+  const failed = results.find((r) => r.status === 'rejected');
+  showStatus(failed && failed.reason);
+}
+
+async function signIn() {
+  try {
+    role = (await api('GET', '/admin/whoami')).role;
+  } catch (err) {
+    sessionStorage.removeItem('adminToken');
+    $('signInError').textContent = err.message;
+    return;
+  }
+  $('signInError').textContent = '';
+  $('role').textContent = 'Signed in as ' + role;
+  $('signIn').hidden = true;
+  $('signOut').hidden = false;
+  $('console').hidden = false;
+  for (const el of document.querySelectorAll('[data-role="admin"]')) {
+    el.hidden = role !== 'admin';
+  }
+  refresh();
+  timer = setInterval(refresh, refreshInterval);
+}
+
+function signOut() {
+  sessionStorage.removeItem('adminToken');
+  clearInterval(timer);
+  role = '';
+  $('role').textContent = '';
+  $('signIn').hidden = false;
+  $('signOut').hidden = true;
+  $('console').hidden = true;
+}
+
+function onSubmit(id, fn) {
+  $(id).addEventListener('submit', async (e) => {
+    e.preventDefault();
+    try {
+      await fn();
+      showStatus();
+      refresh();
+    } catch (err) {
+      showStatus(err);
+    }
+  });
+}
+
+$('signInButton').addEventListener('click', () => {
+  sessionStorage.setItem('adminToken', $('token').value.trim());
+  $('token').value = '';
+  signIn();
+});
+$('signOut').addEventListener('click', signOut);
+$('subscriberRoom').addEventListener('change', () => loadSubscribers().catch(showStatus));
+
+onSubmit('announce', async () => {
+  await api('POST', '/admin/rooms/' + enc($('announceRoom').value.trim()) + '/announce', { message: $('announceMessage').value });
+  $('announceMessage').value = '';
+});
+onSubmit('ban', async () => {
+  await api('PUT', '/admin/bans/' + enc($('banUser').value.trim()), { reason: $('banReason').value });
+  $('banUser').value = $('banReason').value = '';
+});
+onSubmit('mute', async () => {
+  await api('POST', '/admin/spam/' + enc($('muteUser').value.trim()) + '/mute');
+  $('muteUser').value = '';
+});
+onSubmit('moderation', async () => {
+  await api('PUT', '/admin/rooms/' + enc($('moderationRoom').value.trim()) + '/moderation', $('moderationPolicy').value || '{}');
+});
+$('moderationLoad').addEventListener('click', async () => {
+  try {
+    const policy = await api('GET', '/admin/rooms/' + enc($('moderationRoom').value.trim()) + '/moderation');
+    $('moderationPolicy').value = JSON.stringify(policy, null, 2);
+    showStatus();
+  } catch (err) {
+    showStatus(err);
+  }
+});
+
+if (token()) {
+  signIn();
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	analyticsQueueSize = 10000
+	analyticsTimeout   = 10 * time.Second
+	analyticsAttempts  = 3
+	// analyticsCloseTimeout bounds the last flush at shutdown.
+	analyticsCloseTimeout = 5 * time.Second
+
+	analyticsSinkStdout  = "stdout"
+	analyticsSinkHTTP    = "http"
+	analyticsSinkSegment = "segment"
+
+	segmentBatchURL = "https://api.segment.io/v1/batch"
+)
+
+var (
+	analyticsExported = newCounterVec("chat_analytics_events_total", "Envelopes handed to the analytics sink, by result.", "result")
+	analyticsClient   = &http.Client{Timeout: analyticsTimeout}
+)
+
+// AnalyticsEvent is what sinks get for an envelope. Message text never goes
+// out: chat messages are described by their shape in Properties, and other
+// events by their name alone.
+type AnalyticsEvent struct {
+	ID         string         `json:"id"`
+	Event      string         `json:"event"`
+	Room       string         `json:"room,omitempty"`
+	Seq        uint64         `json:"seq,omitempty"`
+	Time       time.Time      `json:"time"`
+	UserID     string         `json:"user_id,omitempty"`
+	Origin     string         `json:"origin,omitempty"`
+	Properties map[string]any `json:"properties,omitempty"`
+}
+
+func analyticsEventOf(env Envelope) AnalyticsEvent {
+	e := AnalyticsEvent{ID: env.ID, Event: env.Event, Room: env.Room, Seq: env.Seq, Time: env.Time, Origin: env.Origin}
+	if env.Event != "" {
+		var sender struct {
+			UserID string `json:"user_id"`
+		}
+		json.Unmarshal(env.Data, &sender)
+		e.UserID = sender.UserID
+		return e
+	}
+
+	e.Event = "message"
+	chat := Chat{}
+	if json.Unmarshal(env.Data, &chat) != nil {
+		return e
+	}
+	e.UserID = chat.UserID
+	e.Properties = map[string]any{
+		"content_type": cmp.Or(chat.ContentType, contentPlain),
+		"length":       len(chat.Message),
+		"encrypted":    chat.Ciphertext != "",
+	}
+	if chat.Attachment != nil {
+		e.Properties["attachment"] = chat.Attachment.Kind
+	}
+	if chat.Via != "" {
+		e.Properties["via"] = chat.Via
+	}
+	if chat.ForwardedFrom != nil {
+		e.Properties["forwarded"] = true
+	}
+	if chat.Poll != nil {
+		e.Properties["poll"] = true
+	}
+	if len(chat.Metadata) > 0 {
+		e.Properties["metadata"] = chat.Metadata
+	}
+	return e
+}
+
+// analyticsSink ships a batch of events somewhere.
+type analyticsSink interface {
+	Export(ctx context.Context, events []AnalyticsEvent) error
+}
+
+// stdoutSink writes one JSON line per event, for a log shipper to pick up.
+type stdoutSink struct {
+	w io.Writer
+}
+
+func (s stdoutSink) Export(ctx context.Context, events []AnalyticsEvent) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	_, err := s.w.Write(buf.Bytes())
+	return err
+}
+
+// httpSink POSTs each batch to a collector as {"events": [...]}, with the
+// key, if any, as a bearer token.
+type httpSink struct {
+	url string
+	key string
+}
+
+func (s httpSink) Export(ctx context.Context, events []AnalyticsEvent) error {
+	body, err := json.Marshal(map[string]any{"events": events})
+	if err != nil {
+		return err
+	}
+	return postAnalytics(ctx, s.url, body, func(req *http.Request) {
+		if s.key != "" {
+			req.Header.Set("Authorization", "Bearer "+s.key)
+		}
+	})
+}
+
+// segmentSink sends each batch to a Segment-compatible batch API as track
+// calls, authenticated with the write key.
+type segmentSink struct {
+	url      string
+	writeKey string
+}
+
+type segmentTrack struct {
+	Type        string         `json:"type"`
+	Event       string         `json:"event"`
+	MessageID   string         `json:"messageId"`
+	UserID      string         `json:"userId,omitempty"`
+	AnonymousID string         `json:"anonymousId,omitempty"`
+	Timestamp   time.Time      `json:"timestamp"`
+	Properties  map[string]any `json:"properties"`
+}
+
+func (s segmentSink) Export(ctx context.Context, events []AnalyticsEvent) error {
+	batch := make([]segmentTrack, 0, len(events))
+	for _, e := range events {
+		properties := map[string]any{"room": e.Room, "seq": e.Seq}
+		for key, value := range e.Properties {
+			properties[key] = value
+		}
+		if e.Origin != "" {
+			properties["origin"] = e.Origin
+		}
+		track := segmentTrack{Type: "track", Event: "Chat " + e.Event, MessageID: e.ID, UserID: e.UserID, Timestamp: e.Time, Properties: properties}
+		if track.UserID == "" {
+			// Segment wants someone behind every call; events nobody sent
+			// are the server's.
+			track.AnonymousID = "chat-server"
+		}
+		batch = append(batch, track)
+	}
+	body, err := json.Marshal(map[string]any{"batch": batch, "sentAt": time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	return postAnalytics(ctx, s.url, body, func(req *http.Request) { req.SetBasicAuth(s.writeKey, "") })
+}
+
+func postAnalytics(ctx context.Context, url string, body []byte, authorize func(*http.Request)) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	authorize(req)
+	resp, err := analyticsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// newAnalyticsSink builds the sink -analytics names.
+func newAnalyticsSink(kind, collector, key string) (analyticsSink, error) {
+	switch kind {
+	case analyticsSinkStdout:
+		return stdoutSink{w: os.Stdout}, nil
+	case analyticsSinkHTTP:
+		if u, err := url.Parse(collector); err != nil || u.Host == "" {
+			return nil, fmt.Errorf("-analytics http needs an absolute -analytics-url")
+		}
+		return httpSink{url: collector, key: key}, nil
+	case analyticsSinkSegment:
+		if key == "" {
+			return nil, fmt.Errorf("-analytics segment needs the write key in -analytics-key")
+		}
+		return segmentSink{url: cmp.Or(collector, segmentBatchURL), writeKey: key}, nil
+	}
+	return nil, fmt.Errorf("-analytics must be stdout, http or segment, not %q", kind)
+}
+
+// analyticsExporter hands every envelope the broker delivers to a sink, off
+// the delivery path: Observe only queues it, and a worker converts and sends
+// batches of up to size, at least every interval. A full queue drops rather
+// than slow delivery down, and a batch the sink still refuses after a few
+// attempts is dropped too. Every node exports what it delivers, so it
+// should be enabled on one node only.
+type analyticsExporter struct {
+	sink     analyticsSink
+	size     int
+	interval time.Duration
+
+	queue     chan Envelope
+	closing   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newAnalyticsExporter(sink analyticsSink, size int, interval time.Duration) *analyticsExporter {
+	e := &analyticsExporter{
+		sink:     sink,
+		size:     max(size, 1),
+		interval: interval,
+		queue:    make(chan Envelope, analyticsQueueSize),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	newGaugeFunc("chat_analytics_queue", "Envelopes waiting to be exported to analytics.", func() float64 { return float64(len(e.queue)) })
+	go e.run()
+	return e
+}
+
+func (e *analyticsExporter) Observe(env Envelope) {
+	select {
+	case e.queue <- env:
+	default:
+		analyticsExported.With("dropped").Add(1)
+	}
+}
+
+func (e *analyticsExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	batch := make([]AnalyticsEvent, 0, e.size)
+	flush := func(ctx context.Context) {
+		if len(batch) > 0 {
+			e.export(ctx, batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case env := <-e.queue:
+			if batch = append(batch, analyticsEventOf(env)); len(batch) >= e.size {
+				flush(context.Background())
+			}
+		case <-ticker.C:
+			flush(context.Background())
+		case <-e.closing:
+			ctx, cancel := context.WithTimeout(context.Background(), analyticsCloseTimeout)
+			defer cancel()
+		drain:
+			for {
+				select {
+				case env := <-e.queue:
+					if batch = append(batch, analyticsEventOf(env)); len(batch) >= e.size {
+						flush(ctx)
+					}
+				default:
+					break drain
+				}
+			}
+			flush(ctx)
+			return
+		}
+	}
+}
+
+func (e *analyticsExporter) export(ctx context.Context, batch []AnalyticsEvent) {
+	var err error
+	for attempt := range analyticsAttempts {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Duration(attempt) * time.Second):
+			}
+		}
+		if err = e.sink.Export(ctx, batch); err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		log.Printf("Analytics: dropping %d events: %v", len(batch), err)
+		analyticsExported.With("failed").Add(uint64(len(batch)))
+		return
+	}
+	analyticsExported.With("exported").Add(uint64(len(batch)))
+}
+
+// Close exports what is still queued and waits for it, within
+// analyticsCloseTimeout.
+func (e *analyticsExporter) Close() {
+	e.closeOnce.Do(func() { close(e.closing) })
+	<-e.done
+}
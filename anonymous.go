@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errRateLimited = errors.New("rate limited")
+
+	anonymousRequests = newCounterVec("chat_anonymous_requests_total", "Unauthenticated stream and replay requests by result.", "result")
+)
+
+// anonymousLimiter rate limits unauthenticated readers per remote address,
+// separately from and usually tighter than signed-in users.
+type anonymousLimiter struct {
+	rate      float64
+	burst     float64
+	tightened atomic.Bool
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// newAnonymousLimiter allows perMinute requests a minute from each address;
+// zero or less disables the limit.
+func newAnonymousLimiter(perMinute float64) *anonymousLimiter {
+	l := &anonymousLimiter{rate: perMinute / 60, burst: max(perMinute/6, 1), buckets: make(map[string]*tokenBucket)}
+	if perMinute > 0 {
+		go l.sweep()
+	}
+	return l
+}
+
+// Allow takes a request from host's allowance, returning how long to wait if
+// there is none left.
+func (l *anonymousLimiter) Allow(host string) (bool, time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	bucket, ok := l.buckets[host]
+	if !ok {
+		bucket = newTokenBucket(l.rate, l.burst)
+		l.buckets[host] = bucket
+	}
+	l.mu.Unlock()
+
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	bucket.refill(time.Now())
+	cost := 1.0
+	if l.tightened.Load() {
+		cost = min(2, l.burst)
+	}
+	if bucket.tokens < cost {
+		return false, time.Duration((cost - bucket.tokens) / bucket.rate * float64(time.Second))
+	}
+	bucket.tokens -= cost
+	return true, 0
+}
+
+// Tighten halves every address's allowance while on.
+func (l *anonymousLimiter) Tighten(on bool) {
+	l.tightened.Store(on)
+}
+
+// sweep forgets addresses whose allowance has fully refilled.
+func (l *anonymousLimiter) sweep() {
+	for range time.Tick(time.Minute) {
+		l.mu.Lock()
+		now := time.Now()
+		for host, bucket := range l.buckets {
+			bucket.mu.Lock()
+			bucket.refill(now)
+			full := bucket.tokens >= bucket.burst
+			bucket.mu.Unlock()
+			if full {
+				delete(l.buckets, host)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// anonymousGuard applies to streams opened without a user. With allowAll
+// false only rooms marked public_stream can be read that way, and every
+// anonymous stream counts against the limiter of its address.
+func anonymousGuard(rooms *roomRegistry, limiter *anonymousLimiter, allowAll bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if userFromRequest(r) != "" {
+			next(w, r)
+			return
+		}
+
+		streamRooms, err := roomsFromRequest(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if !allowAll {
+			for _, room := range streamRooms {
+				if !rooms.PublicStream(room) {
+					anonymousRequests.With("unauthenticated").Add(1)
+					writeError(w, r, withDetails(errUnauthenticated, map[string]string{"room": room}))
+					return
+				}
+			}
+		}
+		if ok, wait := limiter.Allow(clientAddress(r)); !ok {
+			anonymousRequests.With("rate_limited").Add(1)
+			writeError(w, r, withRetryAfter(errRateLimited, wait))
+			return
+		}
+		anonymousRequests.With("ok").Add(1)
+		next(w, r)
+	}
+}
+
+type publicStreamRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+func setPublicStreamHandler(rooms *roomRegistry, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("room")
+		user := userFromRequest(r)
+		if !rooms.IsOwner(name, user) {
+			writeError(w, r, fmt.Errorf("%w: only the room owner can open its stream", errForbidden))
+			return
+		}
+
+		req := publicStreamRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+
+		room, err := rooms.SetPublicStream(name, req.Enabled)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record(user, "room.public_stream", name, strconv.FormatBool(room.PublicStream))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(room)
+	}
+}
+
+// replayHandler returns the history of a room after the after sequence as a
+// JSON array. Anonymous callers may only replay rooms registered as readable
+// by anyone: public_stream rooms or, with allowAll, rooms that were created
+// open. System rooms take the admin token. Responses only change when the
+// room does, so they carry an ETag; only those of public_stream rooms, which
+// read the same for every caller, may be kept by shared caches, for maxAge.
+func replayHandler(adminToken string, broker *Broker, tiers *tieredHistory, rooms *roomRegistry, limiter *anonymousLimiter, allowAll bool, maxAge time.Duration) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room := r.PathValue("room")
+		user := userFromRequest(r)
+		public := !isSystemRoom(room) && rooms.PublicStream(room)
+		switch {
+		case isSystemRoom(room):
+			if !isAdmin(adminToken, r) {
+				writeError(w, r, errSystemRoom)
+				return
+			}
+		case user == "":
+			registered, ok := rooms.Get(room)
+			open := ok && allowAll && !registered.Private && registered.Mode != roomModeFeedback
+			if !public && !open {
+				writeError(w, r, errUnauthenticated)
+				return
+			}
+			if ok, wait := limiter.Allow(clientAddress(r)); !ok {
+				anonymousRequests.With("rate_limited").Add(1)
+				writeError(w, r, withRetryAfter(errRateLimited, wait))
+				return
+			}
+			anonymousRequests.With("ok").Add(1)
+		case !rooms.CanRead(room, user):
+			writeError(w, r, errNotMember)
+			return
+		}
+
+		after := uint64(0)
+		if raw := r.URL.Query().Get("after"); raw != "" {
+			var err error
+			if after, err = strconv.ParseUint(raw, 10, 64); err != nil {
+				writeError(w, r, fmt.Errorf("%w: after must be a sequence number", errInvalidRequest))
+				return
+			}
+		}
+		limit, err := replayLimit(r.URL.Query().Get("limit"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		etag := fmt.Sprintf("%q", fmt.Sprintf("%s-%d-%d-%d", room, after, limit, broker.LatestSequence(room)))
+		if public {
+			w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+		} else {
+			w.Header().Set("Cache-Control", "private, no-cache")
+			w.Header().Set("Vary", "Authorization, Cookie")
+		}
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		envs, err := tiers.Since(r.Context(), room, after, limit)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if envs == nil {
+			envs = []Envelope{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(envs)
+	}
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	apiKeyUserPrefix = "bot:"
+	apiKeyContext    = "apikey:"
+	maxSignedBody    = maxImageSize + 1<<20
+	maxAPIKeyRooms   = 50
+	maxRotationGrace = 7 * 24 * time.Hour
+
+	// Scopes of API keys: send covers every write outside the admin API,
+	// subscribe streams and reads, and admin the admin API and everything
+	// else.
+	scopeSend      = "send"
+	scopeSubscribe = "subscribe"
+	scopeAdmin     = "admin"
+)
+
+var (
+	errAPIKeyNotFound    = errors.New("API key not found")
+	errSignatureInvalid  = errors.New("invalid request signature")
+	errSignatureExpired  = errors.New("request timestamp outside the allowed skew")
+	errSignatureReplayed = errors.New("request nonce already used")
+	errAPIKeyScope       = errors.New("API key not allowed to do this")
+
+	apiKeyScopes        = []string{scopeSend, scopeSubscribe, scopeAdmin}
+	defaultAPIKeyScopes = []string{scopeSend, scopeSubscribe}
+
+	signedRequests = newCounterVec("chat_signed_requests_total", "Requests made with an API key by result.", "result")
+)
+
+// APIKey lets a bot or service call the API as user "bot:<name>", within its
+// scopes and, if it lists any, only in its rooms. Its secret is only shown
+// when the key is created or rotated. Requests are signed with the SHA-256
+// digest of the secret. The server doesn't keep either: it derives the
+// secret from its own -api-key-secret and a random salt, and only the salt
+// is stored.
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	User      string    `json:"user_id"`
+	Scopes    []string  `json:"scopes"`
+	Rooms     []string  `json:"rooms,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	RotatedAt time.Time `json:"rotated_at,omitzero"`
+	// PreviousValidUntil is when the secret replaced by the last rotation
+	// stops working.
+	PreviousValidUntil *time.Time `json:"previous_valid_until,omitempty"`
+	LastUsed           time.Time  `json:"last_used,omitzero"`
+
+	salt     string
+	previous string
+}
+
+// Allows reports whether the key has scope. Admin keys have every scope.
+func (k APIKey) Allows(scope string) bool {
+	return slices.Contains(k.Scopes, scopeAdmin) || slices.Contains(k.Scopes, scope)
+}
+
+type apiKeyRegistry struct {
+	skew   time.Duration
+	secret []byte
+
+	mu     sync.Mutex
+	keys   map[string]*APIKey
+	nonces map[string]time.Time
+	swept  time.Time
+	store  apiKeyStore
+}
+
+// apiKeyStore persists API keys, less their secrets, as they change.
+type apiKeyStore interface {
+	SaveAPIKey(key APIKey) error
+	DeleteAPIKey(ID string) error
+}
+
+// newAPIKeyRegistry derives key secrets from secret and accepts signed
+// requests whose timestamp is at most skew away from the server clock.
+// Nonces are remembered for as long as such a timestamp stays acceptable.
+func newAPIKeyRegistry(secret []byte, skew time.Duration) *apiKeyRegistry {
+	return &apiKeyRegistry{skew: skew, secret: secret, keys: make(map[string]*APIKey), nonces: make(map[string]time.Time), swept: time.Now()}
+}
+
+// UseStore saves every key from now on in store before making it.
+func (kr *apiKeyRegistry) UseStore(store apiKeyStore) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.store = store
+}
+
+// Replace swaps every key for the ones in keys.
+func (kr *apiKeyRegistry) Replace(keys []APIKey) {
+	replaced := make(map[string]*APIKey, len(keys))
+	for _, key := range keys {
+		replaced[key.ID] = &key
+	}
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.keys = replaced
+}
+
+// keySecret is the secret of key ID with salt.
+func (kr *apiKeyRegistry) keySecret(ID, salt string) string {
+	mac := hmac.New(sha256.New, kr.secret)
+	mac.Write([]byte(apiKeyContext + ID + ":" + salt))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func newAPIKeySalt() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+func (kr *apiKeyRegistry) Create(name string, scopes, rooms []string) (APIKey, string, error) {
+	ID := make([]byte, 8)
+	if _, err := rand.Read(ID); err != nil {
+		return APIKey{}, "", err
+	}
+	salt, err := newAPIKeySalt()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	key := &APIKey{
+		ID:        hex.EncodeToString(ID),
+		Name:      name,
+		User:      apiKeyUserPrefix + name,
+		Scopes:    scopes,
+		Rooms:     rooms,
+		CreatedAt: time.Now().UTC(),
+		salt:      salt,
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if kr.store != nil {
+		if err := kr.store.SaveAPIKey(*key); err != nil {
+			return APIKey{}, "", err
+		}
+	}
+	kr.keys[key.ID] = key
+	return *key, kr.keySecret(key.ID, salt), nil
+}
+
+// Rotate gives key ID a new secret. The old one keeps working for grace, so
+// a service can roll it out without downtime; a second rotation ends that
+// early.
+func (kr *apiKeyRegistry) Rotate(ID string, grace time.Duration) (APIKey, string, error) {
+	salt, err := newAPIKeySalt()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	current, ok := kr.keys[ID]
+	if !ok {
+		return APIKey{}, "", errAPIKeyNotFound
+	}
+	key := *current
+	now := time.Now().UTC()
+	key.previous, key.salt, key.RotatedAt, key.PreviousValidUntil = key.salt, salt, now, nil
+	if grace > 0 {
+		until := now.Add(grace)
+		key.PreviousValidUntil = &until
+	}
+	if kr.store != nil {
+		if err := kr.store.SaveAPIKey(key); err != nil {
+			return APIKey{}, "", err
+		}
+	}
+	*current = key
+	return key, kr.keySecret(ID, salt), nil
+}
+
+func (kr *apiKeyRegistry) List() []APIKey {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	keys := make([]APIKey, 0, len(kr.keys))
+	for _, key := range kr.keys {
+		keys = append(keys, *key)
+	}
+	slices.SortFunc(keys, func(a, b APIKey) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return keys
+}
+
+func (kr *apiKeyRegistry) Revoke(ID string) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	if _, ok := kr.keys[ID]; !ok {
+		return errAPIKeyNotFound
+	}
+	if kr.store != nil {
+		if err := kr.store.DeleteAPIKey(ID); err != nil {
+			return err
+		}
+	}
+	delete(kr.keys, ID)
+	return nil
+}
+
+// requestSignature is the HMAC-SHA256 under key, hex encoded, of the method,
+// request URI, timestamp, nonce and body digest of a request, one per line.
+func requestSignature(key []byte, method, uri, timestamp, nonce string, body []byte) string {
+	digest := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", method, uri, timestamp, nonce, hex.EncodeToString(digest[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature headers of r against body and returns the key
+// that signed it. A nonce is used up by its first valid request.
+func (kr *apiKeyRegistry) Verify(r *http.Request, body []byte) (APIKey, error) {
+	timestamp, nonce := r.Header.Get("X-Timestamp"), r.Header.Get("X-Nonce")
+	signature := r.Header.Get("X-Signature")
+	if timestamp == "" || nonce == "" || signature == "" {
+		return APIKey{}, fmt.Errorf("%w: X-Timestamp, X-Nonce and X-Signature required", errSignatureInvalid)
+	}
+	if len(nonce) < 16 || len(nonce) > 128 {
+		return APIKey{}, fmt.Errorf("%w: nonce must be 16 to 128 characters", errSignatureInvalid)
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return APIKey{}, fmt.Errorf("%w: X-Timestamp must be Unix seconds", errSignatureInvalid)
+	}
+	now := time.Now()
+	if skew := now.Sub(time.Unix(unix, 0)); skew > kr.skew || skew < -kr.skew {
+		return APIKey{}, withDetails(errSignatureExpired, map[string]int64{"server_time": now.Unix()})
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	key, ok := kr.keys[r.Header.Get("X-API-Key")]
+	if !ok {
+		return APIKey{}, errSignatureInvalid
+	}
+	salts := []string{key.salt}
+	if key.PreviousValidUntil != nil && now.Before(*key.PreviousValidUntil) {
+		salts = append(salts, key.previous)
+	}
+	valid := false
+	for _, salt := range salts {
+		digest := sha256.Sum256([]byte(kr.keySecret(key.ID, salt)))
+		expected := requestSignature(digest[:], r.Method, r.URL.RequestURI(), timestamp, nonce, body)
+		valid = valid || hmac.Equal([]byte(expected), []byte(strings.ToLower(signature)))
+	}
+	if !valid {
+		return APIKey{}, errSignatureInvalid
+	}
+
+	if now.Sub(kr.swept) > kr.skew {
+		for seen, expires := range kr.nonces {
+			if now.After(expires) {
+				delete(kr.nonces, seen)
+			}
+		}
+		kr.swept = now
+	}
+	if _, seen := kr.nonces[key.ID+":"+nonce]; seen {
+		return APIKey{}, errSignatureReplayed
+	}
+	kr.nonces[key.ID+":"+nonce] = now.Add(2 * kr.skew)
+	key.LastUsed = now.UTC()
+	return *key, nil
+}
+
+type apiKeyContextKey struct{}
+
+// apiKeyFrom returns the API key r was signed with, if any.
+func apiKeyFrom(r *http.Request) (APIKey, bool) {
+	key, ok := r.Context().Value(apiKeyContextKey{}).(APIKey)
+	return key, ok
+}
+
+// requiredScope is the scope a request needs from the API key it is signed
+// with.
+func requiredScope(r *http.Request) string {
+	_, path, _ := versionPrefix(r.URL.Path)
+	switch {
+	case strings.HasPrefix(path, "/admin/"):
+		return scopeAdmin
+	case path == "/chat/events", strings.HasPrefix(path, "/chat/subscriptions/"), r.Method == http.MethodGet, r.Method == http.MethodHead:
+		return scopeSubscribe
+	default:
+		return scopeSend
+	}
+}
+
+// requestRooms returns the rooms r names in its path, its room or rooms
+// query parameters or the room field of its JSON body. Sends that name none
+// go to the default room.
+func requestRooms(r *http.Request, body []byte) ([]string, error) {
+	_, path, _ := versionPrefix(r.URL.Path)
+	var named []string
+	if _, rest, ok := strings.Cut(path, "/rooms/"); ok {
+		if room, _, _ := strings.Cut(rest, "/"); room != "" {
+			named = append(named, room)
+		}
+	}
+	if path == "/chat/events" {
+		rooms, err := roomsFromRequest(r)
+		if err != nil {
+			return nil, err
+		}
+		named = append(named, rooms...)
+	} else if room := r.URL.Query().Get("room"); room != "" {
+		named = append(named, room)
+	}
+	payload := struct {
+		Room string `json:"room"`
+	}{}
+	if json.Unmarshal(body, &payload) == nil && payload.Room != "" {
+		named = append(named, payload.Room)
+	} else if path == "/chat/send" || path == "/chat/send/batch" {
+		named = append(named, defaultRoom)
+	}
+	return named, nil
+}
+
+// authorize checks that k may make request r with body.
+func (k APIKey) authorize(r *http.Request, body []byte) error {
+	if scope := requiredScope(r); !k.Allows(scope) {
+		return fmt.Errorf("%w: the %s scope is required", errAPIKeyScope, scope)
+	}
+	if len(k.Rooms) == 0 {
+		return nil
+	}
+	rooms, err := requestRooms(r, body)
+	if err != nil {
+		return err
+	}
+	for _, room := range rooms {
+		if !slices.Contains(k.Rooms, room) {
+			return fmt.Errorf("%w: room %s is not one of the key's rooms", errAPIKeyScope, room)
+		}
+	}
+	return nil
+}
+
+// signedRequestMiddleware authenticates requests carrying X-API-Key. They
+// must be signed; a valid one acts as the key's user whatever else it
+// claims, an invalid one is refused outright. So is one the key's scopes or
+// rooms don't cover.
+func signedRequestMiddleware(keys *apiKeyRegistry, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSignedBody))
+		if err != nil {
+			writeError(w, r, fmt.Errorf("%w: %v", errInvalidRequest, err))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		key, err := keys.Verify(r, body)
+		if err == nil {
+			err = key.authorize(r, body)
+		}
+		switch {
+		case errors.Is(err, errSignatureExpired):
+			signedRequests.With("expired").Add(1)
+		case errors.Is(err, errSignatureReplayed):
+			signedRequests.With("replayed").Add(1)
+		case errors.Is(err, errAPIKeyScope):
+			signedRequests.With("forbidden").Add(1)
+		case err != nil:
+			signedRequests.With("invalid").Add(1)
+		default:
+			signedRequests.With("ok").Add(1)
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		r.Header.Del("X-User-ID")
+		query := r.URL.Query()
+		query.Del("user_id")
+		r.URL.RawQuery = query.Encode()
+		r = withIdentity(r, key.User, time.Time{})
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	})
+}
+
+type createAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	Rooms  []string `json:"rooms"`
+}
+
+type createdAPIKey struct {
+	APIKey
+	Secret string `json:"secret"`
+}
+
+func createAPIKeyHandler(keys *apiKeyRegistry, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := createAPIKeyRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+		if !groupNamePattern.MatchString(req.Name) {
+			writeError(w, r, fmt.Errorf("%w: name must be 1-64 letters, digits, dots, dashes or underscores", errInvalidRequest))
+			return
+		}
+		if len(req.Scopes) == 0 {
+			req.Scopes = defaultAPIKeyScopes
+		}
+		for _, scope := range req.Scopes {
+			if !slices.Contains(apiKeyScopes, scope) {
+				writeError(w, r, fmt.Errorf("%w: unknown scope %q, scopes are %s", errInvalidRequest, scope, strings.Join(apiKeyScopes, ", ")))
+				return
+			}
+		}
+		if len(req.Rooms) > maxAPIKeyRooms || slices.Contains(req.Rooms, "") {
+			writeError(w, r, fmt.Errorf("%w: at most %d rooms, none empty", errInvalidRequest, maxAPIKeyRooms))
+			return
+		}
+		slices.Sort(req.Scopes)
+		req.Scopes = slices.Compact(req.Scopes)
+
+		key, secret, err := keys.Create(req.Name, req.Scopes, req.Rooms)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record("admin", "apikey.create", "", "id="+key.ID+" user="+key.User+" scopes="+strings.Join(key.Scopes, ","))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(createdAPIKey{APIKey: key, Secret: secret})
+	}
+}
+
+func listAPIKeysHandler(keys *apiKeyRegistry) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keys.List())
+	}
+}
+
+type rotateAPIKeyRequest struct {
+	Grace configDuration `json:"grace"`
+}
+
+// rotateAPIKeyHandler issues a new secret for a key. The old one stays valid
+// for the grace period asked for, if any.
+func rotateAPIKeyHandler(keys *apiKeyRegistry, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := rotateAPIKeyRequest{}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, r, invalidJSON(err))
+				return
+			}
+		}
+		if grace := time.Duration(req.Grace); grace < 0 || grace > maxRotationGrace {
+			writeError(w, r, fmt.Errorf("%w: grace must be between 0s and %s", errInvalidRequest, maxRotationGrace))
+			return
+		}
+
+		key, secret, err := keys.Rotate(r.PathValue("id"), time.Duration(req.Grace))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record("admin", "apikey.rotate", "", "id="+key.ID+" grace="+time.Duration(req.Grace).String())
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(createdAPIKey{APIKey: key, Secret: secret})
+	}
+}
+
+func revokeAPIKeyHandler(keys *apiKeyRegistry, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ID := r.PathValue("id")
+		if err := keys.Revoke(ID); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record("admin", "apikey.revoke", "", "id="+ID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// storedAPIKey is how a key is kept in the store: its salts, never the secret
+// they make with -api-key-secret.
+type storedAPIKey struct {
+	APIKey
+	Salt     string `json:"salt"`
+	Previous string `json:"previous_salt,omitempty"`
+}
+
+func (s *messageStore) SaveAPIKey(key APIKey) error {
+	data, err := json.Marshal(storedAPIKey{APIKey: key, Salt: key.salt, Previous: key.previous})
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO api_keys (id, data, created_at) VALUES (?, ?, ?)`, key.ID, data, key.CreatedAt.UnixNano())
+	return err
+}
+
+func (s *messageStore) DeleteAPIKey(ID string) error {
+	_, err := s.db.Exec(`DELETE FROM api_keys WHERE id = ?`, ID)
+	return err
+}
+
+// RecoverAPIKeys puts the stored API keys back in keys and returns how many
+// there were. They only verify under the -api-key-secret they were made
+// with.
+func (s *messageStore) RecoverAPIKeys(ctx context.Context, keys *apiKeyRegistry) (int, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, data FROM api_keys`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	stored := []APIKey{}
+	for rows.Next() {
+		var ID string
+		var data []byte
+		if err := rows.Scan(&ID, &data); err != nil {
+			return 0, err
+		}
+		key := storedAPIKey{}
+		if err := json.Unmarshal(data, &key); err != nil {
+			return 0, fmt.Errorf("API key %s: %w", ID, err)
+		}
+		key.APIKey.salt, key.APIKey.previous = key.Salt, key.Previous
+		stored = append(stored, key.APIKey)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	keys.Replace(stored)
+	return len(stored), nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	asyncWorkers    = 4
+	asyncQueueSize  = 1024
+	asyncStatusTTL  = 10 * time.Minute
+	respondAsync    = "respond-async"
+	publishQueued   = "queued"
+	publishDone     = "published"
+	publishFailed   = "failed"
+	asyncRetryAfter = time.Second
+)
+
+var asyncPublishes = newCounterVec("chat_async_publishes_total", "Sends accepted with 202 by outcome.", "result")
+
+// PublishStatus is where a message accepted with 202 is on its way out.
+type PublishStatus struct {
+	MessageID   string         `json:"message_id"`
+	Room        string         `json:"room"`
+	Status      string         `json:"status"`
+	EnvelopeID  string         `json:"envelope_id,omitempty"`
+	Seq         uint64         `json:"seq,omitempty"`
+	Error       *ErrorResponse `json:"error,omitempty"`
+	AcceptedAt  time.Time      `json:"accepted_at"`
+	PublishedAt time.Time      `json:"published_at,omitzero"`
+
+	user string
+	key  [32]byte
+}
+
+type asyncJob struct {
+	ID   string
+	chat Chat
+	key  [32]byte
+	r    *http.Request
+}
+
+// asyncPublisher publishes accepted messages from per-room queues, so the
+// sender gets its answer before the fan-out, and remembers how each went
+// for asyncStatusTTL. A room always maps to the same queue, which keeps its
+// messages in the order they were accepted.
+type asyncPublisher struct {
+	broker   *Broker
+	dedup    *publishDeduper
+	unfurl   *unfurler
+	features *featureSet
+
+	queues  []chan asyncJob
+	pending atomic.Int64
+
+	mu        sync.Mutex
+	statuses  map[string]*PublishStatus
+	byKey     map[[32]byte]string
+	lastSweep time.Time
+}
+
+func newAsyncPublisher(broker *Broker, dedup *publishDeduper, unfurl *unfurler, features *featureSet) *asyncPublisher {
+	p := &asyncPublisher{
+		broker:   broker,
+		dedup:    dedup,
+		unfurl:   unfurl,
+		features: features,
+		queues:   make([]chan asyncJob, asyncWorkers),
+		statuses: make(map[string]*PublishStatus),
+		byKey:    make(map[[32]byte]string),
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan asyncJob, asyncQueueSize/asyncWorkers)
+		go p.run(p.queues[i])
+	}
+	return p
+}
+
+// wantsAsync reports whether the sender asked, with Prefer: respond-async,
+// not to wait for the fan-out.
+func wantsAsync(r *http.Request) bool {
+	for _, prefer := range r.Header.Values("Prefer") {
+		for token := range strings.SplitSeq(prefer, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), respondAsync) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Pending is the number of accepted messages not published yet.
+func (p *asyncPublisher) Pending() int {
+	return int(p.pending.Load())
+}
+
+// Accepted returns the status of the message accepted under key, if it is
+// still remembered and didn't fail. Retries of an accepted message get its
+// status back instead of being sent again.
+func (p *asyncPublisher) Accepted(key [32]byte) (PublishStatus, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ID, ok := p.byKey[key]
+	if !ok {
+		return PublishStatus{}, false
+	}
+	return *p.statuses[ID], true
+}
+
+func (p *asyncPublisher) track(status *PublishStatus) {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now.Sub(p.lastSweep) >= time.Minute {
+		p.lastSweep = now
+		for ID, s := range p.statuses {
+			if now.Sub(s.AcceptedAt) >= asyncStatusTTL {
+				delete(p.statuses, ID)
+				delete(p.byKey, s.key)
+			}
+		}
+	}
+	p.statuses[status.MessageID] = status
+	p.byKey[status.key] = status.MessageID
+}
+
+func newAsyncID() string {
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// Enqueue accepts chat, already claimed under key, for publishing.
+func (p *asyncPublisher) Enqueue(r *http.Request, chat Chat, key [32]byte) (PublishStatus, error) {
+	status := &PublishStatus{MessageID: newAsyncID(), Room: chat.Room, Status: publishQueued, AcceptedAt: time.Now().UTC(), user: chat.UserID, key: key}
+	h := fnv.New32a()
+	h.Write([]byte(chat.Room))
+	queue := p.queues[h.Sum32()%uint32(len(p.queues))]
+
+	// Tracked before queueing so the worker always finds it.
+	p.track(status)
+	p.pending.Add(1)
+	select {
+	case queue <- asyncJob{ID: status.MessageID, chat: chat, key: key, r: r}:
+	default:
+		p.pending.Add(-1)
+		p.forget(status)
+		asyncPublishes.With("rejected").Add(1)
+		return PublishStatus{}, withRetryAfter(errSaturated, asyncRetryAfter)
+	}
+	return p.snapshot(status), nil
+}
+
+// Published records a message that never needed the queue, like a shadow
+// muted one, so it is reported like the rest.
+func (p *asyncPublisher) Published(chat Chat, key [32]byte) PublishStatus {
+	now := time.Now().UTC()
+	status := &PublishStatus{MessageID: newAsyncID(), Room: chat.Room, Status: publishDone, AcceptedAt: now, PublishedAt: now, user: chat.UserID, key: key}
+	p.track(status)
+	return p.snapshot(status)
+}
+
+func (p *asyncPublisher) forget(status *PublishStatus) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.statuses, status.MessageID)
+	delete(p.byKey, status.key)
+}
+
+func (p *asyncPublisher) snapshot(status *PublishStatus) PublishStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return *status
+}
+
+// Status returns the status of message ID, as the user who sent it.
+func (p *asyncPublisher) Status(ID, user string) (PublishStatus, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status, ok := p.statuses[ID]
+	if !ok || status.user != user {
+		return PublishStatus{}, false
+	}
+	return *status, true
+}
+
+func (p *asyncPublisher) run(queue chan asyncJob) {
+	for job := range queue {
+		p.publish(job)
+		p.pending.Add(-1)
+	}
+}
+
+func (p *asyncPublisher) publish(job asyncJob) {
+	env, err := publishChat(p.broker, job.chat)
+
+	p.mu.Lock()
+	status, ok := p.statuses[job.ID]
+	if !ok {
+		status = &PublishStatus{}
+	}
+	if err != nil {
+		_, body := errorResponse(job.r, err)
+		status.Status, status.Error = publishFailed, &body
+		delete(p.byKey, job.key)
+	} else {
+		status.Status, status.EnvelopeID, status.Seq, status.PublishedAt = publishDone, env.ID, env.Seq, time.Now().UTC()
+	}
+	p.mu.Unlock()
+
+	if err != nil {
+		p.dedup.Release(job.key)
+		asyncPublishes.With(publishFailed).Add(1)
+		return
+	}
+	p.dedup.Published(job.key, env)
+	asyncPublishes.With(publishDone).Add(1)
+	if p.unfurl != nil && env.ID != "" && p.features.Enabled(featurePreviews) {
+		p.unfurl.Enqueue(env.ID, env.Room, job.chat.Message)
+	}
+}
+
+// writeAccepted answers an asynchronous send with 202 and where to follow it.
+func writeAccepted(w http.ResponseWriter, status PublishStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Preference-Applied", respondAsync)
+	w.Header().Set("Location", "/chat/messages/"+status.MessageID+"/status")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(status)
+}
+
+// publishStatusHandler reports how an asynchronous send went. Only its
+// sender can see it.
+func publishStatusHandler(async *asyncPublisher) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, ok := async.Status(r.PathValue("id"), userFromRequest(r))
+		if !ok {
+			writeError(w, r, errMessageNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
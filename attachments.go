@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	maxImageSize       = 10 << 20
+	maxVoiceNoteSize   = 5 << 20
+	maxVoiceNoteLength = 5 * time.Minute
+)
+
+var (
+	errAttachmentNotFound = errors.New("attachment not found")
+	errAttachmentTooLarge = errors.New("attachment too large")
+	errAttachmentType     = errors.New("unsupported attachment type")
+)
+
+type Attachment struct {
+	ID          string `json:"id"`
+	Kind        string `json:"kind"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	DurationMS  int64  `json:"duration_ms,omitempty"`
+	URL         string `json:"url"`
+	Room        string `json:"-"`
+}
+
+// attachmentStore keeps attachment metadata in memory, and with a message
+// store there too, and the bytes in a BlobStore, keyed by attachment ID. With
+// a presigning store, downloads are redirected to URLs valid for presignTTL.
+type attachmentStore struct {
+	blobs      BlobStore
+	presignTTL time.Duration
+
+	mu          sync.RWMutex
+	attachments map[string]Attachment
+	store       attachmentMetaStore
+}
+
+// attachmentMetaStore persists attachment metadata as it changes.
+type attachmentMetaStore interface {
+	SaveAttachment(attachment Attachment) error
+	DeleteAttachment(ID string) error
+}
+
+func newAttachmentStore(blobs BlobStore, presignTTL time.Duration) *attachmentStore {
+	return &attachmentStore{blobs: blobs, presignTTL: presignTTL, attachments: make(map[string]Attachment)}
+}
+
+func (s *attachmentStore) Get(ID string) (Attachment, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	attachment, ok := s.attachments[ID]
+	return attachment, ok
+}
+
+// UseStore saves every attachment from now on in store before adding it.
+func (s *attachmentStore) UseStore(store attachmentMetaStore) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.store = store
+}
+
+// Replace swaps every attachment for the ones in attachments.
+func (s *attachmentStore) Replace(attachments []Attachment) {
+	replaced := make(map[string]Attachment, len(attachments))
+	for _, attachment := range attachments {
+		replaced[attachment.ID] = attachment
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attachments = replaced
+}
+
+func (s *attachmentStore) Add(attachment Attachment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.store != nil {
+		if err := s.store.SaveAttachment(attachment); err != nil {
+			return err
+		}
+	}
+	s.attachments[attachment.ID] = attachment
+	return nil
+}
+
+// Purged is the message store's purge hook: it deletes the blob of an
+// attachment once the message carrying it is gone for good.
+func (s *attachmentStore) Purged(room string, data []byte) {
+	chat := Chat{}
+	if json.Unmarshal(data, &chat) != nil || chat.Attachment == nil {
+		return
+	}
+	if err := s.blobs.Delete(context.Background(), chat.Attachment.ID); err != nil {
+		log.Printf("Attachments: deleting %s: %v", chat.Attachment.ID, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.store != nil {
+		if err := s.store.DeleteAttachment(chat.Attachment.ID); err != nil {
+			log.Printf("Attachments: deleting %s: %v", chat.Attachment.ID, err)
+		}
+	}
+	delete(s.attachments, chat.Attachment.ID)
+}
+
+// classifyAttachment sniffs data and validates it against the limits of its
+// kind, returning the attachment with everything but ID, URL and Room set.
+func classifyAttachment(data []byte) (Attachment, error) {
+	if contentType := sniffAudio(data); contentType != "" {
+		if len(data) > maxVoiceNoteSize {
+			return Attachment{}, fmt.Errorf("%w: voice notes are limited to %d bytes", errAttachmentTooLarge, maxVoiceNoteSize)
+		}
+		duration, err := audioDuration(contentType, data)
+		if err != nil {
+			return Attachment{}, fmt.Errorf("%w: %v", errAttachmentType, err)
+		}
+		if duration <= 0 || duration > maxVoiceNoteLength {
+			return Attachment{}, fmt.Errorf("%w: voice notes are limited to %s", errAttachmentTooLarge, maxVoiceNoteLength)
+		}
+		return Attachment{Kind: "voice", ContentType: contentType, Size: len(data), DurationMS: duration.Milliseconds()}, nil
+	}
+
+	switch contentType := http.DetectContentType(data); contentType {
+	case "image/png", "image/jpeg", "image/gif", "image/webp":
+		if len(data) > maxImageSize {
+			return Attachment{}, fmt.Errorf("%w: images are limited to %d bytes", errAttachmentTooLarge, maxImageSize)
+		}
+		return Attachment{Kind: "image", ContentType: contentType, Size: len(data)}, nil
+	}
+	return Attachment{}, errAttachmentType
+}
+
+func newAttachmentID() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// uploadAttachmentHandler accepts a multipart upload with a "file" part and an
+// optional "message" caption, stores it and broadcasts it as a chat message.
+func uploadAttachmentHandler(broker *Broker, rooms *roomRegistry, attachments *attachmentStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromRequest(r)
+		if user == "" {
+			writeError(w, r, errUnauthenticated)
+			return
+		}
+		room := roomFromRequest(r)
+		if err := rooms.CheckPublish(room, user); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if err := broker.Admit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxImageSize+1<<20)
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			writeError(w, r, fmt.Errorf("%w: multipart field \"file\" required", errInvalidRequest))
+			return
+		}
+		defer file.Close()
+
+		data, err := io.ReadAll(file)
+		if err != nil {
+			writeError(w, r, fmt.Errorf("%w: %v", errAttachmentTooLarge, err))
+			return
+		}
+
+		chat := Chat{
+			Room:        room,
+			UserID:      user,
+			Message:     r.FormValue("message"),
+			ContentType: r.FormValue("content_type"),
+		}
+		if err := rooms.Moderate(room, &chat); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		attachment, err := classifyAttachment(data)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if attachment.ID, err = newAttachmentID(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		attachment.Room = room
+		attachment.URL = absoluteURL(r, "/chat/attachments/"+attachment.ID)
+
+		if err := attachments.blobs.Put(r.Context(), attachment.ID, attachment.ContentType, bytes.NewReader(data)); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if err := attachments.Add(attachment); err != nil {
+			attachments.blobs.Delete(context.Background(), attachment.ID)
+			writeError(w, r, err)
+			return
+		}
+
+		chat.Attachment = &attachment
+		chatRaw, err := json.Marshal(chat)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if _, err := broker.Publish(room, chatRaw); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(attachment)
+	}
+}
+
+func downloadAttachmentHandler(rooms *roomRegistry, attachments *attachmentStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		attachment, ok := attachments.Get(r.PathValue("id"))
+		if !ok {
+			writeError(w, r, errAttachmentNotFound)
+			return
+		}
+		if !rooms.CanAccess(attachment.Room, userFromRequest(r)) {
+			writeError(w, r, errNotMember)
+			return
+		}
+
+		if presigner, ok := attachments.blobs.(blobPresigner); ok {
+			signed, err := presigner.PresignGet(r.Context(), attachment.ID, attachments.presignTTL)
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			w.Header().Set("Cache-Control", "private, no-store")
+			http.Redirect(w, r, signed, http.StatusFound)
+			return
+		}
+
+		body, contentType, err := attachments.blobs.Get(r.Context(), attachment.ID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer body.Close()
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "private, max-age=86400, immutable")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		io.Copy(w, body)
+	}
+}
+
+func (s *messageStore) SaveAttachment(attachment Attachment) error {
+	data, err := json.Marshal(attachment)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO attachments (id, room, data, created_at) VALUES (?, ?, ?, ?)`, attachment.ID, attachment.Room, data, time.Now().UnixNano())
+	return err
+}
+
+func (s *messageStore) DeleteAttachment(ID string) error {
+	_, err := s.db.Exec(`DELETE FROM attachments WHERE id = ?`, ID)
+	return err
+}
+
+// RecoverAttachments puts the stored attachment metadata back in attachments
+// and returns how many there were.
+func (s *messageStore) RecoverAttachments(ctx context.Context, attachments *attachmentStore) (int, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, room, data FROM attachments`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	stored := []Attachment{}
+	for rows.Next() {
+		var ID, room string
+		var data []byte
+		if err := rows.Scan(&ID, &room, &data); err != nil {
+			return 0, err
+		}
+		attachment := Attachment{}
+		if err := json.Unmarshal(data, &attachment); err != nil {
+			return 0, fmt.Errorf("attachment %s: %w", ID, err)
+		}
+		attachment.Room = room
+		stored = append(stored, attachment)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	attachments.Replace(stored)
+	return len(stored), nil
+}
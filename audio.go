@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+var errAudioUnsupported = errors.New("unsupported or corrupt audio")
+
+// audioDuration extracts the playback length of a WAV, Ogg (Opus or Vorbis)
+// or MP4/M4A file from its container metadata, without decoding it.
+func audioDuration(contentType string, data []byte) (time.Duration, error) {
+	switch contentType {
+	case "audio/wav":
+		return wavDuration(data)
+	case "audio/ogg":
+		return oggDuration(data)
+	case "audio/mp4":
+		return mp4Duration(data)
+	}
+	return 0, errAudioUnsupported
+}
+
+// sniffAudio identifies the container by magic bytes rather than trusting the
+// client's Content-Type.
+func sniffAudio(data []byte) string {
+	switch {
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WAVE":
+		return "audio/wav"
+	case len(data) >= 4 && string(data[:4]) == "OggS":
+		return "audio/ogg"
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		return "audio/mp4"
+	}
+	return ""
+}
+
+func wavDuration(data []byte) (time.Duration, error) {
+	var byteRate uint32
+	for pos := 12; pos+8 <= len(data); {
+		id := string(data[pos : pos+4])
+		size := binary.LittleEndian.Uint32(data[pos+4 : pos+8])
+		body := pos + 8
+
+		switch id {
+		case "fmt ":
+			if body+12 > len(data) {
+				return 0, errAudioUnsupported
+			}
+			byteRate = binary.LittleEndian.Uint32(data[body+8 : body+12])
+		case "data":
+			if byteRate == 0 {
+				return 0, errAudioUnsupported
+			}
+			return time.Duration(float64(size) / float64(byteRate) * float64(time.Second)), nil
+		}
+		pos = body + int(size) + int(size%2)
+	}
+	return 0, errAudioUnsupported
+}
+
+// oggDuration reads the sample rate from the codec header and the total
+// sample count from the granule position of the last page.
+func oggDuration(data []byte) (time.Duration, error) {
+	var rate, preSkip uint64
+	switch {
+	case bytes.Contains(data[:min(len(data), 512)], []byte("OpusHead")):
+		head := bytes.Index(data, []byte("OpusHead"))
+		if head+12 > len(data) {
+			return 0, errAudioUnsupported
+		}
+		rate = 48000
+		preSkip = uint64(binary.LittleEndian.Uint16(data[head+10 : head+12]))
+	case bytes.Contains(data[:min(len(data), 512)], []byte("\x01vorbis")):
+		head := bytes.Index(data, []byte("\x01vorbis"))
+		if head+16 > len(data) {
+			return 0, errAudioUnsupported
+		}
+		rate = uint64(binary.LittleEndian.Uint32(data[head+12 : head+16]))
+	default:
+		return 0, errAudioUnsupported
+	}
+
+	last := bytes.LastIndex(data, []byte("OggS"))
+	if last < 0 || last+14 > len(data) || rate == 0 {
+		return 0, errAudioUnsupported
+	}
+	granule := binary.LittleEndian.Uint64(data[last+6 : last+14])
+	if granule < preSkip {
+		return 0, errAudioUnsupported
+	}
+	return time.Duration(float64(granule-preSkip) / float64(rate) * float64(time.Second)), nil
+}
+
+// mp4Duration walks the top-level boxes down to moov/mvhd.
+func mp4Duration(data []byte) (time.Duration, error) {
+	moov, ok := mp4Box(data, "moov")
+	if !ok {
+		return 0, errAudioUnsupported
+	}
+	mvhd, ok := mp4Box(moov, "mvhd")
+	if !ok || len(mvhd) < 20 {
+		return 0, errAudioUnsupported
+	}
+
+	var timescale, duration uint64
+	if mvhd[0] == 1 {
+		if len(mvhd) < 32 {
+			return 0, errAudioUnsupported
+		}
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[20:24]))
+		duration = binary.BigEndian.Uint64(mvhd[24:32])
+	} else {
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(mvhd[16:20]))
+	}
+	if timescale == 0 {
+		return 0, errAudioUnsupported
+	}
+	return time.Duration(float64(duration) / float64(timescale) * float64(time.Second)), nil
+}
+
+func mp4Box(data []byte, name string) ([]byte, bool) {
+	for pos := 0; pos+8 <= len(data); {
+		size := uint64(binary.BigEndian.Uint32(data[pos : pos+4]))
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data) - pos)
+		case 1:
+			if pos+16 > len(data) {
+				return nil, false
+			}
+			size = binary.BigEndian.Uint64(data[pos+8 : pos+16])
+			header = 16
+		}
+		if size < header || uint64(pos)+size > uint64(len(data)) {
+			return nil, false
+		}
+		if string(data[pos+4:pos+8]) == name {
+			return data[uint64(pos)+header : uint64(pos)+size], true
+		}
+		pos += int(size)
+	}
+	return nil, false
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const auditLogSize = 10000
+
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Room   string    `json:"room,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// auditLog is an append-only record of privileged actions, capped to the most
+// recent auditLogSize entries.
+type auditLog struct {
+	mu      sync.RWMutex
+	entries []AuditEntry
+}
+
+func newAuditLog() *auditLog {
+	return &auditLog{}
+}
+
+func (a *auditLog) Record(actor, action, room, detail string) {
+	entry := AuditEntry{Time: time.Now().UTC(), Actor: actor, Action: action, Room: room, Detail: detail}
+	log.Printf("Audit: %s %s room=%q %s", entry.Actor, entry.Action, entry.Room, entry.Detail)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.entries = append(a.entries, entry)
+	if len(a.entries) > auditLogSize {
+		a.entries = a.entries[len(a.entries)-auditLogSize:]
+	}
+}
+
+func (a *auditLog) Entries() []AuditEntry {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return append([]AuditEntry(nil), a.entries...)
+}
+
+func auditHandler(audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(audit.Entries())
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	userTokenContext    = "user:"
+	defaultUserTokenTTL = time.Hour
+	maxUserTokenTTL     = 30 * 24 * time.Hour
+)
+
+type identityKey struct{}
+
+// identity is who a request was verified to come from, and when the
+// credential that says so runs out; zero if it doesn't.
+type identity struct {
+	user    string
+	expires time.Time
+}
+
+func withIdentity(r *http.Request, user string, expires time.Time) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, identity{user: user, expires: expires}))
+}
+
+// userFromRequest returns the caller's user ID as identityMiddleware or
+// signedRequestMiddleware verified it, or "" for anonymous callers.
+func userFromRequest(r *http.Request) string {
+	id, _ := r.Context().Value(identityKey{}).(identity)
+	return id.user
+}
+
+// claimedUser returns the user a request names in X-User-ID or, for
+// EventSource, the user_id query parameter. A claim on its own proves
+// nothing; it has to match the verified user.
+func claimedUser(r *http.Request) string {
+	if user := r.Header.Get("X-User-ID"); user != "" {
+		return user
+	}
+	return r.URL.Query().Get("user_id")
+}
+
+type userToken struct {
+	User      string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// IssueUser signs a token that authenticates its holder as user for ttl.
+// Gateways holding the invite secret can mint the same tokens themselves.
+func (s *inviteSigner) IssueUser(user string, ttl time.Duration) (string, time.Time, error) {
+	expiresAt := time.Now().Add(ttl)
+	raw, err := json.Marshal(userToken{User: user, ExpiresAt: expiresAt.Unix()})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(raw)
+	return payload + "." + s.sign(userTokenContext+payload), expiresAt, nil
+}
+
+// VerifyUser returns the user and expiry of a token made by IssueUser.
+func (s *inviteSigner) VerifyUser(token string) (string, time.Time, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(s.sign(userTokenContext+payload))) {
+		return "", time.Time{}, errUnauthenticated
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", time.Time{}, errUnauthenticated
+	}
+	tok := userToken{}
+	if err := json.Unmarshal(raw, &tok); err != nil || tok.User == "" {
+		return "", time.Time{}, errUnauthenticated
+	}
+	expires := time.Unix(tok.ExpiresAt, 0)
+	if !expires.After(time.Now()) {
+		return "", time.Time{}, errAuthExpired
+	}
+	return tok.User, expires, nil
+}
+
+// identityMiddleware identifies the caller by a verified credential: a user
+// token, as bearer token or access_token, or else a guest cookie. Requests
+// signed with an API key already are. Naming a user in X-User-ID or user_id
+// takes a credential for that user.
+func identityMiddleware(signer *inviteSigner, guests *guestAccounts, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(identityKey{}).(identity); !ok {
+			user, expires, err := signer.VerifyUser(bearerToken(r))
+			switch {
+			case err == nil:
+				r = withIdentity(r, user, expires)
+			case errors.Is(err, errAuthExpired):
+				writeError(w, r, err)
+				return
+			default:
+				if ID, ok := guests.guestFromRequest(r); ok {
+					r = withIdentity(r, guests.resolve(ID), time.Time{})
+				}
+			}
+		}
+		if claimed := claimedUser(r); claimed != "" && claimed != userFromRequest(r) {
+			writeError(w, r, fmt.Errorf("%w: acting as %q takes a user token, guest cookie or API key of theirs", errUnauthenticated, claimed))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type createUserTokenRequest struct {
+	TTL string `json:"ttl"`
+}
+
+type createUserTokenResponse struct {
+	UserID    string    `json:"user_id"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// createUserTokenHandler issues a user token for a backend to hand its
+// signed-in user.
+func createUserTokenHandler(signer *inviteSigner, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.PathValue("user")
+		req := createUserTokenRequest{}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, r, invalidJSON(err))
+				return
+			}
+		}
+		ttl := defaultUserTokenTTL
+		if req.TTL != "" {
+			d, err := time.ParseDuration(req.TTL)
+			if err != nil || d <= 0 || d > maxUserTokenTTL {
+				writeError(w, r, fmt.Errorf("%w: ttl must be a positive duration up to %s", errInvalidRequest, maxUserTokenTTL))
+				return
+			}
+			ttl = d
+		}
+
+		token, expiresAt, err := signer.IssueUser(user, ttl)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record(auditActor(r), "user.token", "", "user="+user+" ttl="+ttl.String())
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(createUserTokenResponse{UserID: user, Token: token, ExpiresAt: expiresAt.UTC()})
+	}
+}
+
+// bearerToken reads the Authorization header, falling back to the
+// access_token query parameter for EventSource clients.
+func bearerToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// isAdmin reports whether r carries the admin token or is signed with an
+// admin API key. Neither works with the admin API disabled.
+func isAdmin(adminToken string, r *http.Request) bool {
+	if adminToken == "" {
+		return false
+	}
+	if key, ok := apiKeyFrom(r); ok && key.Allows(scopeAdmin) {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(adminToken)) == 1
+}
+
+// adminOnly guards the admin API with the token given by -admin-token. With no
+// token configured the admin API is disabled.
+func adminOnly(adminToken string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			writeError(w, r, errAdminDisabled)
+			return
+		}
+		if !isAdmin(adminToken, r) {
+			writeError(w, r, errUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+const (
+	roleAdmin     = "admin"
+	roleModerator = "moderator"
+)
+
+type staffRoleKey struct{}
+
+// staffRole returns the role r is authenticated with on the admin API:
+// admin for the admin token or an admin API key, moderator for the token
+// given by -moderator-token, or nothing.
+func staffRole(adminToken, moderatorToken string, r *http.Request) string {
+	if isAdmin(adminToken, r) {
+		return roleAdmin
+	}
+	if adminToken != "" && moderatorToken != "" && subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(moderatorToken)) == 1 {
+		return roleModerator
+	}
+	return ""
+}
+
+// moderatorOnly guards the parts of the admin API moderators may use as well
+// as admins: reading who is connected and acting on users and rooms. Like the
+// rest of the admin API it is disabled without an admin token.
+func moderatorOnly(adminToken, moderatorToken string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			writeError(w, r, errAdminDisabled)
+			return
+		}
+		role := staffRole(adminToken, moderatorToken, r)
+		if role == "" {
+			writeError(w, r, errUnauthorized)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), staffRoleKey{}, role)))
+	}
+}
+
+// auditActor is who the audit log records for an admin API request.
+func auditActor(r *http.Request) string {
+	if role, ok := r.Context().Value(staffRoleKey{}).(string); ok {
+		return role
+	}
+	return roleAdmin
+}
+
+// systemRoomGuard restricts subscriptions to system rooms to admins.
+func systemRoomGuard(adminToken string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rooms, err := roomsFromRequest(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if slices.ContainsFunc(rooms, isSystemRoom) && !isAdmin(adminToken, r) {
+			writeError(w, r, fmt.Errorf("%w: subscriptions require the admin token", errSystemRoom))
+			return
+		}
+		next(w, r)
+	}
+}
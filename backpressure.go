@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+const backpressureRetryAfter = time.Second
+
+var (
+	errSaturated = errors.New("server is saturated, retry later")
+
+	rejectedPublishes = newCounter("chat_publishes_rejected_total", "User publishes turned away with 503 because delivery queues were saturated.")
+)
+
+// saturationLimit is stored as the bits of a float64 so it can change while
+// publishers read it.
+type saturationLimit struct {
+	bits atomic.Uint64
+}
+
+func (l *saturationLimit) Load() float64       { return math.Float64frombits(l.bits.Load()) }
+func (l *saturationLimit) Store(limit float64) { l.bits.Store(math.Float64bits(limit)) }
+
+// Saturation is how full the fullest shard delivery queue is, from 0 to 1.
+// Publishes block once a queue is full, so this is what publishers feel.
+func (b *Broker) Saturation() float64 {
+	fill := 0.0
+	for _, s := range b.shards {
+		fill = max(fill, float64(len(s.publish))/float64(cap(s.publish)))
+	}
+	return fill
+}
+
+// QueueDepth is the number of events waiting in all shard delivery queues.
+func (b *Broker) QueueDepth() int {
+	depth := 0
+	for _, s := range b.shards {
+		depth += len(s.publish)
+	}
+	return depth
+}
+
+// SetSaturationLimit makes Admit turn publishers away once Saturation reaches
+// limit. Zero or less disables back-pressure.
+func (b *Broker) SetSaturationLimit(limit float64) {
+	b.saturation.Store(limit)
+}
+
+// StopAdmitting makes Admit refuse every publish from now on, telling
+// clients to retry after the given delay.
+func (b *Broker) StopAdmitting(retryAfter time.Duration) {
+	b.drainRetryAfter.Store(int64(max(retryAfter, time.Second)))
+}
+
+// Admit reports whether a user publish should go ahead. It is checked before
+// publishing rather than inside it so server-generated events like presence
+// changes are never refused.
+func (b *Broker) Admit() error {
+	if after := b.drainRetryAfter.Load(); after > 0 {
+		return withRetryAfter(errShuttingDown, time.Duration(after))
+	}
+	limit := b.saturation.Load()
+	if limit <= 0 || b.Saturation() < limit {
+		return nil
+	}
+	rejectedPublishes.Inc()
+	return withRetryAfter(errSaturated, backpressureRetryAfter)
+}
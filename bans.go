@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errBanned = errors.New("user is banned")
+
+type Ban struct {
+	UserID string    `json:"user_id"`
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// banList holds users locked out of the chat API, and with a store keeps
+// them there across restarts.
+type banList struct {
+	mu    sync.RWMutex
+	bans  map[string]Ban
+	store banStore
+}
+
+// banStore persists bans as they change.
+type banStore interface {
+	SaveBan(ban Ban) error
+	DeleteBan(user string) error
+}
+
+func newBanList() *banList {
+	return &banList{bans: make(map[string]Ban)}
+}
+
+// UseStore saves every ban from now on in store before making it.
+func (b *banList) UseStore(store banStore) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.store = store
+}
+
+func (b *banList) Ban(user, reason string) (Ban, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ban := Ban{UserID: user, Reason: reason, Since: time.Now().UTC()}
+	if b.store != nil {
+		if err := b.store.SaveBan(ban); err != nil {
+			return Ban{}, err
+		}
+	}
+	b.bans[user] = ban
+	return ban, nil
+}
+
+func (b *banList) Unban(user string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.bans[user]
+	if ok && b.store != nil {
+		if err := b.store.DeleteBan(user); err != nil {
+			return false, err
+		}
+	}
+	delete(b.bans, user)
+	return ok, nil
+}
+
+func (b *banList) IsBanned(user string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	_, ok := b.bans[user]
+	return ok
+}
+
+func (b *banList) List() []Ban {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	bans := make([]Ban, 0, len(b.bans))
+	for _, ban := range b.bans {
+		bans = append(bans, ban)
+	}
+	return bans
+}
+
+// banMiddleware turns banned users away from every /chat/ endpoint.
+func banMiddleware(bans *banList, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/chat/") {
+			if user := userFromRequest(r); user != "" && bans.IsBanned(user) {
+				writeError(w, r, errBanned)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type banRequest struct {
+	Reason string `json:"reason"`
+}
+
+func listBansHandler(bans *banList) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bans.List())
+	}
+}
+
+// banUserHandler bans a user and disconnects their open streams.
+func banUserHandler(broker *Broker, bans *banList, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.PathValue("user")
+
+		req := banRequest{}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, r, invalidJSON(err))
+				return
+			}
+		}
+
+		ban, err := bans.Ban(user, req.Reason)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		broker.Kick(user)
+		audit.Record(auditActor(r), "user.ban", "", "user="+user+" reason="+req.Reason)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ban)
+	}
+}
+
+func unbanUserHandler(bans *banList, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.PathValue("user")
+		unbanned, err := bans.Unban(user)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if unbanned {
+			audit.Record(auditActor(r), "user.unban", "", "user="+user)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *messageStore) SaveBan(ban Ban) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO bans (user_id, reason, since) VALUES (?, ?, ?)`, ban.UserID, ban.Reason, ban.Since.UnixNano())
+	return err
+}
+
+func (s *messageStore) DeleteBan(user string) error {
+	_, err := s.db.Exec(`DELETE FROM bans WHERE user_id = ?`, user)
+	return err
+}
+
+// RecoverBans puts the stored bans back in bans and returns how many there
+// were.
+func (s *messageStore) RecoverBans(ctx context.Context, bans *banList) (int, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT user_id, reason, since FROM bans`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	stored := []Ban{}
+	for rows.Next() {
+		ban := Ban{}
+		var since int64
+		if err := rows.Scan(&ban.UserID, &ban.Reason, &since); err != nil {
+			return 0, err
+		}
+		ban.Since = time.Unix(0, since).UTC()
+		stored = append(stored, ban)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	bans.Replace(stored)
+	return len(stored), nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const (
+	maxBatchMessages = 100
+	maxBatchBody     = 1 << 20
+)
+
+var batchItems = newCounterVec("chat_batch_messages_total", "Messages sent through /chat/send/batch by result.", "result")
+
+type batchSendRequest struct {
+	Room     string `json:"room"`
+	Messages []Chat `json:"messages"`
+}
+
+// batchResult is the outcome of one message of a batch: published (or
+// duplicate, if it was published before), rejected with an error, or
+// skipped because an earlier message couldn't be published.
+type batchResult struct {
+	Index  int            `json:"index"`
+	Status string         `json:"status"`
+	ID     string         `json:"id,omitempty"`
+	Seq    uint64         `json:"seq,omitempty"`
+	Error  *ErrorResponse `json:"error,omitempty"`
+}
+
+type batchSendResponse struct {
+	Room      string        `json:"room"`
+	Published int           `json:"published"`
+	Results   []batchResult `json:"results"`
+}
+
+// sendBatchHandler publishes up to maxBatchMessages messages into one room
+// in the order given. The request as a whole is admitted, authorized and
+// checked for spam once; each message is then moderated and deduplicated on
+// its own. Should publishing fail, the messages after it are skipped rather
+// than published out of order. An Idempotency-Key on the batch gives every
+// message without a client_message_id one of its own, so a retried batch
+// only publishes what didn't go out the first time.
+func sendBatchHandler(broker *Broker, rooms *roomRegistry, spam *spamDetector, challenge *sendChallenge, dedup *publishDeduper, unfurl *unfurler, emojis *emojiRegistry, features *featureSet) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := broker.Admit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		user := userFromRequest(r)
+		if user == "" {
+			writeError(w, r, errUnauthenticated)
+			return
+		}
+
+		req := batchSendRequest{}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBatchBody)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+		if req.Room == "" {
+			req.Room = defaultRoom
+		}
+		if len(req.Messages) == 0 || len(req.Messages) > maxBatchMessages {
+			writeError(w, r, fmt.Errorf("%w: a batch has 1 to %d messages", errInvalidRequest, maxBatchMessages))
+			return
+		}
+		if err := rooms.CheckPublish(req.Room, user); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if err := challenge.Check(r, rooms, req.Room); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		resp := batchSendResponse{Room: req.Room, Results: make([]batchResult, len(req.Messages))}
+		fail := func(i int, err error) {
+			_, body := errorResponse(r, err)
+			body.RequestID = ""
+			resp.Results[i].Status, resp.Results[i].Error = "rejected", &body
+		}
+
+		idempotencyKey := r.Header.Get("Idempotency-Key")
+		var accepted []int
+		for i := range req.Messages {
+			chat := &req.Messages[i]
+			resp.Results[i].Index = i
+			if chat.Room != "" && chat.Room != req.Room {
+				fail(i, fmt.Errorf("%w: every message of a batch goes to the batch's room", errInvalidRequest))
+				continue
+			}
+			if chat.UserID != "" && chat.UserID != user {
+				fail(i, fmt.Errorf("%w: user_id does not match the caller", errForbidden))
+				continue
+			}
+			chat.Room, chat.UserID = req.Room, user
+			chat.ForwardedFrom, chat.Attachment, chat.Via = nil, nil, ""
+			if err := rooms.Moderate(chat.Room, chat); err != nil {
+				fail(i, err)
+				continue
+			}
+			if chat.ClientMessageID == "" && idempotencyKey != "" {
+				chat.ClientMessageID = idempotencyKey + ":" + strconv.Itoa(i)
+			}
+			if len(chat.ClientMessageID) > maxClientMessageID {
+				fail(i, fmt.Errorf("%w: client_message_id is limited to %d bytes", errInvalidRequest, maxClientMessageID))
+				continue
+			}
+			if err := checkSentAt(chat); err != nil {
+				fail(i, err)
+				continue
+			}
+			chat.Emoji = nil
+			if features.Enabled(featureEmoji) {
+				chat.Emoji = emojis.Resolve(chat.Room, chat.Message)
+			}
+			accepted = append(accepted, i)
+		}
+
+		messages := make([]string, len(accepted))
+		for j, i := range accepted {
+			messages[j] = req.Messages[i].payload()
+		}
+		muted := len(accepted) > 0 && spam.CheckBatch(spamKey(r), req.Room, messages).Muted
+
+		failed := false
+		for _, i := range accepted {
+			chat := req.Messages[i]
+			result := &resp.Results[i]
+			if failed {
+				result.Status = "skipped"
+				continue
+			}
+
+			key, fresh := dedup.Claim(chat)
+			if !fresh {
+				original, _ := dedup.Original(key)
+				result.Status, result.ID, result.Seq = "duplicate", original.ID, original.Seq
+				continue
+			}
+			if muted {
+				shadowMutedSent.Inc()
+				shadow := shadowEnvelope(broker, chat.Room)
+				result.Status, result.ID, result.Seq = "published", shadow.ID, shadow.Seq
+				resp.Published++
+				continue
+			}
+
+			env, err := publishChat(broker, chat)
+			if err == nil {
+				dedup.Published(key, env)
+				result.Status, result.ID, result.Seq = "published", env.ID, env.Seq
+				resp.Published++
+				if unfurl != nil && env.ID != "" && features.Enabled(featurePreviews) {
+					unfurl.Enqueue(env.ID, env.Room, chat.Message)
+				}
+				continue
+			}
+			dedup.Release(key)
+			fail(i, err)
+			failed = true
+		}
+
+		for _, result := range resp.Results {
+			batchItems.With(result.Status).Add(1)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var errBlobNotFound = errors.New("blob not found")
+
+// BlobStore holds opaque binary objects such as attachments.
+type BlobStore interface {
+	Put(ctx context.Context, key, contentType string, r io.Reader) error
+	Get(ctx context.Context, key string) (io.ReadCloser, string, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// blobPresigner is implemented by stores that can hand out time-limited
+// download URLs, letting clients fetch blobs without going through the server.
+type blobPresigner interface {
+	PresignGet(ctx context.Context, key string, ttl time.Duration) (string, error)
+}
+
+type memoryBlob struct {
+	data        []byte
+	contentType string
+}
+
+type memoryBlobStore struct {
+	mu    sync.RWMutex
+	blobs map[string]memoryBlob
+}
+
+func newMemoryBlobStore() BlobStore {
+	return &memoryBlobStore{blobs: make(map[string]memoryBlob)}
+}
+
+func (s *memoryBlobStore) Put(ctx context.Context, key, contentType string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[key] = memoryBlob{data: data, contentType: contentType}
+	return nil
+}
+
+func (s *memoryBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	blob, ok := s.blobs[key]
+	if !ok {
+		return nil, "", errBlobNotFound
+	}
+	return io.NopCloser(bytes.NewReader(blob.data)), blob.contentType, nil
+}
+
+func (s *memoryBlobStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.blobs, key)
+	return nil
+}
+
+// blobConfig selects and configures the BlobStore driver from flags shared
+// by the server and the maintenance commands.
+type blobConfig struct {
+	driver     string
+	dir        string
+	s3         s3Config
+	presignTTL time.Duration
+}
+
+func (c *blobConfig) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.driver, "blob-store", "memory", "blob storage driver: memory, local or s3")
+	fs.StringVar(&c.dir, "blob-dir", "blobs", "directory of the local blob store")
+	fs.StringVar(&c.s3.Endpoint, "s3-endpoint", "https://s3.amazonaws.com", "S3 or S3-compatible endpoint URL")
+	fs.StringVar(&c.s3.Region, "s3-region", "us-east-1", "S3 region")
+	fs.StringVar(&c.s3.Bucket, "s3-bucket", "", "S3 bucket")
+	fs.StringVar(&c.s3.AccessKey, "s3-access-key", os.Getenv("AWS_ACCESS_KEY_ID"), "S3 access key")
+	fs.StringVar(&c.s3.SecretKey, "s3-secret-key", os.Getenv("AWS_SECRET_ACCESS_KEY"), "S3 secret key")
+	fs.BoolVar(&c.s3.PathStyle, "s3-path-style", false, "use path-style bucket addressing (MinIO and most S3-compatible services)")
+	fs.DurationVar(&c.presignTTL, "blob-presign-ttl", 15*time.Minute, "lifetime of presigned download URLs")
+}
+
+func (c *blobConfig) open() (BlobStore, error) {
+	switch c.driver {
+	case "memory":
+		return newMemoryBlobStore(), nil
+	case "local":
+		return newLocalBlobStore(c.dir)
+	case "s3":
+		return newS3BlobStore(c.s3)
+	}
+	return nil, fmt.Errorf("unknown blob store %q", c.driver)
+}
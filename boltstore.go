@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	storeEngineSQLite = "sqlite"
+	storeEngineBolt   = "bolt"
+)
+
+var (
+	// boltMessages holds a bucket of envelopes per room, keyed by sequence.
+	boltMessages = []byte("messages")
+	// boltCursors holds the highest sequence published in every room.
+	boltCursors       = []byte("cursors")
+	boltRoomEvents    = []byte("room_events")
+	boltRoomSnapshots = []byte("room_snapshots")
+	boltBans          = []byte("bans")
+	boltGuestLinks    = []byte("guest_links")
+	boltBuckets       = [][]byte{boltMessages, boltCursors, boltRoomEvents, boltRoomSnapshots, boltBans, boltGuestLinks}
+)
+
+// boltStore keeps messages, room cursors, the room journal, bans and guest
+// links in a single bbolt file, for deployments that want durable history and resume
+// without anything but a data directory. The janitor expires its messages
+// like the SQLite store's; everything else -store offers needs the SQLite
+// engine.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("store: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range boltBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("store: %w", err)
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+func boltSeqKey(seq uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, seq)
+}
+
+// AppendEnvelope stores env in its room and advances the room's cursor.
+func (s *boltStore) AppendEnvelope(env Envelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		room, err := tx.Bucket(boltMessages).CreateBucketIfNotExists([]byte(env.Room))
+		if err != nil {
+			return err
+		}
+		if err := room.Put(boltSeqKey(env.Seq), data); err != nil {
+			return err
+		}
+		cursors := tx.Bucket(boltCursors)
+		if cursor := cursors.Get([]byte(env.Room)); cursor != nil && binary.BigEndian.Uint64(cursor) >= env.Seq {
+			return nil
+		}
+		return cursors.Put([]byte(env.Room), boltSeqKey(env.Seq))
+	})
+}
+
+// Recover calls fn with the cursor of every stored room and its newest
+// historySize envelopes, oldest first, like messageStore.Recover.
+func (s *boltStore) Recover(ctx context.Context, fn func(room string, seq uint64, recent []Envelope)) (int, error) {
+	seqs := make(map[string]uint64)
+	recent := make(map[string][]Envelope)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(boltCursors).ForEach(func(room, cursor []byte) error {
+			seqs[string(room)] = binary.BigEndian.Uint64(cursor)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		messages := tx.Bucket(boltMessages)
+		for room := range seqs {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			bucket := messages.Bucket([]byte(room))
+			if bucket == nil {
+				continue
+			}
+			var envs []Envelope
+			c := bucket.Cursor()
+			for k, v := c.Last(); k != nil && len(envs) < historySize; k, v = c.Prev() {
+				env := Envelope{}
+				if err := json.Unmarshal(v, &env); err != nil {
+					return fmt.Errorf("message %s:%d: %w", room, binary.BigEndian.Uint64(k), err)
+				}
+				envs = append(envs, env)
+			}
+			for i, j := 0, len(envs)-1; i < j; i, j = i+1, j-1 {
+				envs[i], envs[j] = envs[j], envs[i]
+			}
+			recent[room] = envs
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for room, seq := range seqs {
+		fn(room, seq, recent[room])
+	}
+	return len(seqs), nil
+}
+
+// ExpireMessages deletes the chat messages of room published before cutoff,
+// except those held sent, and returns their envelope IDs. Room cursors stay,
+// so sequences carry on past what expired.
+func (s *boltStore) ExpireMessages(ctx context.Context, room string, cutoff time.Time, held func(user string) bool) ([]string, error) {
+	var IDs []string
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltMessages).Bucket([]byte(room))
+		if bucket == nil {
+			return nil
+		}
+		var expired [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			env := Envelope{}
+			if err := json.Unmarshal(v, &env); err != nil {
+				return fmt.Errorf("message %s:%d: %w", room, binary.BigEndian.Uint64(k), err)
+			}
+			if env.Event != "" || !env.Time.Before(cutoff) || held != nil && held(senderOf(env.Data)) {
+				return nil
+			}
+			expired = append(expired, k)
+			IDs = append(IDs, env.ID)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return IDs, nil
+}
+
+// AppendRoomEvent stores e and returns its sequence.
+func (s *boltStore) AppendRoomEvent(e RoomEvent) (uint64, error) {
+	var seq uint64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		seq, err = appendBoltRoomEvent(tx, e)
+		return err
+	})
+	return seq, err
+}
+
+func appendBoltRoomEvent(tx *bolt.Tx, e RoomEvent) (uint64, error) {
+	events := tx.Bucket(boltRoomEvents)
+	seq, err := events.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	e.Seq = seq
+	data, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+	return seq, events.Put(boltSeqKey(seq), data)
+}
+
+// SaveRoomSnapshot stores rooms as the state after event seq, in place of
+// older snapshots. The events stay.
+func (s *boltStore) SaveRoomSnapshot(seq uint64, rooms []roomState) error {
+	data, err := json.Marshal(rooms)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		snapshots := tx.Bucket(boltRoomSnapshots)
+		var older [][]byte
+		c := snapshots.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) < seq; k, _ = c.Next() {
+			older = append(older, k)
+		}
+		for _, k := range older {
+			if err := snapshots.Delete(k); err != nil {
+				return err
+			}
+		}
+		return snapshots.Put(boltSeqKey(seq), data)
+	})
+}
+
+// RecoverRooms rebuilds rooms from the newest snapshot and the events after
+// it, and returns how many events that replayed.
+func (s *boltStore) RecoverRooms(ctx context.Context, rooms *roomRegistry) (int, error) {
+	var seq uint64
+	snapshot := []roomState{}
+	var events []RoomEvent
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if k, v := tx.Bucket(boltRoomSnapshots).Cursor().Last(); k != nil {
+			seq = binary.BigEndian.Uint64(k)
+			if err := json.Unmarshal(v, &snapshot); err != nil {
+				return fmt.Errorf("room snapshot %d: %w", seq, err)
+			}
+		}
+		c := tx.Bucket(boltRoomEvents).Cursor()
+		for k, v := c.Seek(boltSeqKey(seq + 1)); k != nil; k, v = c.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			e := RoomEvent{}
+			if err := json.Unmarshal(v, &e); err != nil {
+				return fmt.Errorf("room event %d: %w", binary.BigEndian.Uint64(k), err)
+			}
+			e.Seq = binary.BigEndian.Uint64(k)
+			events = append(events, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	rooms.Rebuild(snapshot, seq, events)
+	return len(events), nil
+}
+
+func (s *boltStore) SaveBan(ban Ban) error {
+	data, err := json.Marshal(ban)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBans).Put([]byte(ban.UserID), data)
+	})
+}
+
+func (s *boltStore) DeleteBan(user string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBans).Delete([]byte(user))
+	})
+}
+
+// RecoverBans puts the stored bans back in bans and returns how many there
+// were.
+func (s *boltStore) RecoverBans(ctx context.Context, bans *banList) (int, error) {
+	stored := []Ban{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBans).ForEach(func(user, data []byte) error {
+			ban := Ban{}
+			if err := json.Unmarshal(data, &ban); err != nil {
+				return fmt.Errorf("ban of %s: %w", user, err)
+			}
+			stored = append(stored, ban)
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	bans.Replace(stored)
+	return len(stored), nil
+}
+
+// LinkGuest records the link of guest to user, as guestLinkStore describes.
+// Resume tokens need the SQLite engine, so there are none to move.
+func (s *boltStore) LinkGuest(ctx context.Context, guest, user string, e RoomEvent) (int, uint64, error) {
+	var n int
+	var seq uint64
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		messages := tx.Bucket(boltMessages)
+		err := messages.ForEachBucket(func(name []byte) error {
+			room := messages.Bucket(name)
+			changed := make(map[string][]byte)
+			err := room.ForEach(func(k, v []byte) error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				env := Envelope{}
+				if err := json.Unmarshal(v, &env); err != nil {
+					return fmt.Errorf("message %s:%d: %w", name, binary.BigEndian.Uint64(k), err)
+				}
+				if env.Event != "" || senderOf(env.Data) != guest {
+					return nil
+				}
+				fields := map[string]json.RawMessage{}
+				if err := json.Unmarshal(env.Data, &fields); err != nil {
+					return err
+				}
+				fields["user_id"], _ = json.Marshal(user)
+				data, err := json.Marshal(fields)
+				if err != nil {
+					return err
+				}
+				env.Data = data
+				if changed[string(k)], err = json.Marshal(env); err != nil {
+					return err
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for k, v := range changed {
+				if err := room.Put([]byte(k), v); err != nil {
+					return err
+				}
+			}
+			n += len(changed)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if seq, err = appendBoltRoomEvent(tx, e); err != nil {
+			return err
+		}
+		return tx.Bucket(boltGuestLinks).Put([]byte(guest), []byte(user))
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return n, seq, nil
+}
+
+// RecoverGuestLinks puts the stored links back in guests and returns how
+// many there were.
+func (s *boltStore) RecoverGuestLinks(ctx context.Context, guests *guestAccounts) (int, error) {
+	links := make(map[string]string)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltGuestLinks).ForEach(func(guest, user []byte) error {
+			links[string(guest)] = string(user)
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	guests.Replace(links)
+	return len(links), nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestBoltStore(t *testing.T, path string) *boltStore {
+	t.Helper()
+	kv, err := openBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv
+}
+
+func TestBoltStoreRecoversAfterReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.bolt")
+	kv := openTestBoltStore(t, path)
+	broker := newTestBroker(t, 4)
+	broker.UseJournal(kv)
+	for i := range 3 {
+		if _, err := broker.Publish("general", fmt.Appendf(nil, `{"message":"m%d"}`, i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rooms := newRoomRegistry()
+	rooms.UseJournal(kv)
+	// One past a snapshot, so recovery reads both the snapshot and the
+	// events after it.
+	for i := range roomSnapshotEvery + 2 {
+		if _, err := rooms.Create(fmt.Sprintf("room-%d", i), "alice", roomSettings{Private: i == 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bans := newBanList()
+	bans.UseStore(kv)
+	if _, err := bans.Ban("mallory", "spam"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bans.Ban("bob", "spam"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bans.Unban("bob"); err != nil {
+		t.Fatal(err)
+	}
+	broker.Close()
+	if err := kv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	kv = openTestBoltStore(t, path)
+	defer kv.Close()
+	broker = newTestBroker(t, 4)
+	t.Cleanup(broker.Close)
+	if _, err := kv.Recover(context.Background(), broker.Restore); err != nil {
+		t.Fatal(err)
+	}
+	broker.UseJournal(kv)
+	env, err := broker.Publish("general", []byte(`{"message":"m4"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Seq != 4 {
+		t.Errorf("first publish after reopening got seq %d, want 4", env.Seq)
+	}
+
+	srv := httptest.NewServer(testStreamHandler(t, broker))
+	defer srv.Close()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/chat/events?room=general", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replayed []string
+	lines := bufio.NewScanner(resp.Body)
+	for len(replayed) < 3 && lines.Scan() {
+		if id, ok := strings.CutPrefix(lines.Text(), "id: "); ok {
+			replayed = append(replayed, id)
+		}
+	}
+	resp.Body.Close()
+	if want := []string{"2", "3", "4"}; !slices.Equal(replayed, want) {
+		t.Errorf("resuming after Last-Event-ID 1 replayed %v, want %v", replayed, want)
+	}
+
+	rooms = newRoomRegistry()
+	replayedEvents, err := kv.RecoverRooms(context.Background(), rooms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayedEvents != 2 {
+		t.Errorf("replayed %d room events after the snapshot, want 2", replayedEvents)
+	}
+	if n := len(rooms.List()); n != roomSnapshotEvery+2 {
+		t.Errorf("rebuilt %d rooms, want %d", n, roomSnapshotEvery+2)
+	}
+	if room, ok := rooms.Get("room-0"); !ok || !room.Private || room.Owner != "alice" {
+		t.Errorf("room-0 rebuilt as %+v, %v", room, ok)
+	}
+
+	bans = newBanList()
+	if n, err := kv.RecoverBans(context.Background(), bans); err != nil || n != 1 {
+		t.Fatalf("recovered %d bans, %v; want 1", n, err)
+	}
+	if !bans.IsBanned("mallory") || bans.IsBanned("bob") {
+		t.Error("recovered bans don't match what was banned and unbanned")
+	}
+}
+
+func TestBoltStoreExpiredMessagesStayGone(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.bolt")
+	kv := openTestBoltStore(t, path)
+	defer kv.Close()
+	broker := newTestBroker(t, 4)
+	t.Cleanup(broker.Close)
+	broker.UseJournal(kv)
+	for _, user := range []string{"alice", "bob"} {
+		if _, err := broker.Publish("general", fmt.Appendf(nil, `{"user_id":%q,"message":"hi"}`, user)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	held := func(user string) bool { return user == "bob" }
+	if err := expireRoom(context.Background(), broker, kv, "general", -time.Minute, held); err != nil {
+		t.Fatal(err)
+	}
+
+	var recovered []Envelope
+	var seq uint64
+	if _, err := kv.Recover(context.Background(), func(room string, last uint64, recent []Envelope) {
+		seq, recovered = last, recent
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The expired notice was published after the messages, as seq 3.
+	if seq != 3 {
+		t.Errorf("recovered cursor %d, want 3", seq)
+	}
+	var IDs []string
+	for _, env := range recovered {
+		IDs = append(IDs, env.ID)
+	}
+	if want := []string{"general:2", "general:3"}; !slices.Equal(IDs, want) {
+		t.Errorf("recovered %v, want the held message and the notice %v", IDs, want)
+	}
+}
@@ -0,0 +1,746 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	subscriberBufferSize = 64
+	controlBufferSize    = 8
+)
+
+var (
+	droppedEvents  = newCounter("chat_dropped_events_total", "Events dropped because a subscriber's buffer was full.")
+	droppedControl = newCounter("chat_dropped_control_total", "Control notices dropped because a subscriber's control lane was full.")
+)
+
+var errSubscriberNotFound = errors.New("subscriber not found")
+
+type Subscriber struct {
+	ID       string
+	User     string
+	ClientID string
+	Groups   []string
+	Origin   ConnOrigin
+	Channel  chan Envelope
+	Dropped  atomic.Uint64
+
+	// control carries notices about the stream itself, apart from Channel
+	// so a backlog of room events can't hold them up.
+	control chan Envelope
+
+	filter func(Envelope) bool
+	policy atomic.Pointer[StreamPolicy]
+	// rooms and kicked are guarded by the lock of the subscriber's shard.
+	rooms  map[string]bool
+	kicked bool
+	kick   chan struct{}
+
+	authExpires atomic.Int64
+	reauth      chan struct{}
+
+	binding atomic.Pointer[subscriberBinding]
+	window  atomic.Pointer[flowWindow]
+
+	// Capabilities are those the stream granted, nil if it declared none.
+	// They are set before the subscriber is announced.
+	Capabilities []string
+}
+
+// Control receives the control notices of the stream, which should be
+// written ahead of anything waiting on Channel.
+func (s *Subscriber) Control() <-chan Envelope {
+	return s.control
+}
+
+// Kicked is closed when an operator disconnects the subscriber.
+func (s *Subscriber) Kicked() <-chan struct{} {
+	return s.kick
+}
+
+// SubscriberInfo is a point-in-time description of a subscriber.
+type SubscriberInfo struct {
+	ID       string        `json:"id"`
+	User     string        `json:"user_id,omitempty"`
+	ClientID string        `json:"client_id,omitempty"`
+	Rooms    []string      `json:"rooms"`
+	Groups   []string      `json:"groups,omitempty"`
+	Origin   ConnOrigin    `json:"origin"`
+	Dropped  uint64        `json:"dropped"`
+	Policy   *StreamPolicy `json:"policy,omitempty"`
+	// Capabilities is nil for streams that declared none.
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// addressed reports whether env is for the subscriber, either through one
+// of its rooms or, for group notices, through one of its groups. The shard
+// lock must be held.
+func (s *Subscriber) addressed(env Envelope) bool {
+	if env.Group != "" {
+		return slices.Contains(s.Groups, env.Group)
+	}
+	return s.rooms[env.Room]
+}
+
+// rejects returns why a room envelope addressed to the subscriber is
+// filtered out, by its policy or its filter, or "" if it isn't.
+func (s *Subscriber) rejects(env Envelope) string {
+	switch {
+	case env.Group != "":
+		return ""
+	case !s.Policy().allows(env):
+		return "policy"
+	case s.filter != nil && !s.filter(env):
+		return "filter"
+	}
+	return ""
+}
+
+// shard owns a slice of the subscriber registry. Each shard has its own lock
+// and delivery loop so publishes and subscribes on different shards never
+// contend with each other.
+type shard struct {
+	mu          sync.RWMutex
+	subscribers map[string]*Subscriber
+	publish     chan Envelope
+	deliveries  *deliveryLog
+}
+
+func newShard(done <-chan struct{}, stopped *sync.WaitGroup) *shard {
+	s := &shard{
+		subscribers: make(map[string]*Subscriber),
+		publish:     make(chan Envelope, subscriberBufferSize),
+	}
+	stopped.Add(1)
+	go func() {
+		defer stopped.Done()
+		s.deliver(done)
+	}()
+	return s
+}
+
+func (s *shard) deliver(done <-chan struct{}) {
+	for {
+		var env Envelope
+		select {
+		case env = <-s.publish:
+		case <-done:
+			return
+		}
+		s.mu.RLock()
+		for _, subscriber := range s.subscribers {
+			if !subscriber.addressed(env) {
+				continue
+			}
+			if reason := subscriber.rejects(env); reason != "" {
+				s.deliveries.Record(subscriber, env, deliveryFiltered, reason)
+				continue
+			}
+			select {
+			case subscriber.Channel <- env:
+			default:
+				subscriber.Dropped.Add(1)
+				droppedEvents.Inc()
+				s.deliveries.Record(subscriber, env, deliveryDropped, "buffer full")
+			}
+		}
+		s.mu.RUnlock()
+	}
+}
+
+type Broker struct {
+	shards    []*shard
+	nextID    atomic.Uint64
+	backend   Backend
+	sequencer *roomSequencer
+	history   *history
+	store     *messageStore
+	journal   envelopeJournal
+	// deliveries, if not nil, records what each subscriber was sent.
+	deliveries *deliveryLog
+
+	saturation      saturationLimit
+	drainRetryAfter atomic.Int64
+	shedding        atomic.Bool
+	occupancy       func(room string, delta int)
+	lifecycle       func(LifecycleEvent)
+
+	tapsMu sync.RWMutex
+	taps   []func(Envelope)
+
+	done      chan struct{}
+	closeOnce sync.Once
+	stopped   sync.WaitGroup
+}
+
+func NewBroker(shardCount int, backend Backend) (*Broker, error) {
+	if shardCount < 1 {
+		shardCount = 1
+	}
+
+	b := &Broker{
+		shards:  make([]*shard, shardCount),
+		backend: backend,
+		history: newHistory(),
+		done:    make(chan struct{}),
+	}
+	for i := range b.shards {
+		b.shards[i] = newShard(b.done, &b.stopped)
+	}
+	b.sequencer = newRoomSequencer(b.fanOut)
+
+	if err := backend.Subscribe(b.receive); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *Broker) shardFor(ID string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(ID))
+	return b.shards[h.Sum32()%uint32(len(b.shards))]
+}
+
+// Subscribe registers a subscriber of user on client to rooms and groups.
+// filter, when not nil, is consulted on the delivery path for every room
+// envelope and must not block.
+func (b *Broker) Subscribe(user, client string, origin ConnOrigin, rooms, groups []string, filter func(Envelope) bool) *Subscriber {
+	subscriber := &Subscriber{
+		ID:       fmt.Sprintf("%d", b.nextID.Add(1)),
+		User:     user,
+		ClientID: client,
+		Groups:   groups,
+		Origin:   origin,
+		Channel:  make(chan Envelope, subscriberBufferSize),
+		control:  make(chan Envelope, controlBufferSize),
+		filter:   filter,
+		rooms:    make(map[string]bool, len(rooms)),
+		kick:     make(chan struct{}),
+		reauth:   make(chan struct{}, 1),
+	}
+	for _, room := range rooms {
+		subscriber.rooms[room] = true
+	}
+
+	leaks.channelOpened()
+
+	s := b.shardFor(subscriber.ID)
+	s.mu.Lock()
+	s.subscribers[subscriber.ID] = subscriber
+	b.changed(lifecycleConnect, subscriber, "")
+	for _, room := range rooms {
+		b.occupied(room, 1)
+		b.changed(lifecycleJoin, subscriber, room)
+	}
+	s.mu.Unlock()
+	return subscriber
+}
+
+// Unsubscribe removes the subscriber and returns the rooms it was in.
+func (b *Broker) Unsubscribe(ID string) []string {
+	s := b.shardFor(ID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subscriber, ok := s.subscribers[ID]
+	if !ok {
+		return nil
+	}
+	delete(s.subscribers, ID)
+	close(subscriber.Channel)
+	leaks.channelClosed()
+	rooms := slices.Collect(maps.Keys(subscriber.rooms))
+	for _, room := range rooms {
+		b.occupied(room, -1)
+		b.changed(lifecycleLeave, subscriber, room)
+	}
+	b.changed(lifecycleDisconnect, subscriber, "")
+	return rooms
+}
+
+// OnOccupancy registers fn to follow how many subscribers each room has. It
+// runs under a shard lock and must not block. Set it before serving.
+func (b *Broker) OnOccupancy(fn func(room string, delta int)) {
+	b.occupancy = fn
+}
+
+func (b *Broker) occupied(room string, delta int) {
+	if b.occupancy != nil {
+		b.occupancy(room, delta)
+	}
+}
+
+// Lookup returns the subscriber with ID, if it is connected to this node.
+func (b *Broker) Lookup(ID string) (*Subscriber, bool) {
+	s := b.shardFor(ID)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	subscriber, ok := s.subscribers[ID]
+	return subscriber, ok
+}
+
+// RoomsOf returns the rooms of a connected subscriber.
+func (b *Broker) RoomsOf(ID string) []string {
+	s := b.shardFor(ID)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	subscriber, ok := s.subscribers[ID]
+	if !ok {
+		return nil
+	}
+	return slices.Sorted(maps.Keys(subscriber.rooms))
+}
+
+// Join adds room to a connected subscriber. It reports false if the
+// subscriber was already in room.
+func (b *Broker) Join(ID, room string, limit int) (bool, error) {
+	s := b.shardFor(ID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subscriber, ok := s.subscribers[ID]
+	if !ok {
+		return false, errSubscriberNotFound
+	}
+	if subscriber.rooms[room] {
+		return false, nil
+	}
+	if len(subscriber.rooms) >= limit {
+		return false, fmt.Errorf("%w: at most %d rooms per stream", errInvalidRequest, limit)
+	}
+	subscriber.rooms[room] = true
+	b.occupied(room, 1)
+	b.changed(lifecycleJoin, subscriber, room)
+	return true, nil
+}
+
+// Leave removes room from a connected subscriber. It reports false if the
+// subscriber wasn't in room.
+func (b *Broker) Leave(ID, room string) (bool, error) {
+	s := b.shardFor(ID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subscriber, ok := s.subscribers[ID]
+	if !ok {
+		return false, errSubscriberNotFound
+	}
+	if !subscriber.rooms[room] {
+		return false, nil
+	}
+	delete(subscriber.rooms, room)
+	b.occupied(room, -1)
+	b.changed(lifecycleLeave, subscriber, room)
+	return true, nil
+}
+
+// Publish assigns the next sequence of room and hands the envelope to the
+// backend. Local subscribers receive it once the backend delivers it back, so
+// they observe the same order as every other node.
+func (b *Broker) Publish(room string, data []byte) (Envelope, error) {
+	return b.PublishEvent(room, "", data)
+}
+
+// UseStore persists every room envelope in store before it is published. It
+// must be called before the broker is used.
+func (b *Broker) UseStore(store *messageStore) {
+	store.sequence, store.publish = b.sequence, b.publishSequenced
+	b.store = store
+}
+
+// envelopeJournal persists room envelopes once they are sequenced.
+type envelopeJournal interface {
+	AppendEnvelope(env Envelope) error
+}
+
+// UseJournal appends every envelope published on this node from now on to
+// journal before handing it to the backend. It is the store-less
+// alternative to UseStore and must be called before the broker is used.
+func (b *Broker) UseJournal(journal envelopeJournal) {
+	b.journal = journal
+}
+
+// PublishEvent is Publish for a named SSE event, sequenced in the room
+// alongside its chat messages. With a store, the envelope goes through its
+// outbox; a zero Envelope and nil error mean it is stored but not published
+// yet.
+func (b *Broker) PublishEvent(room, event string, data []byte) (Envelope, error) {
+	return b.publish(room, event, data, nil, "")
+}
+
+// PublishSent is Publish for a chat message the sender says it sent at
+// sentAt by its own clock, if not nil.
+func (b *Broker) PublishSent(room string, data []byte, sentAt *time.Time) (Envelope, error) {
+	return b.publish(room, "", data, sentAt, "")
+}
+
+// PublishFrom is PublishEvent for an envelope a federated server, origin,
+// sent.
+func (b *Broker) PublishFrom(room, event string, data []byte, sentAt *time.Time, origin string) (Envelope, error) {
+	return b.publish(room, event, data, sentAt, origin)
+}
+
+func (b *Broker) publish(room, event string, data []byte, sentAt *time.Time, origin string) (Envelope, error) {
+	if forwarder, ok := b.backend.(publishForwarder); ok {
+		return forwarder.Forward(room, event, data, sentAt, origin)
+	}
+	if b.store != nil {
+		return b.store.Publish(room, event, data, sentAt, origin)
+	}
+	return b.publishEvent(room, event, data, sentAt, origin)
+}
+
+func (b *Broker) publishEvent(room, event string, data []byte, sentAt *time.Time, origin string) (Envelope, error) {
+	env, err := b.sequence(room, event, data, sentAt, origin)
+	if err != nil {
+		return Envelope{}, err
+	}
+	if err := b.publishSequenced(env); err != nil {
+		return Envelope{}, err
+	}
+	return env, nil
+}
+
+// sequence makes the envelope of a message published now, taking the next
+// sequence of room.
+func (b *Broker) sequence(room, event string, data []byte, sentAt *time.Time, origin string) (Envelope, error) {
+	seq, err := b.backend.NextSequence(room)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	env := Envelope{
+		ID:     fmt.Sprintf("%s:%d", room, seq),
+		Room:   room,
+		Seq:    seq,
+		Event:  event,
+		Data:   data,
+		SentAt: sentAt,
+		Origin: origin,
+	}
+	env.stamp(time.Now().UTC())
+	return env, nil
+}
+
+// publishSequenced hands env, as sequence made it, to the backend.
+// Publishing the same envelope again is harmless: the sequencer drops
+// sequences it has already released.
+func (b *Broker) publishSequenced(env Envelope) error {
+	if b.journal != nil {
+		if err := b.journal.AppendEnvelope(env); err != nil {
+			return err
+		}
+	}
+	return b.backend.Publish(env)
+}
+
+// PublishToGroup sends a notice to every subscriber tagged with group, on any
+// node and in any room. Group notices aren't sequenced or kept in history.
+func (b *Broker) PublishToGroup(group, event string, data []byte) error {
+	return b.backend.Publish(Envelope{
+		ID:    fmt.Sprintf("%s:%d", group, time.Now().UnixNano()),
+		Group: group,
+		Event: event,
+		Time:  time.Now().UTC(),
+		Data:  data,
+	})
+}
+
+func (b *Broker) receive(env Envelope) {
+	if env.Group != "" {
+		b.deliver(env)
+		return
+	}
+	b.sequencer.Accept(env)
+}
+
+// Restore picks room up where a previous run left it: sequences continue
+// after seq and recent, its newest envelopes oldest first, can be resumed
+// from. Call it before publishing.
+func (b *Broker) Restore(room string, seq uint64, recent []Envelope) {
+	if seeder, ok := b.backend.(sequenceSeeder); ok {
+		seeder.SeedSequence(room, seq)
+	}
+	b.sequencer.Seed(room, seq)
+	b.history.Restore(room, seq, recent)
+}
+
+// Replay returns the envelopes of room published after seq, by server time
+// and then sequence.
+func (b *Broker) Replay(room string, seq uint64) []Envelope {
+	envs := b.history.Since(room, seq)
+	slices.SortStableFunc(envs, compareServerTime)
+	return envs
+}
+
+// Sequences returns the latest sequence of every room in history.
+func (b *Broker) Sequences() map[string]uint64 {
+	return b.history.Sequences()
+}
+
+// LatestSequence returns the sequence of the newest envelope delivered in
+// room, or 0 if it has none in history.
+func (b *Broker) LatestSequence(room string) uint64 {
+	return b.history.Latest(room)
+}
+
+// Message looks up a recent envelope by its ID.
+func (b *Broker) Message(ID string) (Envelope, bool) {
+	sep := strings.LastIndex(ID, ":")
+	if sep < 0 {
+		return Envelope{}, false
+	}
+	seq, err := strconv.ParseUint(ID[sep+1:], 10, 64)
+	if err != nil {
+		return Envelope{}, false
+	}
+	return b.history.Get(ID[:sep], seq)
+}
+
+// Tap registers fn to observe every room envelope after sequencing, in
+// order. fn runs on the delivery path and must not block.
+func (b *Broker) Tap(fn func(Envelope)) {
+	b.tapsMu.Lock()
+	defer b.tapsMu.Unlock()
+	b.taps = append(b.taps, fn)
+}
+
+// fanOut encodes the SSE frame of env once; every subscriber and every later
+// replay writes that same byte slice.
+func (b *Broker) fanOut(env Envelope) {
+	// Server times of a room never go backwards along its sequence, so
+	// ordering by time, then sequence, is the delivery order everywhere.
+	if last := b.history.LastTime(env.Room); env.Time.Before(last) {
+		env.stamp(last)
+	}
+	if frame, err := encodeFrame(env); err == nil {
+		env.frame = frame
+	}
+
+	b.history.Append(env)
+	b.deliver(env)
+
+	b.tapsMu.RLock()
+	for _, tap := range b.taps {
+		tap(env)
+	}
+	b.tapsMu.RUnlock()
+}
+
+func (b *Broker) deliver(env Envelope) {
+	if b.shedding.Load() && lowPriorityEvents[env.Event] {
+		shedEvents.With(env.Event).Add(1)
+		return
+	}
+	if env.frame == nil {
+		if frame, err := encodeFrame(env); err == nil {
+			env.frame = frame
+		}
+	}
+	for _, s := range b.shards {
+		select {
+		case s.publish <- env:
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// Close stops the delivery loops of every shard once the streams are gone.
+// What is published after it is no longer delivered.
+func (b *Broker) Close() {
+	b.closeOnce.Do(func() { close(b.done) })
+	b.stopped.Wait()
+}
+
+// ReassignAuthor attributes the chat messages of from in the replay history
+// to to and returns how many it changed.
+func (b *Broker) ReassignAuthor(from, to string) int {
+	return b.history.Rewrite(func(env Envelope) (Envelope, bool) {
+		chat := Chat{}
+		if env.Event != "" || json.Unmarshal(env.Data, &chat) != nil || chat.UserID != from {
+			return env, false
+		}
+		chat.UserID = to
+		chatRaw, err := json.Marshal(chat)
+		if err != nil {
+			return env, false
+		}
+		env.Data = chatRaw
+		env.frame, _ = encodeFrame(env)
+		return env, true
+	})
+}
+
+// Subscribers describes the subscribers connected to this node, optionally
+// only those in room.
+func (b *Broker) Subscribers(room string) []SubscriberInfo {
+	var infos []SubscriberInfo
+	for _, s := range b.shards {
+		s.mu.RLock()
+		for _, subscriber := range s.subscribers {
+			if room != "" && !subscriber.rooms[room] {
+				continue
+			}
+			rooms := slices.Sorted(maps.Keys(subscriber.rooms))
+			infos = append(infos, SubscriberInfo{
+				ID:       subscriber.ID,
+				User:     subscriber.User,
+				ClientID: subscriber.ClientID,
+				Rooms:    rooms,
+				Groups:   subscriber.Groups,
+				Origin:   subscriber.Origin,
+				Dropped:  subscriber.Dropped.Load(),
+				Policy:   subscriber.Policy(),
+
+				Capabilities: subscriber.Capabilities,
+			})
+		}
+		s.mu.RUnlock()
+	}
+	slices.SortFunc(infos, func(a, b SubscriberInfo) int { return strings.Compare(a.ID, b.ID) })
+	return infos
+}
+
+// Kick disconnects every stream of user on this node and returns how many
+// there were.
+func (b *Broker) Kick(user string) int {
+	kicked := 0
+	for _, s := range b.shards {
+		s.mu.Lock()
+		for _, subscriber := range s.subscribers {
+			if subscriber.User != user || subscriber.kicked {
+				continue
+			}
+			subscriber.kicked = true
+			close(subscriber.kick)
+			b.changed(lifecycleKick, subscriber, "")
+			kicked++
+		}
+		s.mu.Unlock()
+	}
+	return kicked
+}
+
+// CloseAll disconnects every subscriber, as if kicked.
+func (b *Broker) CloseAll() int {
+	closed := 0
+	for _, s := range b.shards {
+		s.mu.Lock()
+		for _, subscriber := range s.subscribers {
+			if subscriber.kicked {
+				continue
+			}
+			subscriber.kicked = true
+			close(subscriber.kick)
+			closed++
+		}
+		s.mu.Unlock()
+	}
+	return closed
+}
+
+// notify queues env on the control lane of subscriber. The shard lock must
+// be held.
+func (s *Subscriber) notify(env Envelope) bool {
+	select {
+	case s.control <- env:
+		return true
+	default:
+		droppedControl.Inc()
+		return false
+	}
+}
+
+// Notify hands env to the control lane of one subscriber on this node. It
+// reports false if the subscriber is gone or its lane is full.
+func (b *Broker) Notify(ID string, env Envelope) bool {
+	s := b.shardFor(ID)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	subscriber, ok := s.subscribers[ID]
+	return ok && subscriber.notify(env)
+}
+
+// NotifyUser hands env to the control lane of every stream of user on this
+// node and returns how many took it.
+func (b *Broker) NotifyUser(user string, env Envelope) int {
+	notified := 0
+	for _, s := range b.shards {
+		s.mu.RLock()
+		for _, subscriber := range s.subscribers {
+			if subscriber.User == user && subscriber.notify(env) {
+				notified++
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return notified
+}
+
+// NotifyAll hands every subscriber on this node an envelope from notice,
+// whatever its rooms, and returns how many took it. Notices bypass the room
+// sequence and the backend, so they are about this node only.
+func (b *Broker) NotifyAll(notice func() Envelope) int {
+	notified := 0
+	for _, s := range b.shards {
+		s.mu.RLock()
+		for _, subscriber := range s.subscribers {
+			if subscriber.notify(notice()) {
+				notified++
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return notified
+}
+
+// Buffered is the number of events and notices waiting to be written to
+// subscribers.
+func (b *Broker) Buffered() int {
+	buffered := 0
+	for _, s := range b.shards {
+		s.mu.RLock()
+		for _, subscriber := range s.subscribers {
+			buffered += len(subscriber.Channel) + len(subscriber.control)
+		}
+		s.mu.RUnlock()
+	}
+	return buffered
+}
+
+// RegionCounts counts connected subscribers by region.
+func (b *Broker) RegionCounts() map[string]float64 {
+	counts := make(map[string]float64)
+	for _, s := range b.shards {
+		s.mu.RLock()
+		for _, subscriber := range s.subscribers {
+			counts[subscriber.Origin.RegionLabel()]++
+		}
+		s.mu.RUnlock()
+	}
+	return counts
+}
+
+func (b *Broker) SubscriberCount() int {
+	count := 0
+	for _, s := range b.shards {
+		s.mu.RLock()
+		count += len(s.subscribers)
+		s.mu.RUnlock()
+	}
+	return count
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestBroker(tb testing.TB, shards int) *Broker {
+	tb.Helper()
+	broker, err := NewBroker(shards, NewLocalBackend())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return broker
+}
+
+// benchShards compares a single shard, which is one lock and one delivery
+// loop for every subscriber, with sharded registries.
+var benchShards = []int{1, 4, 16}
+
+var benchSubscriberCounts = []int{100, 1000, 10000}
+
+// benchFanOut subscribes n subscribers to room, each handing what it is
+// delivered to handle. The returned wait blocks until every subscriber has
+// been delivered, or has dropped, total envelopes.
+func benchFanOut(b *testing.B, broker *Broker, room string, n int, handle func(Envelope)) (wait func(total int)) {
+	b.Helper()
+	var delivered atomic.Uint64
+	var drained sync.WaitGroup
+	subscribers := make([]*Subscriber, n)
+	for i := range subscribers {
+		subscriber := broker.Subscribe(fmt.Sprintf("user-%d", i), "", ConnOrigin{}, []string{room}, nil, nil)
+		subscribers[i] = subscriber
+		drained.Add(1)
+		go func() {
+			defer drained.Done()
+			for {
+				select {
+				case env := <-subscriber.Channel:
+					handle(env)
+					delivered.Add(1)
+				case <-subscriber.kick:
+					return
+				}
+			}
+		}()
+	}
+	b.Cleanup(func() {
+		broker.CloseAll()
+		drained.Wait()
+		broker.Close()
+	})
+
+	return func(total int) {
+		for {
+			got := delivered.Load()
+			for _, subscriber := range subscribers {
+				got += subscriber.Dropped.Load()
+			}
+			if got >= uint64(total*n) {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func BenchmarkBrokerPublish(b *testing.B) {
+	for _, shards := range benchShards {
+		for _, n := range benchSubscriberCounts {
+			b.Run(fmt.Sprintf("shards=%d/subscribers=%d", shards, n), func(b *testing.B) {
+				broker := newTestBroker(b, shards)
+				wait := benchFanOut(b, broker, "general", n, func(Envelope) {})
+				data := []byte(`{"text":"hello"}`)
+
+				b.ResetTimer()
+				for range b.N {
+					if _, err := broker.Publish("general", data); err != nil {
+						b.Fatal(err)
+					}
+				}
+				wait(b.N)
+			})
+		}
+	}
+}
+
+// BenchmarkBrokerSubscribe measures connection churn while a room with n
+// subscribers is published to, which is where a single lock contends.
+func BenchmarkBrokerSubscribe(b *testing.B) {
+	for _, shards := range benchShards {
+		for _, n := range benchSubscriberCounts {
+			b.Run(fmt.Sprintf("shards=%d/subscribers=%d", shards, n), func(b *testing.B) {
+				broker := newTestBroker(b, shards)
+				benchFanOut(b, broker, "general", n, func(Envelope) {})
+
+				stop := make(chan struct{})
+				published := make(chan struct{})
+				go func() {
+					defer close(published)
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+							broker.Publish("general", []byte(`{"text":"hello"}`))
+						}
+					}
+				}()
+
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						subscriber := broker.Subscribe("churn", "", ConnOrigin{}, []string{"general"}, nil, nil)
+						broker.Unsubscribe(subscriber.ID)
+					}
+				})
+				b.StopTimer()
+				close(stop)
+				<-published
+			})
+		}
+	}
+}
+
+// discardWriter is a stream's ResponseWriter with nowhere to write to.
+type discardWriter struct{ header http.Header }
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+// BenchmarkFanOut reports the allocations of a publish written out by every
+// subscriber. With the frame built once in fanOut they don't grow with the
+// subscribers; reencoded is the cost of formatting the event per write.
+func BenchmarkFanOut(b *testing.B) {
+	for _, prebuilt := range []bool{true, false} {
+		name := "prebuilt"
+		if !prebuilt {
+			name = "reencoded"
+		}
+		for _, n := range benchSubscriberCounts {
+			b.Run(fmt.Sprintf("%s/subscribers=%d", name, n), func(b *testing.B) {
+				broker := newTestBroker(b, 4)
+				w := &discardWriter{}
+				wait := benchFanOut(b, broker, "general", n, func(env Envelope) {
+					if !prebuilt {
+						env.frame = nil
+					}
+					writeEnvelope(w, env)
+				})
+				data := []byte(`{"text":"hello"}`)
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for range b.N {
+					if _, err := broker.Publish("general", data); err != nil {
+						b.Fatal(err)
+					}
+				}
+				wait(b.N)
+			})
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Stream capabilities a client can declare, in ?capabilities= or the
+// X-Stream-Capabilities header, comma-separated.
+const (
+	capabilityBatch       = "batch"
+	capabilityBinary      = "binary"
+	capabilityMeta        = "meta"
+	capabilityCompression = "compression"
+
+	capabilitiesHeader = "X-Stream-Capabilities"
+	batchEvent         = "batch"
+	maxStreamBatch     = 64
+	binaryContentType  = "application/vnd.msgpack"
+)
+
+var (
+	knownCapabilities = []string{capabilityBatch, capabilityBinary, capabilityMeta, capabilityCompression}
+	streamCapability  = newCounterVec("chat_stream_capabilities_total", "Streams opened, by capability granted; none for streams that declared no capabilities.", "capability")
+)
+
+// streamCapabilities is what a client said its stream may use. A client
+// that declares nothing is nil and gets the stream as it always was: meta
+// events, compression if it accepts an encoding, one text frame per event.
+// One that declares anything gets only what it named, so features added
+// later stay off for clients that don't know them. Unknown names are
+// ignored.
+type streamCapabilities map[string]bool
+
+func capabilitiesFrom(r *http.Request) streamCapabilities {
+	raw := r.URL.Query().Get("capabilities")
+	if raw == "" {
+		raw = r.Header.Get(capabilitiesHeader)
+	}
+	if strings.TrimSpace(raw) == "" {
+		return nil
+	}
+	caps := streamCapabilities{}
+	for _, name := range strings.Split(raw, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); slices.Contains(knownCapabilities, name) {
+			caps[name] = true
+		}
+	}
+	return caps
+}
+
+func countCapabilities(granted []string) {
+	if granted == nil {
+		streamCapability.With("none").Add(1)
+	}
+	for _, name := range granted {
+		streamCapability.With(name).Add(1)
+	}
+}
+
+func (c streamCapabilities) Has(name string) bool {
+	if c == nil {
+		return name == capabilityMeta || name == capabilityCompression
+	}
+	return c[name]
+}
+
+// granted lists the capabilities the stream written to w actually uses,
+// which the client is told in its subscribed event: binary framing is only
+// for NDJSON streams, and compression depends on Accept-Encoding too.
+func (c streamCapabilities) granted(w http.ResponseWriter) []string {
+	if c == nil {
+		return nil
+	}
+	granted := []string{}
+	for _, name := range knownCapabilities {
+		switch {
+		case !c[name]:
+		case name == capabilityBinary:
+			if _, ok := w.(*binaryWriter); ok {
+				granted = append(granted, name)
+			}
+		case name == capabilityCompression:
+			if w.Header().Get("Content-Encoding") != "" {
+				granted = append(granted, name)
+			}
+		default:
+			granted = append(granted, name)
+		}
+	}
+	return granted
+}
+
+// streamBatcher collects the room events a batch-capable stream has queued
+// into one batch event, rather than writing and flushing each. Streams
+// without the capability write events straight through.
+type streamBatcher struct {
+	w       http.ResponseWriter
+	enabled bool
+	pending []Envelope
+}
+
+func (b *streamBatcher) write(env Envelope) {
+	if !b.enabled {
+		writeEnvelope(b.w, env)
+		return
+	}
+	b.pending = append(b.pending, env)
+}
+
+// collecting reports whether another queued event may join the batch.
+func (b *streamBatcher) collecting() bool {
+	return b.enabled && len(b.pending) < maxStreamBatch
+}
+
+// flush writes what was collected: one event on its own as it is, more as a
+// batch event carrying them in order, with the sequence of the last so
+// Last-Event-ID resumes after all of them.
+func (b *streamBatcher) flush() {
+	switch len(b.pending) {
+	case 0:
+		return
+	case 1:
+		writeEnvelope(b.w, b.pending[0])
+	default:
+		data, _ := json.Marshal(b.pending)
+		last := b.pending[len(b.pending)-1]
+		batch := Envelope{ID: batchEvent + ":" + last.ID, Event: batchEvent, Time: time.Now().UTC(), Data: data}
+		if seq, room := last.Seq, last.Room; seq > 0 && !slices.ContainsFunc(b.pending, func(env Envelope) bool { return env.Room != room }) {
+			batch.Room, batch.Seq = room, seq
+		}
+		writeEnvelope(b.w, batch)
+	}
+	b.pending = b.pending[:0]
+}
+
+// binaryWriter frames the envelopes of an NDJSON stream as MessagePack for
+// clients with the binary capability: each is its length, as a big-endian
+// uint32, and then the MessagePack of its JSON.
+type binaryWriter struct {
+	http.ResponseWriter
+}
+
+func (w *binaryWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func (w *binaryWriter) writeEnvelope(env Envelope) error {
+	data := ndjsonLine(env.frame)
+	if data == nil {
+		var err error
+		if data, err = json.Marshal(env); err != nil {
+			return err
+		}
+	}
+	packed, err := msgpackCodec{}.Encode(data)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(packed))), packed...))
+	return err
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	challengeTokenHeader = "X-Captcha-Token"
+	maxChallengePasses   = 100000
+)
+
+var (
+	errChallengeRequired    = errors.New("solve the room's captcha and send its token in X-Captcha-Token")
+	errChallengeUnavailable = errors.New("the room requires a captcha, but no captcha provider is configured")
+
+	sendChallenges = newCounterVec("chat_send_challenges_total", "Sends a room's challenge policy applied to, by result.", "result")
+)
+
+// ChallengePolicy names the senders a room wants a captcha from before it
+// takes their messages: those not signed in, guests, and those whose trust
+// score has dropped below MinTrust. A solved captcha lets the sender through
+// for a while rather than for one message.
+type ChallengePolicy struct {
+	Anonymous bool    `json:"anonymous,omitempty"`
+	Guests    bool    `json:"guests,omitempty"`
+	MinTrust  float64 `json:"min_trust,omitempty"`
+}
+
+func (p *ChallengePolicy) validate() error {
+	if p.MinTrust < 0 || p.MinTrust > 1 {
+		return fmt.Errorf("%w: min_trust must be between 0 and 1", errInvalidRequest)
+	}
+	return nil
+}
+
+func (p *ChallengePolicy) empty() bool {
+	return !p.Anonymous && !p.Guests && p.MinTrust == 0
+}
+
+// SetChallenge replaces the challenge policy of room; nil removes it.
+func (rr *roomRegistry) SetChallenge(name string, policy *ChallengePolicy) error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	return rr.record(RoomEvent{Type: roomChallengeSet, Room: name, Challenge: policy})
+}
+
+func (rr *roomRegistry) Challenge(name string) *ChallengePolicy {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+
+	if room, ok := rr.rooms[name]; ok {
+		return room.Challenge
+	}
+	return nil
+}
+
+// sendChallenge enforces the challenge policies of rooms on senders, with
+// the verifier of the configured captcha provider.
+type sendChallenge struct {
+	verifier captchaVerifier
+	provider string
+	siteKey  string
+	passTTL  time.Duration
+	spam     *spamDetector
+
+	mu     sync.Mutex
+	passed map[string]time.Time
+}
+
+func newSendChallenge(verifier captchaVerifier, provider, siteKey string, passTTL time.Duration, spam *spamDetector) *sendChallenge {
+	return &sendChallenge{verifier: verifier, provider: provider, siteKey: siteKey, passTTL: passTTL, spam: spam, passed: make(map[string]time.Time)}
+}
+
+// applies reports whether policy wants a captcha from the sender of r.
+// Senders who aren't signed in are told apart, and scored, by their address.
+func (c *sendChallenge) applies(r *http.Request, policy *ChallengePolicy) (string, bool) {
+	user := userFromRequest(r)
+	key := spamKey(r)
+	switch {
+	case policy == nil:
+		return key, false
+	case policy.Anonymous && user == "", policy.Guests && isGuest(user):
+		return key, true
+	case policy.MinTrust > 0 && c.spam.Score(key) < policy.MinTrust:
+		return key, true
+	}
+	return key, false
+}
+
+// Check lets the sender of r publish to room if the room's policy doesn't
+// want a captcha from them, they passed one recently, or the token the
+// request carries verifies.
+func (c *sendChallenge) Check(r *http.Request, rooms *roomRegistry, room string) error {
+	key, ok := c.applies(r, rooms.Challenge(room))
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	c.mu.Lock()
+	until, passed := c.passed[key]
+	c.mu.Unlock()
+	if passed && now.Before(until) {
+		sendChallenges.With("passed_before").Add(1)
+		return nil
+	}
+
+	if c.verifier == nil {
+		sendChallenges.With("unavailable").Add(1)
+		return errChallengeUnavailable
+	}
+	token := r.Header.Get(challengeTokenHeader)
+	if token == "" {
+		sendChallenges.With("required").Add(1)
+		return withDetails(errChallengeRequired, map[string]string{"provider": c.provider, "site_key": c.siteKey})
+	}
+	if err := c.verifier.Verify(r.Context(), token, clientAddress(r)); err != nil {
+		sendChallenges.With("failed").Add(1)
+		return err
+	}
+	sendChallenges.With("passed").Add(1)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.passed) >= maxChallengePasses {
+		for key, until := range c.passed {
+			if !now.Before(until) {
+				delete(c.passed, key)
+			}
+		}
+	}
+	if len(c.passed) < maxChallengePasses {
+		c.passed[key] = now.Add(c.passTTL)
+	}
+	return nil
+}
+
+// setChallengeHandler sets which senders to a room must solve a captcha;
+// an empty policy lifts it.
+func setChallengeHandler(rooms *roomRegistry, challenge *sendChallenge, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("room")
+		policy := &ChallengePolicy{}
+		if err := json.NewDecoder(r.Body).Decode(policy); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+		if err := policy.validate(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if policy.empty() {
+			policy = nil
+		} else if challenge.verifier == nil {
+			writeError(w, r, fmt.Errorf("%w: start the server with -captcha-provider or -captcha-verify-url first", errInvalidRequest))
+			return
+		}
+
+		if err := rooms.SetChallenge(name, policy); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		detail := "off"
+		if policy != nil {
+			detail = fmt.Sprintf("anonymous=%t guests=%t min_trust=%g", policy.Anonymous, policy.Guests, policy.MinTrust)
+		}
+		audit.Record(auditActor(r), "room.challenge", name, detail)
+
+		if policy == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(policy)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// channelAckEvent answers every message sent up a channel, on the
+	// stream's control lane.
+	channelAckEvent = "ack"
+
+	maxChannelLine = 1 << 20
+)
+
+var channelSends = newCounterVec("chat_channel_sends_total", "Messages sent up duplex channels by response status.", "status")
+
+type subscriberHookKey struct{}
+
+// announceSubscriber hands the subscriber of a stream to whoever opened it
+// as a channel.
+func announceSubscriber(r *http.Request, subscriber *Subscriber) {
+	if hook, ok := r.Context().Value(subscriberHookKey{}).(func(*Subscriber)); ok {
+		hook(subscriber)
+	}
+}
+
+type channelAck struct {
+	Line            int             `json:"line"`
+	ClientMessageID string          `json:"client_message_id,omitempty"`
+	Status          int             `json:"status"`
+	Result          json.RawMessage `json:"result,omitempty"`
+	Error           *ErrorResponse  `json:"error,omitempty"`
+}
+
+// capturedResponse keeps what a handler answered to a message sent up a
+// channel.
+type capturedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (c *capturedResponse) Header() http.Header { return c.header }
+
+func (c *capturedResponse) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+}
+
+func (c *capturedResponse) Write(p []byte) (int, error) {
+	c.WriteHeader(http.StatusOK)
+	return c.body.Write(p)
+}
+
+// channelHandler is an experiment in running a whole client over one
+// request: the response is the stream /chat/events would send for the same
+// query, and every line of the streamed request body is a message handled as
+// a POST /chat/send with the request's headers. Each gets an ack event with
+// its line number and the status, result or error /chat/send answered.
+//
+// It needs a client that can stream a request body while reading the
+// response. Browsers' fetch upload streaming is half duplex for now, so the
+// page stays on SSE and POST; clients that find the duplex feature off in
+// /chat/capabilities should do the same. Signed requests can't use it, since
+// their body is only verified once it ends.
+func channelHandler(broker *Broker, events, send http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// HTTP/2 and HTTP/3 are full duplex already.
+		if err := http.NewResponseController(w).EnableFullDuplex(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			writeError(w, r, fmt.Errorf("%w: %v", errStreamingUnsupported, err))
+			return
+		}
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		subscribed := make(chan *Subscriber, 1)
+		ctx = context.WithValue(ctx, subscriberHookKey{}, func(s *Subscriber) { subscribed <- s })
+
+		// A read answers Expect: 100-continue, which has to go out before
+		// the stream's headers or the body is closed for good.
+		body := r.Body
+		body.Read(nil)
+		stream := r.Clone(ctx)
+		stream.Body = http.NoBody
+
+		go func() {
+			select {
+			case subscriber := <-subscribed:
+				channelSendLoop(ctx, broker, subscriber, r, body, send)
+			case <-ctx.Done():
+			}
+		}()
+		events(w, stream)
+	}
+}
+
+// channelSendLoop handles the lines of body one after the other until it
+// ends or the stream does.
+func channelSendLoop(ctx context.Context, broker *Broker, subscriber *Subscriber, r *http.Request, body io.Reader, send http.HandlerFunc) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxChannelLine)
+	for line := 1; scanner.Scan(); line++ {
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		ack := channelSend(ctx, r, send, raw)
+		ack.Line = line
+		if !notifyAck(ctx, broker, subscriber, ack) {
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		_, errBody := errorResponse(r, fmt.Errorf("%w: %v", errInvalidRequest, err))
+		notifyAck(ctx, broker, subscriber, channelAck{Status: http.StatusBadRequest, Error: &errBody})
+		log.Printf("Channel of subscriber %s: %v", subscriber.ID, err)
+	}
+}
+
+func channelSend(ctx context.Context, r *http.Request, send http.HandlerFunc, raw []byte) channelAck {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/chat/send", bytes.NewReader(raw))
+	if err != nil {
+		_, body := errorResponse(r, err)
+		return channelAck{Status: http.StatusInternalServerError, Error: &body}
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Set("Content-Type", "application/json")
+	req.URL.RawQuery = r.URL.RawQuery
+	req.RemoteAddr, req.Host, req.TLS = r.RemoteAddr, r.Host, r.TLS
+
+	resp := &capturedResponse{header: make(http.Header)}
+	send(resp, req)
+	channelSends.With(strconv.Itoa(resp.status)).Add(1)
+
+	ack := channelAck{Status: resp.status}
+	var chat struct {
+		ClientMessageID string `json:"client_message_id"`
+	}
+	if json.Unmarshal(raw, &chat) == nil {
+		ack.ClientMessageID = chat.ClientMessageID
+	}
+	if resp.status >= http.StatusBadRequest {
+		ack.Error = &ErrorResponse{}
+		if json.Unmarshal(resp.body.Bytes(), ack.Error) != nil {
+			ack.Error.Message = resp.body.String()
+		}
+	} else if json.Valid(resp.body.Bytes()) {
+		ack.Result = bytes.TrimSpace(resp.body.Bytes())
+	}
+	return ack
+}
+
+// notifyAck waits for room on the control lane rather than drop an ack, so a
+// client that doesn't read its stream stops being read from too.
+func notifyAck(ctx context.Context, broker *Broker, subscriber *Subscriber, ack channelAck) bool {
+	data, _ := json.Marshal(ack)
+	env := Envelope{ID: subscriber.ID + ":ack:" + strconv.Itoa(ack.Line), Event: channelAckEvent, Time: time.Now().UTC(), Data: data}
+	for !broker.Notify(subscriber.ID, env) {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// chaosConfig describes the failures injected into the SSE path when the
+// server runs with -chaos. It's meant for client authors exercising their
+// reconnection and dedup logic, never for production.
+type chaosConfig struct {
+	Latency        time.Duration
+	Jitter         time.Duration
+	DropRate       float64
+	DisconnectRate float64
+}
+
+func (c chaosConfig) delay() time.Duration {
+	d := c.Latency
+	if c.Jitter > 0 {
+		d += rand.N(c.Jitter)
+	}
+	return d
+}
+
+var errChaosDisconnect = errors.New("chaos: injected disconnect")
+
+// chaosWriter applies the configured failures per Write. The SSE handler
+// writes one whole frame per call, so a dropped Write is a dropped event.
+type chaosWriter struct {
+	http.ResponseWriter
+	cfg        chaosConfig
+	disconnect context.CancelFunc
+}
+
+func (w *chaosWriter) Write(p []byte) (int, error) {
+	if d := w.cfg.delay(); d > 0 {
+		time.Sleep(d)
+	}
+	if rand.Float64() < w.cfg.DisconnectRate {
+		log.Println("Chaos: disconnecting client")
+		w.disconnect()
+		return 0, errChaosDisconnect
+	}
+	if rand.Float64() < w.cfg.DropRate {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *chaosWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *chaosWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func chaosMiddleware(cfg chaosConfig, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		next(&chaosWriter{ResponseWriter: w, cfg: cfg, disconnect: cancel}, r.WithContext(ctx))
+	}
+}
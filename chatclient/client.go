@@ -0,0 +1,526 @@
+// Package chatclient is a Go client for the chat server's HTTP API.
+package chatclient
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+
+	// APIVersion is the version of the server API this client speaks; it
+	// asks for it on every request so newer servers keep answering in kind.
+	APIVersion = "1"
+)
+
+// Client talks to one chat server as one user.
+type Client struct {
+	BaseURL    string
+	UserID     string
+	HTTPClient *http.Client
+
+	// Token is a user token the server issued for UserID. Without it, or an
+	// API key, the client is anonymous and UserID only names its messages.
+	Token string
+
+	// APIKey and APISecret, when set, sign every request with the key
+	// instead.
+	APIKey    string
+	APISecret string
+
+	mu         sync.Mutex
+	clientID   string
+	dictionary []byte
+	dictID     string
+}
+
+func New(baseURL, userID string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), UserID: userID, HTTPClient: http.DefaultClient}
+}
+
+// APIError is an error response of the server.
+type APIError struct {
+	Status    int    `json:"-"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s (%s, status %d)", e.Message, e.Code, e.Status)
+}
+
+// Envelope is one event of a room stream.
+type Envelope struct {
+	ID    string          `json:"id"`
+	Room  string          `json:"room"`
+	Group string          `json:"group"`
+	Seq   uint64          `json:"seq"`
+	Event string          `json:"event"`
+	Time  time.Time       `json:"time"`
+	Data  json.RawMessage `json:"data"`
+	// SentAt is the sender's clock when it sent a chat message, if it said,
+	// and SkewMillis how far Time is past it.
+	SentAt     *time.Time `json:"sent_at"`
+	SkewMillis int64      `json:"skew_ms"`
+}
+
+// Message is a chat message, the data of envelopes without an event name.
+type Message struct {
+	Room        string `json:"room"`
+	UserID      string `json:"user_id"`
+	Message     string `json:"message"`
+	ContentType string `json:"content_type,omitempty"`
+	Language    string `json:"language,omitempty"`
+	// Ciphertext and KeyID replace Message in encrypted rooms. The client
+	// seals and opens them with keys its users exchange themselves.
+	Ciphertext []byte `json:"ciphertext,omitempty"`
+	KeyID      string `json:"key_id,omitempty"`
+	// Metadata is a small string map for the app's own routing, which
+	// subscribers can filter on.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Message decodes the chat message carried by env, if it is one.
+func (env Envelope) Message() (Message, bool) {
+	msg := Message{}
+	if env.Event != "" || json.Unmarshal(env.Data, &msg) != nil {
+		return Message{}, false
+	}
+	return msg, true
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	var raw []byte
+	if c.APIKey != "" && body != nil {
+		var err error
+		if raw, err = io.ReadAll(body); err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(raw)
+	}
+	c.mu.Lock()
+	base := c.BaseURL
+	c.mu.Unlock()
+	req, err := http.NewRequestWithContext(ctx, method, base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.APIKey != "" {
+		if err := c.sign(req, raw); err != nil {
+			return nil, err
+		}
+	} else if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if clientID := c.ClientID(); clientID != "" {
+		req.Header.Set("X-Client-ID", clientID)
+	}
+	req.Header.Set("X-API-Version", APIVersion)
+	return req, nil
+}
+
+// sign adds the API key signature headers to req, whose body is body.
+func (c *Client) sign(req *http.Request, body []byte) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	digest := sha256.Sum256(body)
+	signingKey := sha256.Sum256([]byte(c.APISecret))
+	mac := hmac.New(sha256.New, signingKey[:])
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s", req.Method, req.URL.RequestURI(), timestamp, hex.EncodeToString(nonce), hex.EncodeToString(digest[:]))
+
+	req.Header.Set("X-API-Key", c.APIKey)
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Nonce", hex.EncodeToString(nonce))
+	req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	apiErr := &APIError{Status: resp.StatusCode}
+	if json.NewDecoder(resp.Body).Decode(apiErr) != nil || apiErr.Message == "" {
+		apiErr.Message = resp.Status
+	}
+	return apiErr
+}
+
+// Sent is the envelope a message went out as, to match against the copy
+// that comes back on the stream. Duplicate marks the answer to a retry.
+type Sent struct {
+	MessageID       string    `json:"message_id"`
+	Room            string    `json:"room"`
+	Seq             uint64    `json:"seq"`
+	Time            time.Time `json:"time"`
+	ClientMessageID string    `json:"client_message_id"`
+	Duplicate       bool      `json:"duplicate"`
+}
+
+// Send posts message into room.
+func (c *Client) Send(ctx context.Context, room, message string) error {
+	_, err := c.Post(ctx, Message{Room: room, UserID: c.UserID, Message: message})
+	return err
+}
+
+// SendSealed posts ciphertext sealed with the key keyID into an encrypted
+// room.
+func (c *Client) SendSealed(ctx context.Context, room, keyID string, ciphertext []byte) error {
+	_, err := c.Post(ctx, Message{Room: room, UserID: c.UserID, Ciphertext: ciphertext, KeyID: keyID})
+	return err
+}
+
+// Post sends msg and returns the envelope it went out as.
+func (c *Client) Post(ctx context.Context, msg Message) (Sent, error) {
+	body, err := json.Marshal(struct {
+		Message
+		SentAt time.Time `json:"sent_at"`
+	}{msg, time.Now()})
+	if err != nil {
+		return Sent{}, err
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, "/chat/send?room="+url.QueryEscape(msg.Room), bytes.NewReader(body))
+	if err != nil {
+		return Sent{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Version", "2")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return Sent{}, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return Sent{}, err
+	}
+	sent := Sent{}
+	return sent, json.NewDecoder(resp.Body).Decode(&sent)
+}
+
+// PublishEvent publishes an application event named event into room, with
+// data encoded as JSON.
+func (c *Client) PublishEvent(ctx context.Context, room, event string, data any) (Envelope, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Envelope{}, err
+	}
+	body, err := json.Marshal(map[string]any{"room": room, "event": event, "data": json.RawMessage(raw)})
+	if err != nil {
+		return Envelope{}, err
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, "/events/publish", bytes.NewReader(body))
+	if err != nil {
+		return Envelope{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return Envelope{}, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return Envelope{}, err
+	}
+	env := Envelope{}
+	return env, json.NewDecoder(resp.Body).Decode(&env)
+}
+
+// Heartbeat reports the user as active in room.
+func (c *Client) Heartbeat(ctx context.Context, room string) error {
+	req, err := c.newRequest(ctx, http.MethodPost, "/chat/heartbeat?room="+url.QueryEscape(room), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// Presence is a user's presence in a room.
+type Presence struct {
+	UserID       string    `json:"user_id"`
+	Status       string    `json:"status"`
+	LastSeen     time.Time `json:"last_seen"`
+	Availability string    `json:"availability"`
+	StatusText   string    `json:"status_text,omitempty"`
+}
+
+// Presence lists who is present in room.
+func (c *Client) Presence(ctx context.Context, room string) ([]Presence, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/chat/rooms/"+url.PathEscape(room)+"/presence", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+
+	var present []Presence
+	return present, json.NewDecoder(resp.Body).Decode(&present)
+}
+
+// SubscribeOptions tunes Subscribe.
+type SubscribeOptions struct {
+	// History replays the room's recent history before live events.
+	History bool
+	// OnError is told about every failed connection attempt before Subscribe
+	// retries. Returning false stops Subscribe with that error.
+	OnError func(error) bool
+	// Compress asks for the stream compressed with the server's stream
+	// dictionary, or with gzip if the dictionary can't be fetched. The
+	// server only compresses when started with -compress-streams.
+	Compress bool
+	// Metadata limits the chat messages of the stream to those whose
+	// metadata has these values. Other events still come through.
+	Metadata map[string]string
+}
+
+// handoffNotice is the data of the "handoff" event of a server handing its
+// streams off to another before it goes away.
+type handoffNotice struct {
+	Target           string `json:"target"`
+	ResumeToken      string `json:"resume_token"`
+	ReconnectAfterMS int64  `json:"reconnect_after_ms"`
+}
+
+// Subscribe streams room to handle until ctx is done, reconnecting with
+// exponential backoff and resuming after the last event received. Errors the
+// server reports for the request itself, like a 403, aren't retried. A
+// server handing off to another points the client, BaseURL and all, at the
+// other, where the stream resumes with the token it was given.
+func (c *Client) Subscribe(ctx context.Context, room string, opts SubscribeOptions, handle func(Envelope)) error {
+	lastEventID := ""
+	if opts.History {
+		lastEventID = "0"
+	}
+
+	backoff := minBackoff
+	resumeToken := ""
+	for {
+		handoff := handoffNotice{}
+		received, err := c.stream(ctx, room, opts, &lastEventID, resumeToken, &handoff, handle)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if received {
+			resumeToken = ""
+		}
+		if handoff.Target != "" {
+			c.mu.Lock()
+			c.BaseURL = strings.TrimSuffix(handoff.Target, "/")
+			c.mu.Unlock()
+			resumeToken, backoff = handoff.ResumeToken, minBackoff
+			select {
+			case <-time.After(time.Duration(handoff.ReconnectAfterMS) * time.Millisecond):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+		if apiErr, ok := err.(*APIError); ok && apiErr.Code == "handoff_token_invalid" {
+			// Last-Event-ID resumes the room as well, if not as surely.
+			resumeToken = ""
+			continue
+		}
+		if apiErr, ok := err.(*APIError); ok && apiErr.Status < 500 {
+			return err
+		}
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		if opts.OnError != nil && !opts.OnError(err) {
+			return err
+		}
+
+		if received {
+			backoff = minBackoff
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// stream runs one SSE connection and reports whether it delivered anything.
+// It ends at a handoff event, which it decodes into handoff.
+func (c *Client) stream(ctx context.Context, room string, opts SubscribeOptions, lastEventID *string, resumeToken string, handoff *handoffNotice, handle func(Envelope)) (bool, error) {
+	query := url.Values{"room": {room}}
+	if resumeToken != "" {
+		query.Set("resume_token", resumeToken)
+	}
+	for key, value := range opts.Metadata {
+		query.Set("meta."+key, value)
+	}
+	req, err := c.newRequest(ctx, http.MethodGet, "/chat/events?"+query.Encode(), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if *lastEventID != "" {
+		req.Header.Set("Last-Event-ID", *lastEventID)
+	}
+	var dict []byte
+	if opts.Compress {
+		req.Header.Set("Accept-Encoding", "gzip")
+		var dictID string
+		if dict, dictID, err = c.streamDictionary(ctx); err == nil {
+			req.Header.Set("Accept-Encoding", "deflate-dict, gzip")
+			req.Header.Set("X-Stream-Dictionary", dictID)
+		}
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return false, err
+	}
+
+	var body io.Reader = resp.Body
+	switch resp.Header.Get("Content-Encoding") {
+	case "deflate-dict":
+		zr := flate.NewReaderDict(resp.Body, dict)
+		defer zr.Close()
+		body = zr
+	case "gzip":
+		if !opts.Compress {
+			break
+		}
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return false, err
+		}
+		defer zr.Close()
+		body = zr
+	}
+
+	received := false
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	var id, data string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = line[len("id: "):]
+		case strings.HasPrefix(line, "data: "):
+			data = line[len("data: "):]
+		case line == "":
+			if data == "" {
+				continue
+			}
+			env := Envelope{}
+			if err := json.Unmarshal([]byte(data), &env); err == nil {
+				c.observe(env)
+				handle(env)
+				received = true
+			}
+			if id != "" {
+				*lastEventID = id
+			}
+			id, data = "", ""
+			if env.Event == "handoff" && json.Unmarshal(env.Data, handoff) == nil && handoff.Target != "" {
+				return received, nil
+			}
+		}
+	}
+	return received, scanner.Err()
+}
+
+// streamDictionary fetches the server's stream dictionary once and caches
+// it with its ID.
+func (c *Client) streamDictionary(ctx context.Context) ([]byte, string, error) {
+	c.mu.Lock()
+	dict, ID := c.dictionary, c.dictID
+	c.mu.Unlock()
+	if dict != nil {
+		return dict, ID, nil
+	}
+
+	req, err := c.newRequest(ctx, http.MethodGet, "/chat/stream-dictionary", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, "", err
+	}
+	if dict, err = io.ReadAll(resp.Body); err != nil {
+		return nil, "", err
+	}
+	ID = resp.Header.Get("X-Stream-Dictionary")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dictionary, c.dictID = dict, ID
+	return dict, ID, nil
+}
+
+// ClientID returns the stable client ID the server assigned on the first
+// stream, sent back on every later request so reconnects are correlated.
+func (c *Client) ClientID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clientID
+}
+
+// SetClientID reuses a client ID from an earlier session.
+func (c *Client) SetClientID(ID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clientID = ID
+}
+
+// observe picks the client ID out of the stream's subscribed event.
+func (c *Client) observe(env Envelope) {
+	if env.Event != "subscribed" {
+		return
+	}
+	subscribed := struct {
+		ClientID string `json:"client_id"`
+	}{}
+	if json.Unmarshal(env.Data, &subscribed) == nil && subscribed.ClientID != "" {
+		c.SetClientID(subscribed.ClientID)
+	}
+}
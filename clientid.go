@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	clientIDCookie = "chat_client_id"
+	clientIDMaxAge = 365 * 24 * time.Hour
+
+	// reconnectWindow is how soon after its last stream closed a client's
+	// new stream counts as a reconnect rather than a new visit.
+	reconnectWindow = 5 * time.Minute
+)
+
+var (
+	clientIDPattern  = regexp.MustCompile(`^[a-f0-9]{32}$`)
+	clientReconnects = newCounter("chat_client_reconnects_total", "Streams opened by a client shortly after its previous one closed.")
+)
+
+// requestClientID returns the client ID the caller passed, or "" without
+// one.
+func requestClientID(r *http.Request) string {
+	for _, ID := range []string{r.Header.Get("X-Client-ID"), r.URL.Query().Get("client_id")} {
+		if clientIDPattern.MatchString(ID) {
+			return ID
+		}
+	}
+	return cookieClientID(r)
+}
+
+// cookieClientID returns the client ID in the caller's cookie, or "". Any
+// client can send an ID it learned in X-Client-ID or client_id, but only the
+// one holding the HttpOnly cookie has this, so stream bindings compare it.
+func cookieClientID(r *http.Request) string {
+	if cookie, err := r.Cookie(clientIDCookie); err == nil && clientIDPattern.MatchString(cookie.Value) {
+		return cookie.Value
+	}
+	return ""
+}
+
+// clientIDFromRequest returns the caller's stable client ID, which outlives
+// the per-connection subscriber ID, and the one its cookie holds. Clients
+// that can't keep cookies pass it back in the X-Client-ID header or
+// client_id query parameter. A caller without a valid ID is given a new one
+// in a cookie.
+func clientIDFromRequest(w http.ResponseWriter, r *http.Request) (string, string) {
+	if ID := requestClientID(r); ID != "" {
+		return ID, cookieClientID(r)
+	}
+
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	ID := hex.EncodeToString(raw)
+	http.SetCookie(w, &http.Cookie{
+		Name:     clientIDCookie,
+		Value:    ID,
+		Path:     "/",
+		MaxAge:   int(clientIDMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: cookieSameSite(r),
+	})
+	return ID, ID
+}
+
+// clientTracker counts the streams of each client so metrics report unique
+// clients instead of connections, and notices reconnects.
+type clientTracker struct {
+	mu     sync.Mutex
+	conns  map[string]int
+	closed map[string]time.Time
+}
+
+func newClientTracker() *clientTracker {
+	t := &clientTracker{conns: make(map[string]int), closed: make(map[string]time.Time)}
+	newGaugeFunc("chat_unique_clients", "Distinct clients with at least one open stream.", t.count)
+	go t.sweep()
+	return t
+}
+
+// Open records a new stream of client and reports whether it is a reconnect.
+func (t *clientTracker) Open(client string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	closedAt, seen := t.closed[client]
+	delete(t.closed, client)
+	reconnect := t.conns[client] > 0 || (seen && time.Since(closedAt) < reconnectWindow)
+	t.conns[client]++
+	if reconnect {
+		clientReconnects.Inc()
+	}
+	return reconnect
+}
+
+func (t *clientTracker) Close(client string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conns[client]--; t.conns[client] <= 0 {
+		delete(t.conns, client)
+		t.closed[client] = time.Now()
+	}
+}
+
+func (t *clientTracker) count() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return float64(len(t.conns))
+}
+
+func (t *clientTracker) sweep() {
+	for range time.Tick(reconnectWindow) {
+		t.mu.Lock()
+		for client, closedAt := range t.closed {
+			if time.Since(closedAt) >= reconnectWindow {
+				delete(t.closed, client)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
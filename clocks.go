@@ -0,0 +1,72 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// maxClientClockSkew bounds how far a sender's sent_at may be from the
+// server clock. Further off, the client clock is wrong rather than skewed.
+const maxClientClockSkew = 24 * time.Hour
+
+// stamp sets the server time of env and, when the sender gave its own, the
+// skew between the two.
+func (env *Envelope) stamp(t time.Time) {
+	env.Time = t
+	if env.SentAt != nil {
+		env.Skew = t.Sub(*env.SentAt).Milliseconds()
+	}
+}
+
+// compareServerTime orders envelopes by server time, then sequence. Client
+// clocks never take part.
+func compareServerTime(a, b Envelope) int {
+	if c := a.Time.Compare(b.Time); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.Seq, b.Seq)
+}
+
+// checkSentAt validates the client clock of chat, if it has one.
+func checkSentAt(chat *Chat) error {
+	if chat.SentAt == nil {
+		return nil
+	}
+	if skew := time.Since(*chat.SentAt); skew > maxClientClockSkew || skew < -maxClientClockSkew {
+		return fmt.Errorf("%w: sent_at is more than %s off the server clock", errInvalidRequest, maxClientClockSkew)
+	}
+	utc := chat.SentAt.UTC()
+	chat.SentAt = &utc
+	return nil
+}
+
+// publishChat publishes chat with its sent_at moved out of the data and into
+// the envelope.
+func publishChat(broker *Broker, chat Chat) (Envelope, error) {
+	sentAt := chat.SentAt
+	chat.SentAt = nil
+	chatRaw, err := json.Marshal(chat)
+	if err != nil {
+		return Envelope{}, err
+	}
+	return broker.PublishSent(chat.Room, chatRaw, sentAt)
+}
+
+// unixNanos and fromUnixNanos carry optional times in and out of the store.
+func unixNanos(t *time.Time) *int64 {
+	if t == nil {
+		return nil
+	}
+	n := t.UnixNano()
+	return &n
+}
+
+func fromUnixNanos(n *int64) *time.Time {
+	if n == nil {
+		return nil
+	}
+	t := time.Unix(0, *n).UTC()
+	return &t
+}
@@ -0,0 +1,203 @@
+// Command chat-tui is a terminal chat client.
+//
+// Type a line to send it to the current room. Commands:
+//
+//	/join <room>   switch to room, replaying its recent history
+//	/rooms         list the rooms joined this session
+//	/who           list who is present in the current room
+//	/quit          exit
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/afikrim/go-event-stream-chat/chatclient"
+)
+
+const (
+	ansiDim   = "\033[2m"
+	ansiBold  = "\033[1m"
+	ansiReset = "\033[0m"
+)
+
+type session struct {
+	client *chatclient.Client
+
+	mu     sync.Mutex
+	room   string
+	joined []string
+	cancel context.CancelFunc
+}
+
+func main() {
+	server := flag.String("server", "http://localhost:8080", "chat server base URL")
+	room := flag.String("room", "general", "room to start in")
+	name := flag.String("user", defaultUser(), "user ID to chat as")
+	token := flag.String("token", os.Getenv("CHAT_TOKEN"), "user token for -user, as issued by the server (default $CHAT_TOKEN)")
+	flag.Parse()
+
+	s := &session{client: chatclient.New(*server, *name)}
+	s.client.Token = *token
+	s.join(*room)
+
+	input := bufio.NewScanner(os.Stdin)
+	for input.Scan() {
+		line := strings.TrimSpace(input.Text())
+		if line == "" {
+			continue
+		}
+		if !s.command(line) {
+			break
+		}
+	}
+	s.leave()
+}
+
+func defaultUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "guest"
+}
+
+// command handles one input line and reports whether to keep going.
+func (s *session) command(line string) bool {
+	go s.client.Heartbeat(context.Background(), s.current())
+
+	if !strings.HasPrefix(line, "/") {
+		if err := s.client.Send(context.Background(), s.current(), line); err != nil {
+			s.status("send failed: %v", err)
+		}
+		return true
+	}
+
+	verb, arg, _ := strings.Cut(line, " ")
+	switch verb {
+	case "/join":
+		if arg = strings.TrimSpace(arg); arg == "" {
+			s.status("usage: /join <room>")
+			break
+		}
+		s.join(arg)
+	case "/rooms":
+		s.mu.Lock()
+		s.status("rooms: %s (current: %s)", strings.Join(s.joined, ", "), s.room)
+		s.mu.Unlock()
+	case "/who":
+		s.who()
+	case "/quit":
+		return false
+	default:
+		s.status("unknown command %s", verb)
+	}
+	return true
+}
+
+func (s *session) current() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.room
+}
+
+func (s *session) leave() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// join switches the live stream to room. The server replays the room's
+// recent history first, so switching back and forth keeps context.
+func (s *session) join(room string) {
+	s.leave()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mu.Lock()
+	s.room = room
+	s.cancel = cancel
+	if !slices.Contains(s.joined, room) {
+		s.joined = append(s.joined, room)
+	}
+	s.mu.Unlock()
+
+	fmt.Printf("\n%s── %s ──%s\n", ansiBold, room, ansiReset)
+	go func() {
+		err := s.client.Subscribe(ctx, room, chatclient.SubscribeOptions{
+			History: true,
+			OnError: func(err error) bool {
+				s.status("connection lost (%v), reconnecting", err)
+				return true
+			},
+		}, s.print)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			s.status("left %s: %v", room, err)
+		}
+	}()
+}
+
+func (s *session) print(env chatclient.Envelope) {
+	if env.Room != "" && env.Room != s.current() {
+		return
+	}
+	stamp := env.Time.Local().Format("15:04")
+
+	if msg, ok := env.Message(); ok {
+		fmt.Printf("%s%s%s %s%s%s: %s\n", ansiDim, stamp, ansiReset, ansiBold, msg.UserID, ansiReset, msg.Message)
+		return
+	}
+
+	switch env.Event {
+	case "presence":
+		p := struct {
+			UserID string `json:"user_id"`
+			Status string `json:"status"`
+		}{}
+		if json.Unmarshal(env.Data, &p) == nil {
+			s.status("%s is %s", p.UserID, p.Status)
+		}
+	case "announcement":
+		a := struct {
+			Message string `json:"message"`
+		}{}
+		if json.Unmarshal(env.Data, &a) == nil {
+			fmt.Printf("%s%s ** %s **%s\n", ansiBold, stamp, a.Message, ansiReset)
+		}
+	case "preview":
+		p := struct {
+			URL   string `json:"url"`
+			Title string `json:"title"`
+		}{}
+		if json.Unmarshal(env.Data, &p) == nil && p.Title != "" {
+			s.status("%s — %s", p.Title, p.URL)
+		}
+	}
+}
+
+func (s *session) who() {
+	room := s.current()
+	present, err := s.client.Presence(context.Background(), room)
+	if err != nil {
+		s.status("who: %v", err)
+		return
+	}
+	names := make([]string, 0, len(present))
+	for _, p := range present {
+		names = append(names, p.UserID+" ("+p.Status+")")
+	}
+	s.status("in %s: %s", room, strings.Join(names, ", "))
+}
+
+func (s *session) status(format string, args ...any) {
+	fmt.Printf("%s-- %s%s\n", ansiDim, fmt.Sprintf(format, args...), ansiReset)
+}
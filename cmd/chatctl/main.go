@@ -0,0 +1,292 @@
+// Command chatctl administers a chat server through its admin API.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `usage: chatctl [-server URL] [-token TOKEN] <command> [args]
+
+commands:
+  rooms                      list rooms
+  subscribers [room]         list connected subscribers
+  announce <room> <message>  post an announcement into a room
+  kick <user>                disconnect every stream of a user
+  ban <user> [reason]        ban a user and disconnect them
+  unban <user>               lift a ban
+  bans                       list banned users
+  export <room>              write a room's history to stdout as NDJSON
+  tail <room>                follow a room's stream
+
+The token defaults to $CHATCTL_TOKEN.
+`
+
+type client struct {
+	server string
+	token  string
+	http   *http.Client
+}
+
+func main() {
+	server := flag.String("server", "http://localhost:8080", "chat server base URL")
+	token := flag.String("token", os.Getenv("CHATCTL_TOKEN"), "admin token")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := &client{server: strings.TrimSuffix(*server, "/"), token: *token, http: &http.Client{Timeout: 30 * time.Second}}
+	if err := c.run(args[0], args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "chatctl:", err)
+		os.Exit(1)
+	}
+}
+
+func (c *client) run(command string, args []string) error {
+	need := func(n int) {
+		if len(args) < n {
+			flag.Usage()
+			os.Exit(2)
+		}
+	}
+
+	switch command {
+	case "rooms":
+		return c.rooms()
+	case "subscribers":
+		room := ""
+		if len(args) > 0 {
+			room = args[0]
+		}
+		return c.subscribers(room)
+	case "announce":
+		need(2)
+		return c.do(http.MethodPost, "/admin/rooms/"+url.PathEscape(args[0])+"/announce",
+			map[string]string{"message": strings.Join(args[1:], " ")}, nil)
+	case "kick":
+		need(1)
+		result := map[string]int{}
+		if err := c.do(http.MethodPost, "/admin/users/"+url.PathEscape(args[0])+"/kick", nil, &result); err != nil {
+			return err
+		}
+		fmt.Printf("kicked %d stream(s)\n", result["kicked"])
+		return nil
+	case "ban":
+		need(1)
+		return c.do(http.MethodPut, "/admin/bans/"+url.PathEscape(args[0]),
+			map[string]string{"reason": strings.Join(args[1:], " ")}, nil)
+	case "unban":
+		need(1)
+		return c.do(http.MethodDelete, "/admin/bans/"+url.PathEscape(args[0]), nil, nil)
+	case "bans":
+		return c.bans()
+	case "export":
+		need(1)
+		return c.export(args[0])
+	case "tail":
+		need(1)
+		return c.tail(args[0])
+	}
+	flag.Usage()
+	os.Exit(2)
+	return nil
+}
+
+func (c *client) request(method, path string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(raw)
+	}
+
+	req, err := http.NewRequest(method, c.server+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.http.Do(req)
+}
+
+// do sends a request and decodes the JSON response into out, if not nil.
+func (c *client) do(method, path string, body, out any) error {
+	resp, err := c.request(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	problem := struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}{}
+	if json.NewDecoder(resp.Body).Decode(&problem) != nil || problem.Message == "" {
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+	return fmt.Errorf("%s (%s)", problem.Message, problem.Code)
+}
+
+func (c *client) rooms() error {
+	var rooms []struct {
+		Name      string    `json:"name"`
+		Owner     string    `json:"owner"`
+		Private   bool      `json:"private"`
+		Mode      string    `json:"mode"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	if err := c.do(http.MethodGet, "/admin/rooms", nil, &rooms); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tOWNER\tPRIVATE\tMODE\tCREATED")
+	for _, room := range rooms {
+		fmt.Fprintf(tw, "%s\t%s\t%t\t%s\t%s\n", room.Name, room.Owner, room.Private, room.Mode, room.CreatedAt.Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+func (c *client) subscribers(room string) error {
+	var subscribers []struct {
+		ID       string   `json:"id"`
+		User     string   `json:"user_id"`
+		ClientID string   `json:"client_id"`
+		Rooms    []string `json:"rooms"`
+		Dropped  uint64   `json:"dropped"`
+	}
+	path := "/admin/subscribers"
+	if room != "" {
+		path += "?room=" + url.QueryEscape(room)
+	}
+	if err := c.do(http.MethodGet, path, nil, &subscribers); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUSER\tCLIENT\tROOMS\tDROPPED")
+	for _, s := range subscribers {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\n", s.ID, s.User, s.ClientID, strings.Join(s.Rooms, ","), s.Dropped)
+	}
+	return tw.Flush()
+}
+
+func (c *client) bans() error {
+	var bans []struct {
+		UserID string    `json:"user_id"`
+		Reason string    `json:"reason"`
+		Since  time.Time `json:"since"`
+	}
+	if err := c.do(http.MethodGet, "/admin/bans", nil, &bans); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tSINCE\tREASON")
+	for _, ban := range bans {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", ban.UserID, ban.Since.Format(time.RFC3339), ban.Reason)
+	}
+	return tw.Flush()
+}
+
+func (c *client) export(room string) error {
+	resp, err := c.request(http.MethodGet, "/admin/rooms/"+url.PathEscape(room)+"/history", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
+
+type envelope struct {
+	Room  string          `json:"room"`
+	Event string          `json:"event"`
+	Time  time.Time       `json:"time"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// tail follows the room's SSE stream until interrupted.
+func (c *client) tail(room string) error {
+	c.http.Timeout = 0
+	resp, err := c.request(http.MethodGet, "/chat/events?room="+url.QueryEscape(room), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		env := envelope{}
+		if err := json.Unmarshal([]byte(data), &env); err != nil {
+			continue
+		}
+		printEnvelope(env)
+	}
+	return scanner.Err()
+}
+
+func printEnvelope(env envelope) {
+	stamp := env.Time.Local().Format("15:04:05")
+	switch env.Event {
+	case "":
+		chat := struct {
+			UserID  string `json:"user_id"`
+			Message string `json:"message"`
+		}{}
+		if json.Unmarshal(env.Data, &chat) == nil {
+			fmt.Printf("%s %s <%s> %s\n", stamp, env.Room, chat.UserID, chat.Message)
+			return
+		}
+	case "subscribed":
+		return
+	}
+	fmt.Printf("%s %s [%s] %s\n", stamp, env.Room, env.Event, env.Data)
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Stored message data starts with codecMagic, the ID of the codec that wrote
+// it and that codec's format version. JSON never starts with a zero byte, so
+// rows without a header are the plain JSON the store always wrote, and
+// switching codecs needs no rewrite: old rows keep decoding as they are.
+const (
+	codecMagic      = 0x00
+	codecHeaderSize = 3
+
+	codecJSON    = "json"
+	codecMsgpack = "msgpack"
+)
+
+var errUnknownCodec = errors.New("unknown store codec")
+
+// storeCodec turns the JSON data of a message into what the store keeps and
+// back. Decode is given the format version from the row's header.
+type storeCodec interface {
+	Name() string
+	ID() byte
+	Version() byte
+	Encode(data []byte) ([]byte, error)
+	Decode(version byte, stored []byte) ([]byte, error)
+}
+
+var storeCodecs = []storeCodec{jsonCodec{}, msgpackCodec{}}
+
+func storeCodecByName(name string) (storeCodec, error) {
+	for _, c := range storeCodecs {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("%w %q", errUnknownCodec, name)
+}
+
+// encodeStored encodes data with c and prepends the header. JSON is stored
+// as it is, so SQLite's JSON functions keep working on it.
+func encodeStored(c storeCodec, data []byte) ([]byte, error) {
+	if _, ok := c.(jsonCodec); ok {
+		return data, nil
+	}
+	payload, err := c.Encode(data)
+	if err != nil {
+		return nil, fmt.Errorf("store: %s: %w", c.Name(), err)
+	}
+	return append([]byte{codecMagic, c.ID(), c.Version()}, payload...), nil
+}
+
+// decodeStored returns the JSON data of a stored row, whichever codec wrote
+// it.
+func decodeStored(stored []byte) ([]byte, error) {
+	if len(stored) == 0 || stored[0] != codecMagic {
+		return stored, nil
+	}
+	if len(stored) < codecHeaderSize {
+		return nil, fmt.Errorf("store: truncated codec header")
+	}
+	if isCompressed(stored) {
+		return decompressStored(stored[2], stored[codecHeaderSize:])
+	}
+	for _, c := range storeCodecs {
+		if c.ID() == stored[1] {
+			if stored[2] > c.Version() {
+				return nil, fmt.Errorf("store: %s version %d is newer than this server's %d", c.Name(), stored[2], c.Version())
+			}
+			return c.Decode(stored[2], stored[codecHeaderSize:])
+		}
+	}
+	return nil, fmt.Errorf("%w with ID %d", errUnknownCodec, stored[1])
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                       { return codecJSON }
+func (jsonCodec) ID() byte                           { return 0 }
+func (jsonCodec) Version() byte                      { return 0 }
+func (jsonCodec) Encode(data []byte) ([]byte, error) { return data, nil }
+func (jsonCodec) Decode(_ byte, stored []byte) ([]byte, error) {
+	return stored, nil
+}
+
+// msgpackCodec transcodes JSON to MessagePack, keeping object keys in order.
+// Numbers that are neither 64-bit integers nor exact as a float64 are kept as
+// their JSON literal in an extension, so decoding gives back the same values.
+type msgpackCodec struct{}
+
+const msgpackNumberExt = 1
+
+func (msgpackCodec) Name() string  { return codecMsgpack }
+func (msgpackCodec) ID() byte      { return 1 }
+func (msgpackCodec) Version() byte { return 1 }
+
+func (msgpackCodec) Encode(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	out, err := appendMsgpack(nil, dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("trailing data after JSON value")
+	}
+	return out, nil
+}
+
+func (msgpackCodec) Decode(_ byte, stored []byte) ([]byte, error) {
+	r := &msgpackReader{buf: stored}
+	out, err := r.appendJSON(nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.pos != len(r.buf) {
+		return nil, fmt.Errorf("msgpack: trailing data")
+	}
+	return out, nil
+}
+
+func appendMsgpack(out []byte, dec *json.Decoder) ([]byte, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch v := tok.(type) {
+	case nil:
+		return append(out, 0xc0), nil
+	case bool:
+		if v {
+			return append(out, 0xc3), nil
+		}
+		return append(out, 0xc2), nil
+	case string:
+		return appendMsgpackString(out, v), nil
+	case json.Number:
+		return appendMsgpackNumber(out, v), nil
+	case json.Delim:
+		var body []byte
+		n := 0
+		for dec.More() {
+			if v == '{' {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				body = appendMsgpackString(body, key.(string))
+			}
+			if body, err = appendMsgpack(body, dec); err != nil {
+				return nil, err
+			}
+			n++
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		if v == '{' {
+			out = appendMsgpackHeader(out, n, 0x80, 0xde)
+		} else {
+			out = appendMsgpackHeader(out, n, 0x90, 0xdc)
+		}
+		return append(out, body...), nil
+	}
+	return nil, fmt.Errorf("unexpected JSON token %v", tok)
+}
+
+// appendMsgpackHeader writes the length of a map or array: in the fix
+// format below 16 entries, as 16 or 32 bits above.
+func appendMsgpackHeader(out []byte, n int, fix, sized byte) []byte {
+	switch {
+	case n < 16:
+		return append(out, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(out, sized), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(out, sized+1), uint32(n))
+	}
+}
+
+func appendMsgpackString(out []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		out = append(out, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		out = append(out, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		out = binary.BigEndian.AppendUint16(append(out, 0xda), uint16(n))
+	default:
+		out = binary.BigEndian.AppendUint32(append(out, 0xdb), uint32(n))
+	}
+	return append(out, s...)
+}
+
+func appendMsgpackNumber(out []byte, n json.Number) []byte {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		switch {
+		case i >= 0 && i <= 0x7f, i < 0 && i >= -32:
+			return append(out, byte(i))
+		case i >= math.MinInt8 && i <= math.MaxInt8:
+			return append(out, 0xd0, byte(i))
+		case i >= math.MinInt16 && i <= math.MaxInt16:
+			return binary.BigEndian.AppendUint16(append(out, 0xd1), uint16(i))
+		case i >= math.MinInt32 && i <= math.MaxInt32:
+			return binary.BigEndian.AppendUint32(append(out, 0xd2), uint32(i))
+		default:
+			return binary.BigEndian.AppendUint64(append(out, 0xd3), uint64(i))
+		}
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		return binary.BigEndian.AppendUint64(append(out, 0xcf), u)
+	}
+	if f, err := strconv.ParseFloat(string(n), 64); err == nil && strconv.FormatFloat(f, 'g', -1, 64) == string(n) {
+		return binary.BigEndian.AppendUint64(append(out, 0xcb), math.Float64bits(f))
+	}
+	if len(n) <= math.MaxUint8 {
+		out = append(out, 0xc7, byte(len(n)))
+	} else {
+		out = binary.BigEndian.AppendUint16(append(out, 0xc8), uint16(len(n)))
+	}
+	return append(append(out, msgpackNumberExt), n...)
+}
+
+type msgpackReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *msgpackReader) next(n int) ([]byte, error) {
+	if n < 0 || len(r.buf)-r.pos < n {
+		return nil, fmt.Errorf("msgpack: truncated")
+	}
+	b := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+// uint reads a big-endian unsigned integer of size bytes.
+func (r *msgpackReader) uint(size int) (uint64, error) {
+	b, err := r.next(size)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (r *msgpackReader) appendJSON(out []byte) ([]byte, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+
+	switch {
+	case c <= 0x7f:
+		return strconv.AppendInt(out, int64(c), 10), nil
+	case c >= 0xe0:
+		return strconv.AppendInt(out, int64(int8(c)), 10), nil
+	case c&0xf0 == 0x80:
+		return r.appendObject(out, int(c&0x0f))
+	case c&0xf0 == 0x90:
+		return r.appendArray(out, int(c&0x0f))
+	case c&0xe0 == 0xa0:
+		return r.appendString(out, int(c&0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return append(out, "null"...), nil
+	case 0xc2:
+		return append(out, "false"...), nil
+	case 0xc3:
+		return append(out, "true"...), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := r.uint(1 << (c - 0xcc))
+		return strconv.AppendUint(out, v, 10), err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		v, err := r.uint(size)
+		// Sign-extend from size bytes.
+		shift := 64 - 8*size
+		return strconv.AppendInt(out, int64(v<<shift)>>shift, 10), err
+	case 0xca:
+		v, err := r.uint(4)
+		return strconv.AppendFloat(out, float64(math.Float32frombits(uint32(v))), 'g', -1, 32), err
+	case 0xcb:
+		v, err := r.uint(8)
+		return strconv.AppendFloat(out, math.Float64frombits(v), 'g', -1, 64), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := r.uint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return r.appendString(out, int(n))
+	case 0xdc, 0xdd:
+		n, err := r.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return r.appendArray(out, int(n))
+	case 0xde, 0xdf:
+		n, err := r.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return r.appendObject(out, int(n))
+	case 0xc7, 0xc8:
+		n, err := r.uint(1 << (c - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		ext, err := r.next(int(n) + 1)
+		if err != nil {
+			return nil, err
+		}
+		if ext[0] != msgpackNumberExt || !json.Valid(ext[1:]) {
+			return nil, fmt.Errorf("msgpack: unsupported extension %d", ext[0])
+		}
+		return append(out, ext[1:]...), nil
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type 0x%02x", c)
+}
+
+func (r *msgpackReader) appendString(out []byte, n int) ([]byte, error) {
+	b, err := r.next(n)
+	if err != nil {
+		return nil, err
+	}
+	s, _ := json.Marshal(string(b))
+	return append(out, s...), nil
+}
+
+func (r *msgpackReader) appendArray(out []byte, n int) ([]byte, error) {
+	out = append(out, '[')
+	for i := range n {
+		if i > 0 {
+			out = append(out, ',')
+		}
+		var err error
+		if out, err = r.appendJSON(out); err != nil {
+			return nil, err
+		}
+	}
+	return append(out, ']'), nil
+}
+
+func (r *msgpackReader) appendObject(out []byte, n int) ([]byte, error) {
+	out = append(out, '{')
+	for i := range n {
+		if i > 0 {
+			out = append(out, ',')
+		}
+		key := len(out)
+		var err error
+		if out, err = r.appendJSON(out); err != nil {
+			return nil, err
+		}
+		if out[key] != '"' {
+			return nil, fmt.Errorf("msgpack: object key is not a string")
+		}
+		out = append(out, ':')
+		if out, err = r.appendJSON(out); err != nil {
+			return nil, err
+		}
+	}
+	return append(out, '}'), nil
+}
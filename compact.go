@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	compactBatchSize    = 500
+	vacuumBatchPages    = 256
+	defaultTombstoneTTL = 7 * 24 * time.Hour
+)
+
+var errStoreDisabled = errors.New("persistence disabled")
+
+// CompactionReport summarises one compaction run. Sizes are in bytes.
+type CompactionReport struct {
+	Purged     int64         `json:"purged"`
+	SizeBefore int64         `json:"size_before"`
+	SizeAfter  int64         `json:"size_after"`
+	Reclaimed  int64         `json:"reclaimed"`
+	Full       bool          `json:"full"`
+	Duration   time.Duration `json:"duration_ns"`
+}
+
+func (s *messageStore) pragmaInt(name string) (int64, error) {
+	var value int64
+	err := s.db.QueryRow("PRAGMA " + name).Scan(&value)
+	return value, err
+}
+
+func (s *messageStore) size() (int64, error) {
+	pages, err := s.pragmaInt("page_count")
+	if err != nil {
+		return 0, err
+	}
+	pageSize, err := s.pragmaInt("page_size")
+	return pages * pageSize, err
+}
+
+// Tombstone marks a published message as deleted. Its row is kept, so the
+// deletion can be replicated, until compaction purges it past retention.
+func (s *messageStore) Tombstone(envelopeID string) error {
+	_, err := s.db.Exec(`UPDATE messages SET deleted_at = ? WHERE envelope_id = ? AND deleted_at IS NULL`,
+		time.Now().UnixNano(), envelopeID)
+	return err
+}
+
+// purgeBatch deletes up to compactBatchSize messages tombstoned before cutoff
+// and runs the purge hooks for them.
+func (s *messageStore) purgeBatch(ctx context.Context, cutoff int64) (int64, error) {
+	rows, err := s.db.QueryContext(ctx, `DELETE FROM messages WHERE id IN (
+		SELECT id FROM messages WHERE deleted_at IS NOT NULL AND deleted_at < ? LIMIT ?)
+		RETURNING room, data`, cutoff, compactBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	type purged struct {
+		room string
+		data []byte
+	}
+	var batch []purged
+	for rows.Next() {
+		p := purged{}
+		if err := rows.Scan(&p.room, &p.data); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, p := range batch {
+		data, err := decodeStored(p.data)
+		if err != nil {
+			log.Printf("Compact: purged message of %s: %v", p.room, err)
+			continue
+		}
+		for _, hook := range s.purgeHooks {
+			hook(p.room, data)
+		}
+	}
+	return int64(len(batch)), nil
+}
+
+// OnPurge registers hook to run for every message compaction removes, so
+// resources it references, such as attachment blobs, can be released.
+func (s *messageStore) OnPurge(hook func(room string, data []byte)) {
+	s.purgeHooks = append(s.purgeHooks, hook)
+}
+
+// Compact purges messages tombstoned before retention ago, rebuilds the
+// indexes and returns free pages to the file system. Every step is a short
+// statement of its own, so publishes interleave with an online run instead of
+// waiting for it. full runs VACUUM instead of the incremental vacuum; it
+// rewrites the whole database under one lock and is meant for offline use.
+func (s *messageStore) Compact(ctx context.Context, retention time.Duration, full bool) (CompactionReport, error) {
+	start := time.Now()
+	report := CompactionReport{Full: full}
+
+	var err error
+	if report.SizeBefore, err = s.size(); err != nil {
+		return report, err
+	}
+
+	cutoff := time.Now().Add(-retention).UnixNano()
+	for {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		n, err := s.purgeBatch(ctx, cutoff)
+		if err != nil {
+			return report, err
+		}
+		report.Purged += n
+		if n < compactBatchSize {
+			break
+		}
+	}
+
+	if _, err := s.db.ExecContext(ctx, `REINDEX messages`); err != nil {
+		return report, err
+	}
+
+	if full {
+		if _, err := s.db.ExecContext(ctx, `VACUUM`); err != nil {
+			return report, err
+		}
+	} else {
+		for {
+			free, err := s.pragmaInt("freelist_count")
+			if err != nil {
+				return report, err
+			}
+			if free == 0 || ctx.Err() != nil {
+				break
+			}
+			if _, err := s.db.ExecContext(ctx, fmt.Sprintf("PRAGMA incremental_vacuum(%d)", vacuumBatchPages)); err != nil {
+				return report, err
+			}
+			if after, err := s.pragmaInt("freelist_count"); err != nil || after == free {
+				// Not in incremental auto_vacuum mode; only a full run helps.
+				break
+			}
+		}
+	}
+
+	if report.SizeAfter, err = s.size(); err != nil {
+		return report, err
+	}
+	report.Reclaimed = report.SizeBefore - report.SizeAfter
+	report.Duration = time.Since(start)
+	return report, nil
+}
+
+func compactHandler(store *messageStore, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if store == nil {
+			writeError(w, r, errStoreDisabled)
+			return
+		}
+
+		retention := defaultTombstoneTTL
+		if raw := r.URL.Query().Get("retention"); raw != "" {
+			d, err := time.ParseDuration(raw)
+			if err != nil || d < 0 {
+				writeError(w, r, fmt.Errorf("%w: retention must be a non-negative duration", errInvalidRequest))
+				return
+			}
+			retention = d
+		}
+
+		report, err := store.Compact(r.Context(), retention, false)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record("admin", "store.compact", "", fmt.Sprintf("purged %d, reclaimed %d bytes", report.Purged, report.Reclaimed))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// runCompact implements the "compact" maintenance command.
+func runCompact(args []string) {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	storePath := fs.String("store", "", "SQLite database to compact")
+	retention := fs.Duration("retention", defaultTombstoneTTL, "purge messages deleted longer ago than this")
+	full := fs.Bool("full", false, "run a full VACUUM (locks the database; stop the server first)")
+	blobCfg := blobConfig{}
+	blobCfg.register(fs)
+	fs.Parse(args)
+
+	if *storePath == "" {
+		fmt.Fprintln(os.Stderr, "compact: -store is required")
+		os.Exit(2)
+	}
+	store, err := openMessageStore(*storePath, migrateCheck)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.db.Close()
+
+	// Delete the attachment blobs of purged messages, as the server does.
+	if blobCfg.driver != "memory" {
+		blobs, err := blobCfg.open()
+		if err != nil {
+			log.Fatal(err)
+		}
+		store.OnPurge(newAttachmentStore(blobs, 0).Purged)
+	}
+
+	report, err := store.Compact(context.Background(), *retention, *full)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("purged %d messages, %d -> %d bytes (reclaimed %d) in %s\n",
+		report.Purged, report.SizeBefore, report.SizeAfter, report.Reclaimed, report.Duration.Round(time.Millisecond))
+}
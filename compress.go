@@ -0,0 +1,162 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	encodingGzip        = "gzip"
+	encodingDeflateDict = "deflate-dict"
+	dictionaryHeader    = "X-Stream-Dictionary"
+)
+
+// streamDictionary primes the compressor of deflate-dict streams with what
+// every SSE frame repeats: field lines, envelope and chat keys, and the
+// shape of timestamps. Deflate favours matches near the end, so the most
+// common frame goes last.
+var streamDictionary = []byte(`event: meta
+data: {"id":"","event":"meta","time":"T00:00:00.000000000Z","data":{"server_time":"T00:00:00.000000000Z","lag":{"":0},"buffered":0,"buffer_size":64,"dropped":0}}
+
+event: presence
+data: {"id":"","room":"","seq":,"event":"presence","time":"T00:00:00.000000000Z","data":{"room":"","user_id":"","status":"online","last_seen":"T00:00:00.000000000Z"}}
+
+event: preview
+data: {"id":"","room":"","seq":,"event":"preview","time":"T00:00:00.000000000Z","data":{"message_id":"","url":"https://","title":"","description":"","image":"https://"}}
+
+id:
+data: {"id":"","room":"","seq":,"time":"T00:00:00.000000000Z","data":{"room":"","user_id":"","message":"","attachment":{"id":"","kind":"image","content_type":"image/","size":,"url":"https://"},"via":"webhook","client_message_id":""}}
+
+id:
+data: {"id":"","room":"","seq":,"time":"2026-01-01T00:00:00.000000000Z","data":{"room":"","user_id":"","message":"","client_message_id":""}}
+
+`)
+
+// streamDictionaryID names the dictionary by its content, so clients can
+// cache it across reconnects and a changed dictionary never gets mixed up
+// with an old one.
+var streamDictionaryID = func() string {
+	sum := sha256.Sum256(streamDictionary)
+	return hex.EncodeToString(sum[:8])
+}()
+
+var (
+	streamRawBytes  = newCounterVec("chat_stream_raw_bytes_total", "SSE bytes written before compression, by encoding.", "encoding")
+	streamWireBytes = newCounterVec("chat_stream_wire_bytes_total", "SSE bytes sent after compression, by encoding.", "encoding")
+)
+
+type flushWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressedWriter compresses an event stream, flushing the compressor with
+// every flush of the stream so events aren't held back.
+type compressedWriter struct {
+	http.ResponseWriter
+	encoding string
+	zw       flushWriter
+}
+
+func (w *compressedWriter) Write(p []byte) (int, error) {
+	streamRawBytes.With(w.encoding).Add(uint64(len(p)))
+	return w.zw.Write(p)
+}
+
+func (w *compressedWriter) Flush() {
+	w.zw.Flush()
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *compressedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countingWriter counts what the compressor hands to the connection.
+type countingWriter struct {
+	w        io.Writer
+	encoding string
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	streamWireBytes.With(c.encoding).Add(uint64(n))
+	return n, err
+}
+
+// acceptsEncoding reports whether the Accept-Encoding of r lists encoding
+// without refusing it with q=0.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, part := range strings.Split(strings.Join(r.Header.Values("Accept-Encoding"), ","), ",") {
+		name, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			weight, err := strconv.ParseFloat(q, 64)
+			return err == nil && weight > 0
+		}
+		return true
+	}
+	return false
+}
+
+// compressMiddleware compresses streams for clients that ask for it. Clients
+// that fetched the stream dictionary and send its ID in X-Stream-Dictionary
+// can accept deflate-dict, raw deflate primed with that dictionary; anyone
+// else accepting gzip gets gzip. Either way the compressor is flushed per
+// event, which costs part of the ratio but keeps the stream live. Every
+// compressed stream holds its own compressor, a few hundred KB even at
+// BestSpeed, which is why this is off by default.
+func compressMiddleware(enabled bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !enabled || !capabilitiesFrom(r).Has(capabilityCompression) {
+			next(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := ""
+		switch {
+		case acceptsEncoding(r, encodingDeflateDict) && r.Header.Get(dictionaryHeader) == streamDictionaryID:
+			encoding = encodingDeflateDict
+		case acceptsEncoding(r, encodingGzip):
+			encoding = encodingGzip
+		default:
+			next(w, r)
+			return
+		}
+
+		wire := countingWriter{w: w, encoding: encoding}
+		cw := &compressedWriter{ResponseWriter: w, encoding: encoding}
+		if encoding == encodingDeflateDict {
+			zw, _ := flate.NewWriterDict(wire, flate.BestSpeed, streamDictionary)
+			cw.zw = zw
+			w.Header().Set(dictionaryHeader, streamDictionaryID)
+		} else {
+			cw.zw, _ = gzip.NewWriterLevel(wire, gzip.BestSpeed)
+		}
+		defer cw.zw.Close()
+
+		w.Header().Set("Content-Encoding", encoding)
+		next(cw, r)
+	}
+}
+
+// streamDictionaryHandler serves the deflate-dict dictionary along with its
+// ID, which clients cache it under.
+func streamDictionaryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(dictionaryHeader, streamDictionaryID)
+	w.Header().Set("ETag", `"`+streamDictionaryID+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write(streamDictionary)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	contentPlain    = "plain"
+	contentMarkdown = "markdown"
+	contentCode     = "code"
+)
+
+var (
+	codeLanguagePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9+#._-]{0,31}$`)
+	autolinkPattern     = regexp.MustCompile(`^<(?i:https?|mailto):[^\s<>]*>`)
+	referencePattern    = regexp.MustCompile(`^( {0,3}\[[^\]]+\]:[ \t]*)(<[^>\n]*>|\S+)`)
+
+	safeLinkSchemes = []string{"http", "https", "mailto"}
+
+	sanitizedMessages = newCounterVec("chat_messages_sanitized_total", "Messages rewritten to be safe to render, by content type.", "content_type")
+)
+
+// prepareContent checks the content type of chat and makes formats that
+// render to HTML safe to render as they are: raw HTML in markdown is
+// escaped and links to anything but http, https and mailto point nowhere.
+// Plain text and code never become HTML, so they pass through untouched.
+func prepareContent(chat *Chat) error {
+	switch chat.ContentType {
+	case "", contentPlain, contentMarkdown:
+		if chat.Language != "" {
+			return fmt.Errorf("%w: language is only for code", errInvalidRequest)
+		}
+	case contentCode:
+		if chat.Language != "" && !codeLanguagePattern.MatchString(chat.Language) {
+			return fmt.Errorf("%w: invalid language %q", errInvalidRequest, chat.Language)
+		}
+	default:
+		return fmt.Errorf("%w: content_type must be plain, markdown or code", errInvalidRequest)
+	}
+
+	if chat.ContentType == contentMarkdown {
+		if sanitized := sanitizeMarkdown(chat.Message); sanitized != chat.Message {
+			chat.Message = sanitized
+			sanitizedMessages.With(contentMarkdown).Add(1)
+		}
+	}
+	return nil
+}
+
+// sanitizeMarkdown leaves code blocks alone and sanitizes the text between
+// them.
+func sanitizeMarkdown(text string) string {
+	var b, prose strings.Builder
+	flush := func() {
+		b.WriteString(sanitizeProse(prose.String()))
+		prose.Reset()
+	}
+
+	fence := ""
+	blank := true
+	indented := false
+	for _, line := range strings.SplitAfter(text, "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		indent := len(line) - len(trimmed)
+		switch {
+		case fence != "":
+			b.WriteString(line)
+			if closesFence(trimmed, fence) {
+				fence = ""
+			}
+		case indent < 4 && fenceMarker(trimmed) != "":
+			flush()
+			fence = fenceMarker(trimmed)
+			b.WriteString(line)
+		case (indent >= 4 || strings.HasPrefix(line, "\t")) && (blank || indented):
+			flush()
+			indented = true
+			b.WriteString(line)
+		default:
+			indented = indented && strings.TrimSpace(line) == ""
+			if indented {
+				b.WriteString(line)
+			} else {
+				prose.WriteString(line)
+			}
+		}
+		blank = strings.TrimSpace(line) == ""
+	}
+	flush()
+	return b.String()
+}
+
+// fenceMarker returns the ``` or ~~~ run opening a fenced code block.
+func fenceMarker(line string) string {
+	for _, c := range "`~" {
+		run := len(line) - len(strings.TrimLeft(line, string(c)))
+		if run >= 3 {
+			// Backtick fences can't have backticks in their info string.
+			if c == '`' && strings.Contains(line[run:], "`") {
+				return ""
+			}
+			return line[:run]
+		}
+	}
+	return ""
+}
+
+func closesFence(line, fence string) bool {
+	rest := strings.TrimLeft(line, fence[:1])
+	return len(line)-len(rest) >= len(fence) && strings.TrimSpace(rest) == ""
+}
+
+// sanitizeProse escapes every < that doesn't start an autolink to a safe
+// scheme and neutralizes unsafe link destinations. Code spans and existing
+// backslash escapes are copied as they are.
+func sanitizeProse(text string) string {
+	lines := strings.SplitAfter(text, "\n")
+	for i, line := range lines {
+		if m := referencePattern.FindStringSubmatchIndex(line); m != nil && !safeDestination(line[m[4]:m[5]]) {
+			lines[i] = line[:m[3]] + "#" + line[m[5]:]
+		}
+	}
+	text = strings.Join(lines, "")
+
+	var b strings.Builder
+	for len(text) > 0 {
+		i := strings.IndexAny(text, "\\`<]")
+		if i < 0 {
+			b.WriteString(text)
+			break
+		}
+		b.WriteString(text[:i])
+		text = text[i:]
+
+		n := 1
+		switch text[0] {
+		case '\\':
+			if len(text) > 1 {
+				_, size := utf8.DecodeRuneInString(text[1:])
+				n += size
+			}
+		case '`':
+			run := len(text) - len(strings.TrimLeft(text, "`"))
+			n = run
+			if end := strings.Index(text[run:], text[:run]); end >= 0 {
+				n = run + end + run
+			}
+		case '<':
+			if m := autolinkPattern.FindString(text); m != "" {
+				n = len(m)
+			} else {
+				b.WriteString(`\<`)
+				text = text[1:]
+				continue
+			}
+		case ']':
+			if dest, end := linkDestination(text[1:]); end > 0 && !safeDestination(dest) {
+				b.WriteString("](#)")
+				text = text[1+end:]
+				continue
+			}
+		}
+		b.WriteString(text[:n])
+		text = text[n:]
+	}
+	return b.String()
+}
+
+// linkDestination parses the "(destination" following the ] of a link or
+// image. end is where the link ends in text, or 0 if it isn't one.
+func linkDestination(text string) (dest string, end int) {
+	if !strings.HasPrefix(text, "(") {
+		return "", 0
+	}
+	i := 1
+	for i < len(text) && (text[i] == ' ' || text[i] == '\t' || text[i] == '\n') {
+		i++
+	}
+	start := i
+	if i < len(text) && text[i] == '<' {
+		close := strings.IndexAny(text[i:], ">\n")
+		if close < 0 || text[i+close] != '>' {
+			return "", 0
+		}
+		i += close + 1
+	} else {
+		depth := 0
+		for ; i < len(text); i++ {
+			c := text[i]
+			if c == '\\' {
+				i++
+				continue
+			}
+			if c == '(' {
+				depth++
+			} else if c == ')' {
+				if depth == 0 {
+					break
+				}
+				depth--
+			} else if c <= ' ' {
+				break
+			}
+		}
+		i = min(i, len(text))
+	}
+	dest = text[start:i]
+
+	close := strings.IndexByte(text[i:], ')')
+	if close < 0 {
+		return "", 0
+	}
+	return dest, i + close + 1
+}
+
+// safeDestination reports whether a link destination is relative or uses a
+// safe scheme, looking at it the way a renderer would: after decoding
+// entities and dropping the whitespace and control characters browsers
+// ignore in schemes.
+func safeDestination(dest string) bool {
+	dest = html.UnescapeString(strings.TrimSuffix(strings.TrimPrefix(dest, "<"), ">"))
+	dest = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, dest)
+
+	colon := strings.IndexByte(dest, ':')
+	if colon < 0 || strings.ContainsAny(dest[:colon], "/?#") {
+		return true
+	}
+	return slices.Contains(safeLinkSchemes, strings.ToLower(dest[:colon]))
+}
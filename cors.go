@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+const (
+	corsAllowMethods = "GET, POST, PUT, DELETE, OPTIONS"
+	// Cache-Control and X-Requested-With are sent by EventSource polyfills.
+	corsAllowHeaders  = "Authorization, Cache-Control, Content-Type, Last-Event-ID, Prefer, X-API-Key, X-API-Version, X-Captcha-Token, X-Client-ID, X-Nonce, X-Requested-With, X-Signature, X-Stream-Capabilities, X-Timestamp, X-User-ID"
+	corsExposeHeaders = "Deprecation, Location, Preference-Applied, Retry-After, Sunset, X-API-Version, X-Request-ID, " + dictionaryHeader
+)
+
+// corsPolicy is the set of origins browsers may call the API from. "*"
+// allows any origin, but only listed origins may send credentials: cookies,
+// and so EventSource with withCredentials, only work from those.
+type corsPolicy struct {
+	mu      sync.RWMutex
+	origins []string
+}
+
+func newCORSPolicy(origins []string) *corsPolicy {
+	return &corsPolicy{origins: origins}
+}
+
+func (c *corsPolicy) Set(origins []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.origins = slices.Clone(origins)
+}
+
+// allows reports whether origin may call the API, and whether it may do so
+// with credentials.
+func (c *corsPolicy) allows(origin string) (allowed, credentials bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if origin != "null" && slices.Contains(c.origins, origin) {
+		return true, true
+	}
+	return slices.Contains(c.origins, "*"), false
+}
+
+type corsCredentialsKey struct{}
+
+// corsCredentials reports whether r comes from an origin allowed to send
+// credentials cross-origin.
+func corsCredentials(r *http.Request) bool {
+	allowed, _ := r.Context().Value(corsCredentialsKey{}).(bool)
+	return allowed
+}
+
+// cookieSameSite is the SameSite mode of cookies set in response to r. Lax
+// keeps them off cross-site requests, so frontends on an origin allowed
+// credentials get None instead, which browsers only accept over TLS.
+func cookieSameSite(r *http.Request) http.SameSite {
+	if r.TLS != nil && corsCredentials(r) {
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteLaxMode
+}
+
+// corsMiddleware answers preflight requests and sets the CORS headers for
+// allowed origins. Requests from other origins pass through without them, so
+// browsers block reading the response. The origin is always echoed rather
+// than answered with *, which browsers reject for credentialed requests.
+func corsMiddleware(cors *corsPolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		allowed, credentials := cors.allows(origin)
+		if !allowed {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if credentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			r = r.WithContext(context.WithValue(r.Context(), corsCredentialsKey{}, true))
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method, Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
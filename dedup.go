@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const maxClientMessageID = 128
+
+var dedupHits = newCounter("chat_dedup_hits_total", "Publishes absorbed as duplicates of a recent one.")
+
+// publishDeduper absorbs double submits and retried requests. A publish is a
+// duplicate of an earlier one from the same sender within the window when it
+// carries the same client message ID or, without one, the same room and text.
+type publishDeduper struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	seen      map[[32]byte]dedupClaim
+	lastSweep time.Time
+}
+
+// dedupClaim is when a publish was claimed and, once published, its
+// envelope, so duplicates can be answered with the original's ID.
+type dedupClaim struct {
+	at  time.Time
+	env *Envelope
+}
+
+// newPublishDeduper returns nil for a window of zero, which disables it.
+func newPublishDeduper(window time.Duration) *publishDeduper {
+	if window <= 0 {
+		return nil
+	}
+	return &publishDeduper{window: window, seen: make(map[[32]byte]dedupClaim)}
+}
+
+func dedupKey(chat Chat) [32]byte {
+	if chat.ClientMessageID != "" {
+		return sha256.Sum256([]byte("id\x00" + chat.UserID + "\x00" + chat.ClientMessageID))
+	}
+	return sha256.Sum256([]byte("text\x00" + chat.UserID + "\x00" + chat.Room + "\x00" + chat.payload() + "\x00" + metadataKey(chat)))
+}
+
+// Claim records chat and reports whether it is new. A nil deduper claims
+// everything.
+func (d *publishDeduper) Claim(chat Chat) ([32]byte, bool) {
+	key := dedupKey(chat)
+	if d == nil {
+		return key, true
+	}
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sweep(now)
+
+	if claim, ok := d.seen[key]; ok && now.Sub(claim.at) < d.window {
+		dedupHits.Inc()
+		return key, false
+	}
+	d.seen[key] = dedupClaim{at: now}
+	return key, true
+}
+
+// Published records the envelope a claimed publish went out as.
+func (d *publishDeduper) Published(key [32]byte, env Envelope) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if claim, ok := d.seen[key]; ok {
+		claim.env = &env
+		d.seen[key] = claim
+	}
+}
+
+// Original returns the envelope of the publish key duplicates, unless it is
+// still being published.
+func (d *publishDeduper) Original(key [32]byte) (Envelope, bool) {
+	if d == nil {
+		return Envelope{}, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if claim, ok := d.seen[key]; ok && claim.env != nil {
+		return *claim.env, true
+	}
+	return Envelope{}, false
+}
+
+// Release forgets a claim whose publish failed so the retry goes through.
+func (d *publishDeduper) Release(key [32]byte) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.seen, key)
+}
+
+// sweep drops expired claims, at most once per window. Callers hold d.mu.
+func (d *publishDeduper) sweep(now time.Time) {
+	if now.Sub(d.lastSweep) < d.window {
+		return
+	}
+	d.lastSweep = now
+	for key, claim := range d.seen {
+		if now.Sub(claim.at) >= d.window {
+			delete(d.seen, key)
+		}
+	}
+}
+
+// clientMessageID takes the client's ID for a publish from the body or,
+// failing that, the Idempotency-Key header.
+func clientMessageID(r *http.Request, chat *Chat) error {
+	if chat.ClientMessageID == "" {
+		chat.ClientMessageID = r.Header.Get("Idempotency-Key")
+	}
+	if len(chat.ClientMessageID) > maxClientMessageID {
+		return fmt.Errorf("%w: client_message_id is limited to %d bytes", errInvalidRequest, maxClientMessageID)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Delivery outcomes. The shard decides whether an envelope addressed to a
+// subscriber is filtered or dropped; the stream decides whether it's
+// written, live or from history, or held back by its flow control window.
+const (
+	deliveryDelivered = "delivered"
+	deliveryReplayed  = "replayed"
+	deliveryFiltered  = "filtered"
+	deliveryDropped   = "dropped"
+	deliveryHeld      = "held"
+
+	maxDeliveryRecords = 5000
+)
+
+var errDeliveryLogDisabled = errors.New("delivery log disabled; start the server with -delivery-log")
+
+// DeliveryRecord is what became of one envelope for one subscriber.
+type DeliveryRecord struct {
+	Time       time.Time `json:"time"`
+	Subscriber string    `json:"subscriber_id"`
+	Client     string    `json:"client_id,omitempty"`
+	User       string    `json:"user_id,omitempty"`
+	EnvelopeID string    `json:"envelope_id"`
+	Room       string    `json:"room,omitempty"`
+	Group      string    `json:"group,omitempty"`
+	Seq        uint64    `json:"seq,omitempty"`
+	Event      string    `json:"event,omitempty"`
+	Outcome    string    `json:"outcome"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// deliveryLog keeps the latest delivery outcomes of every subscriber in a
+// ring, oldest overwritten first, so support can see afterwards what a
+// client was sent. It is off, and costs nothing, unless -delivery-log sizes
+// it.
+type deliveryLog struct {
+	mu      sync.Mutex
+	records []DeliveryRecord
+	next    int
+	full    bool
+}
+
+func newDeliveryLog(size int) *deliveryLog {
+	if size <= 0 {
+		return nil
+	}
+	return &deliveryLog{records: make([]DeliveryRecord, size)}
+}
+
+func (dl *deliveryLog) Record(s *Subscriber, env Envelope, outcome, reason string) {
+	if dl == nil {
+		return
+	}
+	record := DeliveryRecord{
+		Time:       time.Now().UTC(),
+		Subscriber: s.ID,
+		Client:     s.ClientID,
+		User:       s.User,
+		EnvelopeID: env.ID,
+		Room:       env.Room,
+		Group:      env.Group,
+		Seq:        env.Seq,
+		Event:      env.Event,
+		Outcome:    outcome,
+		Reason:     reason,
+	}
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	dl.records[dl.next] = record
+	if dl.next++; dl.next == len(dl.records) {
+		dl.next, dl.full = 0, true
+	}
+}
+
+type deliveryQuery struct {
+	Subscriber, Client, Room string
+	From, Until              time.Time
+}
+
+func (q deliveryQuery) matches(r DeliveryRecord) bool {
+	return (q.Subscriber == "" || r.Subscriber == q.Subscriber) &&
+		(q.Client == "" || r.Client == q.Client) &&
+		(q.Room == "" || r.Room == q.Room) &&
+		(q.From.IsZero() || !r.Time.Before(q.From)) &&
+		(q.Until.IsZero() || r.Time.Before(q.Until))
+}
+
+// Find returns the records q matches, oldest first, up to limit of the
+// newest, and whether there were more.
+func (dl *deliveryLog) Find(q deliveryQuery, limit int) ([]DeliveryRecord, bool) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+
+	ordered := dl.records[:dl.next]
+	if dl.full {
+		ordered = append(dl.records[dl.next:len(dl.records):len(dl.records)], dl.records[:dl.next]...)
+	}
+	found := []DeliveryRecord{}
+	for _, r := range ordered {
+		if q.matches(r) {
+			found = append(found, r)
+		}
+	}
+	if len(found) > limit {
+		return found[len(found)-limit:], true
+	}
+	return found, false
+}
+
+// Oldest returns the time of the oldest record kept.
+func (dl *deliveryLog) Oldest() time.Time {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	if dl.full {
+		return dl.records[dl.next].Time
+	}
+	if dl.next > 0 {
+		return dl.records[0].Time
+	}
+	return time.Time{}
+}
+
+// UseDeliveryLog records delivery outcomes in dl. It must be called before
+// the broker is used.
+func (b *Broker) UseDeliveryLog(dl *deliveryLog) {
+	b.deliveries = dl
+	for _, s := range b.shards {
+		s.deliveries = dl
+	}
+}
+
+// RecordDelivery notes what a stream did with env for subscriber.
+func (b *Broker) RecordDelivery(s *Subscriber, env Envelope, outcome, reason string) {
+	b.deliveries.Record(s, env, outcome, reason)
+}
+
+type DeliveryReport struct {
+	Records []DeliveryRecord `json:"records"`
+	Counts  map[string]int   `json:"counts"`
+	// Truncated is set if older matching records were left out; Since is
+	// the oldest time the log still covers.
+	Truncated bool      `json:"truncated"`
+	Since     time.Time `json:"since,omitzero"`
+}
+
+// deliveriesHandler reconstructs what a subscriber or client was sent,
+// dropped or had filtered between from and until, for a room or all of
+// them. Subscriber IDs are reused across restarts; client IDs are stable.
+func deliveriesHandler(deliveries *deliveryLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if deliveries == nil {
+			writeError(w, r, errDeliveryLogDisabled)
+			return
+		}
+		query := r.URL.Query()
+		q := deliveryQuery{Subscriber: query.Get("subscriber_id"), Client: query.Get("client_id"), Room: query.Get("room")}
+		if q.Subscriber == "" && q.Client == "" {
+			writeError(w, r, fmt.Errorf("%w: subscriber_id or client_id required", errInvalidRequest))
+			return
+		}
+		var err error
+		if q.From, q.Until, err = transcriptRange(r); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		report := DeliveryReport{Counts: map[string]int{}, Since: deliveries.Oldest()}
+		report.Records, report.Truncated = deliveries.Find(q, maxDeliveryRecords)
+		for _, record := range report.Records {
+			report.Counts[record.Outcome]++
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+const (
+	// expiredEvent tells clients which messages of the room disappeared, so
+	// they can remove them from view.
+	expiredEvent = "expired"
+
+	minMessageTTL      = time.Minute
+	maxMessageTTL      = 30 * 24 * time.Hour
+	janitorInterval    = 30 * time.Second
+	maxExpiredPerEvent = 500
+)
+
+var expiredMessages = newCounter("chat_messages_expired_total", "Messages removed by the disappearing messages janitor.")
+
+// SetMessageTTL makes the messages of room disappear ttl after they were
+// sent; zero keeps them.
+func (rr *roomRegistry) SetMessageTTL(name string, ttl time.Duration) (Room, error) {
+	if ttl != 0 && (ttl < minMessageTTL || ttl > maxMessageTTL) {
+		return Room{}, fmt.Errorf("%w: message_ttl must be between %s and %s, or 0s", errInvalidRequest, minMessageTTL, maxMessageTTL)
+	}
+
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	room, ok := rr.rooms[name]
+	if !ok {
+		return Room{}, errRoomNotFound
+	}
+	if err := rr.record(RoomEvent{Type: roomMessageTTLSet, Room: name, MessageTTL: configDuration(ttl)}); err != nil {
+		return Room{}, err
+	}
+	return *room, nil
+}
+
+// MessageTTLs returns the message TTL of every room that has one.
+func (rr *roomRegistry) MessageTTLs() map[string]time.Duration {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+
+	ttls := make(map[string]time.Duration)
+	for name, room := range rr.rooms {
+		if room.MessageTTL > 0 {
+			ttls[name] = time.Duration(room.MessageTTL)
+		}
+	}
+	return ttls
+}
+
+// Expire drops the chat messages of room published before cutoff, except
+// those held sent, and returns them. Named events stay.
+func (h *history) Expire(room string, cutoff time.Time, held func(user string) bool) []Envelope {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var expired []Envelope
+	h.rooms[room] = slices.DeleteFunc(h.rooms[room], func(env Envelope) bool {
+		if env.Event == "" && env.Time.Before(cutoff) {
+			if held != nil && held(senderOf(env.Data)) {
+				return false
+			}
+			expired = append(expired, env)
+			return true
+		}
+		return false
+	})
+	return expired
+}
+
+// ExpireMessages removes the stored chat messages of room created before
+// cutoff, except those held sent, runs the purge hooks for them and returns
+// their envelope IDs.
+// Disappearing messages are deleted outright rather than tombstoned: every
+// node expires them on its own, so there is no deletion to replicate.
+func (s *messageStore) ExpireMessages(ctx context.Context, room string, cutoff time.Time, held func(user string) bool) ([]string, error) {
+	query := `DELETE FROM messages
+		WHERE room = ? AND event = '' AND created_at < ? AND id NOT IN (SELECT message_id FROM outbox)
+		RETURNING envelope_id, data`
+	args := []any{room, cutoff.UnixNano()}
+	if held != nil {
+		unheld, err := s.unheldMessages(ctx, room, cutoff, held)
+		if err != nil {
+			return nil, err
+		}
+		raw, _ := json.Marshal(unheld)
+		query = `DELETE FROM messages WHERE id IN (SELECT value FROM json_each(?)) RETURNING envelope_id, data`
+		args = []any{string(raw)}
+	}
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var IDs []string
+	var purged [][]byte
+	for rows.Next() {
+		var ID *string
+		var data []byte
+		if err := rows.Scan(&ID, &data); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if ID != nil {
+			IDs = append(IDs, *ID)
+		}
+		purged = append(purged, data)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, stored := range purged {
+		data, err := decodeStored(stored)
+		if err != nil {
+			log.Printf("Janitor: expired message of %s: %v", room, err)
+			continue
+		}
+		for _, hook := range s.purgeHooks {
+			hook(room, data)
+		}
+	}
+	return IDs, nil
+}
+
+// messageExpirer is the store the janitor deletes expired messages from.
+type messageExpirer interface {
+	ExpireMessages(ctx context.Context, room string, cutoff time.Time, held func(user string) bool) ([]string, error)
+}
+
+type expiredNotice struct {
+	MessageIDs []string  `json:"message_ids"`
+	Before     time.Time `json:"before"`
+}
+
+// expireRoom removes what of room is older than ttl, and wasn't sent by a
+// held user, from history and the store and tells the room which messages
+// went.
+func expireRoom(ctx context.Context, broker *Broker, store messageExpirer, room string, ttl time.Duration, held func(user string) bool) error {
+	cutoff := time.Now().Add(-ttl)
+	var IDs []string
+	for _, env := range broker.history.Expire(room, cutoff, held) {
+		IDs = append(IDs, env.ID)
+	}
+	if store != nil {
+		stored, err := store.ExpireMessages(ctx, room, cutoff, held)
+		if err != nil {
+			return err
+		}
+		IDs = append(IDs, stored...)
+	}
+	slices.Sort(IDs)
+	IDs = slices.Compact(IDs)
+	if len(IDs) == 0 {
+		return nil
+	}
+	expiredMessages.Add(uint64(len(IDs)))
+
+	for batch := range slices.Chunk(IDs, maxExpiredPerEvent) {
+		raw, _ := json.Marshal(expiredNotice{MessageIDs: batch, Before: cutoff.UTC()})
+		if _, err := broker.PublishEvent(room, expiredEvent, raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runMessageJanitor expires the messages of rooms with a message TTL or a
+// tenant retention every janitorInterval, sparing legal holds.
+func runMessageJanitor(broker *Broker, store messageExpirer, rooms *roomRegistry, retention *retentionPolicies) {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		held := retention.UserHolds()
+		for room, ttl := range retention.Expiries(rooms) {
+			if err := expireRoom(context.Background(), broker, store, room, ttl, held); err != nil {
+				log.Printf("Janitor: expiring %s: %v", room, err)
+			}
+		}
+	}
+}
+
+type messageTTLRequest struct {
+	MessageTTL configDuration `json:"message_ttl"`
+}
+
+// setMessageTTLHandler turns disappearing messages on or off for a room. Only
+// its owner can. Messages already older than the new TTL go with the next
+// janitor run.
+func setMessageTTLHandler(rooms *roomRegistry, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("room")
+		user := userFromRequest(r)
+		if !rooms.IsOwner(name, user) {
+			writeError(w, r, fmt.Errorf("%w: only the room owner can change disappearing messages", errForbidden))
+			return
+		}
+
+		req := messageTTLRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+		room, err := rooms.SetMessageTTL(name, time.Duration(req.MessageTTL))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record(user, "room.message_ttl", name, time.Duration(room.MessageTTL).String())
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(room)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	emojiEvent    = "emoji"
+	maxEmojiSize  = 256 << 10
+	maxRoomEmojis = 200
+)
+
+var (
+	errEmojiNotFound = errors.New("emoji not found")
+	errEmojiLimit    = errors.New("too many custom emoji")
+
+	emojiNamePattern = regexp.MustCompile(`^[a-z0-9_+-]{2,32}$`)
+	emojiRefPattern  = regexp.MustCompile(`:([a-z0-9_+-]{2,32}):`)
+)
+
+// Emoji is a custom emoji or sticker of a room, referenced as :name: in
+// messages of that room.
+type Emoji struct {
+	Name        string    `json:"name"`
+	Room        string    `json:"room"`
+	ContentType string    `json:"content_type"`
+	Size        int       `json:"size"`
+	URL         string    `json:"url"`
+	CreatedBy   string    `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type emojiUpdate struct {
+	Action string `json:"action"`
+	Emoji  Emoji  `json:"emoji"`
+}
+
+// emojiRegistry keeps the custom emoji of every room, with the images in a
+// BlobStore. Changes are broadcast into the room as emoji events.
+type emojiRegistry struct {
+	blobs  BlobStore
+	broker *Broker
+
+	mu    sync.RWMutex
+	rooms map[string]map[string]Emoji
+}
+
+func newEmojiRegistry(blobs BlobStore, broker *Broker) *emojiRegistry {
+	return &emojiRegistry{blobs: blobs, broker: broker, rooms: make(map[string]map[string]Emoji)}
+}
+
+func emojiBlobKey(room, name string) string {
+	return "emoji/" + url.PathEscape(room) + "/" + name
+}
+
+func (er *emojiRegistry) Get(room, name string) (Emoji, bool) {
+	er.mu.RLock()
+	defer er.mu.RUnlock()
+
+	emoji, ok := er.rooms[room][name]
+	return emoji, ok
+}
+
+func (er *emojiRegistry) List(room string) []Emoji {
+	er.mu.RLock()
+	defer er.mu.RUnlock()
+
+	emojis := make([]Emoji, 0, len(er.rooms[room]))
+	for _, emoji := range er.rooms[room] {
+		emojis = append(emojis, emoji)
+	}
+	slices.SortFunc(emojis, func(a, b Emoji) int { return strings.Compare(a.Name, b.Name) })
+	return emojis
+}
+
+// Resolve maps the custom emoji message refers to onto their URLs, so the
+// message renders the same even after the registry changes. References to
+// unknown names are left alone; they may be standard shortcodes.
+func (er *emojiRegistry) Resolve(room, message string) map[string]string {
+	er.mu.RLock()
+	defer er.mu.RUnlock()
+
+	var resolved map[string]string
+	for _, match := range emojiRefPattern.FindAllStringSubmatch(message, -1) {
+		emoji, ok := er.rooms[room][match[1]]
+		if !ok {
+			continue
+		}
+		if resolved == nil {
+			resolved = make(map[string]string)
+		}
+		resolved[emoji.Name] = emoji.URL
+	}
+	return resolved
+}
+
+func (er *emojiRegistry) Put(r *http.Request, emoji Emoji, data []byte) error {
+	er.mu.RLock()
+	_, replacing := er.rooms[emoji.Room][emoji.Name]
+	full := len(er.rooms[emoji.Room]) >= maxRoomEmojis
+	er.mu.RUnlock()
+	if full && !replacing {
+		return fmt.Errorf("%w: at most %d per room", errEmojiLimit, maxRoomEmojis)
+	}
+
+	if err := er.blobs.Put(r.Context(), emojiBlobKey(emoji.Room, emoji.Name), emoji.ContentType, bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	er.mu.Lock()
+	if er.rooms[emoji.Room] == nil {
+		er.rooms[emoji.Room] = make(map[string]Emoji)
+	}
+	er.rooms[emoji.Room][emoji.Name] = emoji
+	er.mu.Unlock()
+
+	er.broadcast(emoji.Room, "added", emoji)
+	return nil
+}
+
+func (er *emojiRegistry) Delete(r *http.Request, room, name string) error {
+	er.mu.Lock()
+	emoji, ok := er.rooms[room][name]
+	if ok {
+		delete(er.rooms[room], name)
+	}
+	er.mu.Unlock()
+	if !ok {
+		return errEmojiNotFound
+	}
+
+	if err := er.blobs.Delete(r.Context(), emojiBlobKey(room, name)); err != nil {
+		log.Printf("Emoji: deleting %s in %s: %v", name, room, err)
+	}
+	er.broadcast(room, "removed", emoji)
+	return nil
+}
+
+func (er *emojiRegistry) broadcast(room, action string, emoji Emoji) {
+	updateRaw, err := json.Marshal(emojiUpdate{Action: action, Emoji: emoji})
+	if err != nil {
+		return
+	}
+	if _, err := er.broker.PublishEvent(room, emojiEvent, updateRaw); err != nil {
+		log.Printf("Emoji: broadcasting %s of %s in %s: %v", action, emoji.Name, room, err)
+	}
+}
+
+func listEmojiHandler(rooms *roomRegistry, emojis *emojiRegistry) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room := r.PathValue("room")
+		if !rooms.CanRead(room, userFromRequest(r)) {
+			writeError(w, r, errNotMember)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(emojis.List(room))
+	}
+}
+
+// putEmojiHandler registers the image in the request body as a custom emoji
+// of the room, replacing one of the same name.
+func putEmojiHandler(rooms *roomRegistry, emojis *emojiRegistry, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, name := r.PathValue("room"), r.PathValue("name")
+		user := userFromRequest(r)
+		if !rooms.IsOwner(room, user) {
+			writeError(w, r, fmt.Errorf("%w: only the room owner can manage its emoji", errForbidden))
+			return
+		}
+		if !emojiNamePattern.MatchString(name) {
+			writeError(w, r, fmt.Errorf("%w: emoji names are 2-32 lowercase letters, digits, _, + or -", errInvalidRequest))
+			return
+		}
+
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxEmojiSize))
+		if err != nil {
+			writeError(w, r, fmt.Errorf("%w: emoji are limited to %d bytes", errAttachmentTooLarge, maxEmojiSize))
+			return
+		}
+		emoji := Emoji{
+			Name:      name,
+			Room:      room,
+			Size:      len(data),
+			URL:       absoluteURL(r, "/chat/rooms/"+url.PathEscape(room)+"/emoji/"+name),
+			CreatedBy: user,
+			CreatedAt: time.Now().UTC(),
+		}
+		switch emoji.ContentType = http.DetectContentType(data); emoji.ContentType {
+		case "image/png", "image/gif", "image/webp":
+		default:
+			writeError(w, r, fmt.Errorf("%w: emoji must be PNG, GIF or WebP", errAttachmentType))
+			return
+		}
+
+		if err := emojis.Put(r, emoji, data); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record(user, "emoji.put", room, name)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(emoji)
+	}
+}
+
+func deleteEmojiHandler(rooms *roomRegistry, emojis *emojiRegistry, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, name := r.PathValue("room"), r.PathValue("name")
+		user := userFromRequest(r)
+		if !rooms.IsOwner(room, user) {
+			writeError(w, r, fmt.Errorf("%w: only the room owner can manage its emoji", errForbidden))
+			return
+		}
+		if err := emojis.Delete(r, room, name); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record(user, "emoji.delete", room, name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func downloadEmojiHandler(rooms *roomRegistry, emojis *emojiRegistry) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, name := r.PathValue("room"), r.PathValue("name")
+		if !rooms.CanRead(room, userFromRequest(r)) {
+			writeError(w, r, errNotMember)
+			return
+		}
+		if _, ok := emojis.Get(room, name); !ok {
+			writeError(w, r, errEmojiNotFound)
+			return
+		}
+
+		body, contentType, err := emojis.blobs.Get(r.Context(), emojiBlobKey(room, name))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer body.Close()
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "private, max-age=300")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		io.Copy(w, body)
+	}
+}
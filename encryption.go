@@ -0,0 +1,112 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+const maxCiphertextSize = 64 << 10
+
+var (
+	errRoomEncrypted = errors.New("room is end-to-end encrypted")
+
+	keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+)
+
+// SetEncrypted makes the server treat the messages of room as opaque
+// ciphertext from now on. Messages already sent keep the form they had.
+func (rr *roomRegistry) SetEncrypted(name string, encrypted bool) (Room, error) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	room, ok := rr.rooms[name]
+	if !ok {
+		return Room{}, errRoomNotFound
+	}
+	if err := rr.record(RoomEvent{Type: roomEncryptionSet, Room: name, Enabled: encrypted}); err != nil {
+		return Room{}, err
+	}
+	return *room, nil
+}
+
+func (rr *roomRegistry) Encrypted(name string) bool {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+
+	room, ok := rr.rooms[name]
+	return ok && room.Encrypted
+}
+
+// checkCiphertext validates a message for an encrypted room: base64
+// ciphertext and the ID of the key it was sealed with, which members
+// exchange among themselves, and nothing in plaintext. Content type and
+// language belong inside the ciphertext too.
+func checkCiphertext(chat *Chat) error {
+	if chat.Ciphertext == "" || chat.KeyID == "" {
+		return fmt.Errorf("%w: send ciphertext and key_id instead of message", errRoomEncrypted)
+	}
+	if chat.Message != "" || chat.ContentType != "" || chat.Language != "" || chat.Attachment != nil {
+		return fmt.Errorf("%w: message, content_type, language and attachments can't be sent in plaintext", errRoomEncrypted)
+	}
+	if !keyIDPattern.MatchString(chat.KeyID) {
+		return fmt.Errorf("%w: key_id must be 1-64 letters, digits, '.', '_', ':' or '-'", errInvalidRequest)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(chat.Ciphertext)
+	if err != nil {
+		return fmt.Errorf("%w: ciphertext must be standard base64", errInvalidRequest)
+	}
+	if len(ciphertext) > maxCiphertextSize {
+		return fmt.Errorf("%w: ciphertext is limited to %d bytes", errInvalidRequest, maxCiphertextSize)
+	}
+	return nil
+}
+
+// payload is what identifies the content of chat for duplicate and spam
+// checks, which don't need to read it.
+func (chat Chat) payload() string {
+	return cmp.Or(chat.Message, chat.Ciphertext)
+}
+
+type encryptionRequest struct {
+	Encrypted bool `json:"encrypted"`
+}
+
+// setEncryptionHandler turns end-to-end encryption on or off for a room. Only
+// its owner can, and not while webhooks post plaintext into it. While on,
+// the room's moderation policy, link previews and custom emoji are not
+// applied, as they would need to read messages.
+func setEncryptionHandler(rooms *roomRegistry, webhooks *webhookRegistry, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("room")
+		user := userFromRequest(r)
+		if !rooms.IsOwner(name, user) {
+			writeError(w, r, fmt.Errorf("%w: only the room owner can change encryption", errForbidden))
+			return
+		}
+
+		req := encryptionRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+		if req.Encrypted && len(webhooks.List(name)) > 0 {
+			writeError(w, r, fmt.Errorf("%w: remove the room's webhooks first", errRoomEncrypted))
+			return
+		}
+		room, err := rooms.SetEncrypted(name, req.Encrypted)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record(user, "room.encryption", name, strconv.FormatBool(room.Encrypted))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(room)
+	}
+}
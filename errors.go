@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrorResponse is the body of every non-2xx response.
+type ErrorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Details   any    `json:"details,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+var (
+	errInvalidRequest       = errors.New("invalid request")
+	errUnauthenticated      = errors.New("authentication required")
+	errUnauthorized         = errors.New("invalid credentials")
+	errForbidden            = errors.New("forbidden")
+	errNotMember            = errors.New("not a member of this room")
+	errSystemRoom           = errors.New("system rooms are reserved")
+	errMessageNotFound      = errors.New("message not found")
+	errAdminDisabled        = errors.New("admin API disabled")
+	errStreamingUnsupported = errors.New("streaming unsupported")
+)
+
+// errorStatuses maps sentinel errors to their HTTP status and error code. The
+// first match wins, so more specific errors go first.
+var errorStatuses = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{errInvalidRequest, http.StatusBadRequest, "invalid_request"},
+	{errUnsupportedVersion, http.StatusBadRequest, "unsupported_api_version"},
+	{errRoomMode, http.StatusBadRequest, "invalid_room_mode"},
+	{errInvalidPolicy, http.StatusBadRequest, "invalid_policy"},
+	{errInviteInvalid, http.StatusBadRequest, "invite_invalid"},
+	{errGuestInvalid, http.StatusBadRequest, "guest_invalid"},
+	{errInvalidConfig, http.StatusUnprocessableEntity, "invalid_config"},
+	{errUnauthenticated, http.StatusUnauthorized, "unauthenticated"},
+	{errUnauthorized, http.StatusUnauthorized, "unauthorized"},
+	{errAuthExpired, http.StatusUnauthorized, "auth_expired"},
+	{errSignatureInvalid, http.StatusUnauthorized, "signature_invalid"},
+	{errSignatureExpired, http.StatusUnauthorized, "signature_expired"},
+	{errSignatureReplayed, http.StatusUnauthorized, "signature_replayed"},
+	{errNotMember, http.StatusForbidden, "not_member"},
+	{errSystemRoom, http.StatusForbidden, "system_room"},
+	{errRoomReadOnly, http.StatusForbidden, "room_read_only"},
+	{errBanned, http.StatusForbidden, "banned"},
+	{errForbidden, http.StatusForbidden, "forbidden"},
+	{errRoomNotFound, http.StatusNotFound, "room_not_found"},
+	{errMessageNotFound, http.StatusNotFound, "message_not_found"},
+	{errAdminDisabled, http.StatusNotFound, "admin_disabled"},
+	{errAttachmentNotFound, http.StatusNotFound, "attachment_not_found"},
+	{errBlobNotFound, http.StatusNotFound, "blob_not_found"},
+	{errStoreDisabled, http.StatusNotFound, "store_disabled"},
+	{errSubscriberNotFound, http.StatusNotFound, "subscriber_not_found"},
+	{errWebhookNotFound, http.StatusNotFound, "webhook_not_found"},
+	{errAPIKeyNotFound, http.StatusNotFound, "api_key_not_found"},
+	{errAPIKeyScope, http.StatusForbidden, "insufficient_scope"},
+	{errEmojiNotFound, http.StatusNotFound, "emoji_not_found"},
+	{errActionNotFound, http.StatusNotFound, "action_not_found"},
+	{errComponentNotFound, http.StatusNotFound, "component_not_found"},
+	{errReloadDisabled, http.StatusNotFound, "reload_disabled"},
+	{errSelfTestDisabled, http.StatusNotFound, "selftest_disabled"},
+	{errRelayDisabled, http.StatusNotFound, "relay_disabled"},
+	{errFederationDisabled, http.StatusNotFound, "federation_disabled"},
+	{errDeliveryLogDisabled, http.StatusNotFound, "delivery_log_disabled"},
+	{errFeatureDisabled, http.StatusNotFound, "feature_disabled"},
+	{errRoomExists, http.StatusConflict, "room_exists"},
+	{errGuestLinked, http.StatusConflict, "guest_linked"},
+	{errRoomFull, http.StatusConflict, "room_full"},
+	{errRoomEncrypted, http.StatusConflict, "room_encrypted"},
+	{errEmojiLimit, http.StatusConflict, "emoji_limit"},
+	{errPollClosed, http.StatusConflict, "poll_closed"},
+	{errInviteExpired, http.StatusGone, "invite_expired"},
+	{errInviteUsed, http.StatusGone, "invite_used"},
+	{errMessageRejected, http.StatusUnprocessableEntity, "message_rejected"},
+	{errWebhookPayload, http.StatusUnprocessableEntity, "webhook_payload"},
+	{errAttachmentTooLarge, http.StatusRequestEntityTooLarge, "attachment_too_large"},
+	{errAttachmentType, http.StatusUnsupportedMediaType, "attachment_unsupported"},
+	{errStreamingUnsupported, http.StatusInternalServerError, "streaming_unsupported"},
+	{errRelayUpstream, http.StatusBadGateway, "relay_upstream"},
+	{errActionFailed, http.StatusBadGateway, "action_failed"},
+	{errRateLimited, http.StatusTooManyRequests, "rate_limited"},
+	{errSaturated, http.StatusServiceUnavailable, "saturated"},
+	{errShuttingDown, http.StatusServiceUnavailable, "shutting_down"},
+	{errShedding, http.StatusServiceUnavailable, "shedding_load"},
+	{errStreamAdmission, http.StatusServiceUnavailable, "stream_admission"},
+	{errStreamBinding, http.StatusForbidden, "stream_binding"},
+	{errCaptchaFailed, http.StatusForbidden, "captcha_failed"},
+	{errChallengeRequired, http.StatusForbidden, "challenge_required"},
+	{errChallengeUnavailable, http.StatusServiceUnavailable, "challenge_unavailable"},
+	{errRoomTemplateNotFound, http.StatusNotFound, "room_template_not_found"},
+	{errHandoffToken, http.StatusGone, "handoff_token_invalid"},
+	{errStandby, http.StatusServiceUnavailable, "standby"},
+	{errUnknownCodec, http.StatusServiceUnavailable, "unknown_codec"},
+	{errBrokenSequence, http.StatusConflict, "broken_sequence"},
+}
+
+type detailedError struct {
+	err     error
+	details any
+}
+
+func (e *detailedError) Error() string { return e.err.Error() }
+func (e *detailedError) Unwrap() error { return e.err }
+
+// withDetails attaches machine-readable details to err for the response body.
+func withDetails(err error, details any) error {
+	return &detailedError{err: err, details: details}
+}
+
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryAfterError) Error() string { return e.err.Error() }
+func (e *retryAfterError) Unwrap() error { return e.err }
+
+// withRetryAfter tells the client, through a Retry-After header, when to try
+// again.
+func withRetryAfter(err error, after time.Duration) error {
+	return &retryAfterError{err: err, after: after}
+}
+
+func invalidJSON(err error) error {
+	return withDetails(fmt.Errorf("%w: malformed JSON body", errInvalidRequest), err.Error())
+}
+
+// errorResponse maps err onto its status and response body.
+func errorResponse(r *http.Request, err error) (int, ErrorResponse) {
+	resp := ErrorResponse{
+		Code:      "internal_error",
+		Message:   "internal error",
+		RequestID: requestIDFrom(r.Context()),
+	}
+	status := 0
+
+	for _, s := range errorStatuses {
+		if errors.Is(err, s.err) {
+			status, resp.Code, resp.Message = s.status, s.code, err.Error()
+			break
+		}
+	}
+	if status == 0 {
+		status = http.StatusInternalServerError
+		log.Printf("Request %s failed: %v", resp.RequestID, err)
+	}
+
+	var detailed *detailedError
+	if errors.As(err, &detailed) {
+		resp.Details = detailed.details
+	}
+	return status, resp
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status, resp := errorResponse(r, err)
+	var retry *retryAfterError
+	if errors.As(err, &retry) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.after.Seconds()))))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+type requestIDKey struct{}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestIDMiddleware tags every request with an ID, reusing the caller's
+// X-Request-ID when present, and echoes it back in the response headers.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 128 {
+			raw := make([]byte, 8)
+			rand.Read(raw)
+			id = hex.EncodeToString(raw)
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
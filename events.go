@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+const maxEventSize = 64 << 10
+
+// reservedEvents are the event names the server emits itself. Only admins
+// may publish them, so clients can trust what they mean.
+var reservedEvents = []string{
+	"message",
+	"subscribed",
+	"announcement",
+	"queue-position",
+	"preview",
+	authEvent,
+	emojiEvent,
+	shutdownEvent,
+	metaEvent,
+	overflowEvent,
+	presenceEvent,
+	defaultGroupEvent,
+	filterEvent,
+	policyEvent,
+	lifecycleEvent,
+	sheddingEvent,
+	channelAckEvent,
+	expiredEvent,
+	welcomeEvent,
+	handoffEvent,
+}
+
+var publishedEvents = newCounterVec("chat_custom_events_total", "Events published through /events/publish by result.", "result")
+
+type eventPublishRequest struct {
+	Room  string          `json:"room"`
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// publishEventHandler publishes an application-defined event into a room.
+// Subscribers get it like any other event of the room, under its own name;
+// the data is passed through as is. Signed-in users need to be allowed to
+// send into the room; the admin token can publish anywhere.
+func publishEventHandler(adminToken string, broker *Broker, rooms *roomRegistry) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin := isAdmin(adminToken, r)
+		user := userFromRequest(r)
+		if user == "" && !admin {
+			writeError(w, r, errUnauthenticated)
+			return
+		}
+
+		req := eventPublishRequest{}
+		r.Body = http.MaxBytesReader(w, r.Body, maxEventSize)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+		if req.Room == "" {
+			writeError(w, r, fmt.Errorf("%w: room required", errInvalidRequest))
+			return
+		}
+		if len(req.Data) == 0 {
+			writeError(w, r, fmt.Errorf("%w: data required", errInvalidRequest))
+			return
+		}
+		if !eventNamePattern.MatchString(req.Event) {
+			writeError(w, r, fmt.Errorf("%w: invalid event name %q", errInvalidRequest, req.Event))
+			return
+		}
+		if slices.Contains(reservedEvents, req.Event) && !admin {
+			writeError(w, r, fmt.Errorf("%w: event %q is reserved", errForbidden, req.Event))
+			return
+		}
+		if !admin {
+			if err := rooms.CheckPublish(req.Room, user); err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+		if err := broker.Admit(); err != nil {
+			publishedEvents.With("saturated").Add(1)
+			writeError(w, r, err)
+			return
+		}
+
+		env, err := broker.PublishEvent(req.Room, req.Event, req.Data)
+		if err != nil {
+			publishedEvents.With("error").Add(1)
+			writeError(w, r, err)
+			return
+		}
+		publishedEvents.With("ok").Add(1)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(env)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+const (
+	featureUploads       = "uploads"
+	featureForwarding    = "forwarding"
+	featureInvites       = "invites"
+	featurePresence      = "presence"
+	featurePreferences   = "preferences"
+	featureSubscriptions = "subscriptions"
+	featurePreviews      = "previews"
+	featureWebhooks      = "webhooks"
+	featureEmoji         = "emoji"
+	featureComponents    = "components"
+	featureDuplex        = "duplex"
+	featureAdminUI       = "admin_ui"
+)
+
+// knownFeatures are the subsystems a deployment can switch on and off. All of
+// them are on unless disabled by -disable-features or the config file, except
+// experimental ones, which are off until enabled there or by
+// -enable-features.
+var knownFeatures = []string{
+	featureUploads,
+	featureForwarding,
+	featureInvites,
+	featurePresence,
+	featurePreferences,
+	featureSubscriptions,
+	featurePreviews,
+	featureWebhooks,
+	featureEmoji,
+	featureComponents,
+	featureDuplex,
+	featureAdminUI,
+}
+
+var experimentalFeatures = []string{featureDuplex}
+
+var errFeatureDisabled = errors.New("feature disabled")
+
+// featureSet tracks which subsystems are enabled.
+type featureSet struct {
+	mu      sync.RWMutex
+	enabled map[string]bool
+}
+
+func newFeatureSet() *featureSet {
+	f := &featureSet{enabled: make(map[string]bool, len(knownFeatures))}
+	for _, name := range knownFeatures {
+		f.enabled[name] = !slices.Contains(experimentalFeatures, name)
+	}
+	return f
+}
+
+func validateFeatures(overrides map[string]bool) error {
+	for name := range overrides {
+		if !slices.Contains(knownFeatures, name) {
+			return fmt.Errorf("%w: unknown feature %q", errInvalidConfig, name)
+		}
+	}
+	return nil
+}
+
+// Set applies overrides to the defaults: every known feature but the
+// experimental ones enabled.
+func (f *featureSet) Set(overrides map[string]bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, name := range knownFeatures {
+		enabled, ok := overrides[name]
+		if !ok {
+			enabled = !slices.Contains(experimentalFeatures, name)
+		}
+		f.enabled[name] = enabled
+	}
+}
+
+func (f *featureSet) Enabled(name string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.enabled[name]
+}
+
+func (f *featureSet) Snapshot() map[string]bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return maps.Clone(f.enabled)
+}
+
+// featureGate answers 404 feature_disabled while name is switched off.
+func featureGate(features *featureSet, name string, next func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !features.Enabled(name) {
+			writeError(w, r, withDetails(errFeatureDisabled, map[string]string{"feature": name}))
+			return
+		}
+		next(w, r)
+	}
+}
+
+type Capabilities struct {
+	Features    map[string]bool `json:"features"`
+	Limits      map[string]int  `json:"limits"`
+	APIVersions []APIVersion    `json:"api_versions"`
+}
+
+// capabilitiesHandler tells clients what this deployment supports so they
+// can hide the UI for what it doesn't.
+func capabilitiesHandler(features *featureSet, presence *presenceTracker, previews bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		enabled := features.Snapshot()
+		enabled[featurePreviews] = enabled[featurePreviews] && previews
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Capabilities{
+			Features: enabled,
+			Limits: map[string]int{
+				"max_stream_rooms":       maxStreamRooms,
+				"max_image_bytes":        maxImageSize,
+				"max_ciphertext_bytes":   maxCiphertextSize,
+				"max_metadata_keys":      maxMetadataKeys,
+				"max_metadata_bytes":     maxMetadataBytes,
+				"max_voice_note_bytes":   maxVoiceNoteSize,
+				"max_voice_note_seconds": int(maxVoiceNoteLength.Seconds()),
+				"heartbeat_interval_ms":  int((presence.Idle() / 2).Milliseconds()),
+			},
+			APIVersions: apiVersions,
+		})
+	}
+}
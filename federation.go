@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	federationPath      = "/federation/v1/events"
+	federationQueueSize = 1024
+	federationBatchSize = 100
+	maxFederationBody   = 4 << 20
+	// federationSeenSize is how many received event IDs are remembered to
+	// absorb a peer's retries.
+	federationSeenSize = 10000
+	federationTimeout  = 10 * time.Second
+	minFederationRetry = time.Second
+	maxFederationRetry = 30 * time.Second
+	minPeerSecret      = 32
+)
+
+var serverNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{0,252}$`)
+
+var errFederationDisabled = errors.New("federation disabled; start the server with -federation-name")
+
+var (
+	federatedEvents  = newCounterVec("chat_federation_events_total", "Events exchanged with federated servers, by peer, direction and result.", "peer", "direction", "result")
+	federationClient = &http.Client{Timeout: federationTimeout}
+)
+
+// FederationPeer is another deployment this one shares rooms with, from the
+// config file. Both list each other with the same secret and sign what they
+// send with it, so each end authenticates the other. Only Rooms are shared,
+// and a room is only really shared if both list it.
+type FederationPeer struct {
+	Name   string   `json:"name"`
+	URL    string   `json:"url"`
+	Secret string   `json:"secret,omitempty"`
+	Rooms  []string `json:"rooms"`
+}
+
+func validatePeers(peers []FederationPeer) error {
+	names := map[string]bool{}
+	for _, peer := range peers {
+		if !serverNamePattern.MatchString(peer.Name) || names[peer.Name] {
+			return fmt.Errorf("%w: federation peer names must be unique lowercase host names, not %q", errInvalidConfig, peer.Name)
+		}
+		names[peer.Name] = true
+		if u, err := url.Parse(peer.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%w: url of federation peer %s must be an absolute http or https URL", errInvalidConfig, peer.Name)
+		}
+		if len(peer.Secret) < minPeerSecret {
+			return fmt.Errorf("%w: secret of federation peer %s must be at least %d characters", errInvalidConfig, peer.Name, minPeerSecret)
+		}
+		if len(peer.Rooms) == 0 {
+			return fmt.Errorf("%w: federation peer %s shares no rooms", errInvalidConfig, peer.Name)
+		}
+	}
+	return nil
+}
+
+// federatedEvent is a room envelope as it travels between servers. ID is
+// the envelope's ID on its origin.
+type federatedEvent struct {
+	ID     string          `json:"id"`
+	Room   string          `json:"room"`
+	Event  string          `json:"event,omitempty"`
+	Time   time.Time       `json:"time"`
+	SentAt *time.Time      `json:"sent_at,omitempty"`
+	Data   json.RawMessage `json:"data"`
+}
+
+type federationBatch struct {
+	Origin string           `json:"origin"`
+	Events []federatedEvent `json:"events"`
+}
+
+type federationReceipt struct {
+	Accepted   int `json:"accepted"`
+	Duplicates int `json:"duplicates"`
+	Refused    int `json:"refused"`
+}
+
+// federationLink sends this server's events in the peer's rooms to it, in
+// batches, retrying a failed batch until it goes through.
+type federationLink struct {
+	peer  FederationPeer
+	queue chan federatedEvent
+	stop  chan struct{}
+
+	mu        sync.Mutex
+	lastError string
+	lastSent  time.Time
+}
+
+// PeerStatus is how a link to a peer is doing.
+type PeerStatus struct {
+	FederationPeer
+	Queued    int       `json:"queued"`
+	LastSent  time.Time `json:"last_sent,omitzero"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// federation relays chat messages and presence of shared rooms between this
+// server and its peers. Only envelopes that started here go out, so an
+// event never comes back to where it came from however the peers are
+// connected; what comes in is published with its origin in the envelope
+// and its senders qualified as user@origin. It should run on one node of a
+// deployment, which every envelope reaches.
+type federation struct {
+	name   string
+	broker *Broker
+	rooms  *roomRegistry
+	skew   time.Duration
+
+	mu    sync.RWMutex
+	links map[string]*federationLink
+
+	seenMu    sync.Mutex
+	seen      map[string]bool
+	seenOrder []string
+	nonces    map[string]time.Time
+	swept     time.Time
+}
+
+func newFederation(name string, broker *Broker, rooms *roomRegistry, skew time.Duration) *federation {
+	return &federation{
+		name:   name,
+		broker: broker,
+		rooms:  rooms,
+		skew:   skew,
+		links:  make(map[string]*federationLink),
+		seen:   make(map[string]bool),
+		nonces: make(map[string]time.Time),
+	}
+}
+
+// SetPeers replaces the peers. Links whose peer didn't change keep their
+// queue; the rest are restarted.
+func (f *federation) SetPeers(peers []FederationPeer) {
+	if f == nil {
+		if len(peers) > 0 {
+			log.Printf("Federation: %d peers configured but no -federation-name; ignoring them", len(peers))
+		}
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	next := make(map[string]*federationLink, len(peers))
+	for _, peer := range peers {
+		if link, ok := f.links[peer.Name]; ok && link.peer.URL == peer.URL && link.peer.Secret == peer.Secret && slices.Equal(link.peer.Rooms, peer.Rooms) {
+			next[peer.Name] = link
+			continue
+		}
+		link := &federationLink{peer: peer, queue: make(chan federatedEvent, federationQueueSize), stop: make(chan struct{})}
+		go f.run(link)
+		next[peer.Name] = link
+	}
+	for name, link := range f.links {
+		if next[name] != link {
+			close(link.stop)
+		}
+	}
+	f.links = next
+}
+
+// Observe queues every chat message and presence change of a shared room
+// that started on this server for the peers sharing it.
+func (f *federation) Observe(env Envelope) {
+	if env.Origin != "" || env.Room == "" || (env.Event != "" && env.Event != presenceEvent) {
+		return
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for name, link := range f.links {
+		if !slices.Contains(link.peer.Rooms, env.Room) {
+			continue
+		}
+		select {
+		case link.queue <- federatedEvent{ID: env.ID, Room: env.Room, Event: env.Event, Time: env.Time, SentAt: env.SentAt, Data: env.Data}:
+		default:
+			federatedEvents.With(name, "out", "dropped").Add(1)
+		}
+	}
+}
+
+func (f *federation) run(link *federationLink) {
+	for {
+		var batch []federatedEvent
+		select {
+		case <-link.stop:
+			return
+		case e := <-link.queue:
+			batch = append(batch, e)
+		}
+	collect:
+		for len(batch) < federationBatchSize {
+			select {
+			case e := <-link.queue:
+				batch = append(batch, e)
+			default:
+				break collect
+			}
+		}
+
+		for delay := minFederationRetry; ; delay = min(2*delay, maxFederationRetry) {
+			err := f.send(link.peer, batch)
+			link.mu.Lock()
+			if err == nil {
+				link.lastError, link.lastSent = "", time.Now().UTC()
+			} else {
+				link.lastError = err.Error()
+			}
+			link.mu.Unlock()
+			if err == nil {
+				federatedEvents.With(link.peer.Name, "out", "sent").Add(uint64(len(batch)))
+				break
+			}
+			log.Printf("Federation: sending %d events to %s: %v", len(batch), link.peer.Name, err)
+			select {
+			case <-link.stop:
+				return
+			case <-time.After(delay/2 + rand.N(delay/2)):
+			}
+		}
+	}
+}
+
+func (f *federation) send(peer FederationPeer, events []federatedEvent) error {
+	body, err := json.Marshal(federationBatch{Origin: f.name, Events: events})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(peer.URL, "/")+federationPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	nonce, err := newAttachmentID()
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Federation-Origin", f.name)
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Nonce", nonce)
+	req.Header.Set("X-Signature", requestSignature([]byte(peer.Secret), http.MethodPost, federationPath, timestamp, nonce, body))
+
+	resp, err := federationClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxFederationBody))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", peer.Name, resp.Status)
+	}
+	return nil
+}
+
+// authenticate returns the peer that signed r, whose body is body.
+func (f *federation) authenticate(r *http.Request, body []byte) (FederationPeer, error) {
+	f.mu.RLock()
+	link, ok := f.links[r.Header.Get("X-Federation-Origin")]
+	f.mu.RUnlock()
+	if !ok {
+		return FederationPeer{}, errSignatureInvalid
+	}
+	peer := link.peer
+
+	timestamp, nonce := r.Header.Get("X-Timestamp"), r.Header.Get("X-Nonce")
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(nonce) < 16 || len(nonce) > 128 {
+		return FederationPeer{}, errSignatureInvalid
+	}
+	now := time.Now()
+	if skew := now.Sub(time.Unix(unix, 0)); skew > f.skew || skew < -f.skew {
+		return FederationPeer{}, withDetails(errSignatureExpired, map[string]int64{"server_time": now.Unix()})
+	}
+	expected := requestSignature([]byte(peer.Secret), http.MethodPost, federationPath, timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(r.Header.Get("X-Signature")))) {
+		return FederationPeer{}, errSignatureInvalid
+	}
+
+	f.seenMu.Lock()
+	defer f.seenMu.Unlock()
+	if now.Sub(f.swept) > f.skew {
+		for seen, expires := range f.nonces {
+			if now.After(expires) {
+				delete(f.nonces, seen)
+			}
+		}
+		f.swept = now
+	}
+	if _, seen := f.nonces[peer.Name+":"+nonce]; seen {
+		return FederationPeer{}, errSignatureReplayed
+	}
+	f.nonces[peer.Name+":"+nonce] = now.Add(2 * f.skew)
+	return peer, nil
+}
+
+func (f *federation) received(key string) bool {
+	f.seenMu.Lock()
+	defer f.seenMu.Unlock()
+	return f.seen[key]
+}
+
+func (f *federation) remember(key string) {
+	f.seenMu.Lock()
+	defer f.seenMu.Unlock()
+	if len(f.seenOrder) >= federationSeenSize {
+		delete(f.seen, f.seenOrder[0])
+		f.seenOrder = f.seenOrder[1:]
+	}
+	f.seen[key] = true
+	f.seenOrder = append(f.seenOrder, key)
+}
+
+// accept publishes one event from peer. It reports false for events refused
+// rather than failed, which the peer shouldn't retry.
+func (f *federation) accept(peer FederationPeer, e federatedEvent) (bool, error) {
+	if !slices.Contains(peer.Rooms, e.Room) {
+		return false, nil
+	}
+	remote := func(user string) string { return user + "@" + peer.Name }
+
+	var data []byte
+	var err error
+	switch e.Event {
+	case "":
+		chat := Chat{}
+		if json.Unmarshal(e.Data, &chat) != nil || chat.UserID == "" {
+			return false, nil
+		}
+		// Polls and buttons only work on the server that has their votes
+		// and actions.
+		chat.Room, chat.UserID, chat.Poll, chat.Components = e.Room, remote(chat.UserID), nil, nil
+		if err := f.rooms.Moderate(e.Room, &chat); err != nil {
+			return false, nil
+		}
+		data, err = json.Marshal(chat)
+	case presenceEvent:
+		presence := Presence{}
+		if json.Unmarshal(e.Data, &presence) != nil || presence.UserID == "" {
+			return false, nil
+		}
+		presence.UserID = remote(presence.UserID)
+		data, err = json.Marshal(presence)
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	sentAt := e.SentAt
+	if sentAt == nil {
+		sentAt = &e.Time
+	}
+	_, err = f.broker.PublishFrom(e.Room, e.Event, data, sentAt, peer.Name)
+	return err == nil, err
+}
+
+func (f *federation) Status() []PeerStatus {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	statuses := make([]PeerStatus, 0, len(f.links))
+	for _, link := range f.links {
+		link.mu.Lock()
+		status := PeerStatus{FederationPeer: link.peer, Queued: len(link.queue), LastSent: link.lastSent, LastError: link.lastError}
+		link.mu.Unlock()
+		status.Secret = ""
+		statuses = append(statuses, status)
+	}
+	slices.SortFunc(statuses, func(a, b PeerStatus) int { return strings.Compare(a.Name, b.Name) })
+	return statuses
+}
+
+// receiveFederationHandler takes a signed batch of events from a peer.
+// Events are published in order; if one fails the batch is answered with
+// the error for the peer to retry, and the events already published are
+// recognised as duplicates then.
+func receiveFederationHandler(f *federation) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if f == nil {
+			writeError(w, r, errFederationDisabled)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxFederationBody))
+		if err != nil {
+			writeError(w, r, fmt.Errorf("%w: body is limited to %d bytes", errInvalidRequest, maxFederationBody))
+			return
+		}
+		peer, err := f.authenticate(r, body)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		batch := federationBatch{}
+		if err := json.Unmarshal(body, &batch); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+		if batch.Origin != peer.Name {
+			writeError(w, r, fmt.Errorf("%w: origin must be the signing peer", errInvalidRequest))
+			return
+		}
+
+		receipt := federationReceipt{}
+		for _, e := range batch.Events {
+			key := peer.Name + "/" + e.ID
+			if f.received(key) {
+				receipt.Duplicates++
+				federatedEvents.With(peer.Name, "in", "duplicate").Add(1)
+				continue
+			}
+			ok, err := f.accept(peer, e)
+			if err != nil {
+				federatedEvents.With(peer.Name, "in", "failed").Add(1)
+				writeError(w, r, err)
+				return
+			}
+			f.remember(key)
+			if !ok {
+				receipt.Refused++
+				federatedEvents.With(peer.Name, "in", "refused").Add(1)
+				continue
+			}
+			receipt.Accepted++
+			federatedEvents.With(peer.Name, "in", "accepted").Add(1)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(receipt)
+	}
+}
+
+func federationStatusHandler(f *federation) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if f == nil {
+			writeError(w, r, errFederationDisabled)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"name": f.name, "peers": f.Status()})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	feedbackMaxBody    = 16 << 10
+	feedbackMaxMessage = 4000
+	feedbackVia        = "feedback"
+
+	// feedbackSender is who messages left without a user appear to be from.
+	feedbackSender = "anonymous"
+)
+
+var feedbackMessages = newCounterVec("chat_feedback_messages_total", "Messages left in feedback rooms by result.", "result")
+
+type feedbackRequest struct {
+	Message      string            `json:"message"`
+	Metadata     map[string]string `json:"metadata"`
+	CaptchaToken string            `json:"captcha_token"`
+}
+
+// feedbackHandler takes a message for a feedback room from anyone, the way a
+// support widget would send it: signed in or not, member or not. Senders
+// can't read the room, so they never see who else wrote in. Every address
+// gets a small allowance from limiter, and with a captcha configured every
+// message needs a solved one.
+func feedbackHandler(broker *Broker, rooms *roomRegistry, limiter *anonymousLimiter, captcha captchaVerifier) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room := r.PathValue("room")
+		if !rooms.TakesFeedback(room) {
+			writeError(w, r, fmt.Errorf("%w: room doesn't take feedback", errForbidden))
+			return
+		}
+		if ok, wait := limiter.Allow(clientAddress(r)); !ok {
+			feedbackMessages.With("rate_limited").Add(1)
+			writeError(w, r, withRetryAfter(errRateLimited, wait))
+			return
+		}
+		if err := broker.Admit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		req := feedbackRequest{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, feedbackMaxBody)).Decode(&req); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+		message := strings.TrimSpace(req.Message)
+		if message == "" {
+			writeError(w, r, fmt.Errorf("%w: message required", errInvalidRequest))
+			return
+		}
+		if len(message) > feedbackMaxMessage {
+			writeError(w, r, fmt.Errorf("%w: message is limited to %d bytes", errInvalidRequest, feedbackMaxMessage))
+			return
+		}
+		if captcha != nil {
+			if err := captcha.Verify(r.Context(), req.CaptchaToken, clientAddress(r)); err != nil {
+				feedbackMessages.With("captcha_failed").Add(1)
+				writeError(w, r, err)
+				return
+			}
+		}
+
+		sender := userFromRequest(r)
+		if sender == "" {
+			sender = feedbackSender
+		}
+		chat := Chat{Room: room, UserID: sender, Message: message, Metadata: req.Metadata, Via: feedbackVia}
+		if err := rooms.Moderate(room, &chat); err != nil {
+			feedbackMessages.With("rejected").Add(1)
+			writeError(w, r, err)
+			return
+		}
+		chatRaw, err := json.Marshal(chat)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		env, err := broker.Publish(room, chatRaw)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		feedbackMessages.With("published").Add(1)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"id": env.ID})
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync/atomic"
+)
+
+const maxFlowWindow = 10000
+
+var flowStalls = newCounter("chat_stream_window_stalls_total", "Times a flow-controlled stream held back a room because its window was full or its buffer overflowed.")
+
+// flowWindow is the credit of a stream opened with ?window=N: at most N room
+// events go out that the client hasn't acknowledged through
+// POST /chat/subscriptions/{id}/ack.
+type flowWindow struct {
+	size   uint64
+	sent   atomic.Uint64
+	acked  atomic.Uint64
+	credit chan struct{}
+}
+
+func newFlowWindow(size uint64) *flowWindow {
+	return &flowWindow{size: size, credit: make(chan struct{}, 1)}
+}
+
+// windowFrom reads the window parameter of a stream request, 0 without one.
+func windowFrom(r *http.Request) (uint64, error) {
+	raw := r.URL.Query().Get("window")
+	if raw == "" {
+		return 0, nil
+	}
+	size, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil || size < 1 || size > maxFlowWindow {
+		return 0, fmt.Errorf("%w: window must be 1 to %d events", errInvalidRequest, maxFlowWindow)
+	}
+	return size, nil
+}
+
+func (fw *flowWindow) Outstanding() uint64 {
+	return fw.sent.Load() - fw.acked.Load()
+}
+
+func (fw *flowWindow) Open() bool {
+	return fw.Outstanding() < fw.size
+}
+
+// Ack acknowledges n more events, never more than were sent, and returns
+// how many are still outstanding.
+func (fw *flowWindow) Ack(n uint64) uint64 {
+	for {
+		acked, sent := fw.acked.Load(), fw.sent.Load()
+		next := min(acked+n, sent)
+		if fw.acked.CompareAndSwap(acked, next) {
+			select {
+			case fw.credit <- struct{}{}:
+			default:
+			}
+			return sent - next
+		}
+	}
+}
+
+// streamFlow is the flow control of one stream. Room events that arrive
+// while the window is full aren't queued: the room is marked behind and
+// caught up from history once acks open the window again, so a stream holds
+// no more than its window however far its client falls back.
+type streamFlow struct {
+	window  *flowWindow
+	behind  map[string]bool
+	dropped uint64
+}
+
+func newStreamFlow(size uint64) *streamFlow {
+	if size == 0 {
+		return nil
+	}
+	return &streamFlow{window: newFlowWindow(size), behind: map[string]bool{}}
+}
+
+// Credit fires when acks arrive; it never does without flow control.
+func (f *streamFlow) Credit() <-chan struct{} {
+	if f == nil {
+		return nil
+	}
+	return f.window.credit
+}
+
+func (f *streamFlow) Sent() {
+	if f != nil {
+		f.window.sent.Add(1)
+	}
+}
+
+// hold reports whether env, a room event, is held back rather than written.
+// An overflow of the subscriber's buffer puts every room behind, since the
+// events it lost are in history.
+func (f *streamFlow) hold(env Envelope, subscriber *Subscriber, lastSeqs map[string]uint64) bool {
+	if f == nil {
+		return false
+	}
+	if dropped := subscriber.Dropped.Load(); dropped != f.dropped {
+		f.dropped = dropped
+		for room := range lastSeqs {
+			f.behind[room] = true
+		}
+		flowStalls.Inc()
+	}
+	if f.behind[env.Room] || !f.window.Open() {
+		if !f.behind[env.Room] {
+			flowStalls.Inc()
+		}
+		if _, ok := lastSeqs[env.Room]; !ok {
+			lastSeqs[env.Room] = env.Seq - 1
+		}
+		f.behind[env.Room] = true
+		return true
+	}
+	return false
+}
+
+// catchUp writes what rooms behind missed, from history, while the window
+// stays open. A room history no longer reaches back for gets an overflow
+// event and carries on from its head.
+func (f *streamFlow) catchUp(w http.ResponseWriter, r *http.Request, broker *Broker, subscriber *Subscriber, lastSeqs map[string]uint64) {
+	if f == nil {
+		return
+	}
+	joined := broker.RoomsOf(subscriber.ID)
+	for room := range f.behind {
+		if !slices.Contains(joined, room) {
+			delete(f.behind, room)
+			continue
+		}
+		backlog := broker.Replay(room, lastSeqs[room])
+		if overflow, ok := checkBacklog(r, room, lastSeqs[room], backlog, 0); ok {
+			writeEnvelope(w, overflow)
+			lastSeqs[room] = backlog[len(backlog)-1].Seq
+			delete(f.behind, room)
+			continue
+		}
+		caughtUp := true
+		for _, env := range backlog {
+			if !f.window.Open() {
+				caughtUp = false
+				break
+			}
+			lastSeqs[room] = env.Seq
+			if reason := subscriber.rejects(env); reason != "" {
+				broker.RecordDelivery(subscriber, env, deliveryFiltered, reason)
+				continue
+			}
+			writeEnvelope(w, env)
+			broker.RecordDelivery(subscriber, env, deliveryReplayed, "")
+			f.Sent()
+		}
+		if caughtUp {
+			delete(f.behind, room)
+		}
+	}
+}
+
+type ackRequest struct {
+	Count uint64 `json:"count"`
+}
+
+type ackResponse struct {
+	SubscriberID string `json:"subscriber_id"`
+	Window       uint64 `json:"window"`
+	Outstanding  uint64 `json:"outstanding"`
+}
+
+// ackHandler acknowledges count events of a flow-controlled stream, opening
+// its window by as many.
+func ackHandler(broker *Broker, bindings *streamBindings) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromRequest(r)
+		if user == "" {
+			writeError(w, r, errUnauthenticated)
+			return
+		}
+		subscriber, ok := broker.Lookup(r.PathValue("id"))
+		if !ok || subscriber.User != user {
+			writeError(w, r, errSubscriberNotFound)
+			return
+		}
+		if err := bindings.Verify(r, subscriber); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		window := subscriber.window.Load()
+		if window == nil {
+			writeError(w, r, fmt.Errorf("%w: the stream has no flow control window", errInvalidRequest))
+			return
+		}
+		req := ackRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+		if req.Count == 0 {
+			writeError(w, r, fmt.Errorf("%w: count must be positive", errInvalidRequest))
+			return
+		}
+
+		outstanding := window.Ack(req.Count)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ackResponse{SubscriberID: subscriber.ID, Window: window.size, Outstanding: outstanding})
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Provenance records where a forwarded message was originally posted.
+type Provenance struct {
+	MessageID string    `json:"message_id"`
+	Room      string    `json:"room"`
+	UserID    string    `json:"user_id"`
+	SentAt    time.Time `json:"sent_at"`
+}
+
+func forwardMessageHandler(broker *Broker, rooms *roomRegistry, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromRequest(r)
+		if user == "" {
+			writeError(w, r, errUnauthenticated)
+			return
+		}
+
+		to := r.URL.Query().Get("to")
+		if to == "" {
+			writeError(w, r, fmt.Errorf("%w: destination room required", errInvalidRequest))
+			return
+		}
+
+		env, ok := broker.Message(r.PathValue("id"))
+		if !ok {
+			writeError(w, r, errMessageNotFound)
+			return
+		}
+		if isSystemRoom(env.Room) {
+			writeError(w, r, errSystemRoom)
+			return
+		}
+		if !rooms.CanAccess(env.Room, user) {
+			writeError(w, r, errNotMember)
+			return
+		}
+		if env.Event != "" {
+			writeError(w, r, fmt.Errorf("%w: only chat messages can be forwarded", errInvalidRequest))
+			return
+		}
+		if err := rooms.CheckPublish(to, user); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if err := broker.Admit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		original := Chat{}
+		if err := json.Unmarshal(env.Data, &original); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		provenance := original.ForwardedFrom
+		if provenance == nil {
+			provenance = &Provenance{
+				MessageID: env.ID,
+				Room:      env.Room,
+				UserID:    original.UserID,
+				SentAt:    env.Time,
+			}
+		}
+		forwarded := Chat{
+			Room:          to,
+			UserID:        user,
+			Message:       original.Message,
+			ContentType:   original.ContentType,
+			Language:      original.Language,
+			Ciphertext:    original.Ciphertext,
+			KeyID:         original.KeyID,
+			ForwardedFrom: provenance,
+		}
+		if err := rooms.Moderate(to, &forwarded); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		chatRaw, err := json.Marshal(forwarded)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if _, err := broker.Publish(to, chatRaw); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record(user, "message.forward", to, "from="+env.ID)
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("Message forwarded"))
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+const unknownRegion = "unknown"
+
+var connectionsByRegion = newCounterVec("chat_connections_total", "Streams opened by client region.", "region")
+
+// ConnOrigin is where a connection comes from: the client address and, with
+// a GeoIP database, its country and region.
+type ConnOrigin struct {
+	IP      string `json:"ip,omitempty"`
+	Country string `json:"country,omitempty"`
+	Region  string `json:"region,omitempty"`
+}
+
+// RegionLabel is the region as a metrics label value.
+func (o ConnOrigin) RegionLabel() string {
+	if o.Region == "" {
+		return unknownRegion
+	}
+	return o.Region
+}
+
+type geoEntry struct {
+	country string
+	region  string
+}
+
+// geoDB maps networks to a country and region, loaded from a CSV file of
+// network,country,region lines. Lookups pick the most specific network.
+type geoDB struct {
+	networks map[int]map[netip.Prefix]geoEntry
+}
+
+func loadGeoDB(path string) (*geoDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	db := &geoDB{networks: make(map[int]map[netip.Prefix]geoEntry)}
+	rd := csv.NewReader(f)
+	rd.FieldsPerRecord = 3
+	rd.Comment = '#'
+	for {
+		record, err := rd.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(record[0]))
+		if err != nil {
+			// A header line, most likely.
+			continue
+		}
+		prefix = prefix.Masked()
+		if db.networks[prefix.Bits()] == nil {
+			db.networks[prefix.Bits()] = make(map[netip.Prefix]geoEntry)
+		}
+		db.networks[prefix.Bits()][prefix] = geoEntry{country: strings.TrimSpace(record[1]), region: strings.TrimSpace(record[2])}
+	}
+	return db, nil
+}
+
+func (db *geoDB) Lookup(addr netip.Addr) (geoEntry, bool) {
+	if db == nil || !addr.IsValid() {
+		return geoEntry{}, false
+	}
+	for bits := addr.BitLen(); bits >= 0; bits-- {
+		networks, ok := db.networks[bits]
+		if !ok {
+			continue
+		}
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if entry, ok := networks[prefix]; ok {
+			return entry, true
+		}
+	}
+	return geoEntry{}, false
+}
+
+type originKey struct{}
+
+// originFrom returns the origin originMiddleware attached to ctx.
+func originFrom(ctx context.Context) ConnOrigin {
+	origin, _ := ctx.Value(originKey{}).(ConnOrigin)
+	return origin
+}
+
+// clientAddress is the client IP of r, falling back to the peer address
+// outside originMiddleware.
+func clientAddress(r *http.Request) string {
+	if ip := originFrom(r.Context()).IP; ip != "" {
+		return ip
+	}
+	return remoteHost(r)
+}
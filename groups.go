@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	maxSubscriberGroups = 8
+	defaultGroupEvent   = "notice"
+)
+
+var (
+	groupNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+	eventNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+)
+
+// groupsFromRequest reads the comma-separated groups query parameter a
+// subscriber tags itself with, e.g. ?groups=moderators,ios-clients.
+func groupsFromRequest(r *http.Request) ([]string, error) {
+	raw := r.URL.Query().Get("groups")
+	if raw == "" {
+		return nil, nil
+	}
+
+	groups := strings.Split(raw, ",")
+	if len(groups) > maxSubscriberGroups {
+		return nil, fmt.Errorf("%w: at most %d groups per subscriber", errInvalidRequest, maxSubscriberGroups)
+	}
+	for _, group := range groups {
+		if !groupNamePattern.MatchString(group) {
+			return nil, fmt.Errorf("%w: invalid group name %q", errInvalidRequest, group)
+		}
+	}
+	return groups, nil
+}
+
+type groupPublishRequest struct {
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+func publishToGroupHandler(broker *Broker, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		group := r.PathValue("group")
+		if !groupNamePattern.MatchString(group) {
+			writeError(w, r, fmt.Errorf("%w: invalid group name %q", errInvalidRequest, group))
+			return
+		}
+
+		req := groupPublishRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+		if len(req.Data) == 0 {
+			writeError(w, r, fmt.Errorf("%w: data required", errInvalidRequest))
+			return
+		}
+		if req.Event == "" {
+			req.Event = defaultGroupEvent
+		}
+		if !eventNamePattern.MatchString(req.Event) {
+			writeError(w, r, fmt.Errorf("%w: invalid event name %q", errInvalidRequest, req.Event))
+			return
+		}
+
+		if err := broker.PublishToGroup(group, req.Event, req.Data); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record("admin", "group.publish", "", "group="+group+" event="+req.Event)
+
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("Notice sent"))
+	}
+}
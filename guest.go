@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	guestCookie  = "chat_guest"
+	guestPrefix  = "guest-"
+	guestMaxAge  = 30 * 24 * time.Hour
+	guestContext = "guest:"
+)
+
+var (
+	errGuestInvalid = errors.New("no valid guest identity")
+	errGuestLinked  = errors.New("guest already linked to an account")
+)
+
+// guestAccounts hands out cookie-based guest identities and links them to
+// registered accounts. Guest IDs are signed with the invite secret so nobody
+// can claim another guest's history.
+type guestAccounts struct {
+	signer *inviteSigner
+
+	// mu serialises links so two of them never interleave their steps.
+	mu     sync.Mutex
+	linked map[string]string
+	store  guestLinkStore
+}
+
+// guestLinkStore records a link in one transaction: authorship of the
+// guest's stored messages and its resume tokens pass to the account, the
+// registry's event e is journalled, and the link itself is kept. It returns
+// how many messages changed and the sequence of e.
+type guestLinkStore interface {
+	LinkGuest(ctx context.Context, guest, user string, e RoomEvent) (int, uint64, error)
+}
+
+func newGuestAccounts(signer *inviteSigner) *guestAccounts {
+	return &guestAccounts{signer: signer, linked: make(map[string]string)}
+}
+
+// UseStore records every link from now on in store before making it.
+func (g *guestAccounts) UseStore(store guestLinkStore) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.store = store
+}
+
+// Replace swaps every link for links, by guest, as recovered from a store.
+func (g *guestAccounts) Replace(links map[string]string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.linked = links
+}
+
+func isGuest(user string) bool {
+	return strings.HasPrefix(user, guestPrefix)
+}
+
+func (g *guestAccounts) token(ID string) string {
+	return ID + "." + g.signer.sign(guestContext+ID)
+}
+
+// guestFromRequest returns the guest ID in the caller's cookie, if it is
+// valid.
+func (g *guestAccounts) guestFromRequest(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(guestCookie)
+	if err != nil {
+		return "", false
+	}
+	ID, _, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !isGuest(ID) || !hmac.Equal([]byte(cookie.Value), []byte(g.token(ID))) {
+		return "", false
+	}
+	return ID, true
+}
+
+// resolve maps a guest to the account it was linked to, so tabs still holding
+// the old cookie act as the registered user.
+func (g *guestAccounts) resolve(ID string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if user, ok := g.linked[ID]; ok {
+		return user
+	}
+	return ID
+}
+
+func setGuestCookie(w http.ResponseWriter, r *http.Request, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     guestCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: cookieSameSite(r),
+	})
+}
+
+// createGuestHandler gives the caller a guest identity, or returns the one
+// its cookie already holds.
+func createGuestHandler(guests *guestAccounts) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ID, ok := guests.guestFromRequest(r)
+		status := http.StatusOK
+		if !ok {
+			raw := make([]byte, 8)
+			if _, err := rand.Read(raw); err != nil {
+				writeError(w, r, err)
+				return
+			}
+			ID = guestPrefix + hex.EncodeToString(raw)
+			setGuestCookie(w, r, guests.token(ID), int(guestMaxAge.Seconds()))
+			status = http.StatusCreated
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"user_id": ID})
+	}
+}
+
+type AccountLink struct {
+	GuestID  string `json:"guest_id"`
+	UserID   string `json:"user_id"`
+	Messages int    `json:"messages"`
+	Rooms    int    `json:"rooms"`
+}
+
+// Link moves everything the guest owns to user: authorship of its messages,
+// its resume tokens and the read cursors in them, room memberships and
+// ownership, and notification preferences. With a store, the stored part of
+// that and the link itself are one transaction; if it fails nothing has
+// moved. What is only in memory follows once it has committed, and can't
+// fail.
+func (g *guestAccounts) Link(ctx context.Context, guest, user string, broker *Broker, rooms *roomRegistry, prefs *notificationPrefs) (AccountLink, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, ok := g.linked[guest]; ok {
+		return AccountLink{}, errGuestLinked
+	}
+
+	link := AccountLink{GuestID: guest, UserID: user}
+	var commit func(RoomEvent) (uint64, error)
+	if g.store != nil {
+		commit = func(e RoomEvent) (uint64, error) {
+			n, seq, err := g.store.LinkGuest(ctx, guest, user, e)
+			link.Messages = n
+			return seq, err
+		}
+	}
+	n, err := rooms.ReassignMember(guest, user, commit)
+	if err != nil {
+		return AccountLink{}, err
+	}
+	link.Rooms = n
+
+	if n := broker.ReassignAuthor(guest, user); g.store == nil {
+		link.Messages = n
+	}
+	prefs.Reassign(guest, user)
+	g.linked[guest] = user
+	return link, nil
+}
+
+// linkGuestHandler upgrades the caller's guest identity, taken from its
+// cookie, to the registered account the request is authenticated as.
+func linkGuestHandler(guests *guestAccounts, broker *Broker, rooms *roomRegistry, prefs *notificationPrefs, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromRequest(r)
+		if user == "" || isGuest(user) {
+			writeError(w, r, fmt.Errorf("%w: link from a registered account", errUnauthenticated))
+			return
+		}
+		guest, ok := guests.guestFromRequest(r)
+		if !ok {
+			writeError(w, r, errGuestInvalid)
+			return
+		}
+
+		link, err := guests.Link(r.Context(), guest, user, broker, rooms, prefs)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record(user, "account.link", "", fmt.Sprintf("guest=%s messages=%d rooms=%d", guest, link.Messages, link.Rooms))
+		setGuestCookie(w, r, "", -1)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(link)
+	}
+}
+
+// LinkGuest records the link of guest to user, as guestLinkStore describes.
+func (s *messageStore) LinkGuest(ctx context.Context, guest, user string, e RoomEvent) (int, uint64, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return 0, 0, err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	n, err := s.reassignAuthor(ctx, tx, guest, user)
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE handoff_tokens SET user_id = ? WHERE user_id = ?`, user, guest); err != nil {
+		return 0, 0, err
+	}
+	res, err := tx.ExecContext(ctx, `INSERT INTO room_events (room, type, data, created_at) VALUES (?, ?, ?, ?)`, e.Room, e.Type, data, e.Time.UnixNano())
+	if err != nil {
+		return 0, 0, err
+	}
+	seq, err := res.LastInsertId()
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO guest_links (guest_id, user_id, created_at) VALUES (?, ?, ?)`, guest, user, time.Now().UnixNano()); err != nil {
+		return 0, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return n, uint64(seq), nil
+}
+
+// RecoverGuestLinks puts the stored links back in guests and returns how
+// many there were, so a guest cookie still acts as its account after a
+// restart.
+func (s *messageStore) RecoverGuestLinks(ctx context.Context, guests *guestAccounts) (int, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT guest_id, user_id FROM guest_links`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	links := make(map[string]string)
+	for rows.Next() {
+		var guest, user string
+		if err := rows.Scan(&guest, &user); err != nil {
+			return 0, err
+		}
+		links[guest] = user
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	guests.Replace(links)
+	return len(links), nil
+}
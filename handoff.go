@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	handoffEvent    = "handoff"
+	handoffTokenTTL = 10 * time.Minute
+	handoffPoll     = time.Second
+)
+
+var (
+	errHandoffToken = errors.New("resume token is unknown, used or expired; reconnect with Last-Event-ID instead")
+	errStandby      = errors.New("server is standing by to take over from another instance, retry later")
+
+	handoffStreams = newCounterVec("chat_handoff_streams_total", "Streams handed off to the next instance, and resumed from a handoff, by result.", "result")
+)
+
+type handoffNotice struct {
+	Target           string `json:"target"`
+	ResumeToken      string `json:"resume_token,omitempty"`
+	ReconnectAfterMS int64  `json:"reconnect_after_ms"`
+}
+
+// handoffs moves the streams and room sequences of a node being replaced to
+// its replacement through the store they share, so a rolling deploy loses
+// no messages. Once everything the old node accepted is in the store, it
+// starts a handoff and gives each stream a resume token: the rooms it was
+// in and how far it got in each. When it has stopped publishing for good it
+// completes the handoff with the sequence of every room. The new node,
+// started in standby, takes over when it finds the completed handoff,
+// reloading rooms, bans, guest links and history from the store and
+// carrying each room's sequence on, and a token resumes every room of its
+// stream at once.
+type handoffs struct {
+	store       *messageStore
+	broker      *Broker
+	rooms       *roomRegistry
+	bans        *banList
+	templates   *roomTemplates
+	apiKeys     *apiKeyRegistry
+	attachments *attachmentStore
+	guests      *guestAccounts
+
+	mu sync.Mutex
+	// id is the newest handoff this node started or took over, or that
+	// was completed in the store when it started.
+	id      int64
+	standby atomic.Bool
+}
+
+func newHandoffs(store *messageStore, broker *Broker, rooms *roomRegistry, bans *banList, templates *roomTemplates, apiKeys *apiKeyRegistry, attachments *attachmentStore, guests *guestAccounts, standby bool) (*handoffs, error) {
+	h := &handoffs{store: store, broker: broker, rooms: rooms, bans: bans, templates: templates, apiKeys: apiKeys, attachments: attachments, guests: guests}
+	if store != nil {
+		id, err := store.LatestHandoff(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		h.id = id
+	}
+	h.standby.Store(standby)
+	return h, nil
+}
+
+func (h *handoffs) Standby() bool {
+	return h.standby.Load()
+}
+
+// Begin starts the handoff of this node to target, which resume tokens
+// are issued for. Everything accepted must be in the store by then.
+func (h *handoffs) Begin(target string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	id, err := h.store.BeginHandoff(target)
+	if err != nil {
+		return err
+	}
+	h.id = id
+	return nil
+}
+
+// Complete completes the handoff Begin started with the latest sequence of
+// every room, once this node publishes nothing more.
+func (h *handoffs) Complete() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.store.CompleteHandoff(h.id, h.broker.Sequences())
+}
+
+// Stamp gives the handoff notice for subscriber a resume token for the
+// rooms it is in, from lastSeqs, or where they stand for rooms it hasn't
+// had an event of. Without one, the client reconnects as after a shutdown.
+func (h *handoffs) Stamp(notice Envelope, subscriber *Subscriber, lastSeqs map[string]uint64) Envelope {
+	handoff := handoffNotice{}
+	json.Unmarshal(notice.Data, &handoff)
+	cursors := make(map[string]uint64)
+	for _, room := range h.broker.RoomsOf(subscriber.ID) {
+		seq, ok := lastSeqs[room]
+		if !ok {
+			seq = h.broker.LatestSequence(room)
+		}
+		cursors[room] = seq
+	}
+
+	h.mu.Lock()
+	id := h.id
+	h.mu.Unlock()
+	raw := make([]byte, 24)
+	rand.Read(raw)
+	token := hex.EncodeToString(raw)
+	if err := h.store.SaveHandoffToken(token, id, subscriber.User, cursors); err != nil {
+		log.Printf("Handoff: resume token of subscriber %s: %v", subscriber.ID, err)
+		handoffStreams.With("untokened").Add(1)
+		token = ""
+	} else {
+		handoffStreams.With("handed_off").Add(1)
+	}
+	return handoffEnvelope(handoff.Target, time.Duration(handoff.ReconnectAfterMS)*time.Millisecond, token)
+}
+
+// Redeem returns the rooms and cursors of a resume token of user, taking
+// over its handoff first if this node hasn't yet. Tokens work once, and not
+// before their handoff is complete.
+func (h *handoffs) Redeem(ctx context.Context, token, user string) (map[string]uint64, error) {
+	if h.store == nil {
+		return nil, errHandoffToken
+	}
+	id, cursors, pending, err := h.store.TakeHandoffToken(ctx, token, user, time.Now().Add(-handoffTokenTTL))
+	switch {
+	case pending:
+		return nil, withRetryAfter(errStandby, handoffPoll)
+	case errors.Is(err, sql.ErrNoRows):
+		handoffStreams.With("rejected").Add(1)
+		return nil, errHandoffToken
+	case err != nil:
+		return nil, err
+	}
+	if err := h.TakeOver(ctx, id); err != nil {
+		return nil, err
+	}
+	handoffStreams.With("resumed").Add(1)
+	return cursors, nil
+}
+
+// TakeOver takes over handoff id unless this node is past it already:
+// rooms, bans, templates and recent history are reloaded from the store,
+// and every room carries on after the sequence the old node left it at.
+func (h *handoffs) TakeOver(ctx context.Context, id int64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if id <= h.id {
+		return nil
+	}
+	seqs, err := h.store.HandoffSequences(ctx, id)
+	if err != nil {
+		return err
+	}
+	if _, err := h.store.Recover(ctx, h.broker.Restore); err != nil {
+		return err
+	}
+	for room, seq := range seqs {
+		h.broker.Restore(room, seq, nil)
+	}
+	if _, err := h.store.RecoverRooms(ctx, h.rooms); err != nil {
+		return err
+	}
+	if _, err := h.store.RecoverBans(ctx, h.bans); err != nil {
+		return err
+	}
+	if _, err := h.store.RecoverRoomTemplates(ctx, h.templates); err != nil {
+		return err
+	}
+	if _, err := h.store.RecoverAPIKeys(ctx, h.apiKeys); err != nil {
+		return err
+	}
+	if _, err := h.store.RecoverAttachments(ctx, h.attachments); err != nil {
+		return err
+	}
+	if _, err := h.store.RecoverGuestLinks(ctx, h.guests); err != nil {
+		return err
+	}
+	h.id = id
+	h.standby.Store(false)
+	log.Printf("Handoff: took over handoff %d, %d rooms", id, len(seqs))
+	return nil
+}
+
+// Await takes over the first handoff completed after this node started,
+// which ends its standby.
+func (h *handoffs) Await() {
+	ticker := time.NewTicker(handoffPoll)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !h.Standby() {
+			return
+		}
+		id, err := h.store.LatestHandoff(context.Background())
+		if err == nil {
+			err = h.TakeOver(context.Background(), id)
+		}
+		if err != nil {
+			log.Printf("Handoff: %v", err)
+		}
+	}
+}
+
+// handoffEnvelope points the client at target, to reconnect to after the
+// given delay with token, if it has one.
+func handoffEnvelope(target string, after time.Duration, token string) Envelope {
+	data, _ := json.Marshal(handoffNotice{Target: target, ResumeToken: token, ReconnectAfterMS: after.Milliseconds()})
+	return withRetryField(Envelope{
+		ID:    "handoff:" + strconv.FormatInt(time.Now().UnixNano(), 10),
+		Event: handoffEvent,
+		Time:  time.Now().UTC(),
+		Data:  data,
+	}, after)
+}
+
+// resumeTokenRooms returns the rooms of cursors in the order streams join
+// them.
+func resumeTokenRooms(cursors map[string]uint64) []string {
+	rooms := make([]string, 0, len(cursors))
+	for room := range cursors {
+		rooms = append(rooms, room)
+	}
+	slices.Sort(rooms)
+	return rooms
+}
+
+// standbyGuard turns sends and new streams away until the node has taken
+// over, except streams resuming with a token, which take over on their own.
+func standbyGuard(h *handoffs, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.Standby() && r.URL.Query().Get("resume_token") == "" {
+			writeError(w, r, withRetryAfter(errStandby, handoffPoll))
+			return
+		}
+		next(w, r)
+	}
+}
+
+type handoffRequest struct {
+	Target string `json:"target"`
+}
+
+// handoffHandler starts handing this node off to target: it drains like a
+// shutdown, except that streams are refused from the start and told to
+// resume on target rather than to reconnect.
+func handoffHandler(d *drainer, h *handoffs) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.store == nil {
+			writeError(w, r, errStoreDisabled)
+			return
+		}
+		if h.Standby() {
+			writeError(w, r, fmt.Errorf("%w: the server is standing by and has nothing to hand off", errInvalidRequest))
+			return
+		}
+		req := handoffRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+		target, err := url.Parse(req.Target)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			writeError(w, r, fmt.Errorf("%w: target must be an http or https URL", errInvalidRequest))
+			return
+		}
+		if !d.Handoff(req.Target) {
+			writeError(w, r, fmt.Errorf("%w: the server is already draining", errInvalidRequest))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(d.Status())
+	}
+}
+
+// BeginHandoff stores a handoff to target and returns its ID.
+func (s *messageStore) BeginHandoff(target string) (int64, error) {
+	res, err := s.db.Exec(`INSERT INTO handoffs (target, created_at) VALUES (?, ?)`, target, time.Now().UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// CompleteHandoff completes handoff id with the sequences rooms stand at.
+func (s *messageStore) CompleteHandoff(id int64, seqs map[string]uint64) error {
+	data, err := json.Marshal(seqs)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`UPDATE handoffs SET sequences = ?, completed_at = ? WHERE id = ?`, data, time.Now().UnixNano(), id)
+	return err
+}
+
+// LatestHandoff returns the ID of the newest completed handoff, 0 if there
+// is none.
+func (s *messageStore) LatestHandoff(ctx context.Context) (int64, error) {
+	var id int64
+	err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM handoffs WHERE completed_at IS NOT NULL`).Scan(&id)
+	return id, err
+}
+
+func (s *messageStore) HandoffSequences(ctx context.Context, id int64) (map[string]uint64, error) {
+	var data []byte
+	if err := s.db.QueryRowContext(ctx, `SELECT sequences FROM handoffs WHERE id = ?`, id).Scan(&data); err != nil {
+		return nil, fmt.Errorf("handoff %d: %w", id, err)
+	}
+	seqs := make(map[string]uint64)
+	if err := json.Unmarshal(data, &seqs); err != nil {
+		return nil, fmt.Errorf("handoff %d: %w", id, err)
+	}
+	return seqs, nil
+}
+
+func (s *messageStore) SaveHandoffToken(token string, handoff int64, user string, cursors map[string]uint64) error {
+	data, err := json.Marshal(cursors)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO handoff_tokens (token, handoff_id, user_id, cursors, created_at) VALUES (?, ?, ?, ?, ?)`, token, handoff, user, data, time.Now().UnixNano())
+	return err
+}
+
+// TakeHandoffToken deletes token of user and returns its handoff and
+// cursors, or sql.ErrNoRows if there is no such token issued after since.
+// A token whose handoff isn't complete yet is pending and stays. Tokens
+// issued before since are deleted.
+func (s *messageStore) TakeHandoffToken(ctx context.Context, token, user string, since time.Time) (int64, map[string]uint64, bool, error) {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM handoff_tokens WHERE created_at < ?`, since.UnixNano()); err != nil {
+		return 0, nil, false, err
+	}
+	var id int64
+	var completed bool
+	err := s.db.QueryRowContext(ctx, `SELECT t.handoff_id, h.completed_at IS NOT NULL FROM handoff_tokens t
+		JOIN handoffs h ON h.id = t.handoff_id WHERE t.token = ? AND t.user_id = ?`, token, user).Scan(&id, &completed)
+	if err != nil || !completed {
+		return 0, nil, err == nil, err
+	}
+	var data []byte
+	if err := s.db.QueryRowContext(ctx, `DELETE FROM handoff_tokens WHERE token = ? RETURNING cursors`, token).Scan(&data); err != nil {
+		return 0, nil, false, err
+	}
+	cursors := make(map[string]uint64)
+	if err := json.Unmarshal(data, &cursors); err != nil {
+		return 0, nil, false, fmt.Errorf("resume token: %w", err)
+	}
+	return id, cursors, false, nil
+}
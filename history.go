@@ -0,0 +1,140 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const historySize = 256
+
+// history keeps the most recent envelopes of every room in sequence order so a
+// reconnecting subscriber replays exactly what every other node delivered.
+type history struct {
+	mu    sync.RWMutex
+	rooms map[string][]Envelope
+	// heads holds the sequence each room was restored at, which its newest
+	// envelope may be behind if those after it were deleted.
+	heads map[string]uint64
+}
+
+func newHistory() *history {
+	return &history{rooms: make(map[string][]Envelope), heads: make(map[string]uint64)}
+}
+
+func (h *history) Append(env Envelope) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	envs := append(h.rooms[env.Room], env)
+	if len(envs) > historySize {
+		envs = envs[len(envs)-historySize:]
+	}
+	h.rooms[env.Room] = envs
+}
+
+// Restore fills the history of room with envs, oldest first, or adds those
+// newer than it has, and makes seq its latest sequence until a newer one is
+// appended.
+func (h *history) Restore(room string, seq uint64, envs []Envelope) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.heads[room] = max(h.heads[room], seq)
+	current := h.rooms[room]
+	if len(current) > 0 {
+		newest := current[len(current)-1].Seq
+		for len(envs) > 0 && envs[0].Seq <= newest {
+			envs = envs[1:]
+		}
+	}
+	if len(envs) > 0 {
+		merged := append(current, envs...)
+		h.rooms[room] = merged[max(len(merged)-historySize, 0):]
+	}
+}
+
+// Sequences returns the latest sequence of every room.
+func (h *history) Sequences() map[string]uint64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	seqs := make(map[string]uint64, len(h.rooms)+len(h.heads))
+	for room, seq := range h.heads {
+		seqs[room] = seq
+	}
+	for room, envs := range h.rooms {
+		if len(envs) > 0 {
+			seqs[room] = max(seqs[room], envs[len(envs)-1].Seq)
+		}
+	}
+	return seqs
+}
+
+// Since returns the envelopes of room with a sequence greater than seq.
+func (h *history) Since(room string, seq uint64) []Envelope {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	envs := h.rooms[room]
+	for i, env := range envs {
+		if env.Seq > seq {
+			return append([]Envelope(nil), envs[i:]...)
+		}
+	}
+	return nil
+}
+
+func (h *history) Get(room string, seq uint64) (Envelope, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, env := range h.rooms[room] {
+		if env.Seq == seq {
+			return env, true
+		}
+	}
+	return Envelope{}, false
+}
+
+// Rewrite replaces every envelope fn changes and returns how many it did.
+func (h *history) Rewrite(fn func(Envelope) (Envelope, bool)) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	changed := 0
+	for _, envs := range h.rooms {
+		for i, env := range envs {
+			if rewritten, ok := fn(env); ok {
+				envs[i] = rewritten
+				changed++
+			}
+		}
+	}
+	return changed
+}
+
+// LastTime returns the server time of the newest envelope of room, or the
+// zero time.
+func (h *history) LastTime(room string) time.Time {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	envs := h.rooms[room]
+	if len(envs) == 0 {
+		return time.Time{}
+	}
+	return envs[len(envs)-1].Time
+}
+
+// Latest returns the sequence of the newest envelope of room, or the one it
+// was restored at if that is newer, or 0.
+func (h *history) Latest(room string) uint64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	envs := h.rooms[room]
+	if len(envs) == 0 {
+		return h.heads[room]
+	}
+	return max(envs[len(envs)-1].Seq, h.heads[room])
+}
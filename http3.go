@@ -0,0 +1,29 @@
+//go:build h3
+
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// serveHTTP3 starts an HTTP/3 listener on the UDP side of cfg.Addr and
+// returns middleware advertising it to HTTP/1.1 and HTTP/2 clients.
+func serveHTTP3(cfg serverConfig, handler http.Handler) (func(http.Handler) http.Handler, error) {
+	srv := &http3.Server{Addr: cfg.Addr, Handler: handler}
+	go func() {
+		log.Printf("HTTP/3 listening on %s/udp", cfg.Addr)
+		log.Fatal(srv.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey))
+	}()
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ProtoMajor < 3 {
+				srv.SetQUICHeaders(w.Header())
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
@@ -0,0 +1,12 @@
+//go:build !h3
+
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+func serveHTTP3(cfg serverConfig, handler http.Handler) (func(http.Handler) http.Handler, error) {
+	return nil, errors.New("HTTP/3 support not compiled in, rebuild with -tags h3")
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInviteTTL = 24 * time.Hour
+	maxInviteTTL     = 30 * 24 * time.Hour
+)
+
+var (
+	errInviteInvalid = errors.New("invalid invite")
+	errInviteExpired = errors.New("invite expired")
+	errInviteUsed    = errors.New("invite already used")
+)
+
+type invite struct {
+	Room      string `json:"room"`
+	ExpiresAt int64  `json:"exp"`
+	Nonce     string `json:"nonce"`
+	SingleUse bool   `json:"single_use,omitempty"`
+}
+
+// inviteSigner issues and redeems room invites. Tokens are self-contained and
+// HMAC-signed; only single-use nonces are remembered, and only until expiry.
+type inviteSigner struct {
+	secret []byte
+
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+func newInviteSigner(secret []byte) *inviteSigner {
+	return &inviteSigner{secret: secret, used: make(map[string]time.Time)}
+}
+
+func (s *inviteSigner) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *inviteSigner) Issue(room string, ttl time.Duration, singleUse bool) (string, time.Time, error) {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	raw, err := json.Marshal(invite{
+		Room:      room,
+		ExpiresAt: expiresAt.Unix(),
+		Nonce:     hex.EncodeToString(nonce),
+		SingleUse: singleUse,
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(raw)
+	return payload + "." + s.sign(payload), expiresAt, nil
+}
+
+func (s *inviteSigner) Redeem(token string) (invite, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(s.sign(payload))) {
+		return invite{}, errInviteInvalid
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return invite{}, errInviteInvalid
+	}
+	inv := invite{}
+	if err := json.Unmarshal(raw, &inv); err != nil {
+		return invite{}, errInviteInvalid
+	}
+
+	now := time.Now()
+	if now.Unix() > inv.ExpiresAt {
+		return invite{}, errInviteExpired
+	}
+	if !inv.SingleUse {
+		return inv, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for nonce, expiresAt := range s.used {
+		if now.After(expiresAt) {
+			delete(s.used, nonce)
+		}
+	}
+	if _, ok := s.used[inv.Nonce]; ok {
+		return invite{}, errInviteUsed
+	}
+	s.used[inv.Nonce] = time.Unix(inv.ExpiresAt, 0)
+	return inv, nil
+}
+
+type createInviteRequest struct {
+	TTL       string `json:"ttl"`
+	SingleUse bool   `json:"single_use"`
+}
+
+type createInviteResponse struct {
+	Token     string    `json:"token"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func createInviteHandler(rooms *roomRegistry, invites *inviteSigner, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room := r.PathValue("room")
+		user := userFromRequest(r)
+		if !rooms.IsOwner(room, user) {
+			writeError(w, r, fmt.Errorf("%w: only the room owner can create invites", errForbidden))
+			return
+		}
+
+		req := createInviteRequest{}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, r, invalidJSON(err))
+				return
+			}
+		}
+
+		ttl := defaultInviteTTL
+		if req.TTL != "" {
+			d, err := time.ParseDuration(req.TTL)
+			if err != nil || d <= 0 || d > maxInviteTTL {
+				writeError(w, r, fmt.Errorf("%w: ttl must be a positive duration up to %s", errInvalidRequest, maxInviteTTL))
+				return
+			}
+			ttl = d
+		}
+
+		token, expiresAt, err := invites.Issue(room, ttl, req.SingleUse)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record(user, "invite.create", room, "expires="+expiresAt.UTC().Format(time.RFC3339))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(createInviteResponse{
+			Token:     token,
+			URL:       absoluteURL(r, "/chat/invites/"+token),
+			ExpiresAt: expiresAt.UTC(),
+		})
+	}
+}
+
+func redeemInviteHandler(rooms *roomRegistry, invites *inviteSigner, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromRequest(r)
+		if user == "" {
+			writeError(w, r, errUnauthenticated)
+			return
+		}
+
+		inv, err := invites.Redeem(r.PathValue("token"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		if err := rooms.AddMember(inv.Room, user); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record(user, "invite.redeem", inv.Room, "nonce="+inv.Nonce)
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Joined " + inv.Room))
+	}
+}
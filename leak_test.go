@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+)
+
+// testStreamHandler builds receiveChatHandler the way main wires it, with
+// every request made by alice. The trackers start their sweeps here, so
+// callers take goleak.IgnoreCurrent afterwards.
+func testStreamHandler(t *testing.T, broker *Broker) http.Handler {
+	t.Helper()
+	rooms := newRoomRegistry()
+	statuses := newUserStatuses()
+	bindings, err := newStreamBindings(broker, bindingOff, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handoffs, err := newHandoffs(nil, broker, rooms, nil, nil, nil, nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := receiveChatHandler(broker, rooms, newWaitingRoom(rooms.Capacity), newNotificationPrefs(statuses), newStreamPolicies(),
+		newPresenceTracker(broker, statuses, time.Minute), newClientTracker(), newRoomStats(),
+		newStreamAdmission(0, 0, 0, 0), bindings, handoffs, 0, 0)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(w, withIdentity(r, "alice", time.Time{}))
+	})
+}
+
+// openStream connects to srv and reads until the stream has joined room and
+// delivered a live message in it.
+func openStream(t *testing.T, ctx context.Context, srv *httptest.Server, broker *Broker, room string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/chat/events?room="+room, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bufio.NewScanner(resp.Body)
+	awaitLine(t, lines, "event: subscribed")
+	if _, err := broker.Publish(room, []byte(`{"text":"hello"}`)); err != nil {
+		t.Fatal(err)
+	}
+	awaitLine(t, lines, "hello")
+	return resp
+}
+
+func awaitLine(t *testing.T, lines *bufio.Scanner, want string) {
+	t.Helper()
+	for lines.Scan() {
+		if strings.Contains(lines.Text(), want) {
+			return
+		}
+	}
+	t.Fatalf("stream ended before %q: %v", want, lines.Err())
+}
+
+func TestStreamDisconnectDoesNotLeak(t *testing.T) {
+	broker := newTestBroker(t, 4)
+	t.Cleanup(broker.Close)
+	handler := testStreamHandler(t, broker)
+	ignore := goleak.IgnoreCurrent()
+
+	srv := httptest.NewServer(handler)
+	for range 3 {
+		ctx, cancel := context.WithCancel(context.Background())
+		resp := openStream(t, ctx, srv, broker, "general")
+		cancel()
+		resp.Body.Close()
+	}
+	// Close waits for the handlers to return.
+	srv.Close()
+
+	if n := broker.SubscriberCount(); n != 0 {
+		t.Errorf("%d subscribers left after their streams disconnected", n)
+	}
+	goleak.VerifyNone(t, ignore)
+}
+
+func TestBrokerShutdownDoesNotLeak(t *testing.T) {
+	// The trackers' sweeps live as long as the process; the shard loops
+	// have to stop.
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent(),
+		goleak.IgnoreAnyFunction("github.com/afikrim/go-event-stream-chat.(*clientTracker).sweep"),
+		goleak.IgnoreAnyFunction("github.com/afikrim/go-event-stream-chat.(*presenceTracker).sweep"))
+	broker := newTestBroker(t, 4)
+	handler := testStreamHandler(t, broker)
+
+	srv := httptest.NewServer(handler)
+	resp := openStream(t, context.Background(), srv, broker, "general")
+	defer resp.Body.Close()
+
+	// As the drainer does: close the streams, let the server finish them,
+	// then stop delivery.
+	if n := broker.CloseAll(); n != 1 {
+		t.Errorf("CloseAll closed %d streams, want 1", n)
+	}
+	srv.Close()
+	broker.Close()
+	if _, err := broker.Publish("general", []byte(`{"text":"after close"}`)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// leakGrace is how long a stream handler may take to return after its client
+// went away before it counts as leaked.
+const leakGrace = 10 * time.Second
+
+var leaks = newLeakDetector()
+
+type streamRecord struct {
+	subscriber *Subscriber
+	started    time.Time
+	// cancelled is when the client went away, zero while it is connected.
+	cancelled time.Time
+}
+
+// leakDetector tracks the goroutines and channels that have to go away when a
+// stream ends: every SSE handler and every subscriber channel. A handler still
+// running well after its request was cancelled, or a subscriber with no
+// handler, is a leak.
+type leakDetector struct {
+	channels atomic.Int64
+
+	mu      sync.Mutex
+	streams map[string]*streamRecord
+}
+
+func newLeakDetector() *leakDetector {
+	return &leakDetector{streams: make(map[string]*streamRecord)}
+}
+
+// Stream records a running stream handler; call the returned func when it
+// returns.
+func (d *leakDetector) Stream(ctx context.Context, subscriber *Subscriber) func() {
+	record := &streamRecord{subscriber: subscriber, started: time.Now()}
+	d.mu.Lock()
+	d.streams[subscriber.ID] = record
+	d.mu.Unlock()
+
+	stop := context.AfterFunc(ctx, func() {
+		d.mu.Lock()
+		record.cancelled = time.Now()
+		d.mu.Unlock()
+	})
+	return func() {
+		stop()
+		d.mu.Lock()
+		delete(d.streams, subscriber.ID)
+		d.mu.Unlock()
+	}
+}
+
+func (d *leakDetector) channelOpened() { d.channels.Add(1) }
+func (d *leakDetector) channelClosed() { d.channels.Add(-1) }
+
+type LeakSuspect struct {
+	Kind         string    `json:"kind"`
+	SubscriberID string    `json:"subscriber_id"`
+	User         string    `json:"user_id,omitempty"`
+	ClientID     string    `json:"client_id,omitempty"`
+	Started      time.Time `json:"started,omitempty"`
+}
+
+type LeakReport struct {
+	Goroutines  int           `json:"goroutines"`
+	Streams     int           `json:"streams"`
+	Channels    int64         `json:"subscriber_channels"`
+	Subscribers int           `json:"subscribers"`
+	Suspects    []LeakSuspect `json:"suspects"`
+}
+
+func (d *leakDetector) Report(broker *Broker) LeakReport {
+	infos := broker.Subscribers("")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	report := LeakReport{
+		Goroutines:  runtime.NumGoroutine(),
+		Streams:     len(d.streams),
+		Channels:    d.channels.Load(),
+		Subscribers: len(infos),
+		Suspects:    []LeakSuspect{},
+	}
+	for ID, stream := range d.streams {
+		if !stream.cancelled.IsZero() && time.Since(stream.cancelled) > leakGrace {
+			report.Suspects = append(report.Suspects, LeakSuspect{
+				Kind:         "stream_not_returned",
+				SubscriberID: ID,
+				User:         stream.subscriber.User,
+				ClientID:     stream.subscriber.ClientID,
+				Started:      stream.started.UTC(),
+			})
+		}
+	}
+	for _, info := range infos {
+		if _, ok := d.streams[info.ID]; !ok {
+			report.Suspects = append(report.Suspects, LeakSuspect{
+				Kind:         "orphan_subscriber",
+				SubscriberID: info.ID,
+				User:         info.User,
+				ClientID:     info.ClientID,
+			})
+		}
+	}
+	slices.SortFunc(report.Suspects, func(a, b LeakSuspect) int { return strings.Compare(a.SubscriberID, b.SubscriberID) })
+	return report
+}
+
+func registerLeakMetrics(broker *Broker) {
+	newGaugeFunc("chat_goroutines", "Goroutines in the process.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+	newGaugeFunc("chat_live_streams", "SSE handlers currently running.", func() float64 {
+		leaks.mu.Lock()
+		defer leaks.mu.Unlock()
+		return float64(len(leaks.streams))
+	})
+	newGaugeFunc("chat_subscriber_channels", "Subscriber channels not yet closed.", func() float64 {
+		return float64(leaks.channels.Load())
+	})
+	newGaugeFunc("chat_leak_suspects", "Stream handlers or subscribers that outlived their connection.", func() float64 {
+		return float64(len(leaks.Report(broker).Suspects))
+	})
+}
+
+func leakReportHandler(broker *Broker) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(leaks.Report(broker))
+	}
+}
+
+// goroutineDumpHandler writes the stacks of all goroutines, for finding out
+// where a leaked handler is stuck.
+func goroutineDumpHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	pprof.Lookup("goroutine").WriteTo(w, 1)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// lifecycleRoom mirrors what happens to subscribers and rooms as lifecycle
+// events, so admins and bots can follow it by streaming a room.
+const (
+	lifecycleRoom       = "#system"
+	lifecycleEvent      = "lifecycle"
+	lifecycleBufferSize = 1024
+
+	lifecycleConnect     = "connect"
+	lifecycleDisconnect  = "disconnect"
+	lifecycleJoin        = "join"
+	lifecycleLeave       = "leave"
+	lifecycleKick        = "kick"
+	lifecycleRoomCreated = "room_created"
+)
+
+var droppedLifecycle = newCounter("chat_lifecycle_dropped_total", "Lifecycle events not mirrored into #system because its queue was full.")
+
+type LifecycleEvent struct {
+	Type         string    `json:"type"`
+	Room         string    `json:"room,omitempty"`
+	User         string    `json:"user_id,omitempty"`
+	SubscriberID string    `json:"subscriber_id,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+// OnLifecycle registers fn to hear of subscribers connecting, joining and
+// leaving rooms, being kicked and disconnecting. Like OnOccupancy it runs
+// under a shard lock and must not block. Set it before serving.
+func (b *Broker) OnLifecycle(fn func(LifecycleEvent)) {
+	b.lifecycle = fn
+}
+
+func (b *Broker) changed(kind string, subscriber *Subscriber, room string) {
+	if b.lifecycle != nil {
+		b.lifecycle(LifecycleEvent{Type: kind, Room: room, User: subscriber.User, SubscriberID: subscriber.ID})
+	}
+}
+
+// lifecycleMirror publishes lifecycle events into lifecycleRoom from a queue
+// of its own, since they are raised where publishing could deadlock. Events
+// about system rooms are left out.
+type lifecycleMirror struct {
+	broker *Broker
+	events chan LifecycleEvent
+}
+
+func newLifecycleMirror(broker *Broker) *lifecycleMirror {
+	m := &lifecycleMirror{broker: broker, events: make(chan LifecycleEvent, lifecycleBufferSize)}
+	go m.run()
+	return m
+}
+
+// Record queues e for the mirror. A nil mirror records nothing.
+func (m *lifecycleMirror) Record(e LifecycleEvent) {
+	if m == nil || isSystemRoom(e.Room) {
+		return
+	}
+	e.Time = time.Now().UTC()
+	select {
+	case m.events <- e:
+	default:
+		droppedLifecycle.Inc()
+	}
+}
+
+func (m *lifecycleMirror) run() {
+	for e := range m.events {
+		raw, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		if _, err := m.broker.PublishEvent(lifecycleRoom, lifecycleEvent, raw); err != nil {
+			log.Printf("Lifecycle: publishing %s: %v", e.Type, err)
+		}
+	}
+}
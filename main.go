@@ -1,72 +1,438 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
-type Subscriber struct {
-	ID      string
-	Closed  bool
-	Channel chan []byte
-}
+const defaultRoom = "general"
 
-type Event struct {
-	Subscribers []Subscriber
+func roomFromRequest(r *http.Request) string {
+	if room := r.URL.Query().Get("room"); room != "" {
+		return room
+	}
+	return defaultRoom
 }
 
-func (e *Event) Subscribe() Subscriber {
-	subscriber := Subscriber{
-		ID:      fmt.Sprintf("%d", time.Now().Unix()),
-		Channel: make(chan []byte),
+// resumePoint returns the sequence a subscriber resumes after. The
+// Last-Event-ID header takes precedence over the last_event_id query
+// parameter, or lastEventId as EventSource polyfills send it: browsers keep
+// the URL on reconnect, so the header is the more recent of the two. The
+// query parameter also accepts full envelope IDs ("room:seq"). A position
+// ahead of the room's history, e.g. from before a restart, starts a fresh
+// stream.
+func resumePoint(r *http.Request, room string, broker *Broker) (uint64, bool, error) {
+	source, raw := "Last-Event-ID", r.Header.Get("Last-Event-ID")
+	if raw == "" {
+		source, raw = "last_event_id", r.URL.Query().Get("last_event_id")
+		if raw == "" {
+			source, raw = "lastEventId", r.URL.Query().Get("lastEventId")
+		}
+		if prefix, seq, ok := strings.Cut(raw, ":"); ok {
+			if prefix != room {
+				return 0, false, fmt.Errorf("%w: %s belongs to room %q", errInvalidRequest, source, prefix)
+			}
+			raw = seq
+		}
+	}
+	if raw == "" {
+		return 0, false, nil
+	}
+
+	seq, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("%w: %s must be a sequence number", errInvalidRequest, source)
+	}
+	if latest := broker.LatestSequence(room); seq > latest {
+		log.Printf("Resume point %d of %s is ahead of its history (%d), starting fresh", seq, room, latest)
+		return 0, false, nil
 	}
-	e.Subscribers = append(e.Subscribers, subscriber)
-	return subscriber
+	return seq, true, nil
 }
 
-func (e *Event) Unsubscribe(ID string) {
-	for i, s := range e.Subscribers {
-		if s.ID != ID {
-			continue
-		}
+// overflowEvent tells a resuming client it is too far behind to replay on
+// the stream and should fetch what it missed over the REST API.
+const overflowEvent = "overflow"
+
+var resumeOverflows = newCounterVec("chat_resume_overflows_total", "Resumes answered with an overflow event instead of a replay, by reason.", "reason")
 
-		e.Subscribers = append(e.Subscribers[:i], e.Subscribers[i+1:]...)
-		close(s.Channel)
-		break
+type replayOverflow struct {
+	Room        string `json:"room"`
+	Reason      string `json:"reason"`
+	LastEventID uint64 `json:"last_event_id"`
+	LatestSeq   uint64 `json:"latest_seq"`
+	Missed      uint64 `json:"missed"`
+	// OldestSeq is the oldest event still available for replay.
+	OldestSeq  uint64 `json:"oldest_seq,omitempty"`
+	HistoryURL string `json:"history_url"`
+}
+
+// checkBacklog decides whether backlog, what a client resuming room after
+// seq missed, can be replayed. If it is longer than limit, or history no
+// longer reaches back to seq, it returns the overflow event to send instead.
+func checkBacklog(r *http.Request, room string, seq uint64, backlog []Envelope, limit int) (Envelope, bool) {
+	if len(backlog) == 0 {
+		return Envelope{}, false
+	}
+	overflow := replayOverflow{Room: room, LastEventID: seq, LatestSeq: backlog[len(backlog)-1].Seq, OldestSeq: backlog[0].Seq}
+	switch {
+	case backlog[0].Seq > seq+1:
+		overflow.Reason = "gap"
+	case limit > 0 && len(backlog) > limit:
+		overflow.Reason = "limit"
+	default:
+		return Envelope{}, false
 	}
+	overflow.Missed = overflow.LatestSeq - seq
+	overflow.HistoryURL = absoluteURL(r, "/chat/rooms/"+url.PathEscape(room)+"/replay?after="+strconv.FormatUint(seq, 10))
+	resumeOverflows.With(overflow.Reason).Add(1)
+
+	data, _ := json.Marshal(overflow)
+	return Envelope{ID: room + ":overflow", Room: room, Event: overflowEvent, Time: time.Now().UTC(), Data: data}, true
 }
 
-func (e *Event) Publish(data []byte) {
-	for _, subscriber := range e.Subscribers {
-		subscriber.Channel <- data
+func writeEnvelope(w http.ResponseWriter, env Envelope) error {
+	if nw, ok := w.(*ndjsonWriter); ok {
+		return nw.writeEnvelope(env)
+	}
+	if bw, ok := w.(*binaryWriter); ok {
+		return bw.writeEnvelope(env)
+	}
+	if env.frame != nil {
+		_, err := w.Write(env.frame)
+		return err
+	}
+
+	frame, err := encodeFrame(env)
+	if err != nil {
+		return err
 	}
+	_, err = w.Write(frame)
+	return err
 }
 
-func receiveChatHandler(chatEvent *Event) func(w http.ResponseWriter, r *http.Request) {
+// receiveChatHandler streams the rooms of the request as SSE, or as NDJSON
+// behind ndjsonStream. Every stream starts with a "subscribed" event
+// carrying its subscriber ID, which the subscription endpoints use to join
+// and leave rooms at runtime. Sequences are per room, so only single-room
+// streams can resume. Rooms with a welcome message have it written as a
+// "welcome" event once the stream joins them. A "meta" event with the
+// stream's lag goes out every metaInterval, if set. With ?window=N the
+// stream is flow controlled: no more than N room events go out
+// unacknowledged. Clients that declare capabilities get the stream they
+// asked for; see streamCapabilities. A stream handed off from another node
+// resumes every room it was in with ?resume_token=, and a stream handed off
+// from this one ends with the "handoff" event carrying its token.
+func receiveChatHandler(broker *Broker, rooms *roomRegistry, waiting *waitingRoom, prefs *notificationPrefs, policies *streamPolicies, presence *presenceTracker, clients *clientTracker, stats *roomStats, admission *streamAdmission, bindings *streamBindings, handoffs *handoffs, resumeLimit int, metaInterval time.Duration) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
+		user := userFromRequest(r)
+		var cursors map[string]uint64
+		if token := r.URL.Query().Get("resume_token"); token != "" {
+			var err error
+			if cursors, err = handoffs.Redeem(r.Context(), token, user); err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+		streamRooms, err := roomsFromRequest(r)
+		if cursors != nil {
+			streamRooms, err = resumeTokenRooms(cursors), nil
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		for _, room := range streamRooms {
+			if !rooms.CanRead(room, user) {
+				writeError(w, r, withDetails(errNotMember, map[string]string{"room": room}))
+				return
+			}
+		}
+
+		groups, err := groupsFromRequest(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		metadataFilter, err := metadataFilterFrom(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
 
-		flusher, ok := w.(http.Flusher)
-		if !ok {
-			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		lastSeqs := make(map[string]uint64, len(streamRooms))
+		resume := cursors != nil
+		if resume {
+			maps.Copy(lastSeqs, cursors)
+		} else if len(streamRooms) == 1 {
+			room := streamRooms[0]
+			if lastSeqs[room], resume, err = resumePoint(r, room, broker); err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+		authExpires := authExpiryFrom(r)
+		windowSize, err := windowFrom(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		client, cookieClient := clientIDFromRequest(w, r)
+		if err := bindings.CheckURL(r, user, cookieClient); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		caps := capabilitiesFrom(r)
+		if nw, ok := w.(*ndjsonWriter); ok && caps.Has(capabilityBinary) {
+			w = &binaryWriter{ResponseWriter: nw.ResponseWriter}
+		}
+		granted := caps.granted(w)
+		rc, err := startStream(w, r, streamContentType(w))
+		if err != nil {
+			log.Printf("Stream setup failed for client %s: %v", client, err)
 			return
 		}
 
-		subscriber := chatEvent.Subscribe()
-		defer chatEvent.Unsubscribe(subscriber.ID)
+		if clients.Open(client) {
+			log.Printf("Client %s reconnected from %s", client, clientAddress(r))
+		}
+		defer clients.Close(client)
+
+		// The stream joins its rooms one by one as it gets a slot in each,
+		// queueing for rooms at capacity.
+		filter := allFilters(prefs.subscriberFilter(user), metadataFilter)
+		origin := originFrom(r.Context())
+		connectionsByRegion.With(origin.RegionLabel()).Add(1)
+		subscriber := broker.Subscribe(user, client, origin, nil, groups, filter)
+		subscriber.setAuthExpires(authExpires)
+		subscriber.setPolicy(policies.ForUser(user))
+		subscriber.Capabilities = granted
+		countCapabilities(granted)
+		flow := newStreamFlow(windowSize)
+		if flow != nil {
+			subscriber.window.Store(flow.window)
+		}
+		nonce := bindings.Bind(r, subscriber, cookieClient)
+		announceSubscriber(r, subscriber)
+		defer leaks.Stream(r.Context(), subscriber)()
+		defer func() {
+			for _, room := range broker.Unsubscribe(subscriber.ID) {
+				presence.Disconnect(room, user, client)
+			}
+			waiting.ReleaseAll(subscriber.ID)
+		}()
+
+		data := map[string]any{"subscriber_id": subscriber.ID, "client_id": client, "rooms": streamRooms}
+		if nonce != "" {
+			data["nonce"] = nonce
+		}
+		if windowSize > 0 {
+			data["window"] = windowSize
+		}
+		if granted != nil {
+			data["capabilities"] = granted
+		}
+		subscribedRaw, _ := json.Marshal(data)
+		subscribed := Envelope{ID: subscriber.ID, Event: "subscribed", Time: time.Now().UTC(), Data: subscribedRaw}
+		if admission.retry > 0 {
+			subscribed = withRetryField(subscribed, admission.RetryAfter())
+		}
+		writeEnvelope(w, subscribed)
+		if policy := subscriber.Policy(); policy != nil {
+			writeEnvelope(w, policyEnvelope(subscriber.ID, "user", policy))
+		}
+
+		for _, room := range streamRooms {
+			if !awaitSlot(w, r, rc, waiting, subscriber, room) {
+				return
+			}
+			if _, err := broker.Join(subscriber.ID, room, maxStreamRooms); err != nil {
+				return
+			}
+			presence.Connect(room, user, client)
+			if welcome, ok := rooms.Welcome(room); ok {
+				writeEnvelope(w, welcome)
+			}
+		}
+		if !resume {
+			// Fresh streams start at the head of each room, which is what
+			// the lag in meta events is measured against.
+			for _, room := range streamRooms {
+				lastSeqs[room] = broker.LatestSequence(room)
+			}
+		}
+
+		for _, room := range streamRooms {
+			if !resume {
+				break
+			}
+			// A client too far behind is told to catch up over REST and
+			// carries on live rather than getting the whole backlog here.
+			release, ok := admission.AwaitReplay(r.Context())
+			if !ok {
+				return
+			}
+			backlog := broker.Replay(room, lastSeqs[room])
+			release()
+			if overflow, ok := checkBacklog(r, room, lastSeqs[room], backlog, resumeLimit); ok {
+				writeEnvelope(w, overflow)
+				backlog, lastSeqs[room] = nil, backlog[len(backlog)-1].Seq
+			}
+			if flow != nil && len(backlog) > 0 {
+				// The window paces the backlog like live events.
+				flow.behind[room] = true
+				flow.catchUp(w, r, broker, subscriber, lastSeqs)
+				backlog = nil
+			}
+			for _, env := range backlog {
+				lastSeqs[room] = env.Seq
+				if reason := subscriber.rejects(env); reason != "" {
+					broker.RecordDelivery(subscriber, env, deliveryFiltered, reason)
+					continue
+				}
+				writeEnvelope(w, env)
+				broker.RecordDelivery(subscriber, env, deliveryReplayed, "")
+			}
+		}
+		// Streams of a deprecated version hear about it right away, not only
+		// with the next meta tick.
+		version := apiVersionFrom(r)
+		if version.Deprecated && caps.Has(capabilityMeta) {
+			writeEnvelope(w, streamMeta(broker, subscriber, lastSeqs, version))
+		}
+		rc.Flush()
+
+		var metaTick <-chan time.Time
+		if metaInterval > 0 && caps.Has(capabilityMeta) {
+			ticker := time.NewTicker(metaInterval)
+			defer ticker.Stop()
+			metaTick = ticker.C
+		}
+
+		// Credentials can be refreshed while the stream runs; it is warned
+		// ahead of expiry and closed at it.
+		auth := newAuthTimers(subscriber.AuthExpires())
+		defer auth.Stop()
+
+		batch := &streamBatcher{w: w, enabled: caps.Has(capabilityBatch)}
+		deliver := func(env Envelope) {
+			if env.Seq > 0 && env.Seq <= lastSeqs[env.Room] {
+				return
+			}
+			if env.Seq > 0 && flow.hold(env, subscriber, lastSeqs) {
+				broker.RecordDelivery(subscriber, env, deliveryHeld, "window")
+				if flow.window.Open() {
+					batch.flush()
+					flow.catchUp(w, r, broker, subscriber, lastSeqs)
+				}
+				return
+			}
+			batch.write(env)
+			broker.RecordDelivery(subscriber, env, deliveryDelivered, "")
+			if env.Seq > 0 {
+				lastSeqs[env.Room] = env.Seq
+				stats.Delivered(env)
+				flow.Sent()
+			}
+		}
+
+		// A handoff is the last event of the stream, after everything that
+		// was queued for it, so its token resumes right after them.
+		handOff := func(notice Envelope) {
+		queued:
+			for {
+				select {
+				case env, ok := <-subscriber.Channel:
+					if !ok {
+						break queued
+					}
+					deliver(env)
+				default:
+					break queued
+				}
+			}
+			batch.flush()
+			writeEnvelope(w, handoffs.Stamp(notice, subscriber, lastSeqs))
+			rc.Flush()
+		}
 
 		for {
+			// Control notices go out before any room event still queued.
+			select {
+			case notice := <-subscriber.Control():
+				if notice.Event == handoffEvent {
+					handOff(notice)
+					return
+				}
+				writeEnvelope(w, notice)
+				rc.Flush()
+				continue
+			default:
+			}
+
 			select {
-			case data := <-subscriber.Channel:
-				fmt.Fprintf(w, "data: %s\n\n", string(data))
-				flusher.Flush()
+			case notice := <-subscriber.Control():
+				if notice.Event == handoffEvent {
+					handOff(notice)
+					return
+				}
+				writeEnvelope(w, notice)
+				rc.Flush()
+			case env, ok := <-subscriber.Channel:
+				if !ok {
+					return
+				}
+				deliver(env)
+				// Batch-capable streams take whatever else is queued along.
+			collect:
+				for batch.collecting() {
+					select {
+					case env, ok := <-subscriber.Channel:
+						if !ok {
+							break collect
+						}
+						deliver(env)
+					default:
+						break collect
+					}
+				}
+				batch.flush()
+				rc.Flush()
+			case <-flow.Credit():
+				flow.catchUp(w, r, broker, subscriber, lastSeqs)
+				rc.Flush()
+			case <-metaTick:
+				writeEnvelope(w, streamMeta(broker, subscriber, lastSeqs, version))
+				rc.Flush()
+			case <-subscriber.Reauthed():
+				auth.Reset(subscriber.AuthExpires())
+			case <-auth.warn.C:
+				writeEnvelope(w, authEnvelope(subscriber, "expiring", nil))
+				rc.Flush()
+			case <-auth.expire.C:
+				writeEnvelope(w, authEnvelope(subscriber, "expired", nil))
+				rc.Flush()
+				streamAuthEvents.With("expired").Add(1)
+				log.Printf("Client %s (%s) credentials expired", client, clientAddress(r))
+				return
+			case <-subscriber.Kicked():
+				log.Printf("Client %s (%s) kicked", client, clientAddress(r))
+				return
 			case <-r.Context().Done():
-				log.Println("Client disconnected")
+				log.Printf("Client %s (%s) disconnected", client, clientAddress(r))
 				return
 			}
 		}
@@ -74,30 +440,186 @@ func receiveChatHandler(chatEvent *Event) func(w http.ResponseWriter, r *http.Re
 }
 
 type Chat struct {
+	Room    string `json:"room"`
 	UserID  string `json:"user_id"`
 	Message string `json:"message"`
+	// ContentType says how to render Message: plain (the default), markdown
+	// or code, with Language naming the language of code.
+	ContentType   string      `json:"content_type,omitempty"`
+	Language      string      `json:"language,omitempty"`
+	ForwardedFrom *Provenance `json:"forwarded_from,omitempty"`
+	Attachment    *Attachment `json:"attachment,omitempty"`
+	Via           string      `json:"via,omitempty"`
+	// Emoji maps the custom emoji the message uses to their images. The
+	// server fills it in from the room's registry.
+	Emoji map[string]string `json:"emoji,omitempty"`
+	// ClientMessageID is the sender's own ID for the message, used to absorb
+	// retries and to match the echo to an optimistically rendered message.
+	ClientMessageID string `json:"client_message_id,omitempty"`
+	// SentAt is when the sender sent the message by its own clock. It goes
+	// into the envelope, next to the server time, rather than the data.
+	SentAt *time.Time `json:"sent_at,omitempty"`
+	// Ciphertext replaces Message in encrypted rooms: base64 sealed by the
+	// members with the key KeyID names. The server never sees the key.
+	Ciphertext string `json:"ciphertext,omitempty"`
+	KeyID      string `json:"key_id,omitempty"`
+	// Metadata is the publisher's own small string map for routing in its
+	// app; streams can filter on it.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Poll makes the message a poll with Message as its question;
+	// Components are its buttons.
+	Poll       *Poll       `json:"poll,omitempty"`
+	Components []Component `json:"components,omitempty"`
+}
+
+// SendResult is what /chat/send answers from API version 2 on: the envelope
+// the message went out as, to match against the broadcast. Version 1 answers
+// "Message sent" as text.
+type SendResult struct {
+	MessageID       string    `json:"message_id,omitempty"`
+	Room            string    `json:"room"`
+	Seq             uint64    `json:"seq,omitempty"`
+	Time            time.Time `json:"time"`
+	ClientMessageID string    `json:"client_message_id,omitempty"`
+	// Duplicate marks the answer to a retry of a message already sent. It
+	// has the original's ID unless the original is still being published.
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+func sendResult(chat Chat, env Envelope) SendResult {
+	return SendResult{MessageID: env.ID, Room: chat.Room, Seq: env.Seq, Time: env.Time, ClientMessageID: chat.ClientMessageID}
+}
+
+// shadowEnvelope is what a shadow-muted message would have gone out as, so
+// the sender can't tell it didn't.
+func shadowEnvelope(broker *Broker, room string) Envelope {
+	seq := broker.LatestSequence(room) + 1
+	return Envelope{ID: room + ":" + strconv.FormatUint(seq, 10), Room: room, Seq: seq, Time: time.Now().UTC()}
+}
+
+func writeSent(w http.ResponseWriter, r *http.Request, result SendResult) {
+	if apiVersionFrom(r).Version == "1" {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("Message sent"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(result)
 }
 
-func sendChatHandler(chatEvent *Event) func(w http.ResponseWriter, r *http.Request) {
+func sendChatHandler(broker *Broker, rooms *roomRegistry, spam *spamDetector, challenge *sendChallenge, dedup *publishDeduper, async *asyncPublisher, unfurl *unfurler, emojis *emojiRegistry, features *featureSet) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if err := broker.Admit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
 		chat := Chat{}
 
 		err := json.NewDecoder(r.Body).Decode(&chat)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeError(w, r, invalidJSON(err))
 			return
 		}
 
-		chatRaw, err := json.Marshal(chat)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if chat.Room == "" {
+			chat.Room = defaultRoom
+		}
+		// Messages are sent as the verified caller, a guest at least; a
+		// user_id in the body may only repeat it.
+		user := userFromRequest(r)
+		if user == "" {
+			writeError(w, r, errUnauthenticated)
+			return
+		}
+		if chat.UserID != "" && chat.UserID != user {
+			writeError(w, r, fmt.Errorf("%w: user_id does not match the caller", errForbidden))
+			return
+		}
+		chat.UserID = user
+		if err := rooms.CheckPublish(chat.Room, user); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if err := challenge.Check(r, rooms, chat.Room); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if err := rooms.Moderate(chat.Room, &chat); err != nil {
+			writeError(w, r, err)
 			return
 		}
+		if err := clientMessageID(r, &chat); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if err := checkSentAt(&chat); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		chat.Emoji = nil
+		if features.Enabled(featureEmoji) {
+			chat.Emoji = emojis.Resolve(chat.Room, chat.Message)
+		}
 
-		chatEvent.Publish(chatRaw)
-		w.WriteHeader(http.StatusCreated)
-		w.Write([]byte("Message sent"))
-		return
+		// With Prefer: respond-async the sender gets 202 and a message ID
+		// to follow once the message is queued. Retrying with the same
+		// client_message_id gets the same ID back.
+		accepted := wantsAsync(r)
+		if accepted && chat.ClientMessageID != "" {
+			if status, ok := async.Accepted(dedupKey(chat)); ok {
+				writeAccepted(w, status)
+				return
+			}
+		}
+
+		// Duplicates are answered like the original so the client's retry
+		// logic sees success, and don't count against the sender's trust.
+		key, fresh := dedup.Claim(chat)
+		if !fresh {
+			original, _ := dedup.Original(key)
+			result := sendResult(chat, original)
+			result.Duplicate = true
+			if original.ID == "" {
+				result.Time = time.Now().UTC()
+			}
+			writeSent(w, r, result)
+			return
+		}
+
+		if spam.Check(spamKey(r), chat.Room, chat.payload()).Muted {
+			shadowMutedSent.Inc()
+			if accepted {
+				writeAccepted(w, async.Published(chat, key))
+				return
+			}
+			writeSent(w, r, sendResult(chat, shadowEnvelope(broker, chat.Room)))
+			return
+		}
+
+		if accepted {
+			status, err := async.Enqueue(r, chat, key)
+			if err != nil {
+				dedup.Release(key)
+				writeError(w, r, err)
+				return
+			}
+			writeAccepted(w, status)
+			return
+		}
+
+		env, err := publishChat(broker, chat)
+		if err != nil {
+			dedup.Release(key)
+			writeError(w, r, err)
+			return
+		}
+		dedup.Published(key, env)
+		if unfurl != nil && env.ID != "" && features.Enabled(featurePreviews) {
+			unfurl.Enqueue(env.ID, env.Room, chat.Message)
+		}
+		writeSent(w, r, sendResult(chat, env))
 	}
 }
 
@@ -125,16 +647,64 @@ func htmlHandler(w http.ResponseWriter, r *http.Request) {
     const userIdInput = document.getElementById("user-id");
     const messageInput = document.getElementById("message");
 
+    // Sign in as a guest; the cookie identifies us from then on.
+    fetch("/chat/guest", { method: "POST" })
+      .then(function(response) { return response.json(); })
+      .then(function(guest) {
+        userIdInput.value = guest.user_id;
+        userIdInput.readOnly = true;
+      });
+
     // Connect to the SSE endpoint.
     const evtSource = new EventSource("/chat/events");
 
     evtSource.onmessage = function(e) {
-      const data = JSON.parse(e.data);
+      const data = JSON.parse(e.data).data;
       const li = document.createElement("li");
       li.textContent = "Message from: " + data.user_id + " - " + data.message;
+      if (data.attachment && data.attachment.kind === "voice") {
+        const audio = document.createElement("audio");
+        audio.controls = true;
+        audio.src = data.attachment.url;
+        li.appendChild(audio);
+      } else if (data.attachment) {
+        const img = document.createElement("img");
+        img.src = data.attachment.url;
+        img.style.maxWidth = "240px";
+        li.appendChild(img);
+      }
       eventList.appendChild(li);
     };
 
+    evtSource.addEventListener("preview", function(e) {
+      const preview = JSON.parse(e.data).data;
+      const li = document.createElement("li");
+      li.textContent = "Preview: " + (preview.title || preview.url) + " - " + preview.url;
+      eventList.appendChild(li);
+    });
+
+    evtSource.addEventListener("announcement", function(e) {
+      const announcement = JSON.parse(e.data).data;
+      const li = document.createElement("li");
+      li.textContent = "Announcement: " + announcement.message;
+      eventList.appendChild(li);
+    });
+
+    evtSource.addEventListener("presence", function(e) {
+      const presence = JSON.parse(e.data).data;
+      const li = document.createElement("li");
+      li.textContent = presence.user_id + " is " + presence.status;
+      eventList.appendChild(li);
+    });
+
+    // Report activity so others see us as active rather than just connected.
+    setInterval(function() {
+      const userId = userIdInput.value.trim();
+      if (userId && document.visibilityState === "visible") {
+        fetch("/chat/heartbeat", { method: "POST" });
+      }
+    }, 30000);
+
     evtSource.onerror = function(e) {
       console.error("Error:", e);
     };
@@ -165,7 +735,8 @@ func htmlHandler(w http.ResponseWriter, r *http.Request) {
         if (response.ok) {
           messageInput.value = ""; // Clear message input after sending
         } else {
-          console.error("Failed to send message");
+          const err = await response.json();
+          console.error("Failed to send message:", err.code, err.message);
         }
       } catch (error) {
         console.error("Error sending message:", error);
@@ -179,12 +750,651 @@ func htmlHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	chatEvent := &Event{}
+	if len(os.Args) > 1 && os.Args[1] == "compact" {
+		runCompact(os.Args[2:])
+		return
+	}
+
+	addr := flag.String("addr", ":8080", "listen address")
+	tlsCert := flag.String("tls-cert", "", "TLS certificate file, enables HTTPS and HTTP/2")
+	tlsKey := flag.String("tls-key", "", "TLS private key file")
+	h2c := flag.Bool("h2c", false, "accept cleartext HTTP/2 (prior knowledge), for use behind a TLS-terminating proxy")
+	h3 := flag.Bool("h3", false, "also serve HTTP/3 over QUIC (requires TLS and a build with -tags h3)")
+	shards := flag.Int("shards", runtime.NumCPU(), "number of subscriber registry shards")
+	relayToken := flag.String("relay-token", "", "shared secret of a relay tree: edges present it to their upstream, and with it set this node serves /internal/relay to edges (empty disables relaying)")
+	relayUpstream := flag.String("relay-upstream", "", "run as an edge: comma-separated base URLs of upstream nodes to relay from, the fastest to answer first; publishes are forwarded to them")
+	bandwidth := flag.Int("subscriber-bandwidth", 0, "per-subscriber SSE bandwidth limit in bytes/sec (0 disables)")
+	adminToken := flag.String("admin-token", "", "bearer token for the admin API (empty disables it)")
+	moderatorToken := flag.String("moderator-token", "", "bearer token for the moderator role: the subscriber, room, ban and spam parts of the admin API and UI, but not configuration, keys or the store (needs -admin-token)")
+	unfurlLinks := flag.Bool("unfurl", false, "fetch OpenGraph previews for links in messages")
+	inviteSecret := flag.String("invite-secret", "", "HMAC secret for invite links (random per process if empty)")
+	apiKeySecretFlag := flag.String("api-key-secret", "", "secret API key secrets are derived from; only their salts are stored (random per process if empty)")
+	chaos := flag.Bool("chaos", false, "inject latency, drops and disconnects into /chat/events (dev only)")
+	chaosLatency := flag.Duration("chaos-latency", 0, "fixed latency added to every event when -chaos is set")
+	chaosJitter := flag.Duration("chaos-jitter", 0, "random extra latency up to this duration when -chaos is set")
+	chaosDropRate := flag.Float64("chaos-drop-rate", 0.05, "probability of silently dropping an event when -chaos is set")
+	chaosDisconnectRate := flag.Float64("chaos-disconnect-rate", 0.01, "probability of disconnecting on an event when -chaos is set")
+	selfTestOn := flag.Bool("selftest", false, "run a synthetic load alongside the server: publish into the "+selfTestRoom+" room and report throughput, delivery latency and memory growth in the log and at /admin/selftest")
+	selfTestRate := flag.Float64("selftest-rate", 100, "messages per second the -selftest publisher sends")
+	selfTestSubscribers := flag.Int("selftest-subscribers", 10, "subscribers the -selftest delivers each message to")
+	selfTestSize := flag.Int("selftest-size", 64, "message size in bytes of -selftest messages")
+	selfTestDuration := flag.Duration("selftest-duration", 0, "how long -selftest runs before it stops and reports its totals (0 runs it until shutdown)")
+	selfTestReport := flag.Duration("selftest-report", 10*time.Second, "how often -selftest reports")
+	mqttBroker := flag.String("mqtt-broker", "", "MQTT broker URL to bridge rooms to, e.g. tcp://localhost:1883 (empty disables it)")
+	mqttClientID := flag.String("mqtt-client-id", "go-event-stream-chat", "MQTT client ID")
+	mqttUsername := flag.String("mqtt-username", "", "MQTT username")
+	mqttPassword := flag.String("mqtt-password", "", "MQTT password")
+	mqttOutTopic := flag.String("mqtt-out-topic", "chat/{room}/messages", "MQTT topic room messages are mirrored to")
+	mqttInTopic := flag.String("mqtt-in-topic", "chat/{room}/send", "MQTT topic messages are accepted from")
+	mqttRooms := flag.String("mqtt-rooms", "", "comma-separated rooms to bridge (empty bridges all public rooms)")
+	mqttQoS := flag.Int("mqtt-qos", 1, "MQTT QoS level for bridged messages (0, 1 or 2)")
+	saturation := flag.Float64("backpressure-threshold", 0.9, "delivery queue fill (0-1) at which /chat/send answers 503 (0 disables it)")
+	shedHeap := flag.Uint64("shed-heap-mb", 0, "live heap in MiB at which the node starts shedding load: refusing new streams, tightening rate limits and dropping presence, preview and lifecycle events (0 disables it)")
+	shedBuffers := flag.Float64("shed-buffer-fill", 0, "average subscriber buffer fill (0-1) at which the node starts shedding load (0 disables it)")
+	streamRetry := flag.Duration("stream-retry", 3*time.Second, "reconnection delay streams suggest to EventSource; each gets up to twice this, jittered (0 leaves it to the client)")
+	admissionRate := flag.Float64("stream-admission-rate", 0, "new streams per second /chat/events admits; more get 503 with a jittered Retry-After (0 disables the limit)")
+	admissionBurst := flag.Int("stream-admission-burst", 100, "streams /chat/events admits at once above -stream-admission-rate")
+	streamBinding := flag.String("stream-binding", bindingLog, "what to do when a request acting on a subscription, or a stream opened with credentials in its URL, comes from another client than the stream is bound to: off, log (log, count and alert in #system) or enforce (also refuse it)")
+	streamBindingMatch := flag.String("stream-binding-match", "client_id,user_agent", "comma-separated attributes a stream's client must keep for -stream-binding: client_id (its client ID cookie), ip, network (the IPv4 /24 or IPv6 /48) and user_agent")
+	warmup := flag.Duration("warmup", 0, "after startup, ramp -stream-admission-rate up from a tenth and replay resuming streams a few at a time for this long (0 disables it)")
+	dedupWindow := flag.Duration("dedup-window", 0, "absorb repeated publishes of the same message by the same sender within this window (0 disables it)")
+	metaInterval := flag.Duration("meta-interval", 30*time.Second, "how often streams get a meta event with their lag and drop count (0 disables it)")
+	lifecycleEvents := flag.Bool("lifecycle-events", true, "mirror subscriber connects, joins, leaves and kicks and room creation into the #system room")
+	anonymousStreams := flag.Bool("anonymous-streams", true, "let unauthenticated clients stream public rooms (rooms marked public_stream are always readable)")
+	anonymousRate := flag.Float64("anonymous-rate", 30, "streams and replays per minute an unauthenticated address may open (0 disables the limit)")
+	feedbackRate := flag.Float64("feedback-rate", 3, "messages per minute an address may leave in feedback rooms (0 disables the limit)")
+	captchaURL := flag.String("captcha-verify-url", "", "siteverify endpoint of the captcha provider (hCaptcha, reCAPTCHA or Turnstile) that messages left in feedback rooms, and senders rooms challenge, must pass (empty needs no captcha)")
+	captchaSecret := flag.String("captcha-secret", "", "secret key of the captcha provider")
+	captchaProvider := flag.String("captcha-provider", "", "captcha provider whose siteverify endpoint to use unless -captcha-verify-url is given: hcaptcha, turnstile or recaptcha")
+	captchaSiteKey := flag.String("captcha-site-key", "", "public site key of the captcha provider, handed to senders asked to solve a captcha")
+	captchaPassTTL := flag.Duration("captcha-pass-ttl", 30*time.Minute, "how long a solved send challenge lets its sender through")
+	replayMaxAge := flag.Duration("replay-max-age", 5*time.Second, "how long shared caches may keep replays of publicly readable rooms")
+	proxiesFlag := flag.String("trusted-proxies", "", "comma-separated proxy addresses or CIDRs whose X-Forwarded-For, -Proto and -Host headers are trusted")
+	geoipPath := flag.String("geoip-db", "", "CSV file of network,country,region lines to tag connections with (empty disables GeoIP)")
+	analyticsKind := flag.String("analytics", "", "export every published envelope to an analytics sink: stdout, http or segment (empty disables). Enable it on one node only")
+	analyticsURL := flag.String("analytics-url", "", "collector URL of the http analytics sink, or the batch API of a Segment-compatible one")
+	analyticsKey := flag.String("analytics-key", "", "bearer token of the http analytics sink, or the Segment write key")
+	analyticsBatch := flag.Int("analytics-batch", 100, "envelopes per analytics batch")
+	analyticsFlush := flag.Duration("analytics-flush", 5*time.Second, "longest an envelope waits to be exported to analytics")
+	federationName := flag.String("federation-name", "", "name this server federates with peers as, its host name; federation, with peers from the -config file, is off without it. Set it on one node only")
+	signatureSkew := flag.Duration("signature-skew", 5*time.Minute, "how far the timestamp of a request signed with an API key may be from the server clock")
+	resumeLimit := flag.Int("resume-limit", 200, "most events replayed to a resuming stream; clients further behind get an overflow event pointing at the replay API (0 disables the cap)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "how long a graceful shutdown on SIGTERM may take in total")
+	reconnectDelay := flag.Duration("reconnect-delay", 5*time.Second, "delay suggested to clients in the shutdown event; each gets up to twice this, jittered")
+	handoffStandby := flag.Bool("handoff-standby", false, "refuse sends and new streams until another instance sharing -store hands off to this one through POST /admin/handoff")
+	compressStreams := flag.Bool("compress-streams", false, "compress /chat/events with gzip or the deflate-dict stream dictionary when clients accept it (costs memory per stream)")
+	presenceIdle := flag.Duration("presence-idle", 2*time.Minute, "time without heartbeats after which a user turns away")
+	blobCfg := blobConfig{}
+	blobCfg.register(flag.CommandLine)
+	corsOrigins := flag.String("cors-origins", "", "comma-separated origins allowed to call the API from browsers (* allows any)")
+	disableFeatures := flag.String("disable-features", "", "comma-separated features to switch off: "+strings.Join(knownFeatures, ", "))
+	enableFeatures := flag.String("enable-features", "", "comma-separated experimental features to switch on: "+strings.Join(experimentalFeatures, ", "))
+	configPath := flag.String("config", "", "JSON file with reloadable settings, re-read on SIGHUP and POST /admin/config/reload")
+	migrate := flag.String("migrate", migrateAuto, "schema migrations of -store: auto applies them at startup, check refuses to start with pending ones, only applies them and exits")
+	archiveAfter := flag.Duration("archive-after", 0, "move stored messages older than this into gzipped segments in the blob store; history and replay read them back (0 keeps everything in the store)")
+	dataDir := flag.String("data-dir", "", "directory for durable state: keeps messages in chat.db (chat.bolt with -store-engine bolt) and, with -blob-store local, blobs in blobs/ unless -store or -blob-dir say otherwise")
+	deliveryLogSize := flag.Int("delivery-log", 0, "delivery outcomes of subscribers to keep for /admin/deliveries, newest first (0 disables)")
+	storePath := flag.String("store", "", "database to persist messages in (empty keeps them in memory only)")
+	storeEngine := flag.String("store-engine", storeEngineSQLite, "what -store is: sqlite, or bolt for a bbolt file that keeps only messages, room cursors, rooms, bans and guest links")
+	storeCompressAbove := flag.Int("store-compress-above", 0, "store messages whose encoded data is larger than this many bytes zstd-compressed (0 disables it; compressed rows are always readable)")
+	storeCodecName := flag.String("store-codec", codecJSON, "encoding of messages newly written to -store: json or msgpack (rows written with either are always readable)")
+	flag.Parse()
+	if *storeEngine != storeEngineSQLite && *storeEngine != storeEngineBolt {
+		log.Fatal("-store-engine must be sqlite or bolt")
+	}
+	if *dataDir != "" {
+		if err := applyDataDir(flag.CommandLine, *dataDir, *storeEngine); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var backend Backend = NewLocalBackend()
+	var relay *relayBackend
+	if *relayUpstream != "" {
+		if *storePath != "" {
+			log.Fatal("-relay-upstream stores nothing itself; drop -store, the upstream keeps the history")
+		}
+		edge, err := newRelayBackend(*relayUpstream, *relayToken)
+		if err != nil {
+			log.Fatal(err)
+		}
+		relay, backend = edge, edge
+	}
+	if *federationName != "" && (*relayUpstream != "" || !serverNamePattern.MatchString(*federationName)) {
+		log.Fatal("-federation-name must be a lowercase host name, on a node that isn't a relay edge")
+	}
+	broker, err := NewBroker(*shards, backend)
+	if err != nil {
+		log.Fatal(err)
+	}
+	deliveries := newDeliveryLog(*deliveryLogSize)
+	broker.UseDeliveryLog(deliveries)
+
+	switch *migrate {
+	case migrateAuto, migrateCheck:
+	case migrateOnly:
+		if *storePath == "" || *storeEngine != storeEngineSQLite {
+			log.Fatal("-migrate only needs a SQLite -store")
+		}
+	default:
+		log.Fatal("-migrate must be auto, check or only")
+	}
 
-	http.HandleFunc("/chat/send", sendChatHandler(chatEvent))
-	http.HandleFunc("/chat/events", receiveChatHandler(chatEvent))
+	var store *messageStore
+	var kv *boltStore
+	switch {
+	case *storePath != "" && *storeEngine == storeEngineBolt:
+		kv, err = openBoltStore(*storePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		broker.UseJournal(kv)
+		recovered, err := kv.Recover(context.Background(), broker.Restore)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Store: recovered the history of %d rooms", recovered)
+	case *storePath != "":
+		store, err = openMessageStore(*storePath, *migrate)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *migrate == migrateOnly {
+			store.db.Close()
+			return
+		}
+		codec, err := storeCodecByName(*storeCodecName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		store.UseCodec(codec)
+		if *storeCompressAbove < 0 {
+			log.Fatal("-store-compress-above must not be negative")
+		}
+		store.UseCompression(*storeCompressAbove)
+		broker.UseStore(store)
+		recovered, err := store.Recover(context.Background(), broker.Restore)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Store: recovered the history of %d rooms", recovered)
+		if err := store.drainOutbox(); err != nil {
+			log.Printf("Outbox: %v", err)
+		}
+		go store.runDispatcher()
+		newGaugeFunc("chat_outbox_pending", "Stored messages not yet published.", store.pendingCount)
+	}
+
+	rooms := newRoomRegistry()
+	if store != nil {
+		replayed, err := store.RecoverRooms(context.Background(), rooms)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Store: rebuilt %d rooms, replaying %d events after the last snapshot", len(rooms.List()), replayed)
+		rooms.UseJournal(store)
+	}
+	if kv != nil {
+		replayed, err := kv.RecoverRooms(context.Background(), rooms)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Store: rebuilt %d rooms, replaying %d events after the last snapshot", len(rooms.List()), replayed)
+		rooms.UseJournal(kv)
+	}
+	bans := newBanList()
+	if store != nil {
+		banned, err := store.RecoverBans(context.Background(), bans)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Store: recovered %d bans", banned)
+		bans.UseStore(store)
+	}
+	if kv != nil {
+		banned, err := kv.RecoverBans(context.Background(), bans)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Store: recovered %d bans", banned)
+		bans.UseStore(kv)
+	}
+	templates := newRoomTemplates()
+	if store != nil {
+		recovered, err := store.RecoverRoomTemplates(context.Background(), templates)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Store: recovered %d room templates", recovered)
+		templates.UseStore(store)
+	}
+	apiKeySecret := []byte(*apiKeySecretFlag)
+	if len(apiKeySecret) == 0 {
+		apiKeySecret = make([]byte, 32)
+		if _, err := rand.Read(apiKeySecret); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("No -api-key-secret given, API keys won't survive a restart")
+	}
+	apiKeys := newAPIKeyRegistry(apiKeySecret, *signatureSkew)
+	if store != nil {
+		recovered, err := store.RecoverAPIKeys(context.Background(), apiKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Store: recovered %d API keys", recovered)
+		apiKeys.UseStore(store)
+	}
+	blobs, err := blobCfg.open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	attachments := newAttachmentStore(blobs, blobCfg.presignTTL)
+	if store != nil {
+		recovered, err := store.RecoverAttachments(context.Background(), attachments)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Store: recovered %d attachments", recovered)
+		attachments.UseStore(store)
+	}
+	secret := []byte(*inviteSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("No -invite-secret given, invites won't survive a restart")
+	}
+	invites := newInviteSigner(secret)
+	guests := newGuestAccounts(invites)
+	if store != nil {
+		recovered, err := store.RecoverGuestLinks(context.Background(), guests)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Store: recovered %d guest links", recovered)
+		guests.UseStore(store)
+	}
+	if kv != nil {
+		recovered, err := kv.RecoverGuestLinks(context.Background(), guests)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Store: recovered %d guest links", recovered)
+		guests.UseStore(kv)
+	}
+	if *handoffStandby && store == nil {
+		log.Fatal("-handoff-standby needs -store, which the node it takes over from shares")
+	}
+	handoffs, err := newHandoffs(store, broker, rooms, bans, templates, apiKeys, attachments, guests, *handoffStandby)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *handoffStandby {
+		log.Printf("Handoff: standing by to take over from another instance")
+		go handoffs.Await()
+	}
+	retention := newRetentionPolicies()
+	var expirer messageExpirer
+	switch {
+	case store != nil:
+		expirer = store
+	case kv != nil:
+		expirer = kv
+	}
+	go runMessageJanitor(broker, expirer, rooms, retention)
+	waiting := newWaitingRoom(rooms.Capacity)
+	audit := newAuditLog()
+	stats := newRoomStats()
+	broker.Tap(stats.Observe)
+	polls := newPollRegistry(broker)
+	broker.Tap(polls.Observe)
+	actions := newActionRegistry()
+	var analytics *analyticsExporter
+	if *analyticsKind != "" {
+		sink, err := newAnalyticsSink(*analyticsKind, *analyticsURL, *analyticsKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *analyticsFlush <= 0 {
+			log.Fatal("-analytics-flush must be positive")
+		}
+		analytics = newAnalyticsExporter(sink, *analyticsBatch, *analyticsFlush)
+		broker.Tap(analytics.Observe)
+	}
+	var federated *federation
+	if *federationName != "" {
+		federated = newFederation(*federationName, broker, rooms, *signatureSkew)
+		broker.Tap(federated.Observe)
+	}
+	broker.OnOccupancy(stats.Occupancy)
+	var lifecycle *lifecycleMirror
+	if *lifecycleEvents {
+		lifecycle = newLifecycleMirror(broker)
+		broker.OnLifecycle(lifecycle.Record)
+	}
+	statuses := newUserStatuses()
+	prefs := newNotificationPrefs(statuses)
+	policies := newStreamPolicies()
+	presence := newPresenceTracker(broker, statuses, *presenceIdle)
+	clients := newClientTracker()
+	if relay != nil {
+		relay.Start(rooms, bans)
+	}
+	var relays *relayHub
+	if *relayToken != "" {
+		relays = newRelayHub(broker, rooms, bans)
+		if err := backend.Subscribe(relays.dispatch); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	webhooks := newWebhookRegistry()
+
+	var origins []string
+	if *corsOrigins != "" {
+		origins = strings.Split(*corsOrigins, ",")
+	}
+	cors := newCORSPolicy(origins)
+	proxies, err := parseTrustedProxies(*proxiesFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var geo *geoDB
+	if *geoipPath != "" {
+		if geo, err = loadGeoDB(*geoipPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	bandwidthLimit := &atomic.Int64{}
+	features := newFeatureSet()
+	featureOverrides := map[string]bool{}
+	if *enableFeatures != "" {
+		for _, name := range strings.Split(*enableFeatures, ",") {
+			featureOverrides[strings.TrimSpace(name)] = true
+		}
+	}
+	if *disableFeatures != "" {
+		for _, name := range strings.Split(*disableFeatures, ",") {
+			featureOverrides[strings.TrimSpace(name)] = false
+		}
+	}
+
+	spam := newSpamDetector(defaultSpamConfig, func(flag SpamFlag) {
+		flagRaw, err := json.Marshal(flag)
+		if err != nil {
+			return
+		}
+		broker.Publish(moderationRoom, flagRaw)
+	})
+
+	reloader := &configReloader{
+		path: *configPath,
+		base: RuntimeConfig{
+			SubscriberBandwidth: *bandwidth,
+			BackpressureLimit:   *saturation,
+			PresenceIdle:        configDuration(*presenceIdle),
+			Spam:                spamSettingsFrom(defaultSpamConfig),
+			CORSOrigins:         origins,
+			Features:            featureOverrides,
+		},
+		bandwidth:  bandwidthLimit,
+		broker:     broker,
+		presence:   presence,
+		spam:       spam,
+		cors:       cors,
+		rooms:      rooms,
+		features:   features,
+		federation: federated,
+	}
+	if _, err := reloader.Reload(); err != nil {
+		log.Fatal(err)
+	}
+	if *configPath != "" {
+		go reloader.watchSignals()
+	}
+
+	dedup := newPublishDeduper(*dedupWindow)
+
+	emojis := newEmojiRegistry(blobs, broker)
+	if store != nil {
+		store.OnPurge(attachments.Purged)
+		if *archiveAfter > 0 {
+			go runArchiver(store, blobs, rooms, retention, *archiveAfter)
+		}
+	}
+	tiers := newTieredHistory(broker, store, blobs)
+
+	var unfurl *unfurler
+	if *unfurlLinks {
+		unfurl = newUnfurler(broker)
+	}
+	async := newAsyncPublisher(broker, dedup, unfurl, features)
+
+	if *mqttBroker != "" {
+		var bridged []string
+		if *mqttRooms != "" {
+			bridged = strings.Split(*mqttRooms, ",")
+		}
+		if *mqttQoS < 0 || *mqttQoS > 2 {
+			log.Fatal("-mqtt-qos must be 0, 1 or 2")
+		}
+		err := startMQTTBridge(mqttConfig{
+			Broker:   *mqttBroker,
+			ClientID: *mqttClientID,
+			Username: *mqttUsername,
+			Password: *mqttPassword,
+			OutTopic: *mqttOutTopic,
+			InTopic:  *mqttInTopic,
+			Rooms:    bridged,
+			QoS:      byte(*mqttQoS),
+		}, broker, rooms, dedup)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	newGaugeFunc("chat_subscribers", "Connected SSE subscribers.", func() float64 {
+		return float64(broker.SubscriberCount())
+	})
+	newGaugeVecFunc("chat_subscribers_by_region", "Connected SSE subscribers by client region.", "region", broker.RegionCounts)
+	registerLeakMetrics(broker)
+	newGaugeFunc("chat_delivery_queue_saturation", "Fill ratio of the fullest shard delivery queue.", broker.Saturation)
+	newGaugeFunc("chat_delivery_queue_depth", "Events waiting in shard delivery queues.", func() float64 {
+		return float64(broker.QueueDepth())
+	})
+
+	anonymous := newAnonymousLimiter(*anonymousRate)
+	feedbackLimiter := newAnonymousLimiter(*feedbackRate)
+	var captcha captchaVerifier
+	if *captchaURL != "" || *captchaProvider != "" {
+		verifier, err := newCaptchaVerifier(*captchaProvider, *captchaURL, *captchaSecret, *captchaSiteKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		captcha = verifier
+	}
+	challenge := newSendChallenge(captcha, *captchaProvider, *captchaSiteKey, *captchaPassTTL, spam)
+	admission := newStreamAdmission(*streamRetry, *admissionRate, *admissionBurst, *warmup)
+	bindings, err := newStreamBindings(broker, *streamBinding, *streamBindingMatch)
+	if err != nil {
+		log.Fatal(err)
+	}
+	shedder := newLoadShedder(broker, spam, anonymous, *shedHeap<<20, *shedBuffers)
+	streamHandler := receiveChatHandler(broker, rooms, waiting, prefs, policies, presence, clients, stats, admission, bindings, handoffs, *resumeLimit, *metaInterval)
+	streamChain := func(h http.HandlerFunc) http.HandlerFunc {
+		return throttleMiddleware(bandwidthLimit, compressMiddleware(*compressStreams, systemRoomGuard(*adminToken, anonymousGuard(rooms, anonymous, *anonymousStreams, h))))
+	}
+	eventsHandler := streamChain(streamHandler)
+	ndjsonHandler := streamChain(ndjsonStream(streamHandler))
+	if *chaos {
+		// Inside compression, so faults hit whole frames and never the
+		// compressed stream.
+		log.Println("Chaos mode enabled on /chat/events")
+		eventsHandler = streamChain(chaosMiddleware(chaosConfig{
+			Latency:        *chaosLatency,
+			Jitter:         *chaosJitter,
+			DropRate:       *chaosDropRate,
+			DisconnectRate: *chaosDisconnectRate,
+		}, streamHandler))
+	}
+	var selfTester *selfTest
+	if *selfTestOn {
+		selfTester, err = startSelfTest(selfTestConfig{
+			Rate:        *selfTestRate,
+			Subscribers: *selfTestSubscribers,
+			Size:        *selfTestSize,
+			Duration:    *selfTestDuration,
+			Report:      *selfTestReport,
+		}, broker, rooms)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	drain := newDrainer(broker, store, kv, async, handoffs, *shutdownTimeout, *reconnectDelay)
+	http.HandleFunc("GET /healthz", healthHandler(drain))
+	sendHandler := sendChatHandler(broker, rooms, spam, challenge, dedup, async, unfurl, emojis, features)
+	http.HandleFunc("/chat/send", standbyGuard(handoffs, sendHandler))
+	http.HandleFunc("GET /chat/messages/{id}/status", publishStatusHandler(async))
+	http.HandleFunc("POST /chat/send/batch", standbyGuard(handoffs, sendBatchHandler(broker, rooms, spam, challenge, dedup, unfurl, emojis, features)))
+	http.HandleFunc("POST /chat/messages/{id}/forward", featureGate(features, featureForwarding, forwardMessageHandler(broker, rooms, audit)))
+	http.HandleFunc("POST /chat/messages/{id}/vote", featureGate(features, featureComponents, voteHandler(polls, rooms)))
+	http.HandleFunc("GET /chat/messages/{id}/poll", featureGate(features, featureComponents, pollResultsHandler(polls, rooms)))
+	http.HandleFunc("POST /chat/messages/{id}/actions/{component}", featureGate(features, featureComponents, invokeActionHandler(broker, rooms, actions)))
+	http.HandleFunc("POST /chat/attachments", featureGate(features, featureUploads, uploadAttachmentHandler(broker, rooms, attachments)))
+	http.HandleFunc("GET /chat/attachments/{id}", downloadAttachmentHandler(rooms, attachments))
+	http.HandleFunc("POST /chat/rooms", createRoomHandler(rooms, lifecycle, audit))
+	http.HandleFunc("PUT /chat/rooms/{room}/mode", setRoomModeHandler(rooms, audit))
+	http.HandleFunc("PUT /chat/rooms/{room}/public-stream", setPublicStreamHandler(rooms, audit))
+	http.HandleFunc("POST /chat/rooms/{room}/feedback", feedbackHandler(broker, rooms, feedbackLimiter, captcha))
+	http.HandleFunc("GET /chat/rooms/{room}/replay", replayHandler(*adminToken, broker, tiers, rooms, anonymous, *anonymousStreams, *replayMaxAge))
+	http.HandleFunc("GET /chat/rooms/{room}/stats", roomStatsHandler(rooms, stats, store))
+	http.HandleFunc("PUT /chat/rooms/{room}/message-ttl", setMessageTTLHandler(rooms, audit))
+	http.HandleFunc("PUT /chat/rooms/{room}/welcome", setWelcomeHandler(rooms, audit))
+	http.HandleFunc("PUT /chat/rooms/{room}/encryption", setEncryptionHandler(rooms, webhooks, audit))
+	http.HandleFunc("PUT /chat/rooms/{room}/capacity", setRoomCapacityHandler(rooms, waiting, audit))
+	http.HandleFunc("POST /chat/rooms/{room}/invites", featureGate(features, featureInvites, createInviteHandler(rooms, invites, audit)))
+	http.HandleFunc("PUT /chat/subscriptions/{id}/rooms/{room}", featureGate(features, featureSubscriptions, subscriptionHandler(*adminToken, broker, rooms, waiting, presence, bindings, true)))
+	http.HandleFunc("DELETE /chat/subscriptions/{id}/rooms/{room}", featureGate(features, featureSubscriptions, subscriptionHandler(*adminToken, broker, rooms, waiting, presence, bindings, false)))
+	http.HandleFunc("POST /chat/subscriptions/{id}/ack", ackHandler(broker, bindings))
+	http.HandleFunc("POST /chat/subscriptions/{id}/auth", featureGate(features, featureSubscriptions, refreshAuthHandler(*adminToken, broker, rooms, waiting, presence, bindings)))
+	http.HandleFunc("POST /chat/heartbeat", featureGate(features, featurePresence, heartbeatHandler(rooms, presence)))
+	http.HandleFunc("GET /chat/status", featureGate(features, featurePresence, getStatusHandler(statuses)))
+	http.HandleFunc("PUT /chat/status", featureGate(features, featurePresence, setStatusHandler(statuses, presence)))
+	http.HandleFunc("DELETE /chat/status", featureGate(features, featurePresence, clearStatusHandler(statuses, presence)))
+	http.HandleFunc("GET /chat/users/{user}/status", featureGate(features, featurePresence, getStatusHandler(statuses)))
+	http.HandleFunc("GET /chat/rooms/{room}/presence", featureGate(features, featurePresence, presenceHandler(rooms, presence)))
+	http.HandleFunc("GET /chat/preferences", featureGate(features, featurePreferences, listNotificationPreferencesHandler(prefs)))
+	http.HandleFunc("GET /chat/rooms/{room}/preferences", featureGate(features, featurePreferences, getNotificationPreferenceHandler(prefs)))
+	http.HandleFunc("PUT /chat/rooms/{room}/preferences", featureGate(features, featurePreferences, setNotificationPreferenceHandler(broker, rooms, prefs)))
+	http.HandleFunc("DELETE /chat/rooms/{room}/preferences", featureGate(features, featurePreferences, resetNotificationPreferenceHandler(broker, prefs)))
+	http.HandleFunc("POST /chat/invites/{token}", featureGate(features, featureInvites, redeemInviteHandler(rooms, invites, audit)))
+	http.HandleFunc("POST /chat/rooms/{room}/webhooks", featureGate(features, featureWebhooks, createWebhookHandler(rooms, webhooks, audit)))
+	http.HandleFunc("GET /chat/rooms/{room}/webhooks", featureGate(features, featureWebhooks, listWebhooksHandler(rooms, webhooks)))
+	http.HandleFunc("DELETE /chat/rooms/{room}/webhooks/{id}", featureGate(features, featureWebhooks, deleteWebhookHandler(rooms, webhooks, audit)))
+	http.HandleFunc("POST /hooks/{id}/{token}", featureGate(features, featureWebhooks, receiveWebhookHandler(broker, rooms, webhooks, "")))
+	http.HandleFunc("POST /hooks/{id}/{token}/slack", featureGate(features, featureWebhooks, receiveWebhookHandler(broker, rooms, webhooks, webhookDialectSlack)))
+	http.HandleFunc("POST /hooks/{id}/{token}/discord", featureGate(features, featureWebhooks, receiveWebhookHandler(broker, rooms, webhooks, webhookDialectDiscord)))
+	http.HandleFunc("POST /chat/guest", createGuestHandler(guests))
+	http.HandleFunc("POST /chat/account/link", linkGuestHandler(guests, broker, rooms, prefs, audit))
+	http.HandleFunc("GET /chat/rooms/{room}/emoji", featureGate(features, featureEmoji, listEmojiHandler(rooms, emojis)))
+	http.HandleFunc("PUT /chat/rooms/{room}/emoji/{name}", featureGate(features, featureEmoji, putEmojiHandler(rooms, emojis, audit)))
+	http.HandleFunc("DELETE /chat/rooms/{room}/emoji/{name}", featureGate(features, featureEmoji, deleteEmojiHandler(rooms, emojis, audit)))
+	http.HandleFunc("GET /chat/rooms/{room}/emoji/{name}", featureGate(features, featureEmoji, downloadEmojiHandler(rooms, emojis)))
+	http.HandleFunc("/chat/events", drainGuard(drain, standbyGuard(handoffs, shedGuard(shedder, admissionGuard(admission, eventsHandler)))))
+	http.HandleFunc("GET /chat/stream.ndjson", drainGuard(drain, standbyGuard(handoffs, shedGuard(shedder, admissionGuard(admission, ndjsonHandler)))))
+	http.HandleFunc("POST /chat/channel", featureGate(features, featureDuplex, drainGuard(drain, standbyGuard(handoffs, shedGuard(shedder, channelHandler(broker, eventsHandler, sendHandler))))))
+	http.HandleFunc("GET /chat/stream-dictionary", streamDictionaryHandler)
+	http.HandleFunc("POST /federation/v1/events", receiveFederationHandler(federated))
+	http.HandleFunc("POST /internal/relay", relayOnly(*relayToken, drainGuard(drain, relayStreamHandler(relays))))
+	http.HandleFunc("POST /internal/relay/publish", relayOnly(*relayToken, relayPublishHandler(broker)))
+	http.HandleFunc("POST /events/publish", publishEventHandler(*adminToken, broker, rooms))
+	http.HandleFunc("GET /chat/capabilities", capabilitiesHandler(features, presence, unfurl != nil))
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("GET /admin/audit", moderatorOnly(*adminToken, *moderatorToken, auditHandler(audit)))
+	http.HandleFunc("PUT /admin/rooms/{room}/challenge", adminOnly(*adminToken, setChallengeHandler(rooms, challenge, audit)))
+	http.HandleFunc("GET /admin/rooms/{room}/moderation", adminOnly(*adminToken, getModerationHandler(rooms)))
+	http.HandleFunc("PUT /admin/rooms/{room}/moderation", adminOnly(*adminToken, setModerationHandler(rooms, audit)))
+	http.HandleFunc("POST /admin/groups/{group}/publish", adminOnly(*adminToken, publishToGroupHandler(broker, audit)))
+	http.HandleFunc("GET /admin/store/migrations", adminOnly(*adminToken, listMigrationsHandler(store)))
+	http.HandleFunc("POST /admin/store/migrations", adminOnly(*adminToken, applyMigrationsHandler(store, audit)))
+	http.HandleFunc("GET /admin/store/compression", adminOnly(*adminToken, compressionStatsHandler(store)))
+	http.HandleFunc("POST /admin/store/compact", adminOnly(*adminToken, compactHandler(store, audit)))
+	http.HandleFunc("GET /admin/rooms", moderatorOnly(*adminToken, *moderatorToken, listRoomsHandler(rooms)))
+	http.HandleFunc("GET /admin/load", adminOnly(*adminToken, loadReportHandler(shedder)))
+	http.HandleFunc("GET /admin/subscribers", moderatorOnly(*adminToken, *moderatorToken, listSubscribersHandler(broker)))
+	http.HandleFunc("POST /admin/rooms/{room}/announce", moderatorOnly(*adminToken, *moderatorToken, announceHandler(broker, audit)))
+	http.HandleFunc("PUT /admin/rooms/{room}/tenant", adminOnly(*adminToken, setRoomTenantHandler(rooms, audit)))
+	http.HandleFunc("POST /admin/rooms/provision", adminOnly(*adminToken, provisionRoomsHandler(rooms, templates, lifecycle, audit)))
+	http.HandleFunc("GET /admin/room-templates", adminOnly(*adminToken, listRoomTemplatesHandler(templates)))
+	http.HandleFunc("GET /admin/room-templates/{name}", adminOnly(*adminToken, getRoomTemplateHandler(templates)))
+	http.HandleFunc("PUT /admin/room-templates/{name}", adminOnly(*adminToken, putRoomTemplateHandler(templates, challenge, audit)))
+	http.HandleFunc("DELETE /admin/room-templates/{name}", adminOnly(*adminToken, deleteRoomTemplateHandler(templates, audit)))
+	http.HandleFunc("GET /admin/tenants/retention", adminOnly(*adminToken, listRetentionHandler(retention)))
+	http.HandleFunc("PUT /admin/tenants/{tenant}/retention", adminOnly(*adminToken, tenantRetentionHandler(retention, audit, true)))
+	http.HandleFunc("DELETE /admin/tenants/{tenant}/retention", adminOnly(*adminToken, tenantRetentionHandler(retention, audit, false)))
+	http.HandleFunc("GET /admin/legal-holds", adminOnly(*adminToken, listLegalHoldsHandler(retention)))
+	http.HandleFunc("PUT /admin/legal-holds/rooms/{room}", adminOnly(*adminToken, legalHoldHandler(retention, audit, holdRoom, true)))
+	http.HandleFunc("DELETE /admin/legal-holds/rooms/{room}", adminOnly(*adminToken, legalHoldHandler(retention, audit, holdRoom, false)))
+	http.HandleFunc("PUT /admin/legal-holds/users/{user}", adminOnly(*adminToken, legalHoldHandler(retention, audit, holdUser, true)))
+	http.HandleFunc("DELETE /admin/legal-holds/users/{user}", adminOnly(*adminToken, legalHoldHandler(retention, audit, holdUser, false)))
+	http.HandleFunc("GET /admin/deliveries", adminOnly(*adminToken, deliveriesHandler(deliveries)))
+	http.HandleFunc("GET /admin/federation", adminOnly(*adminToken, federationStatusHandler(federated)))
+	http.HandleFunc("GET /admin/actions", adminOnly(*adminToken, listActionsHandler(actions)))
+	http.HandleFunc("PUT /admin/actions/{name}", adminOnly(*adminToken, putActionHandler(actions, audit)))
+	http.HandleFunc("DELETE /admin/actions/{name}", adminOnly(*adminToken, deleteActionHandler(actions, audit)))
+	http.HandleFunc("GET /admin/rooms/{room}/events", adminOnly(*adminToken, roomEventsHandler(store)))
+	http.HandleFunc("GET /admin/rooms/{room}/history", adminOnly(*adminToken, exportHistoryHandler(tiers)))
+	http.HandleFunc("GET /admin/rooms/{room}/transcript", adminOnly(*adminToken, transcriptHandler(tiers, blobs, audit)))
+	http.HandleFunc("POST /admin/rooms/{room}/exports", adminOnly(*adminToken, createExportHandler(tiers, blobs, blobCfg.presignTTL, audit)))
+	http.HandleFunc("GET /admin/exports/{name}", adminOnly(*adminToken, downloadExportHandler(blobs)))
+	http.HandleFunc("POST /admin/users/{user}/token", adminOnly(*adminToken, createUserTokenHandler(invites, audit)))
+	http.HandleFunc("POST /admin/users/{user}/kick", moderatorOnly(*adminToken, *moderatorToken, kickUserHandler(broker, audit)))
+	http.HandleFunc("PUT /admin/users/{user}/stream-policy", adminOnly(*adminToken, userStreamPolicyHandler(broker, policies, audit, true)))
+	http.HandleFunc("DELETE /admin/users/{user}/stream-policy", adminOnly(*adminToken, userStreamPolicyHandler(broker, policies, audit, false)))
+	http.HandleFunc("PUT /admin/subscribers/{id}/policy", adminOnly(*adminToken, streamPolicyHandler(broker, audit, true)))
+	http.HandleFunc("DELETE /admin/subscribers/{id}/policy", adminOnly(*adminToken, streamPolicyHandler(broker, audit, false)))
+	http.HandleFunc("POST /admin/handoff", adminOnly(*adminToken, handoffHandler(drain, handoffs)))
+	http.HandleFunc("GET /admin/bans", moderatorOnly(*adminToken, *moderatorToken, listBansHandler(bans)))
+	http.HandleFunc("PUT /admin/bans/{user}", moderatorOnly(*adminToken, *moderatorToken, banUserHandler(broker, bans, audit)))
+	http.HandleFunc("DELETE /admin/bans/{user}", moderatorOnly(*adminToken, *moderatorToken, unbanUserHandler(bans, audit)))
+	http.HandleFunc("GET /admin/api-keys", adminOnly(*adminToken, listAPIKeysHandler(apiKeys)))
+	http.HandleFunc("POST /admin/api-keys", adminOnly(*adminToken, createAPIKeyHandler(apiKeys, audit)))
+	http.HandleFunc("POST /admin/api-keys/{id}/rotate", adminOnly(*adminToken, rotateAPIKeyHandler(apiKeys, audit)))
+	http.HandleFunc("DELETE /admin/api-keys/{id}", adminOnly(*adminToken, revokeAPIKeyHandler(apiKeys, audit)))
+	http.HandleFunc("GET /admin/config", adminOnly(*adminToken, getConfigHandler(reloader)))
+	http.HandleFunc("POST /admin/config/reload", adminOnly(*adminToken, reloadConfigHandler(reloader, audit)))
+	http.HandleFunc("GET /debug/leaks", adminOnly(*adminToken, leakReportHandler(broker)))
+	http.HandleFunc("GET /debug/goroutines", adminOnly(*adminToken, goroutineDumpHandler))
+	http.HandleFunc("GET /admin/spam", moderatorOnly(*adminToken, *moderatorToken, spamReportHandler(spam)))
+	http.HandleFunc("POST /admin/spam/{user}/unmute", moderatorOnly(*adminToken, *moderatorToken, spamUnmuteHandler(spam, audit)))
+	http.HandleFunc("POST /admin/spam/{user}/mute", moderatorOnly(*adminToken, *moderatorToken, spamMuteHandler(spam, audit)))
+	http.HandleFunc("GET /admin/selftest", adminOnly(*adminToken, selfTestHandler(selfTester)))
+	http.HandleFunc("GET /admin/whoami", moderatorOnly(*adminToken, *moderatorToken, whoamiHandler))
+	http.HandleFunc("GET /admin/ui/", featureGate(features, featureAdminUI, adminUIHandler(*adminToken)))
 	http.HandleFunc("/", htmlHandler)
 
-	log.Println("Server running on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	cfg := serverConfig{
+		Addr:    *addr,
+		TLSCert: *tlsCert,
+		TLSKey:  *tlsKey,
+		H2C:     *h2c,
+		HTTP3:   *h3,
+	}
+	srv, err := newServer(cfg, requestIDMiddleware(originMiddleware(proxies, geo, corsMiddleware(cors, signedRequestMiddleware(apiKeys, versionMiddleware(identityMiddleware(invites, guests, banMiddleware(bans, http.DefaultServeMux))))))))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if relays != nil {
+		srv.RegisterOnShutdown(relays.Close)
+	}
+	go drain.watchShutdown(srv)
+	if err := serve(cfg, srv); err != nil {
+		log.Fatal(err)
+	}
+	<-drain.Done()
+	if analytics != nil {
+		analytics.Close()
+	}
 }
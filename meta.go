@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+	"time"
+)
+
+const metaEvent = "meta"
+
+// StreamMeta is the data of the periodic "meta" event, which tells a client
+// how far behind its stream is so it can resubscribe or narrow its rooms
+// before it starts losing events.
+type StreamMeta struct {
+	ServerTime time.Time `json:"server_time"`
+	// Lag is, per room, how many events the room has published that this
+	// stream hasn't written yet.
+	Lag        map[string]uint64 `json:"lag"`
+	Buffered   int               `json:"buffered"`
+	BufferSize int               `json:"buffer_size"`
+	Dropped    uint64            `json:"dropped"`
+	// Deprecation is set while the stream speaks a deprecated API version.
+	Deprecation *APIVersion `json:"deprecation,omitempty"`
+}
+
+// SubscriberRooms returns the rooms a connected subscriber is in.
+func (b *Broker) SubscriberRooms(ID string) []string {
+	s := b.shardFor(ID)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if subscriber, ok := s.subscribers[ID]; ok {
+		return slices.Sorted(maps.Keys(subscriber.rooms))
+	}
+	return nil
+}
+
+func streamMeta(broker *Broker, subscriber *Subscriber, lastSeqs map[string]uint64, version APIVersion) Envelope {
+	meta := StreamMeta{
+		ServerTime: time.Now().UTC(),
+		Lag:        make(map[string]uint64),
+		Buffered:   len(subscriber.Channel),
+		BufferSize: cap(subscriber.Channel),
+		Dropped:    subscriber.Dropped.Load(),
+	}
+	if version.Deprecated {
+		meta.Deprecation = &version
+	}
+	for _, room := range broker.SubscriberRooms(subscriber.ID) {
+		// Rooms joined at runtime have no position until their first event.
+		meta.Lag[room] = 0
+		if seen, ok := lastSeqs[room]; ok {
+			if latest := broker.LatestSequence(room); latest > seen {
+				meta.Lag[room] = latest - seen
+			}
+		}
+	}
+
+	metaRaw, _ := json.Marshal(meta)
+	return Envelope{Event: metaEvent, Time: meta.ServerTime, Data: metaRaw}
+}
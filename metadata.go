@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxMetadataKeys  = 16
+	maxMetadataBytes = 1 << 10
+
+	// metadataParamPrefix starts the stream query parameters that filter
+	// messages by metadata, as in meta.channel=orders.
+	metadataParamPrefix = "meta."
+)
+
+var metadataKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// checkMetadata checks the metadata publishers attach to a message for
+// their apps' routing: at most maxMetadataKeys keys and maxMetadataBytes of
+// keys and values together.
+func checkMetadata(chat *Chat) error {
+	if len(chat.Metadata) > maxMetadataKeys {
+		return fmt.Errorf("%w: metadata is limited to %d keys", errInvalidRequest, maxMetadataKeys)
+	}
+	size := 0
+	for key, value := range chat.Metadata {
+		if !metadataKeyPattern.MatchString(key) {
+			return fmt.Errorf("%w: metadata key %q must be 1-64 letters, digits, '.', '_' or '-'", errInvalidRequest, key)
+		}
+		if !utf8.ValidString(value) {
+			return fmt.Errorf("%w: metadata value of %q must be UTF-8", errInvalidRequest, key)
+		}
+		size += len(key) + len(value)
+	}
+	if size > maxMetadataBytes {
+		return fmt.Errorf("%w: metadata is limited to %d bytes", errInvalidRequest, maxMetadataBytes)
+	}
+	return nil
+}
+
+// metadataKey is the metadata of chat in a stable order, for dedup keys.
+func metadataKey(chat Chat) string {
+	var b strings.Builder
+	for _, key := range slices.Sorted(maps.Keys(chat.Metadata)) {
+		b.WriteString(key + "\x00" + chat.Metadata[key] + "\x00")
+	}
+	return b.String()
+}
+
+// metadataFilterFrom reads the meta.<key>=<value> parameters of a stream
+// into a filter, or nil without any. A message passes if its metadata has
+// one of the values given for every key; other events always pass.
+func metadataFilterFrom(r *http.Request) (func(Envelope) bool, error) {
+	want := make(map[string][]string)
+	for name, values := range r.URL.Query() {
+		key, ok := strings.CutPrefix(name, metadataParamPrefix)
+		if !ok {
+			continue
+		}
+		if !metadataKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("%w: invalid metadata key %q", errInvalidRequest, key)
+		}
+		want[key] = values
+	}
+	if len(want) == 0 {
+		return nil, nil
+	}
+	if len(want) > maxMetadataKeys {
+		return nil, fmt.Errorf("%w: streams filter on at most %d metadata keys", errInvalidRequest, maxMetadataKeys)
+	}
+
+	return func(env Envelope) bool {
+		if env.Event != "" {
+			return true
+		}
+		chat := struct {
+			Metadata map[string]string `json:"metadata"`
+		}{}
+		json.Unmarshal(env.Data, &chat)
+		for key, values := range want {
+			if !slices.Contains(values, chat.Metadata[key]) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// allFilters combines the fan-out filters that aren't nil into one, or nil
+// if they all are.
+func allFilters(filters ...func(Envelope) bool) func(Envelope) bool {
+	filters = slices.DeleteFunc(filters, func(f func(Envelope) bool) bool { return f == nil })
+	switch len(filters) {
+	case 0:
+		return nil
+	case 1:
+		return filters[0]
+	}
+	return func(env Envelope) bool {
+		for _, filter := range filters {
+			if !filter(env) {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metric is anything that can render itself in the Prometheus text format.
+type metric interface {
+	write(w *strings.Builder)
+}
+
+var metricsRegistry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func registerMetric(m metric) {
+	metricsRegistry.mu.Lock()
+	defer metricsRegistry.mu.Unlock()
+	metricsRegistry.metrics = append(metricsRegistry.metrics, m)
+}
+
+type counter struct {
+	name, help string
+	value      atomic.Uint64
+}
+
+func newCounter(name, help string) *counter {
+	c := &counter{name: name, help: help}
+	registerMetric(c)
+	return c
+}
+
+func (c *counter) Add(n uint64) { c.value.Add(n) }
+func (c *counter) Inc()         { c.value.Add(1) }
+
+func (c *counter) write(w *strings.Builder) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value.Load())
+}
+
+// counterVec is a counter partitioned by the values of a fixed set of labels.
+type counterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]*atomic.Uint64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: make(map[string]*atomic.Uint64)}
+	registerMetric(c)
+	return c
+}
+
+func (c *counterVec) With(values ...string) *atomic.Uint64 {
+	pairs := make([]string, len(c.labels))
+	for i, label := range c.labels {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = fmt.Sprintf("%s=%q", label, value)
+	}
+	key := strings.Join(pairs, ",")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.values[key]
+	if !ok {
+		v = &atomic.Uint64{}
+		c.values[key] = v
+	}
+	return v
+}
+
+func (c *counterVec) write(w *strings.Builder) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s} %d\n", c.name, key, c.values[key].Load())
+	}
+	c.mu.Unlock()
+}
+
+type gaugeFunc struct {
+	name, help string
+	fn         func() float64
+}
+
+func newGaugeFunc(name, help string, fn func() float64) {
+	registerMetric(&gaugeFunc{name: name, help: help, fn: fn})
+}
+
+func (g *gaugeFunc) write(w *strings.Builder) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", g.name, g.help, g.name, g.name, g.fn())
+}
+
+// gaugeVecFunc is a gauge partitioned by one label, read from fn on every
+// scrape.
+type gaugeVecFunc struct {
+	name, help, label string
+	fn                func() map[string]float64
+}
+
+func newGaugeVecFunc(name, help, label string, fn func() map[string]float64) {
+	registerMetric(&gaugeVecFunc{name: name, help: help, label: label, fn: fn})
+}
+
+func (g *gaugeVecFunc) write(w *strings.Builder) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	values := g.fn()
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %g\n", g.name, g.label, key, values[key])
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	metricsRegistry.mu.Lock()
+	metrics := append([]metric(nil), metricsRegistry.metrics...)
+	metricsRegistry.mu.Unlock()
+
+	var b strings.Builder
+	for _, m := range metrics {
+		m.write(&b)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, b.String())
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	migrateAuto  = "auto"
+	migrateCheck = "check"
+	migrateOnly  = "only"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var errPendingMigrations = errors.New("store has pending migrations")
+
+type migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// MigrationStatus describes one migration and whether the store has it.
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+// loadMigrations reads the embedded migrations, named <version>_<name>.sql,
+// in version order.
+func loadMigrations() ([]migration, error) {
+	names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	migrations := make([]migration, 0, len(names))
+	for _, name := range names {
+		base := strings.TrimSuffix(path.Base(name), ".sql")
+		prefix, label, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("migrations: %s is not named <version>_<name>.sql", name)
+		}
+		raw, err := migrationFiles.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{Version: version, Name: label, SQL: string(raw)})
+	}
+	slices.SortFunc(migrations, func(a, b migration) int { return a.Version - b.Version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("migrations: version %d used twice", migrations[i].Version)
+		}
+	}
+	return migrations, nil
+}
+
+// ensureMigrationTable creates the version table. Stores created before
+// migrations existed already have the early schema; the migrations it
+// matches are recorded as applied instead of run again.
+func ensureMigrationTable(ctx context.Context, db *sql.DB) error {
+	var exists int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'`).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 1 {
+		return nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `CREATE TABLE schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT    NOT NULL,
+		applied_at INTEGER NOT NULL
+	)`); err != nil {
+		return err
+	}
+
+	baseline := map[int]string{}
+	var hasMessages, hasDeletedAt int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'messages'`).Scan(&hasMessages); err != nil {
+		return err
+	}
+	if hasMessages == 1 {
+		baseline[1] = "messages"
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM pragma_table_info('messages') WHERE name = 'deleted_at'`).Scan(&hasDeletedAt); err != nil {
+			return err
+		}
+		if hasDeletedAt == 1 {
+			baseline[2] = "message_tombstones"
+		}
+	}
+	for version, name := range baseline {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+			version, name, time.Now().UnixNano()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Migrations lists every known migration with when it was applied, if it was.
+func (s *messageStore) Migrations(ctx context.Context) ([]MigrationStatus, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	applied := map[int]time.Time{}
+	rows, err := s.db.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var at int64
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = time.Unix(0, at).UTC()
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		status := MigrationStatus{Version: m.Version, Name: m.Name}
+		if at, ok := applied[m.Version]; ok {
+			status.AppliedAt = &at
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Pending returns the migrations the store hasn't applied yet.
+func (s *messageStore) Pending(ctx context.Context) ([]MigrationStatus, error) {
+	statuses, err := s.Migrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(statuses, func(m MigrationStatus) bool { return m.AppliedAt != nil }), nil
+}
+
+// Migrate applies every pending migration in version order, each in its own
+// transaction together with its version row, and returns those it applied.
+// A failing migration leaves the store at the previous version.
+func (s *messageStore) Migrate(ctx context.Context) ([]MigrationStatus, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	pending, err := s.Pending(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := []MigrationStatus{}
+	for _, p := range pending {
+		i := slices.IndexFunc(migrations, func(m migration) bool { return m.Version == p.Version })
+		m := migrations[i]
+
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return applied, err
+		}
+		if _, err := tx.ExecContext(ctx, m.SQL); err != nil {
+			tx.Rollback()
+			return applied, fmt.Errorf("store: migration %d_%s: %w", m.Version, m.Name, err)
+		}
+		now := time.Now().UTC()
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+			m.Version, m.Name, now.UnixNano()); err != nil {
+			tx.Rollback()
+			return applied, err
+		}
+		if err := tx.Commit(); err != nil {
+			return applied, err
+		}
+		applied = append(applied, MigrationStatus{Version: m.Version, Name: m.Name, AppliedAt: &now})
+	}
+	return applied, nil
+}
+
+func listMigrationsHandler(store *messageStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if store == nil {
+			writeError(w, r, errStoreDisabled)
+			return
+		}
+		statuses, err := store.Migrations(r.Context())
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(statuses)
+	}
+}
+
+func applyMigrationsHandler(store *messageStore, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if store == nil {
+			writeError(w, r, errStoreDisabled)
+			return
+		}
+		applied, err := store.Migrate(r.Context())
+		for _, m := range applied {
+			audit.Record("admin", "store.migrate", "", fmt.Sprintf("%d_%s", m.Version, m.Name))
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"applied": applied})
+	}
+}
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS messages (
+	id          INTEGER PRIMARY KEY AUTOINCREMENT,
+	room        TEXT    NOT NULL,
+	event       TEXT    NOT NULL DEFAULT '',
+	data        BLOB    NOT NULL,
+	created_at  INTEGER NOT NULL,
+	envelope_id TEXT,
+	seq         INTEGER
+);
+CREATE INDEX IF NOT EXISTS messages_room ON messages (room, id);
+CREATE TABLE IF NOT EXISTS outbox (
+	message_id INTEGER PRIMARY KEY REFERENCES messages (id),
+	attempts   INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT
+);
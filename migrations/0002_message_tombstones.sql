@@ -0,0 +1,2 @@
+ALTER TABLE messages ADD COLUMN deleted_at INTEGER;
+CREATE INDEX IF NOT EXISTS messages_deleted ON messages (deleted_at) WHERE deleted_at IS NOT NULL;
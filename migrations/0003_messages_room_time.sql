@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS messages_room_time ON messages (room, created_at);
@@ -0,0 +1,2 @@
+ALTER TABLE messages ADD COLUMN sent_at INTEGER;
+ALTER TABLE messages ADD COLUMN published_at INTEGER;
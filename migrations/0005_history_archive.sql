@@ -0,0 +1,10 @@
+CREATE INDEX IF NOT EXISTS messages_room_seq ON messages (room, seq) WHERE seq IS NOT NULL;
+CREATE TABLE IF NOT EXISTS archive_segments (
+	room        TEXT    NOT NULL,
+	first_seq   INTEGER NOT NULL,
+	last_seq    INTEGER NOT NULL,
+	blob_key    TEXT    NOT NULL,
+	messages    INTEGER NOT NULL,
+	archived_at INTEGER NOT NULL,
+	PRIMARY KEY (room, first_seq)
+);
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS room_events (
+	seq        INTEGER PRIMARY KEY AUTOINCREMENT,
+	room       TEXT    NOT NULL,
+	type       TEXT    NOT NULL,
+	data       BLOB    NOT NULL,
+	created_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS room_events_room ON room_events (room, seq);
+CREATE TABLE IF NOT EXISTS room_snapshots (
+	seq        INTEGER PRIMARY KEY,
+	data       BLOB    NOT NULL,
+	created_at INTEGER NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE messages ADD COLUMN origin TEXT;
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS bans (
+	user_id  TEXT    PRIMARY KEY,
+	reason   TEXT    NOT NULL DEFAULT '',
+	since    INTEGER NOT NULL
+);
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS room_templates (
+	name        TEXT    PRIMARY KEY,
+	data        BLOB    NOT NULL,
+	updated_at  INTEGER NOT NULL
+);
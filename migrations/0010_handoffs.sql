@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS handoffs (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	target        TEXT    NOT NULL,
+	sequences     BLOB,
+	created_at    INTEGER NOT NULL,
+	completed_at  INTEGER
+);
+
+CREATE TABLE IF NOT EXISTS handoff_tokens (
+	token       TEXT    PRIMARY KEY,
+	handoff_id  INTEGER NOT NULL REFERENCES handoffs (id),
+	user_id     TEXT    NOT NULL,
+	cursors     BLOB    NOT NULL,
+	created_at  INTEGER NOT NULL
+);
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+	id          TEXT    PRIMARY KEY,
+	data        BLOB    NOT NULL,
+	created_at  INTEGER NOT NULL
+);
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS attachments (
+	id          TEXT    PRIMARY KEY,
+	room        TEXT    NOT NULL,
+	data        BLOB    NOT NULL,
+	created_at  INTEGER NOT NULL
+);
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS guest_links (
+	guest_id    TEXT    PRIMARY KEY,
+	user_id     TEXT    NOT NULL,
+	created_at  INTEGER NOT NULL
+);
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+const (
+	linkPolicyAllow     = "allow"
+	linkPolicyDeny      = "deny"
+	linkPolicyAllowlist = "allowlist"
+
+	// capsMinLetters keeps short shouts like "OK" or "LOL" out of the caps
+	// ratio check.
+	capsMinLetters = 8
+)
+
+var (
+	errMessageRejected = errors.New("message rejected by room policy")
+	errInvalidPolicy   = errors.New("invalid moderation policy")
+)
+
+// ModerationPolicy is a room's content policy, evaluated on every publish.
+type ModerationPolicy struct {
+	Blocklist      []string `json:"blocklist,omitempty"`
+	Patterns       []string `json:"patterns,omitempty"`
+	LinkPolicy     string   `json:"link_policy,omitempty"`
+	AllowedDomains []string `json:"allowed_domains,omitempty"`
+	MaxCapsRatio   float64  `json:"max_caps_ratio,omitempty"`
+
+	blocklist *regexp.Regexp
+	patterns  []*regexp.Regexp
+}
+
+type ModerationViolation struct {
+	Rule   string `json:"rule"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// compile validates p and prepares its matchers. It must be called before
+// Evaluate.
+func (p *ModerationPolicy) compile() error {
+	switch p.LinkPolicy {
+	case "":
+		p.LinkPolicy = linkPolicyAllow
+	case linkPolicyAllow, linkPolicyDeny, linkPolicyAllowlist:
+	default:
+		return fmt.Errorf("%w: unknown link_policy %q", errInvalidPolicy, p.LinkPolicy)
+	}
+	if p.MaxCapsRatio < 0 || p.MaxCapsRatio > 1 {
+		return fmt.Errorf("%w: max_caps_ratio must be between 0 and 1", errInvalidPolicy)
+	}
+
+	var words []string
+	for _, word := range p.Blocklist {
+		if word = strings.TrimSpace(word); word != "" {
+			words = append(words, regexp.QuoteMeta(word))
+		}
+	}
+	if len(words) > 0 {
+		p.blocklist = regexp.MustCompile(`(?i)\b(?:` + strings.Join(words, "|") + `)\b`)
+	}
+
+	p.patterns = p.patterns[:0]
+	for _, pattern := range p.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("%w: pattern %q: %v", errInvalidPolicy, pattern, err)
+		}
+		p.patterns = append(p.patterns, re)
+	}
+
+	for i, domain := range p.AllowedDomains {
+		p.AllowedDomains[i] = strings.ToLower(strings.TrimPrefix(domain, "."))
+	}
+	return nil
+}
+
+func (p *ModerationPolicy) Evaluate(message string) []ModerationViolation {
+	var violations []ModerationViolation
+
+	if p.blocklist != nil {
+		if word := p.blocklist.FindString(message); word != "" {
+			violations = append(violations, ModerationViolation{Rule: "blocklist", Detail: word})
+		}
+	}
+
+	for _, re := range p.patterns {
+		if re.MatchString(message) {
+			violations = append(violations, ModerationViolation{Rule: "pattern", Detail: re.String()})
+		}
+	}
+
+	if p.LinkPolicy != linkPolicyAllow {
+		for _, link := range urlPattern.FindAllString(message, -1) {
+			if p.LinkPolicy == linkPolicyDeny {
+				violations = append(violations, ModerationViolation{Rule: "links_not_allowed"})
+				break
+			}
+			if !p.domainAllowed(link) {
+				violations = append(violations, ModerationViolation{Rule: "link_domain", Detail: link})
+			}
+		}
+	}
+
+	if p.MaxCapsRatio > 0 {
+		letters, upper := 0, 0
+		for _, r := range message {
+			if unicode.IsLetter(r) {
+				letters++
+				if unicode.IsUpper(r) {
+					upper++
+				}
+			}
+		}
+		if letters >= capsMinLetters && float64(upper)/float64(letters) > p.MaxCapsRatio {
+			violations = append(violations, ModerationViolation{Rule: "caps_ratio", Detail: fmt.Sprintf("%.2f", float64(upper)/float64(letters))})
+		}
+	}
+	return violations
+}
+
+func (p *ModerationPolicy) domainAllowed(link string) bool {
+	if !strings.Contains(link, "://") {
+		link = "https://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	return slices.ContainsFunc(p.AllowedDomains, func(domain string) bool {
+		return host == domain || strings.HasSuffix(host, "."+domain)
+	})
+}
+
+func getModerationHandler(rooms *roomRegistry) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room, ok := rooms.Get(r.PathValue("room"))
+		if !ok || room.Moderation == nil {
+			writeError(w, r, errRoomNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(room.Moderation)
+	}
+}
+
+func setModerationHandler(rooms *roomRegistry, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("room")
+		if rooms.Encrypted(name) {
+			writeError(w, r, fmt.Errorf("%w: its messages can't be moderated", errRoomEncrypted))
+			return
+		}
+
+		policy := &ModerationPolicy{}
+		if err := json.NewDecoder(r.Body).Decode(policy); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+		if err := policy.compile(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		if err := rooms.SetModeration(name, policy); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record("admin", "room.moderation", name, "")
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(policy)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	mqttQueueSize = 1024
+	mqttVia       = "mqtt"
+	mqttRoomToken = "{room}"
+)
+
+var mqttMessages = newCounterVec("chat_mqtt_messages_total", "Messages bridged to and from MQTT.", "direction")
+
+// mqttConfig maps rooms onto MQTT topics. OutTopic and InTopic are templates
+// containing {room} as one whole topic level, e.g. "chat/{room}/messages".
+type mqttConfig struct {
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	OutTopic string
+	InTopic  string
+	Rooms    []string
+	QoS      byte
+}
+
+// mqttBridge mirrors room messages to MQTT and publishes messages received
+// on the inbound topics into their rooms, so devices without HTTP can chat.
+type mqttBridge struct {
+	cfg    mqttConfig
+	broker *Broker
+	rooms  *roomRegistry
+	dedup  *publishDeduper
+	client mqtt.Client
+	out    chan Envelope
+}
+
+// validate also rejects identical templates: the bridge would otherwise read
+// back every message it mirrors.
+func (cfg mqttConfig) validate() error {
+	if cfg.OutTopic == cfg.InTopic {
+		return fmt.Errorf("mqtt: inbound and outbound topics must differ")
+	}
+	for _, template := range []string{cfg.OutTopic, cfg.InTopic} {
+		levels := strings.Split(template, "/")
+		if !slices.Contains(levels, mqttRoomToken) {
+			return fmt.Errorf("mqtt: topic template %q must contain %s as a whole level", template, mqttRoomToken)
+		}
+	}
+	return nil
+}
+
+func startMQTTBridge(cfg mqttConfig, broker *Broker, rooms *roomRegistry, dedup *publishDeduper) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	b := &mqttBridge{cfg: cfg, broker: broker, rooms: rooms, dedup: dedup, out: make(chan Envelope, mqttQueueSize)}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOrderMatters(false).
+		SetOnConnectHandler(b.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("MQTT: connection lost: %v", err)
+		})
+	b.client = mqtt.NewClient(opts)
+	b.client.Connect()
+
+	broker.Tap(b.enqueue)
+	go b.mirror()
+	return nil
+}
+
+// onConnect (re)subscribes on every connect; the broker may have dropped the
+// session while we were away.
+func (b *mqttBridge) onConnect(client mqtt.Client) {
+	filter := strings.ReplaceAll(b.cfg.InTopic, mqttRoomToken, "+")
+	token := client.Subscribe(filter, b.cfg.QoS, b.receive)
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			log.Printf("MQTT: subscribing to %s: %v", filter, token.Error())
+			return
+		}
+		log.Printf("MQTT: bridging %s", filter)
+	}()
+}
+
+func (b *mqttBridge) bridged(room string) bool {
+	if isSystemRoom(room) {
+		return false
+	}
+	return len(b.cfg.Rooms) == 0 || slices.Contains(b.cfg.Rooms, room)
+}
+
+func (b *mqttBridge) enqueue(env Envelope) {
+	if env.Event != "" || !b.bridged(env.Room) {
+		return
+	}
+	select {
+	case b.out <- env:
+	default:
+		mqttMessages.With("out_dropped").Add(1)
+	}
+}
+
+func (b *mqttBridge) mirror() {
+	for env := range b.out {
+		payload, err := json.Marshal(env)
+		if err != nil {
+			continue
+		}
+		topic := strings.ReplaceAll(b.cfg.OutTopic, mqttRoomToken, env.Room)
+		if token := b.client.Publish(topic, b.cfg.QoS, false, payload); token.WaitTimeout(5*time.Second) && token.Error() != nil {
+			log.Printf("MQTT: publishing to %s: %v", topic, token.Error())
+			continue
+		}
+		mqttMessages.With("out").Add(1)
+	}
+}
+
+// roomFromTopic extracts the room level of topic according to InTopic.
+func (b *mqttBridge) roomFromTopic(topic string) (string, bool) {
+	template := strings.Split(b.cfg.InTopic, "/")
+	levels := strings.Split(topic, "/")
+	if len(levels) != len(template) {
+		return "", false
+	}
+	room := ""
+	for i, level := range template {
+		switch {
+		case level == mqttRoomToken:
+			room = levels[i]
+		case level != levels[i]:
+			return "", false
+		}
+	}
+	return room, room != ""
+}
+
+// receive accepts either a JSON {"user_id","message"} payload or plain text,
+// which is attributed to the "mqtt" user.
+func (b *mqttBridge) receive(_ mqtt.Client, msg mqtt.Message) {
+	room, ok := b.roomFromTopic(msg.Topic())
+	if !ok || !b.bridged(room) {
+		return
+	}
+
+	chat := Chat{}
+	if err := json.Unmarshal(msg.Payload(), &chat); err != nil || chat.payload() == "" {
+		chat = Chat{UserID: "mqtt", Message: string(msg.Payload())}
+	}
+	chat.Room = room
+	chat.Via = mqttVia
+	if chat.UserID == "" {
+		chat.UserID = "mqtt"
+	}
+
+	// Nothing vouches for a user_id over MQTT, so the bridge publishes as
+	// the mqtt user whatever name the message carries.
+	if err := b.rooms.CheckPublish(room, "mqtt"); err != nil {
+		log.Printf("MQTT: rejected message for %s from %s: %v", room, chat.UserID, err)
+		return
+	}
+	if err := b.rooms.Moderate(room, &chat); err != nil {
+		log.Printf("MQTT: rejected message for %s from %s: %v", room, chat.UserID, err)
+		return
+	}
+
+	if err := b.broker.Admit(); err != nil {
+		log.Printf("MQTT: dropped message for %s: %v", room, err)
+		return
+	}
+	// QoS 1 redeliveries arrive as duplicates.
+	key, fresh := b.dedup.Claim(chat)
+	if !fresh {
+		return
+	}
+
+	chatRaw, err := json.Marshal(chat)
+	if err != nil {
+		return
+	}
+	if _, err := b.broker.Publish(room, chatRaw); err != nil {
+		b.dedup.Release(key)
+		log.Printf("MQTT: publishing into %s: %v", room, err)
+		return
+	}
+	mqttMessages.With("in").Add(1)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+)
+
+const ndjsonContentType = "application/x-ndjson"
+
+var dataField = []byte("data: ")
+
+// ndjsonWriter frames the envelopes of a stream as newline-delimited JSON,
+// one envelope a line, for backends that would rather not parse SSE. Only
+// the framing differs: subscription, resume and every event are those of
+// /chat/events.
+type ndjsonWriter struct {
+	http.ResponseWriter
+}
+
+func (w *ndjsonWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func (w *ndjsonWriter) writeEnvelope(env Envelope) error {
+	line := ndjsonLine(env.frame)
+	if line == nil {
+		data, err := json.Marshal(env)
+		if err != nil {
+			return err
+		}
+		line = append(data, '\n')
+	}
+	_, err := w.Write(line)
+	return err
+}
+
+// ndjsonLine returns the envelope JSON of an SSE frame with its line break,
+// sharing the frame's bytes, or nil if the frame has no data line.
+func ndjsonLine(frame []byte) []byte {
+	for start := 0; start < len(frame); {
+		end := bytes.IndexByte(frame[start:], '\n')
+		if end < 0 {
+			return nil
+		}
+		end += start
+		if bytes.HasPrefix(frame[start:end], dataField) {
+			return frame[start+len(dataField) : end+1]
+		}
+		start = end + 1
+	}
+	return nil
+}
+
+// ndjsonStream serves the stream of next as NDJSON.
+func ndjsonStream(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(&ndjsonWriter{ResponseWriter: w}, r)
+	}
+}
+
+// streamContentType is the content type of the stream written to w.
+func streamContentType(w http.ResponseWriter) string {
+	switch w.(type) {
+	case *ndjsonWriter:
+		return ndjsonContentType
+	case *binaryWriter:
+		return binaryContentType
+	}
+	return "text/event-stream"
+}
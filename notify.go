@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Notification levels. "mentions" only lets through messages that mention the
+// user (and the user's own messages); "none" silences the room entirely.
+const (
+	notifyAll      = "all"
+	notifyMentions = "mentions"
+	notifyNone     = "none"
+)
+
+// NotificationPreference is a user's notification setting for one room. While
+// MutedUntil is in the future nothing from the room is delivered, whatever the
+// level.
+type NotificationPreference struct {
+	Room       string     `json:"room"`
+	Level      string     `json:"level"`
+	MutedUntil *time.Time `json:"muted_until,omitempty"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+func (p NotificationPreference) muted(now time.Time) bool {
+	return p.Level == notifyNone || (p.MutedUntil != nil && now.Before(*p.MutedUntil))
+}
+
+// notificationPrefs stores preferences per user and room. It is consulted by
+// every delivery channel: the SSE fan-out through subscriberFilter, and push
+// or email notifiers through Allows. Do-not-disturb only silences the
+// notifiers; streams still deliver, so what arrived can be read without an
+// alert.
+type notificationPrefs struct {
+	statuses *userStatuses
+
+	mu    sync.RWMutex
+	prefs map[string]map[string]NotificationPreference
+}
+
+func newNotificationPrefs(statuses *userStatuses) *notificationPrefs {
+	return &notificationPrefs{statuses: statuses, prefs: make(map[string]map[string]NotificationPreference)}
+}
+
+func (n *notificationPrefs) Get(user, room string) (NotificationPreference, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	pref, ok := n.prefs[user][room]
+	return pref, ok
+}
+
+func (n *notificationPrefs) List(user string) []NotificationPreference {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	prefs := make([]NotificationPreference, 0, len(n.prefs[user]))
+	for _, pref := range n.prefs[user] {
+		prefs = append(prefs, pref)
+	}
+	return prefs
+}
+
+func (n *notificationPrefs) Set(user string, pref NotificationPreference) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.prefs[user] == nil {
+		n.prefs[user] = make(map[string]NotificationPreference)
+	}
+	n.prefs[user][pref.Room] = pref
+}
+
+func (n *notificationPrefs) Reset(user, room string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.prefs[user], room)
+}
+
+// Reassign moves the preferences of from to to. Rooms to already has a
+// preference for keep it.
+func (n *notificationPrefs) Reassign(from, to string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.prefs[from] == nil {
+		return
+	}
+	if n.prefs[to] == nil {
+		n.prefs[to] = make(map[string]NotificationPreference)
+	}
+	for room, pref := range n.prefs[from] {
+		if _, ok := n.prefs[to][room]; !ok {
+			n.prefs[to][room] = pref
+		}
+	}
+	delete(n.prefs, from)
+}
+
+// Allows reports whether user should be notified of env, published in room.
+// Nothing notifies a user who set do-not-disturb.
+func (n *notificationPrefs) Allows(user, room string, env Envelope) bool {
+	return !n.statuses.DoNotDisturb(user) && n.delivers(user, room, env)
+}
+
+// delivers reports whether env, published in room, should reach user at all.
+func (n *notificationPrefs) delivers(user, room string, env Envelope) bool {
+	pref, ok := n.Get(user, room)
+	if !ok || (pref.Level == notifyAll && pref.MutedUntil == nil) {
+		return true
+	}
+	if pref.muted(time.Now()) {
+		return false
+	}
+	if pref.Level != notifyMentions {
+		return true
+	}
+
+	chat := Chat{}
+	if env.Event != "" || json.Unmarshal(env.Data, &chat) != nil {
+		return false
+	}
+	return chat.UserID == user || mentions(chat.Message, user)
+}
+
+// subscriberFilter returns the fan-out filter for a subscriber of user, or
+// nil for anonymous subscribers, which have no preferences.
+func (n *notificationPrefs) subscriberFilter(user string) func(Envelope) bool {
+	if user == "" {
+		return nil
+	}
+	return func(env Envelope) bool {
+		return n.delivers(user, env.Room, env)
+	}
+}
+
+func mentions(message, user string) bool {
+	re, err := regexp.Compile(`(^|\W)@` + regexp.QuoteMeta(user) + `\b`)
+	return err == nil && re.MatchString(message)
+}
+
+type notificationPreferenceRequest struct {
+	Level      string     `json:"level"`
+	MutedUntil *time.Time `json:"muted_until"`
+}
+
+func listNotificationPreferencesHandler(prefs *notificationPrefs) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromRequest(r)
+		if user == "" {
+			writeError(w, r, errUnauthenticated)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(prefs.List(user))
+	}
+}
+
+func getNotificationPreferenceHandler(prefs *notificationPrefs) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromRequest(r)
+		if user == "" {
+			writeError(w, r, errUnauthenticated)
+			return
+		}
+		room := r.PathValue("room")
+
+		pref, ok := prefs.Get(user, room)
+		if !ok {
+			pref = NotificationPreference{Room: room, Level: notifyAll}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pref)
+	}
+}
+
+// filterEvent confirms to the user's open streams that a preference, and so
+// what they are sent, has changed.
+const filterEvent = "filter"
+
+func filterEnvelope(pref NotificationPreference) Envelope {
+	data, _ := json.Marshal(pref)
+	return Envelope{ID: pref.Room + ":filter", Room: pref.Room, Event: filterEvent, Time: time.Now().UTC(), Data: data}
+}
+
+func setNotificationPreferenceHandler(broker *Broker, rooms *roomRegistry, prefs *notificationPrefs) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromRequest(r)
+		if user == "" {
+			writeError(w, r, errUnauthenticated)
+			return
+		}
+		room := r.PathValue("room")
+		if !rooms.CanAccess(room, user) {
+			writeError(w, r, errNotMember)
+			return
+		}
+
+		req := notificationPreferenceRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+		switch req.Level {
+		case "":
+			req.Level = notifyAll
+		case notifyAll, notifyMentions, notifyNone:
+		default:
+			writeError(w, r, fmt.Errorf("%w: level must be %q, %q or %q", errInvalidRequest, notifyAll, notifyMentions, notifyNone))
+			return
+		}
+		if req.MutedUntil != nil && !req.MutedUntil.After(time.Now()) {
+			req.MutedUntil = nil
+		}
+
+		pref := NotificationPreference{
+			Room:       room,
+			Level:      req.Level,
+			MutedUntil: req.MutedUntil,
+			UpdatedAt:  time.Now().UTC(),
+		}
+		prefs.Set(user, pref)
+		broker.NotifyUser(user, filterEnvelope(pref))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pref)
+	}
+}
+
+func resetNotificationPreferenceHandler(broker *Broker, prefs *notificationPrefs) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromRequest(r)
+		if user == "" {
+			writeError(w, r, errUnauthenticated)
+			return
+		}
+		room := r.PathValue("room")
+		prefs.Reset(user, room)
+		broker.NotifyUser(user, filterEnvelope(NotificationPreference{Room: room, Level: notifyAll, UpdatedAt: time.Now().UTC()}))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
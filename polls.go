@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	pollResultsEvent = "poll_results"
+	minPollOptions   = 2
+	maxPollOptions   = 10
+	maxPollLabel     = 200
+	// maxPolls is how many polls the server counts votes for; the oldest
+	// are forgotten first.
+	maxPolls = 10000
+	// pollUpdateInterval is the least time between two results broadcasts
+	// of a poll. Votes in between go out together.
+	pollUpdateInterval = time.Second
+)
+
+var componentIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+var errPollClosed = errors.New("poll closed")
+
+var pollVotes = newCounterVec("chat_poll_votes_total", "Poll votes taken, by result.", "result")
+
+// Poll makes a chat message a poll: its message is the question and
+// Options the answers. A voter picks one, or any number if Multiple.
+type Poll struct {
+	Options  []PollOption `json:"options"`
+	Multiple bool         `json:"multiple,omitempty"`
+	ClosesAt *time.Time   `json:"closes_at,omitempty"`
+}
+
+type PollOption struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+}
+
+// PollResults is the tally of a poll, broadcast into its room as a
+// poll_results event whenever it changes. Mine, the caller's own vote, is
+// only in answers to the caller.
+type PollResults struct {
+	MessageID string         `json:"message_id"`
+	Counts    map[string]int `json:"counts"`
+	Voters    int            `json:"voters"`
+	Closed    bool           `json:"closed"`
+	Mine      []string       `json:"mine,omitempty"`
+}
+
+func checkPoll(chat *Chat) error {
+	poll := chat.Poll
+	if poll == nil {
+		return nil
+	}
+	if chat.Message == "" {
+		return fmt.Errorf("%w: a poll's message is its question", errInvalidRequest)
+	}
+	if len(poll.Options) < minPollOptions || len(poll.Options) > maxPollOptions {
+		return fmt.Errorf("%w: a poll has %d to %d options", errInvalidRequest, minPollOptions, maxPollOptions)
+	}
+	seen := map[string]bool{}
+	for _, option := range poll.Options {
+		if !componentIDPattern.MatchString(option.ID) {
+			return fmt.Errorf("%w: poll option id %q must be 1-32 letters, digits, '_' or '-'", errInvalidRequest, option.ID)
+		}
+		if seen[option.ID] {
+			return fmt.Errorf("%w: poll option id %q is used twice", errInvalidRequest, option.ID)
+		}
+		seen[option.ID] = true
+		if option.Label == "" || !utf8.ValidString(option.Label) || utf8.RuneCountInString(option.Label) > maxPollLabel {
+			return fmt.Errorf("%w: poll option labels are 1-%d characters", errInvalidRequest, maxPollLabel)
+		}
+	}
+	if poll.ClosesAt != nil && !poll.ClosesAt.After(time.Now()) {
+		return fmt.Errorf("%w: closes_at must be in the future", errInvalidRequest)
+	}
+	return nil
+}
+
+type pollTally struct {
+	room    string
+	poll    Poll
+	votes   map[string][]string
+	closed  bool
+	pending bool
+	sent    time.Time
+}
+
+func (t *pollTally) results(ID string) PollResults {
+	results := PollResults{MessageID: ID, Counts: make(map[string]int, len(t.poll.Options)), Voters: len(t.votes), Closed: t.closed}
+	for _, option := range t.poll.Options {
+		results.Counts[option.ID] = 0
+	}
+	for _, choice := range t.votes {
+		for _, option := range choice {
+			results.Counts[option]++
+		}
+	}
+	return results
+}
+
+// pollRegistry counts the votes of the polls published through the broker,
+// in memory: votes are counted by the node that takes them and are lost on
+// restart.
+type pollRegistry struct {
+	broker *Broker
+
+	mu    sync.Mutex
+	polls map[string]*pollTally
+	order []string
+}
+
+func newPollRegistry(broker *Broker) *pollRegistry {
+	return &pollRegistry{broker: broker, polls: make(map[string]*pollTally)}
+}
+
+// Observe starts counting the votes of every poll as it's published.
+func (pr *pollRegistry) Observe(env Envelope) {
+	if env.Event != "" || !bytes.Contains(env.Data, []byte(`"poll":`)) {
+		return
+	}
+	chat := Chat{}
+	if json.Unmarshal(env.Data, &chat) != nil || chat.Poll == nil {
+		return
+	}
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	pr.track(env.ID, env.Room, *chat.Poll)
+}
+
+// track returns the tally of poll ID, starting one if there is none.
+// pr.mu must be held.
+func (pr *pollRegistry) track(ID, room string, poll Poll) *pollTally {
+	if tally, ok := pr.polls[ID]; ok {
+		return tally
+	}
+	if len(pr.order) >= maxPolls {
+		delete(pr.polls, pr.order[0])
+		pr.order = pr.order[1:]
+	}
+	tally := &pollTally{room: room, poll: poll, votes: map[string][]string{}}
+	pr.polls[ID] = tally
+	pr.order = append(pr.order, ID)
+	if poll.ClosesAt != nil {
+		tally.closed = !poll.ClosesAt.After(time.Now())
+		time.AfterFunc(time.Until(*poll.ClosesAt), func() { pr.close(ID) })
+	}
+	return tally
+}
+
+// lookup returns the tally of poll ID, falling back to the history for a
+// poll published before the server started.
+func (pr *pollRegistry) lookup(ID string) (*pollTally, bool) {
+	pr.mu.Lock()
+	tally, ok := pr.polls[ID]
+	pr.mu.Unlock()
+	if ok {
+		return tally, true
+	}
+
+	env, ok := pr.broker.Message(ID)
+	if !ok || env.Event != "" {
+		return nil, false
+	}
+	chat := Chat{}
+	if json.Unmarshal(env.Data, &chat) != nil || chat.Poll == nil {
+		return nil, false
+	}
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	return pr.track(ID, env.Room, *chat.Poll), true
+}
+
+// Vote replaces the vote of user in a poll with options, or withdraws it
+// if there are none.
+func (pr *pollRegistry) Vote(ID string, tally *pollTally, user string, options []string) (PollResults, error) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	if tally.closed {
+		return PollResults{}, errPollClosed
+	}
+	if len(options) > 1 && !tally.poll.Multiple {
+		return PollResults{}, fmt.Errorf("%w: this poll takes one option", errInvalidRequest)
+	}
+	choice := slices.Clone(options)
+	slices.Sort(choice)
+	if len(slices.Compact(choice)) != len(options) {
+		return PollResults{}, fmt.Errorf("%w: options are listed twice", errInvalidRequest)
+	}
+	for _, option := range options {
+		if !slices.ContainsFunc(tally.poll.Options, func(o PollOption) bool { return o.ID == option }) {
+			return PollResults{}, fmt.Errorf("%w: %q is not an option of this poll", errInvalidRequest, option)
+		}
+	}
+
+	if len(choice) == 0 {
+		delete(tally.votes, user)
+	} else {
+		tally.votes[user] = choice
+	}
+	pr.schedule(ID, tally)
+	results := tally.results(ID)
+	results.Mine = tally.votes[user]
+	return results, nil
+}
+
+// Results returns the tally of a poll as user sees it.
+func (pr *pollRegistry) Results(ID string, tally *pollTally, user string) PollResults {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	results := tally.results(ID)
+	results.Mine = tally.votes[user]
+	return results
+}
+
+func (pr *pollRegistry) close(ID string) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	if tally, ok := pr.polls[ID]; ok && !tally.closed {
+		tally.closed = true
+		pr.schedule(ID, tally)
+	}
+}
+
+// schedule broadcasts the results of a poll once pollUpdateInterval has
+// passed since the last broadcast. pr.mu must be held.
+func (pr *pollRegistry) schedule(ID string, tally *pollTally) {
+	if tally.pending {
+		return
+	}
+	tally.pending = true
+	time.AfterFunc(time.Until(tally.sent.Add(pollUpdateInterval)), func() { pr.flush(ID, tally) })
+}
+
+func (pr *pollRegistry) flush(ID string, tally *pollTally) {
+	pr.mu.Lock()
+	tally.pending, tally.sent = false, time.Now()
+	results := tally.results(ID)
+	pr.mu.Unlock()
+
+	data, err := json.Marshal(results)
+	if err == nil {
+		_, err = pr.broker.PublishEvent(tally.room, pollResultsEvent, data)
+	}
+	if err != nil {
+		log.Printf("Poll %s: broadcasting results: %v", ID, err)
+	}
+}
+
+type voteRequest struct {
+	Options []string `json:"options"`
+}
+
+// pollTallyFor finds the poll of the request's message and checks the
+// caller may see it.
+func pollTallyFor(w http.ResponseWriter, r *http.Request, polls *pollRegistry, rooms *roomRegistry) (*pollTally, string, bool) {
+	user := userFromRequest(r)
+	if user == "" {
+		writeError(w, r, errUnauthenticated)
+		return nil, "", false
+	}
+	tally, ok := polls.lookup(r.PathValue("id"))
+	if !ok {
+		writeError(w, r, errMessageNotFound)
+		return nil, "", false
+	}
+	if !rooms.CanAccess(tally.room, user) {
+		writeError(w, r, errNotMember)
+		return nil, "", false
+	}
+	return tally, user, true
+}
+
+// voteHandler casts the caller's vote in the poll of a message, replacing
+// any earlier one; no options withdraws it. The answer is the tally with
+// the vote counted, which the room sees in its next poll_results event.
+func voteHandler(polls *pollRegistry, rooms *roomRegistry) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tally, user, ok := pollTallyFor(w, r, polls, rooms)
+		if !ok {
+			return
+		}
+		req := voteRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+		results, err := polls.Vote(r.PathValue("id"), tally, user, req.Options)
+		if err != nil {
+			pollVotes.With("rejected").Add(1)
+			writeError(w, r, err)
+			return
+		}
+		pollVotes.With("counted").Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	}
+}
+
+func pollResultsHandler(polls *pollRegistry, rooms *roomRegistry) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tally, user, ok := pollTallyFor(w, r, polls, rooms)
+		if !ok {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(polls.Results(r.PathValue("id"), tally, user))
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Presence statuses. An open SSE connection only makes a user "away"; they
+// are "active" while they keep sending heartbeats.
+const (
+	presenceActive  = "active"
+	presenceAway    = "away"
+	presenceOffline = "offline"
+
+	presenceEvent = "presence"
+)
+
+type Presence struct {
+	UserID      string    `json:"user_id"`
+	Status      string    `json:"status"`
+	Connections int       `json:"connections"`
+	Clients     int       `json:"clients"`
+	LastSeen    time.Time `json:"last_seen,omitzero"`
+	Since       time.Time `json:"since"`
+	// Availability and StatusText are what the user set, see UserStatus.
+	Availability string `json:"availability"`
+	StatusText   string `json:"status_text,omitempty"`
+}
+
+type presenceEntry struct {
+	conns    int
+	clients  map[string]int
+	lastBeat time.Time
+	status   string
+	since    time.Time
+}
+
+// presenceTracker derives presence from SSE connections and heartbeats and
+// publishes a presence event into the room on every status change.
+type presenceTracker struct {
+	broker   *Broker
+	statuses *userStatuses
+
+	mu    sync.Mutex
+	idle  time.Duration
+	rooms map[string]map[string]*presenceEntry
+}
+
+func newPresenceTracker(broker *Broker, statuses *userStatuses, idle time.Duration) *presenceTracker {
+	p := &presenceTracker{idle: idle, broker: broker, statuses: statuses, rooms: make(map[string]map[string]*presenceEntry)}
+	go p.sweep()
+	return p
+}
+
+// Idle is how long a user stays active after a heartbeat.
+func (p *presenceTracker) Idle() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.idle
+}
+
+// SetIdle changes the idle timeout. Users are re-evaluated against it on the
+// next sweep.
+func (p *presenceTracker) SetIdle(idle time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.idle = idle
+}
+
+// update applies change to the entry of user in room and reports the new
+// presence if its status changed. p.mu must be held.
+func (p *presenceTracker) update(room, user string, now time.Time, change func(*presenceEntry)) (Presence, bool) {
+	users := p.rooms[room]
+	if users == nil {
+		users = make(map[string]*presenceEntry)
+		p.rooms[room] = users
+	}
+	entry := users[user]
+	if entry == nil {
+		entry = &presenceEntry{status: presenceOffline, clients: make(map[string]int)}
+		users[user] = entry
+	}
+	change(entry)
+
+	status := presenceOffline
+	switch {
+	case now.Sub(entry.lastBeat) < p.idle:
+		status = presenceActive
+	case entry.conns > 0:
+		status = presenceAway
+	}
+	if status == presenceOffline {
+		delete(users, user)
+		if len(users) == 0 {
+			delete(p.rooms, room)
+		}
+	}
+	if status == entry.status {
+		return Presence{}, false
+	}
+	entry.status = status
+	entry.since = now
+	return p.presence(user, entry), true
+}
+
+func (p *presenceTracker) presence(user string, e *presenceEntry) Presence {
+	status := p.statuses.Get(user)
+	return Presence{
+		UserID:       user,
+		Status:       e.status,
+		Connections:  e.conns,
+		Clients:      len(e.clients),
+		LastSeen:     e.lastBeat,
+		Since:        e.since,
+		Availability: status.Availability,
+		StatusText:   status.Text,
+	}
+}
+
+// StatusChanged announces the status user set to every room they are
+// present in.
+func (p *presenceTracker) StatusChanged(user string) {
+	announcements := make(map[string]Presence)
+	p.mu.Lock()
+	for room, users := range p.rooms {
+		if entry, ok := users[user]; ok {
+			announcements[room] = p.presence(user, entry)
+		}
+	}
+	p.mu.Unlock()
+
+	for room, presence := range announcements {
+		p.announce(room, presence)
+	}
+}
+
+func (p *presenceTracker) announce(room string, presence Presence) {
+	presenceRaw, err := json.Marshal(presence)
+	if err != nil {
+		return
+	}
+	if _, err := p.broker.PublishEvent(room, presenceEvent, presenceRaw); err != nil {
+		log.Printf("Presence: publishing to %s: %v", room, err)
+	}
+}
+
+func (p *presenceTracker) change(room, user string, fn func(*presenceEntry)) {
+	if user == "" || isSystemRoom(room) {
+		return
+	}
+	p.mu.Lock()
+	presence, changed := p.update(room, user, time.Now(), fn)
+	p.mu.Unlock()
+	if changed {
+		p.announce(room, presence)
+	}
+}
+
+// Connect and Disconnect track the streams of user in room; client is the
+// stable client ID, so several tabs or reconnects of one device count once.
+func (p *presenceTracker) Connect(room, user, client string) {
+	p.change(room, user, func(e *presenceEntry) {
+		e.conns++
+		e.clients[client]++
+	})
+}
+
+func (p *presenceTracker) Disconnect(room, user, client string) {
+	p.change(room, user, func(e *presenceEntry) {
+		e.conns--
+		if e.clients[client]--; e.clients[client] <= 0 {
+			delete(e.clients, client)
+		}
+	})
+}
+
+func (p *presenceTracker) Heartbeat(room, user string) {
+	p.change(room, user, func(e *presenceEntry) { e.lastBeat = time.Now() })
+}
+
+func (p *presenceTracker) List(room string) []Presence {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	list := make([]Presence, 0, len(p.rooms[room]))
+	for user, entry := range p.rooms[room] {
+		list = append(list, p.presence(user, entry))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].UserID < list[j].UserID })
+	return list
+}
+
+// sweep moves users whose heartbeats stopped to away or offline.
+func (p *presenceTracker) sweep() {
+	ticker := time.NewTicker(max(p.Idle()/4, time.Second))
+	defer ticker.Stop()
+
+	type transition struct {
+		room     string
+		presence Presence
+	}
+	for now := range ticker.C {
+		var transitions []transition
+		p.mu.Lock()
+		ticker.Reset(max(p.idle/4, time.Second))
+		for room, users := range p.rooms {
+			for user, entry := range users {
+				if entry.status != presenceActive || now.Sub(entry.lastBeat) < p.idle {
+					continue
+				}
+				if presence, changed := p.update(room, user, now, func(*presenceEntry) {}); changed {
+					transitions = append(transitions, transition{room, presence})
+				}
+			}
+		}
+		p.mu.Unlock()
+
+		for _, t := range transitions {
+			p.announce(t.room, t.presence)
+		}
+		for _, user := range p.statuses.Expire(now) {
+			p.StatusChanged(user)
+		}
+	}
+}
+
+// heartbeatHandler marks the caller active in the room. Clients should call
+// it at the returned interval while the user is interacting with the app.
+func heartbeatHandler(rooms *roomRegistry, presence *presenceTracker) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromRequest(r)
+		if user == "" {
+			writeError(w, r, errUnauthenticated)
+			return
+		}
+		room := roomFromRequest(r)
+		if !rooms.CanAccess(room, user) {
+			writeError(w, r, errNotMember)
+			return
+		}
+
+		presence.Heartbeat(room, user)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"status":                presenceActive,
+			"heartbeat_interval_ms": (presence.Idle() / 2).Milliseconds(),
+		})
+	}
+}
+
+func presenceHandler(rooms *roomRegistry, presence *presenceTracker) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room := r.PathValue("room")
+		if !rooms.CanAccess(room, userFromRequest(r)) {
+			writeError(w, r, errNotMember)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(presence.List(room))
+	}
+}
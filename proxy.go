@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// remoteHost is the address a request came from, without the port.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// trustedProxies are the networks whose X-Forwarded-For is believed.
+type trustedProxies []netip.Prefix
+
+func parseTrustedProxies(raw string) (trustedProxies, error) {
+	var proxies trustedProxies
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("trusted proxy %q: %w", entry, err)
+			}
+			proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %w", entry, err)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+func (p trustedProxies) trusts(addr netip.Addr) bool {
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address of the client behind r. X-Forwarded-For is only
+// read when the request came through a trusted proxy, and then from the
+// right: the first hop that isn't a trusted proxy is the client.
+func (p trustedProxies) clientIP(r *http.Request) netip.Addr {
+	addr, err := netip.ParseAddr(remoteHost(r))
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr = addr.Unmap()
+	if !p.trusts(addr) {
+		return addr
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !p.trusts(addr) {
+			break
+		}
+	}
+	return addr
+}
+
+// forwarded returns the first value of a comma-separated X-Forwarded-*
+// header: the one set by the proxy closest to the client.
+func forwarded(r *http.Request, header string) string {
+	value, _, _ := strings.Cut(r.Header.Get(header), ",")
+	return strings.TrimSpace(value)
+}
+
+// requestScheme is the scheme the client used, which behind a trusted proxy
+// originMiddleware takes from X-Forwarded-Proto.
+func requestScheme(r *http.Request) string {
+	if r.URL.Scheme != "" {
+		return r.URL.Scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// absoluteURL turns path into a URL on the host the client called.
+func absoluteURL(r *http.Request, path string) string {
+	return requestScheme(r) + "://" + r.Host + path
+}
+
+// originMiddleware works out where every request comes from. Requests that
+// came through a trusted proxy also get the scheme and host the client used
+// from X-Forwarded-Proto and X-Forwarded-Host, so generated URLs, logs and
+// rate limits see the client rather than the proxy.
+func originMiddleware(proxies trustedProxies, geo *geoDB, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := ConnOrigin{}
+		if addr := proxies.clientIP(r); addr.IsValid() {
+			origin.IP = addr.String()
+			if entry, ok := geo.Lookup(addr); ok {
+				origin.Country, origin.Region = entry.country, entry.region
+			}
+		}
+
+		if peer, err := netip.ParseAddr(remoteHost(r)); err == nil && proxies.trusts(peer.Unmap()) {
+			if proto := strings.ToLower(forwarded(r, "X-Forwarded-Proto")); proto == "http" || proto == "https" {
+				r.URL.Scheme = proto
+			}
+			if host := forwarded(r, "X-Forwarded-Host"); host != "" {
+				r.Host = host
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), originKey{}, origin)))
+	})
+}
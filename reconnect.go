@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// warmupFloor is the fraction of the admission rate allowed right after
+	// startup; it grows to the full rate over the warm-up.
+	warmupFloor = 0.1
+	// maxWarmupReplays bounds how many resuming streams replay their backlog
+	// at once during the warm-up.
+	maxWarmupReplays = 8
+)
+
+var (
+	errStreamAdmission = errors.New("too many streams opening, retry later")
+
+	rejectedAdmissions = newCounter("chat_stream_admissions_rejected_total", "Streams turned away by the admission rate limit.")
+	deferredReplays    = newCounter("chat_warmup_replays_deferred_total", "Resuming streams that waited for a replay slot during warm-up.")
+)
+
+// withRetryField prefixes the frame of env with an SSE retry field, which
+// EventSource uses as its reconnection delay from then on.
+func withRetryField(env Envelope, after time.Duration) Envelope {
+	if frame, err := encodeFrame(env); err == nil {
+		env.frame = append([]byte("retry: "+strconv.FormatInt(after.Milliseconds(), 10)+"\n"), frame...)
+	}
+	return env
+}
+
+// streamAdmission keeps a restart from being flattened by every client
+// reconnecting at once. Streams tell EventSource to wait between retry and
+// twice that before reconnecting, so a dropped node's clients come back
+// spread out; new streams are admitted at most rate a second; and for
+// warmup after startup the rate ramps up from a tenth and resuming streams
+// take turns replaying their backlog.
+type streamAdmission struct {
+	retry   time.Duration
+	rate    float64
+	burst   float64
+	warmup  time.Duration
+	started time.Time
+	replays chan struct{}
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newStreamAdmission returns an admission that admits everything for a rate
+// of zero. A retry of zero leaves the client's own reconnection delay alone.
+func newStreamAdmission(retry time.Duration, rate float64, burst int, warmup time.Duration) *streamAdmission {
+	now := time.Now()
+	a := &streamAdmission{
+		retry:   retry,
+		rate:    rate,
+		burst:   float64(max(burst, 1)),
+		warmup:  warmup,
+		started: now,
+		replays: make(chan struct{}, maxWarmupReplays),
+		last:    now,
+	}
+	a.tokens = a.burstAt(now)
+	newGaugeFunc("chat_warming_up", "1 while the node is in its post-startup warm-up.", func() float64 {
+		if a.Warming() {
+			return 1
+		}
+		return 0
+	})
+	return a
+}
+
+func (a *streamAdmission) Warming() bool {
+	return time.Since(a.started) < a.warmup
+}
+
+// ramp is the fraction of the admission rate in effect at now.
+func (a *streamAdmission) ramp(now time.Time) float64 {
+	elapsed := now.Sub(a.started)
+	if elapsed >= a.warmup {
+		return 1
+	}
+	return max(warmupFloor, float64(elapsed)/float64(a.warmup))
+}
+
+// burstAt is the burst in effect at now, which ramps up with the rate.
+func (a *streamAdmission) burstAt(now time.Time) float64 {
+	return max(1, a.burst*a.ramp(now))
+}
+
+// Admit takes a token for a new stream or says how long to wait for one.
+func (a *streamAdmission) Admit() (time.Duration, bool) {
+	if a.rate <= 0 {
+		return 0, true
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	rate := a.rate * a.ramp(now)
+	a.tokens = min(a.burstAt(now), a.tokens+now.Sub(a.last).Seconds()*rate)
+	a.last = now
+	if a.tokens >= 1 {
+		a.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - a.tokens) / rate * float64(time.Second)), false
+}
+
+// RetryAfter is a reconnection delay between retry and twice that.
+func (a *streamAdmission) RetryAfter() time.Duration {
+	return a.retry + rand.N(a.retry+1)
+}
+
+// AwaitReplay waits for a replay slot during the warm-up and returns its
+// release; afterwards replays go straight ahead. It fails if ctx ends first.
+func (a *streamAdmission) AwaitReplay(ctx context.Context) (func(), bool) {
+	if !a.Warming() {
+		return func() {}, true
+	}
+	select {
+	case a.replays <- struct{}{}:
+	default:
+		deferredReplays.Inc()
+		select {
+		case a.replays <- struct{}{}:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+	return func() { <-a.replays }, true
+}
+
+// admissionGuard turns new streams away once they open faster than the
+// admission allows, with a jittered Retry-After so they don't all come back
+// in the same second.
+func admissionGuard(a *streamAdmission, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if wait, ok := a.Admit(); !ok {
+			rejectedAdmissions.Inc()
+			writeError(w, r, withRetryAfter(errStreamAdmission, max(wait, time.Second)+rand.N(time.Second+wait)))
+			return
+		}
+		next(w, r)
+	}
+}
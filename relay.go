@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	relayHeartbeat      = 15 * time.Second
+	relayReadTimeout    = 3 * relayHeartbeat
+	relayStateInterval  = 5 * time.Second
+	relayProbeTimeout   = 2 * time.Second
+	relayPublishTimeout = 10 * time.Second
+	relayMinBackoff     = time.Second
+	relayMaxBackoff     = 30 * time.Second
+
+	// relayBuffer is how many envelopes an edge may fall behind before its
+	// upstream drops it; it reconnects and resumes from where it was.
+	relayBuffer      = 4096
+	relayMaxBody     = 4 << 20
+	relayContentType = "application/x-ndjson"
+)
+
+var (
+	errRelayDisabled = errors.New("relaying not enabled; start the server with -relay-token")
+	errRelayUpstream = errors.New("relay upstream refused or unreachable")
+
+	relayReconnects = newCounter("chat_relay_reconnects_total", "Times this edge reconnected to its relay upstream.")
+	relayDropped    = newCounter("chat_relay_edges_dropped_total", "Edges dropped for falling more than the relay buffer behind.")
+)
+
+// relayFrame is one line of the relay stream, holding exactly one of its
+// fields.
+type relayFrame struct {
+	Envelope  *Envelope   `json:"envelope,omitempty"`
+	State     *relayState `json:"state,omitempty"`
+	Heartbeat *time.Time  `json:"heartbeat,omitempty"`
+}
+
+// relayState is the part of the upstream's state an edge needs to decide on
+// its own who may read what.
+type relayState struct {
+	Rooms []roomState `json:"rooms"`
+	Bans  []Ban       `json:"bans"`
+}
+
+// relayResume is what an edge sends when it connects: the last sequence it
+// has of every room, so the upstream replays what it missed.
+type relayResume struct {
+	Rooms map[string]uint64 `json:"rooms"`
+}
+
+type relayPublish struct {
+	Room   string          `json:"room,omitempty"`
+	Group  string          `json:"group,omitempty"`
+	Event  string          `json:"event,omitempty"`
+	Data   json.RawMessage `json:"data"`
+	SentAt *time.Time      `json:"sent_at,omitempty"`
+	Origin string          `json:"origin,omitempty"`
+}
+
+// Replace swaps every ban for the ones in bans.
+func (b *banList) Replace(bans []Ban) {
+	replaced := make(map[string]Ban, len(bans))
+	for _, ban := range bans {
+		replaced[ban.UserID] = ban
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bans = replaced
+}
+
+// relayHub serves the relay stream to the edges of this node: every envelope
+// its backend carries, the rooms and bans they're read under, and a
+// heartbeat.
+type relayHub struct {
+	broker *Broker
+	rooms  *roomRegistry
+	bans   *banList
+
+	mu    sync.Mutex
+	edges map[*relayEdge]struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type relayEdge struct {
+	envs    chan Envelope
+	dropped chan struct{}
+}
+
+func newRelayHub(broker *Broker, rooms *roomRegistry, bans *banList) *relayHub {
+	h := &relayHub{broker: broker, rooms: rooms, bans: bans, edges: make(map[*relayEdge]struct{}), done: make(chan struct{})}
+	newGaugeFunc("chat_relay_edges", "Edges relaying from this node.", func() float64 {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return float64(len(h.edges))
+	})
+	return h
+}
+
+// dispatch hands env to every edge, dropping those too far behind to take
+// it. It is the hub's backend handler and must not block.
+func (h *relayHub) dispatch(env Envelope) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for edge := range h.edges {
+		select {
+		case edge.envs <- env:
+		default:
+			delete(h.edges, edge)
+			close(edge.dropped)
+			relayDropped.Inc()
+		}
+	}
+}
+
+func (h *relayHub) attach() *relayEdge {
+	edge := &relayEdge{envs: make(chan Envelope, relayBuffer), dropped: make(chan struct{})}
+	h.mu.Lock()
+	h.edges[edge] = struct{}{}
+	h.mu.Unlock()
+	return edge
+}
+
+func (h *relayHub) detach(edge *relayEdge) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.edges, edge)
+}
+
+// Close ends every relay stream, for shutdown.
+func (h *relayHub) Close() {
+	h.closeOnce.Do(func() { close(h.done) })
+}
+
+func (h *relayHub) state() relayState {
+	bans := h.bans.List()
+	slices.SortFunc(bans, func(a, b Ban) int { return strings.Compare(a.UserID, b.UserID) })
+	return relayState{Rooms: h.rooms.Snapshot(), Bans: bans}
+}
+
+// relayOnly lets through requests carrying the relay token; without one,
+// relaying is off.
+func relayOnly(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			writeError(w, r, errRelayDisabled)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(token)) != 1 {
+			writeError(w, r, errUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// relayStreamHandler streams to an edge. It first sends the current state
+// and replays what the edge missed of each room it resumes, then follows
+// live: envelopes as they come, the state whenever it changed, and a
+// heartbeat so the edge notices a dead connection.
+func relayStreamHandler(hub *relayHub) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resume := relayResume{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, relayMaxBody)).Decode(&resume); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+
+		// Attach before replaying, so nothing published in between is lost;
+		// the edge drops what it gets twice.
+		edge := hub.attach()
+		defer hub.detach(edge)
+		rc, err := startStream(w, r, relayContentType)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		log.Printf("Relay: edge %s connected, resuming %d rooms", clientAddress(r), len(resume.Rooms))
+		defer log.Printf("Relay: edge %s disconnected", clientAddress(r))
+
+		enc := json.NewEncoder(w)
+		state := hub.state()
+		sent, _ := json.Marshal(state)
+		if enc.Encode(relayFrame{State: &state}) != nil {
+			return
+		}
+		for room, seq := range resume.Rooms {
+			for _, env := range hub.broker.Replay(room, seq) {
+				if enc.Encode(relayFrame{Envelope: &env}) != nil {
+					return
+				}
+			}
+		}
+		if rc.Flush() != nil {
+			return
+		}
+
+		heartbeat := time.NewTicker(relayHeartbeat)
+		defer heartbeat.Stop()
+		stateTicker := time.NewTicker(relayStateInterval)
+		defer stateTicker.Stop()
+		for {
+			var frame relayFrame
+			select {
+			case <-r.Context().Done():
+				return
+			case <-hub.done:
+				return
+			case <-edge.dropped:
+				log.Printf("Relay: dropped edge %s, more than %d envelopes behind", clientAddress(r), relayBuffer)
+				return
+			case env := <-edge.envs:
+				frame.Envelope = &env
+			case <-heartbeat.C:
+				now := time.Now().UTC()
+				frame.Heartbeat = &now
+			case <-stateTicker.C:
+				state := hub.state()
+				raw, _ := json.Marshal(state)
+				if bytes.Equal(raw, sent) {
+					continue
+				}
+				sent, frame.State = raw, &state
+			}
+			if enc.Encode(frame) != nil {
+				return
+			}
+			if len(edge.envs) == 0 && rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// relayPublishHandler publishes what an edge forwards, as if it had been
+// published here.
+func relayPublishHandler(broker *Broker) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := relayPublish{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, relayMaxBody)).Decode(&req); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+		var env Envelope
+		var err error
+		switch {
+		case req.Group != "":
+			err = broker.PublishToGroup(req.Group, req.Event, req.Data)
+		case req.Room != "":
+			env, err = broker.publish(req.Room, req.Event, req.Data, req.SentAt, req.Origin)
+		default:
+			err = fmt.Errorf("%w: room or group required", errInvalidRequest)
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(env)
+	}
+}
+
+// publishForwarder is implemented by backends that don't sequence rooms
+// themselves but hand publishes to a node that does.
+type publishForwarder interface {
+	Forward(room, event string, data []byte, sentAt *time.Time, origin string) (Envelope, error)
+}
+
+// relayBackend makes this node an edge of an upstream node, primary or
+// another edge. It holds one stream to the upstream, fans out what comes
+// over it to its own subscribers and keeps its rooms and bans in step with
+// the upstream's; publishes are forwarded up to be sequenced there. Of
+// several upstreams it streams from the one answering fastest.
+type relayBackend struct {
+	upstreams []string
+	token     string
+	stream    *http.Client
+	client    *http.Client
+
+	mu       sync.Mutex
+	handlers []func(Envelope)
+	cursor   map[string]uint64
+
+	current   atomic.Pointer[string]
+	connected atomic.Bool
+	rtt       atomic.Int64
+}
+
+func newRelayBackend(upstreams, token string) (*relayBackend, error) {
+	b := &relayBackend{
+		token:  token,
+		stream: &http.Client{},
+		client: &http.Client{Timeout: relayPublishTimeout},
+		cursor: make(map[string]uint64),
+	}
+	for _, upstream := range strings.Split(upstreams, ",") {
+		upstream = strings.TrimRight(strings.TrimSpace(upstream), "/")
+		if upstream == "" {
+			continue
+		}
+		if !strings.HasPrefix(upstream, "http://") && !strings.HasPrefix(upstream, "https://") {
+			return nil, fmt.Errorf("-relay-upstream: %q is not an http or https URL", upstream)
+		}
+		b.upstreams = append(b.upstreams, upstream)
+	}
+	if len(b.upstreams) == 0 {
+		return nil, fmt.Errorf("-relay-upstream: no upstream given")
+	}
+	if token == "" {
+		return nil, fmt.Errorf("-relay-upstream needs -relay-token")
+	}
+	b.current.Store(&b.upstreams[0])
+	newGaugeFunc("chat_relay_connected", "Whether this edge is connected to its relay upstream.", func() float64 {
+		if b.connected.Load() {
+			return 1
+		}
+		return 0
+	})
+	newGaugeFunc("chat_relay_upstream_rtt_seconds", "Round trip to the relay upstream this edge last chose.", func() float64 {
+		return time.Duration(b.rtt.Load()).Seconds()
+	})
+	return b, nil
+}
+
+// Edges never sequence; the broker forwards their publishes instead.
+func (b *relayBackend) NextSequence(room string) (uint64, error) {
+	return 0, fmt.Errorf("%w: edges don't sequence rooms", errRelayUpstream)
+}
+
+// Publish forwards env upstream. The broker only sends group notices this
+// way.
+func (b *relayBackend) Publish(env Envelope) error {
+	_, err := b.forward(relayPublish{Room: env.Room, Group: env.Group, Event: env.Event, Data: env.Data, SentAt: env.SentAt})
+	return err
+}
+
+func (b *relayBackend) Forward(room, event string, data []byte, sentAt *time.Time, origin string) (Envelope, error) {
+	return b.forward(relayPublish{Room: room, Event: event, Data: data, SentAt: sentAt, Origin: origin})
+}
+
+func (b *relayBackend) Subscribe(handler func(Envelope)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+	return nil
+}
+
+func (b *relayBackend) forward(req relayPublish) (Envelope, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return Envelope{}, err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, *b.current.Load()+"/internal/relay/publish", bytes.NewReader(body))
+	if err != nil {
+		return Envelope{}, err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+b.token)
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := b.client.Do(httpReq)
+	if err != nil {
+		return Envelope{}, fmt.Errorf("%w: %v", errRelayUpstream, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Envelope{}, relayError(resp)
+	}
+	env := Envelope{}
+	if err := json.NewDecoder(resp.Body).Decode(&env); err != nil {
+		return Envelope{}, fmt.Errorf("%w: %v", errRelayUpstream, err)
+	}
+	return env, nil
+}
+
+// relayError turns an upstream's error response into an error carrying its
+// message.
+func relayError(resp *http.Response) error {
+	body := struct {
+		Message string `json:"message"`
+	}{}
+	if json.NewDecoder(resp.Body).Decode(&body) != nil || body.Message == "" {
+		body.Message = resp.Status
+	}
+	return fmt.Errorf("%w: %s", errRelayUpstream, body.Message)
+}
+
+// Start connects to the upstream, applying the state it sends to rooms and
+// bans, and keeps reconnecting with jittered backoff when the stream ends.
+func (b *relayBackend) Start(rooms *roomRegistry, bans *banList) {
+	go func() {
+		backoff := relayMinBackoff
+		for {
+			for _, upstream := range b.byLatency() {
+				started := time.Now()
+				err := b.follow(upstream, rooms, bans)
+				b.connected.Store(false)
+				log.Printf("Relay: stream from %s ended: %v", upstream, err)
+				if time.Since(started) > relayMaxBackoff {
+					backoff = relayMinBackoff
+				}
+			}
+			relayReconnects.Inc()
+			time.Sleep(backoff/2 + rand.N(backoff/2+1))
+			backoff = min(2*backoff, relayMaxBackoff)
+		}
+	}()
+}
+
+// byLatency orders the upstreams by how fast their health endpoint answers;
+// those that don't answer come last.
+func (b *relayBackend) byLatency() []string {
+	if len(b.upstreams) == 1 {
+		return b.upstreams
+	}
+	rtts := make(map[string]time.Duration, len(b.upstreams))
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, upstream := range b.upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rtt := time.Duration(1<<63 - 1)
+			ctx, cancel := context.WithTimeout(context.Background(), relayProbeTimeout)
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, upstream+"/healthz", nil)
+			started := time.Now()
+			if resp, err := b.client.Do(req); err == nil {
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusOK {
+					rtt = time.Since(started)
+				}
+			}
+			mu.Lock()
+			rtts[upstream] = rtt
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	ordered := slices.Clone(b.upstreams)
+	slices.SortStableFunc(ordered, func(a, c string) int { return cmp.Compare(rtts[a], rtts[c]) })
+	return ordered
+}
+
+// follow streams from upstream until the stream breaks or goes quiet for
+// longer than relayReadTimeout.
+func (b *relayBackend) follow(upstream string, rooms *roomRegistry, bans *banList) error {
+	b.mu.Lock()
+	resume, err := json.Marshal(relayResume{Rooms: b.cursor})
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, upstream+"/internal/relay", bytes.NewReader(resume))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	req.Header.Set("Content-Type", "application/json")
+	started := time.Now()
+	resp, err := b.stream.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return relayError(resp)
+	}
+	b.rtt.Store(int64(time.Since(started)))
+	b.current.Store(&upstream)
+	b.connected.Store(true)
+	log.Printf("Relay: streaming from %s (%s)", upstream, time.Since(started).Round(time.Millisecond))
+
+	watchdog := time.AfterFunc(relayReadTimeout, cancel)
+	defer watchdog.Stop()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		frame := relayFrame{}
+		if err := dec.Decode(&frame); err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("nothing received for %s", relayReadTimeout)
+			}
+			return err
+		}
+		watchdog.Reset(relayReadTimeout)
+		switch {
+		case frame.Envelope != nil:
+			b.receive(*frame.Envelope)
+		case frame.State != nil:
+			rooms.Replace(frame.State.Rooms)
+			bans.Replace(frame.State.Bans)
+		}
+	}
+}
+
+func (b *relayBackend) receive(env Envelope) {
+	b.mu.Lock()
+	if env.Room != "" && env.Seq > b.cursor[env.Room] {
+		b.cursor[env.Room] = env.Seq
+	}
+	handlers := b.handlers
+	b.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(env)
+	}
+}
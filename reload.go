@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	errInvalidConfig  = errors.New("invalid config")
+	errReloadDisabled = errors.New("no -config file to reload")
+
+	configReloads = newCounterVec("chat_config_reloads_total", "Config reloads by result.", "result")
+)
+
+// configDuration is a time.Duration written as a string like "90s" in the
+// config file.
+type configDuration time.Duration
+
+func (d configDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *configDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = configDuration(parsed)
+	return nil
+}
+
+type spamSettings struct {
+	DuplicateWindow configDuration `json:"duplicate_window"`
+	BurstLimit      int            `json:"burst_limit"`
+	BurstWindow     configDuration `json:"burst_window"`
+	MaxURLDensity   float64        `json:"max_url_density"`
+	Penalty         float64        `json:"penalty"`
+	Recovery        float64        `json:"recovery"`
+	MuteThreshold   float64        `json:"mute_threshold"`
+}
+
+// RuntimeConfig is the part of the configuration that can change without a
+// restart. The -config file overrides the matching flags; settings it leaves
+// out keep their flag value.
+type RuntimeConfig struct {
+	SubscriberBandwidth int                          `json:"subscriber_bandwidth"`
+	BackpressureLimit   float64                      `json:"backpressure_threshold"`
+	PresenceIdle        configDuration               `json:"presence_idle"`
+	Spam                spamSettings                 `json:"spam"`
+	CORSOrigins         []string                     `json:"cors_origins"`
+	Features            map[string]bool              `json:"features,omitempty"`
+	Moderation          map[string]*ModerationPolicy `json:"moderation,omitempty"`
+	Federation          []FederationPeer             `json:"federation,omitempty"`
+}
+
+func (c *RuntimeConfig) validate() error {
+	if c.SubscriberBandwidth < 0 {
+		return fmt.Errorf("%w: subscriber_bandwidth must not be negative", errInvalidConfig)
+	}
+	if c.BackpressureLimit > 1 {
+		return fmt.Errorf("%w: backpressure_threshold must be at most 1", errInvalidConfig)
+	}
+	if c.PresenceIdle <= 0 {
+		return fmt.Errorf("%w: presence_idle must be positive", errInvalidConfig)
+	}
+	if c.Spam.BurstLimit <= 0 || c.Spam.BurstWindow <= 0 || c.Spam.DuplicateWindow <= 0 {
+		return fmt.Errorf("%w: spam windows and burst_limit must be positive", errInvalidConfig)
+	}
+	if err := validateFeatures(c.Features); err != nil {
+		return err
+	}
+	if err := validatePeers(c.Federation); err != nil {
+		return err
+	}
+	for room, policy := range c.Moderation {
+		if policy == nil {
+			return fmt.Errorf("%w: moderation for %q is empty", errInvalidConfig, room)
+		}
+		if err := policy.compile(); err != nil {
+			return fmt.Errorf("%w: moderation for %q: %w", errInvalidConfig, room, err)
+		}
+	}
+	return nil
+}
+
+// redacted is c without the secrets of its federation peers, for showing.
+func (c RuntimeConfig) redacted() RuntimeConfig {
+	c.Federation = slices.Clone(c.Federation)
+	for i := range c.Federation {
+		c.Federation[i].Secret = ""
+	}
+	return c
+}
+
+func (c RuntimeConfig) spamConfig() spamConfig {
+	return spamConfig{
+		DuplicateWindow: time.Duration(c.Spam.DuplicateWindow),
+		BurstLimit:      c.Spam.BurstLimit,
+		BurstWindow:     time.Duration(c.Spam.BurstWindow),
+		MaxURLDensity:   c.Spam.MaxURLDensity,
+		Penalty:         c.Spam.Penalty,
+		Recovery:        c.Spam.Recovery,
+		MuteThreshold:   c.Spam.MuteThreshold,
+	}
+}
+
+func spamSettingsFrom(cfg spamConfig) spamSettings {
+	return spamSettings{
+		DuplicateWindow: configDuration(cfg.DuplicateWindow),
+		BurstLimit:      cfg.BurstLimit,
+		BurstWindow:     configDuration(cfg.BurstWindow),
+		MaxURLDensity:   cfg.MaxURLDensity,
+		Penalty:         cfg.Penalty,
+		Recovery:        cfg.Recovery,
+		MuteThreshold:   cfg.MuteThreshold,
+	}
+}
+
+// configReloader re-reads the -config file and applies it to the running
+// components. Open SSE streams are left alone; they pick the new settings up
+// on their next write or heartbeat.
+type configReloader struct {
+	path string
+	base RuntimeConfig
+
+	bandwidth  *atomic.Int64
+	broker     *Broker
+	presence   *presenceTracker
+	spam       *spamDetector
+	cors       *corsPolicy
+	rooms      *roomRegistry
+	features   *featureSet
+	federation *federation
+
+	mu      sync.Mutex
+	current RuntimeConfig
+}
+
+// load reads the config file over the flag values without applying it.
+func (c *configReloader) load() (RuntimeConfig, error) {
+	cfg := c.base
+	cfg.Features = maps.Clone(c.base.Features)
+	cfg.Moderation = nil
+	cfg.Federation = nil
+	if c.path == "" {
+		return cfg, cfg.validate()
+	}
+
+	raw, err := os.ReadFile(c.path)
+	if err != nil {
+		return RuntimeConfig{}, err
+	}
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return RuntimeConfig{}, fmt.Errorf("%w: %s: %v", errInvalidConfig, c.path, err)
+	}
+	return cfg, cfg.validate()
+}
+
+func (c *configReloader) Reload() (RuntimeConfig, error) {
+	cfg, err := c.load()
+	if err != nil {
+		configReloads.With("error").Add(1)
+		return RuntimeConfig{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.bandwidth.Store(int64(cfg.SubscriberBandwidth))
+	c.broker.SetSaturationLimit(cfg.BackpressureLimit)
+	c.presence.SetIdle(time.Duration(cfg.PresenceIdle))
+	c.spam.SetConfig(cfg.spamConfig())
+	c.cors.Set(cfg.CORSOrigins)
+	c.features.Set(cfg.Features)
+	c.federation.SetPeers(cfg.Federation)
+
+	// Rooms that lost their policy in the file go back to unmoderated;
+	// policies set through the admin API on other rooms are kept.
+	for room := range c.current.Moderation {
+		if _, ok := cfg.Moderation[room]; !ok {
+			if err := c.rooms.SetModeration(room, nil); err != nil {
+				log.Printf("Config: %v", err)
+			}
+		}
+	}
+	for room, policy := range cfg.Moderation {
+		if err := c.rooms.SetModeration(room, policy); err != nil {
+			log.Printf("Config: %v", err)
+		}
+	}
+
+	c.current = cfg
+	configReloads.With("ok").Add(1)
+	return cfg, nil
+}
+
+func (c *configReloader) Current() RuntimeConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.current
+}
+
+// watchSignals reloads the config on every SIGHUP.
+func (c *configReloader) watchSignals() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if _, err := c.Reload(); err != nil {
+			log.Printf("Config reload failed, keeping the previous config: %v", err)
+			continue
+		}
+		log.Printf("Config reloaded from %s", c.path)
+	}
+}
+
+func getConfigHandler(reloader *configReloader) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reloader.Current().redacted())
+	}
+}
+
+func reloadConfigHandler(reloader *configReloader, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if reloader.path == "" {
+			writeError(w, r, errReloadDisabled)
+			return
+		}
+		cfg, err := reloader.Reload()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record("admin", "config.reload", "", reloader.path)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cfg.redacted())
+	}
+}
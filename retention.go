@@ -0,0 +1,382 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	minRetentionDays = 1
+	maxRetentionDays = 10 * 365
+
+	holdRoom = "room"
+	holdUser = "user"
+)
+
+var tenantPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// LegalHold suspends the deletion of the messages of a room or of a user.
+type LegalHold struct {
+	Kind   string    `json:"kind"`
+	Name   string    `json:"name"`
+	Reason string    `json:"reason,omitempty"`
+	By     string    `json:"by"`
+	Since  time.Time `json:"since"`
+}
+
+type TenantRetention struct {
+	Tenant string `json:"tenant"`
+	Days   int    `json:"retention_days"`
+}
+
+// retentionPolicies holds how long each tenant keeps its rooms' messages and
+// the legal holds that suspend deletion. The janitor deletes messages past
+// the shorter of their room's message TTL and its tenant's retention, except
+// in held rooms and from held users.
+type retentionPolicies struct {
+	mu      sync.RWMutex
+	tenants map[string]int
+	rooms   map[string]LegalHold
+	users   map[string]LegalHold
+}
+
+func newRetentionPolicies() *retentionPolicies {
+	return &retentionPolicies{tenants: make(map[string]int), rooms: make(map[string]LegalHold), users: make(map[string]LegalHold)}
+}
+
+// SetRetention keeps the messages of tenant's rooms for days; zero keeps
+// them until their rooms say otherwise.
+func (p *retentionPolicies) SetRetention(tenant string, days int) error {
+	if days != 0 && (days < minRetentionDays || days > maxRetentionDays) {
+		return fmt.Errorf("%w: retention_days must be between %d and %d", errInvalidRequest, minRetentionDays, maxRetentionDays)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if days == 0 {
+		delete(p.tenants, tenant)
+	} else {
+		p.tenants[tenant] = days
+	}
+	return nil
+}
+
+func (p *retentionPolicies) Retentions() []TenantRetention {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	list := make([]TenantRetention, 0, len(p.tenants))
+	for tenant, days := range p.tenants {
+		list = append(list, TenantRetention{Tenant: tenant, Days: days})
+	}
+	slices.SortFunc(list, func(a, b TenantRetention) int { return cmp.Compare(a.Tenant, b.Tenant) })
+	return list
+}
+
+func (p *retentionPolicies) holds(kind string) map[string]LegalHold {
+	if kind == holdRoom {
+		return p.rooms
+	}
+	return p.users
+}
+
+// Hold places or, with place false, lifts a legal hold.
+func (p *retentionPolicies) Hold(hold LegalHold, place bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if place {
+		p.holds(hold.Kind)[hold.Name] = hold
+	} else {
+		delete(p.holds(hold.Kind), hold.Name)
+	}
+}
+
+func (p *retentionPolicies) Holds() []LegalHold {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	list := make([]LegalHold, 0, len(p.rooms)+len(p.users))
+	for _, holds := range []map[string]LegalHold{p.rooms, p.users} {
+		for _, hold := range holds {
+			list = append(list, hold)
+		}
+	}
+	slices.SortFunc(list, func(a, b LegalHold) int { return cmp.Or(cmp.Compare(a.Kind, b.Kind), cmp.Compare(a.Name, b.Name)) })
+	return list
+}
+
+// UserHolds returns whether a user is held, or nil while nobody is, so
+// deletion can skip looking at senders.
+func (p *retentionPolicies) UserHolds() func(user string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.users) == 0 {
+		return nil
+	}
+	users := make(map[string]bool, len(p.users))
+	for user := range p.users {
+		users[user] = true
+	}
+	return func(user string) bool { return users[user] }
+}
+
+// Expiries returns how long the messages of every room that doesn't keep
+// them forever are kept, leaving out rooms on hold.
+func (p *retentionPolicies) Expiries(rooms *roomRegistry) map[string]time.Duration {
+	ttls := rooms.MessageTTLs()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for room, tenant := range rooms.Tenants() {
+		if days, ok := p.tenants[tenant]; ok {
+			retention := time.Duration(days) * 24 * time.Hour
+			if ttl, ok := ttls[room]; !ok || retention < ttl {
+				ttls[room] = retention
+			}
+		}
+	}
+	for room := range p.rooms {
+		delete(ttls, room)
+	}
+	return ttls
+}
+
+// SetTenant assigns room to tenant, or to none for "".
+func (rr *roomRegistry) SetTenant(name, tenant string) (Room, error) {
+	if tenant != "" && !tenantPattern.MatchString(tenant) {
+		return Room{}, fmt.Errorf("%w: tenant must be 1-64 letters, digits, '.', '_' or '-'", errInvalidRequest)
+	}
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	room, ok := rr.rooms[name]
+	if !ok {
+		return Room{}, errRoomNotFound
+	}
+	if err := rr.record(RoomEvent{Type: roomTenantSet, Room: name, Tenant: tenant}); err != nil {
+		return Room{}, err
+	}
+	return *room, nil
+}
+
+// Tenants returns the tenant of every room that has one.
+func (rr *roomRegistry) Tenants() map[string]string {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+
+	tenants := make(map[string]string)
+	for name, room := range rr.rooms {
+		if room.Tenant != "" {
+			tenants[name] = room.Tenant
+		}
+	}
+	return tenants
+}
+
+// senderOf returns the user_id of a chat message.
+func senderOf(data json.RawMessage) string {
+	chat := struct {
+		UserID string `json:"user_id"`
+	}{}
+	json.Unmarshal(data, &chat)
+	return chat.UserID
+}
+
+// unheldMessages returns the row IDs of the stored chat messages of room
+// created before cutoff that weren't sent by a held user.
+func (s *messageStore) unheldMessages(ctx context.Context, room string, cutoff time.Time, held func(user string) bool) ([]int64, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, data FROM messages
+		WHERE room = ? AND event = '' AND created_at < ? AND id NOT IN (SELECT message_id FROM outbox)`, room, cutoff.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	IDs := []int64{}
+	for rows.Next() {
+		var ID int64
+		var stored []byte
+		if err := rows.Scan(&ID, &stored); err != nil {
+			return nil, err
+		}
+		// What can't be read can't be cleared of a hold either, so it stays.
+		data, err := decodeStored(stored)
+		if err != nil || held(senderOf(data)) {
+			continue
+		}
+		IDs = append(IDs, ID)
+	}
+	return IDs, rows.Err()
+}
+
+// ExpireSegments deletes the archive segments of room archived before
+// cutoff, and so holding only older messages, unless a held user sent one
+// of them. It returns how many messages went. Clients aren't told: they
+// never kept messages that old in view.
+func (s *messageStore) ExpireSegments(ctx context.Context, blobs BlobStore, room string, cutoff time.Time, held func(user string) bool) (int, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT first_seq, last_seq, blob_key, messages FROM archive_segments
+		WHERE room = ? AND archived_at < ? ORDER BY first_seq`, room, cutoff.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	type expiring struct {
+		archiveSegment
+		messages int
+	}
+	var segments []expiring
+	for rows.Next() {
+		segment := expiring{archiveSegment: archiveSegment{Room: room}}
+		if err := rows.Scan(&segment.FirstSeq, &segment.LastSeq, &segment.BlobKey, &segment.messages); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		segments = append(segments, segment)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, segment := range segments {
+		if held != nil {
+			envs, err := readSegment(ctx, blobs, segment.archiveSegment)
+			if err != nil {
+				return expired, err
+			}
+			if slices.ContainsFunc(envs, func(env Envelope) bool { return held(senderOf(env.Data)) }) {
+				continue
+			}
+		}
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM archive_segments WHERE room = ? AND first_seq = ?`, room, segment.FirstSeq); err != nil {
+			return expired, err
+		}
+		if err := blobs.Delete(ctx, segment.BlobKey); err != nil {
+			log.Printf("Retention: deleting archive segment %s: %v", segment.BlobKey, err)
+		}
+		expired += segment.messages
+	}
+	expiredMessages.Add(uint64(expired))
+	return expired, nil
+}
+
+type tenantRequest struct {
+	Tenant string `json:"tenant"`
+}
+
+// setRoomTenantHandler assigns a room to a tenant, whose retention its
+// messages then follow.
+func setRoomTenantHandler(rooms *roomRegistry, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("room")
+		req := tenantRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+		room, err := rooms.SetTenant(name, req.Tenant)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record(auditActor(r), "room.tenant", name, cmp.Or(room.Tenant, "none"))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(room)
+	}
+}
+
+func listRetentionHandler(retention *retentionPolicies) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(retention.Retentions())
+	}
+}
+
+// tenantRetentionHandler sets or, with set false, clears the retention of a
+// tenant. Messages already past a shorter retention go with the next janitor
+// run.
+func tenantRetentionHandler(retention *retentionPolicies, audit *auditLog, set bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenant := r.PathValue("tenant")
+		if !tenantPattern.MatchString(tenant) {
+			writeError(w, r, fmt.Errorf("%w: tenant must be 1-64 letters, digits, '.', '_' or '-'", errInvalidRequest))
+			return
+		}
+		req := TenantRetention{}
+		if set {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, r, invalidJSON(err))
+				return
+			}
+			if req.Days == 0 {
+				writeError(w, r, fmt.Errorf("%w: retention_days is required; DELETE clears the retention", errInvalidRequest))
+				return
+			}
+		}
+		if err := retention.SetRetention(tenant, req.Days); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		req.Tenant = tenant
+		audit.Record(auditActor(r), "tenant.retention", "", "tenant="+tenant+" days="+strconv.Itoa(req.Days))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(req)
+	}
+}
+
+func listLegalHoldsHandler(retention *retentionPolicies) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(retention.Holds())
+	}
+}
+
+type legalHoldRequest struct {
+	Reason string `json:"reason"`
+}
+
+// legalHoldHandler places or, with place false, lifts a legal hold on the
+// room or user named in the path.
+func legalHoldHandler(retention *retentionPolicies, audit *auditLog, kind string, place bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hold := LegalHold{Kind: kind, Name: r.PathValue(kind), By: auditActor(r), Since: time.Now().UTC()}
+		if place {
+			req := legalHoldRequest{}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil && r.ContentLength != 0 {
+				writeError(w, r, invalidJSON(err))
+				return
+			}
+			hold.Reason = req.Reason
+		}
+		retention.Hold(hold, place)
+		action, room, detail := "legal_hold.place", "", kind+"="+hold.Name
+		if !place {
+			action = "legal_hold.lift"
+		}
+		if kind == holdRoom {
+			room = hold.Name
+		}
+		if hold.Reason != "" {
+			detail += " reason=" + hold.Reason
+		}
+		audit.Record(auditActor(r), action, room, detail)
+
+		if !place {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(hold)
+	}
+}
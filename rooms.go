@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errRoomExists   = errors.New("room already exists")
+	errRoomNotFound = errors.New("room not found")
+	errRoomReadOnly = errors.New("room is read-only")
+	errRoomMode     = errors.New("unknown room mode")
+)
+
+// Room modes. In broadcast mode only the owner and the room's presenters can
+// publish; everybody else just listens. In feedback mode only members can
+// read the room, even if it isn't private, and anyone else, signed in or not,
+// can only leave messages in it through its feedback endpoint.
+const (
+	roomModeChat      = "chat"
+	roomModeBroadcast = "broadcast"
+	roomModeFeedback  = "feedback"
+)
+
+// System rooms carry server-generated events (moderation flags and the like).
+// Only admins can subscribe to them and nobody can post into them.
+const (
+	systemRoomPrefix = "#"
+	moderationRoom   = "#moderation"
+)
+
+func isSystemRoom(name string) bool {
+	return strings.HasPrefix(name, systemRoomPrefix)
+}
+
+// Room holds the access policy of a room. Rooms that were never created
+// explicitly are public and have no owner.
+type Room struct {
+	Name         string            `json:"name"`
+	Owner        string            `json:"owner"`
+	Private      bool              `json:"private"`
+	PublicStream bool              `json:"public_stream,omitempty"`
+	Mode         string            `json:"mode"`
+	Presenters   []string          `json:"presenters,omitempty"`
+	Capacity     int               `json:"capacity,omitempty"`
+	MessageTTL   configDuration    `json:"message_ttl,omitempty"`
+	Moderation   *ModerationPolicy `json:"moderation,omitempty"`
+	Challenge    *ChallengePolicy  `json:"challenge,omitempty"`
+	Encrypted    bool              `json:"encrypted,omitempty"`
+	Tenant       string            `json:"tenant,omitempty"`
+	Welcome      string            `json:"welcome,omitempty"`
+	CreatedAt    time.Time         `json:"created_at"`
+	Members      map[string]bool   `json:"-"`
+}
+
+// roomRegistry holds every room. It changes only by recording room events,
+// in a journal when it has one.
+type roomRegistry struct {
+	mu    sync.RWMutex
+	rooms map[string]*Room
+
+	journal     roomJournal
+	seq         uint64
+	snapshotSeq uint64
+}
+
+func newRoomRegistry() *roomRegistry {
+	return &roomRegistry{rooms: make(map[string]*Room)}
+}
+
+// roomSettings are what a room starts out with besides its owner. The zero
+// value is a public chat room without a capacity.
+type roomSettings struct {
+	Private      bool
+	Mode         string
+	Presenters   []string
+	Capacity     int
+	PublicStream bool
+	Encrypted    bool
+}
+
+func (s roomSettings) check() error {
+	if s.Mode != "" && !validRoomMode(s.Mode) {
+		return errRoomMode
+	}
+	if s.Capacity < 0 {
+		return fmt.Errorf("%w: capacity must not be negative", errInvalidRequest)
+	}
+	return nil
+}
+
+// Create registers room name, owned by owner, with settings in a single
+// event, so a room either exists as asked for or not at all.
+func (rr *roomRegistry) Create(name, owner string, settings roomSettings) (*Room, error) {
+	if err := settings.check(); err != nil {
+		return nil, err
+	}
+
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	if _, ok := rr.rooms[name]; ok {
+		return nil, errRoomExists
+	}
+	e := RoomEvent{
+		Type:         roomCreated,
+		Room:         name,
+		Owner:        owner,
+		Private:      settings.Private,
+		Mode:         settings.Mode,
+		Presenters:   settings.Presenters,
+		Capacity:     settings.Capacity,
+		PublicStream: settings.PublicStream,
+		Encrypted:    settings.Encrypted,
+	}
+	if err := rr.record(e); err != nil {
+		return nil, err
+	}
+	return rr.rooms[name], nil
+}
+
+func (rr *roomRegistry) Get(name string) (Room, bool) {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+
+	room, ok := rr.rooms[name]
+	if !ok {
+		return Room{}, false
+	}
+	return *room, true
+}
+
+func (rr *roomRegistry) List() []Room {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+
+	rooms := make([]Room, 0, len(rr.rooms))
+	for _, room := range rr.rooms {
+		rooms = append(rooms, *room)
+	}
+	slices.SortFunc(rooms, func(a, b Room) int { return strings.Compare(a.Name, b.Name) })
+	return rooms
+}
+
+func (rr *roomRegistry) IsOwner(name, user string) bool {
+	room, ok := rr.Get(name)
+	return ok && user != "" && room.Owner == user
+}
+
+func (rr *roomRegistry) CanAccess(name, user string) bool {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+
+	room, ok := rr.rooms[name]
+	if !ok || (!room.Private && room.Mode != roomModeFeedback) {
+		return true
+	}
+	return room.Members[user]
+}
+
+// CanRead reports whether user may stream or replay room.
+func (rr *roomRegistry) CanRead(name, user string) bool {
+	return rr.PublicStream(name) || rr.CanAccess(name, user)
+}
+
+// PublicStream reports whether anyone, signed in or not, may read room even
+// if it is private. Sending into it still takes a signed-in member. Feedback
+// rooms are never public, whatever their flag says.
+func (rr *roomRegistry) PublicStream(name string) bool {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+
+	room, ok := rr.rooms[name]
+	return ok && room.PublicStream && room.Mode != roomModeFeedback
+}
+
+// TakesFeedback reports whether room is in feedback mode.
+func (rr *roomRegistry) TakesFeedback(name string) bool {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+
+	room, ok := rr.rooms[name]
+	return ok && room.Mode == roomModeFeedback
+}
+
+func (rr *roomRegistry) SetPublicStream(name string, enabled bool) (Room, error) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	room, ok := rr.rooms[name]
+	if !ok {
+		return Room{}, errRoomNotFound
+	}
+	if err := rr.record(RoomEvent{Type: roomPublicStreamSet, Room: name, Enabled: enabled}); err != nil {
+		return Room{}, err
+	}
+	return *room, nil
+}
+
+// CheckPublish reports why user can't publish into room, if they can't.
+func (rr *roomRegistry) CheckPublish(name, user string) error {
+	if isSystemRoom(name) {
+		return errSystemRoom
+	}
+	if !rr.CanAccess(name, user) {
+		return errNotMember
+	}
+
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+
+	room, ok := rr.rooms[name]
+	if !ok || room.Mode != roomModeBroadcast || room.Owner == user || slices.Contains(room.Presenters, user) {
+		return nil
+	}
+	return errRoomReadOnly
+}
+
+func validRoomMode(mode string) bool {
+	return mode == roomModeChat || mode == roomModeBroadcast || mode == roomModeFeedback
+}
+
+func (rr *roomRegistry) SetMode(name, mode string, presenters []string) (Room, error) {
+	if !validRoomMode(mode) {
+		return Room{}, errRoomMode
+	}
+
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	room, ok := rr.rooms[name]
+	if !ok {
+		return Room{}, errRoomNotFound
+	}
+	if err := rr.record(RoomEvent{Type: roomModeSet, Room: name, Mode: mode, Presenters: presenters}); err != nil {
+		return Room{}, err
+	}
+	return *room, nil
+}
+
+// SetCapacity limits how many streams can be in room at once, 0 for no
+// limit.
+func (rr *roomRegistry) SetCapacity(name string, capacity int) (Room, error) {
+	if capacity < 0 {
+		return Room{}, fmt.Errorf("%w: capacity must not be negative", errInvalidRequest)
+	}
+
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	room, ok := rr.rooms[name]
+	if !ok {
+		return Room{}, errRoomNotFound
+	}
+	if err := rr.record(RoomEvent{Type: roomCapacitySet, Room: name, Capacity: capacity}); err != nil {
+		return Room{}, err
+	}
+	return *room, nil
+}
+
+func (rr *roomRegistry) Capacity(name string) int {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+
+	if room, ok := rr.rooms[name]; ok {
+		return room.Capacity
+	}
+	return 0
+}
+
+// SetModeration replaces the content policy of room. Admins may set a policy
+// on a room nobody created yet; it is registered as a public, ownerless room.
+func (rr *roomRegistry) SetModeration(name string, policy *ModerationPolicy) error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	return rr.record(RoomEvent{Type: roomModerationSet, Room: name, Moderation: policy})
+}
+
+// Moderate evaluates message against the policy of room. Messages of
+// encrypted rooms can't be read, so they are only checked for being
+// ciphertext.
+func (rr *roomRegistry) Moderate(name string, chat *Chat) error {
+	rr.mu.RLock()
+	room, ok := rr.rooms[name]
+	var policy *ModerationPolicy
+	encrypted := false
+	if ok {
+		policy, encrypted = room.Moderation, room.Encrypted
+	}
+	rr.mu.RUnlock()
+
+	if err := checkMetadata(chat); err != nil {
+		return err
+	}
+	if encrypted {
+		if chat.Poll != nil || chat.Components != nil {
+			return fmt.Errorf("%w: polls and buttons are plaintext", errRoomEncrypted)
+		}
+		return checkCiphertext(chat)
+	}
+	if chat.Ciphertext != "" || chat.KeyID != "" {
+		return fmt.Errorf("%w: ciphertext is only for encrypted rooms", errInvalidRequest)
+	}
+	if err := prepareContent(chat); err != nil {
+		return err
+	}
+	if err := checkPoll(chat); err != nil {
+		return err
+	}
+	if err := checkComponents(chat); err != nil {
+		return err
+	}
+	if policy == nil {
+		return nil
+	}
+	if violations := policy.Evaluate(chat.Message); len(violations) > 0 {
+		return withDetails(errMessageRejected, violations)
+	}
+	return nil
+}
+
+func (rr *roomRegistry) AddMember(name, user string) error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	if _, ok := rr.rooms[name]; !ok {
+		return errRoomNotFound
+	}
+	return rr.record(RoomEvent{Type: roomMemberAdded, Room: name, User: user})
+}
+
+// ReassignMember moves the memberships, ownerships and presenter seats of
+// from to to, in every room with one event, and returns how many rooms it
+// touched. commit, if not nil, journals the event in place of the
+// registry's journal, so the caller can record it in the same transaction
+// as the rest of what it changes; if commit fails nothing has moved.
+func (rr *roomRegistry) ReassignMember(from, to string, commit func(RoomEvent) (uint64, error)) (int, error) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	n := 0
+	for _, room := range rr.rooms {
+		if room.holds(from) {
+			n++
+		}
+	}
+	e := RoomEvent{Type: roomMemberReassigned, User: from, To: to}
+	record := rr.record
+	if commit != nil {
+		record = func(e RoomEvent) error { return rr.recordWith(e, commit) }
+	}
+	if err := record(e); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+type createRoomRequest struct {
+	Name         string   `json:"name"`
+	Private      bool     `json:"private"`
+	Mode         string   `json:"mode"`
+	Presenters   []string `json:"presenters"`
+	Capacity     int      `json:"capacity"`
+	PublicStream bool     `json:"public_stream"`
+	Encrypted    bool     `json:"encrypted"`
+}
+
+type roomModeRequest struct {
+	Mode       string   `json:"mode"`
+	Presenters []string `json:"presenters"`
+}
+
+func createRoomHandler(rooms *roomRegistry, lifecycle *lifecycleMirror, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromRequest(r)
+		if user == "" {
+			writeError(w, r, errUnauthenticated)
+			return
+		}
+
+		req := createRoomRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+		if req.Name == "" {
+			writeError(w, r, fmt.Errorf("%w: room name required", errInvalidRequest))
+			return
+		}
+		// The default room is everyone's before anybody creates it, so
+		// nobody may claim it and lock the others out.
+		if isSystemRoom(req.Name) || req.Name == defaultRoom {
+			writeError(w, r, fmt.Errorf("%w: room name is reserved", errInvalidRequest))
+			return
+		}
+
+		room, err := rooms.Create(req.Name, user, roomSettings{
+			Private:      req.Private,
+			Mode:         req.Mode,
+			Presenters:   req.Presenters,
+			Capacity:     req.Capacity,
+			PublicStream: req.PublicStream,
+			Encrypted:    req.Encrypted,
+		})
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record(user, "room.create", room.Name, "")
+		lifecycle.Record(LifecycleEvent{Type: lifecycleRoomCreated, Room: room.Name, User: user})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(room)
+	}
+}
+
+func setRoomModeHandler(rooms *roomRegistry, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("room")
+		user := userFromRequest(r)
+		if !rooms.IsOwner(name, user) {
+			writeError(w, r, fmt.Errorf("%w: only the room owner can change its mode", errForbidden))
+			return
+		}
+
+		req := roomModeRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+
+		room, err := rooms.SetMode(name, req.Mode, req.Presenters)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record(user, "room.mode", name, fmt.Sprintf("mode=%s presenters=%v", room.Mode, room.Presenters))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(room)
+	}
+}
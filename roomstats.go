@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// statsRetention is how far back the in-memory counters go. Message
+	// counts and senders beyond it need the store.
+	statsRetention   = 24 * time.Hour
+	maxStatsWindow   = 30 * 24 * time.Hour
+	maxStatsBuckets  = 1440
+	maxTrackedSender = 10000
+)
+
+// statsMinute holds what happened in a room during one minute.
+type statsMinute struct {
+	start      int64
+	messages   int
+	peak       int
+	deliveries int
+	latency    time.Duration
+}
+
+type roomCounters struct {
+	minutes     []statsMinute
+	senders     map[string]time.Time
+	subscribers int
+}
+
+// minute returns the bucket for t, appending one if t is in a new minute.
+// Older buckets than the retention are dropped on the way.
+func (rc *roomCounters) minute(t time.Time) *statsMinute {
+	start := t.Truncate(time.Minute).UnixNano()
+	if n := len(rc.minutes); n > 0 && rc.minutes[n-1].start >= start {
+		return &rc.minutes[n-1]
+	}
+	cutoff := t.Add(-statsRetention)
+	drop := 0
+	for drop < len(rc.minutes) && rc.minutes[drop].start < cutoff.UnixNano() {
+		drop++
+	}
+	for sender, sent := range rc.senders {
+		if sent.Before(cutoff) {
+			delete(rc.senders, sender)
+		}
+	}
+	rc.minutes = append(rc.minutes[drop:], statsMinute{start: start, peak: rc.subscribers})
+	return &rc.minutes[len(rc.minutes)-1]
+}
+
+// roomStats keeps lightweight per-minute counters of every room on this
+// node: messages, senders, subscribers and delivery latency.
+type roomStats struct {
+	mu    sync.Mutex
+	rooms map[string]*roomCounters
+}
+
+func newRoomStats() *roomStats {
+	return &roomStats{rooms: make(map[string]*roomCounters)}
+}
+
+func (rs *roomStats) counters(room string) *roomCounters {
+	rc, ok := rs.rooms[room]
+	if !ok {
+		rc = &roomCounters{senders: make(map[string]time.Time)}
+		rs.rooms[room] = rc
+	}
+	return rc
+}
+
+// Observe counts a chat message of a room. It is a broker tap.
+func (rs *roomStats) Observe(env Envelope) {
+	if env.Event != "" {
+		return
+	}
+	sender := struct {
+		UserID string `json:"user_id"`
+	}{}
+	json.Unmarshal(env.Data, &sender)
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rc := rs.counters(env.Room)
+	rc.minute(env.Time).messages++
+	if _, ok := rc.senders[sender.UserID]; ok || len(rc.senders) < maxTrackedSender {
+		rc.senders[sender.UserID] = env.Time
+	}
+}
+
+// Occupancy follows the subscriber count of a room.
+func (rs *roomStats) Occupancy(room string, delta int) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rc := rs.counters(room)
+	rc.subscribers += delta
+	m := rc.minute(time.Now())
+	m.peak = max(m.peak, rc.subscribers)
+}
+
+// Delivered records that a stream wrote env, published at env.Time.
+func (rs *roomStats) Delivered(env Envelope) {
+	now := time.Now()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	m := rs.counters(env.Room).minute(now)
+	m.deliveries++
+	m.latency += now.Sub(env.Time)
+}
+
+type StatsBucket struct {
+	Start    time.Time `json:"start"`
+	Messages int       `json:"messages"`
+}
+
+type RoomStats struct {
+	Room                 string        `json:"room"`
+	Window               string        `json:"window"`
+	Bucket               string        `json:"bucket"`
+	Source               string        `json:"source"`
+	Messages             int           `json:"messages"`
+	Buckets              []StatsBucket `json:"buckets"`
+	UniqueSenders        int           `json:"unique_senders"`
+	Subscribers          int           `json:"subscribers"`
+	PeakSubscribers      int           `json:"peak_subscribers"`
+	Deliveries           int           `json:"deliveries"`
+	AvgDeliveryLatencyMS float64       `json:"avg_delivery_latency_ms"`
+}
+
+// Snapshot summarizes room over the window ending now. Message counts and
+// senders come from memory, so only reach back statsRetention; Stats fills
+// them in from the store when there is one.
+func (rs *roomStats) Snapshot(room string, now time.Time, window, bucket time.Duration) RoomStats {
+	since := now.Add(-window)
+	stats := RoomStats{Room: room, Window: window.String(), Bucket: bucket.String(), Source: "memory", Buckets: statsBuckets(since, now, bucket)}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rc, ok := rs.rooms[room]
+	if !ok {
+		return stats
+	}
+	stats.Subscribers = rc.subscribers
+	stats.PeakSubscribers = rc.subscribers
+
+	var latency time.Duration
+	first := stats.Buckets[0].Start.UnixNano()
+	for _, m := range rc.minutes {
+		if m.start < since.Truncate(time.Minute).UnixNano() {
+			continue
+		}
+		if i := int((m.start - first) / int64(bucket)); i >= 0 && i < len(stats.Buckets) {
+			stats.Buckets[i].Messages += m.messages
+			stats.Messages += m.messages
+		}
+		stats.PeakSubscribers = max(stats.PeakSubscribers, m.peak)
+		stats.Deliveries += m.deliveries
+		latency += m.latency
+	}
+	for _, sent := range rc.senders {
+		if !sent.Before(since) {
+			stats.UniqueSenders++
+		}
+	}
+	if stats.Deliveries > 0 {
+		stats.AvgDeliveryLatencyMS = float64(latency.Microseconds()) / float64(stats.Deliveries) / 1000
+	}
+	return stats
+}
+
+// statsBuckets lays out the empty buckets covering since to now, starting
+// at multiples of bucket since the Unix epoch like the store's.
+func statsBuckets(since, now time.Time, bucket time.Duration) []StatsBucket {
+	var buckets []StatsBucket
+	first := time.Unix(0, since.UnixNano()/int64(bucket)*int64(bucket))
+	for start := first; !start.After(now); start = start.Add(bucket) {
+		buckets = append(buckets, StatsBucket{Start: start.UTC()})
+	}
+	return buckets
+}
+
+// RoomActivity counts the stored chat messages of room since since, in
+// buckets starting at multiples of bucket, and their distinct senders.
+func (s *messageStore) RoomActivity(ctx context.Context, room string, since time.Time, bucket time.Duration) (map[int64]int, int, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT created_at / ? * ?, COUNT(*) FROM messages
+		WHERE room = ? AND event = '' AND created_at >= ? AND deleted_at IS NULL GROUP BY 1`,
+		int64(bucket), int64(bucket), room, since.UnixNano())
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	counts := make(map[int64]int)
+	for rows.Next() {
+		var start int64
+		var count int
+		if err := rows.Scan(&start, &count); err != nil {
+			return nil, 0, err
+		}
+		counts[start] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	senders := make(map[string]bool)
+	rows, err = s.db.QueryContext(ctx, `SELECT DISTINCT json_extract(CAST(data AS TEXT), '$.user_id') FROM messages
+		WHERE room = ? AND event = '' AND created_at >= ? AND deleted_at IS NULL AND `+storedAsJSON, room, since.UnixNano())
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sender sql.NullString
+		if err := rows.Scan(&sender); err != nil {
+			return nil, 0, err
+		}
+		if sender.Valid {
+			senders[sender.String] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	err = s.eachEncoded(ctx, s.db, `SELECT id, data FROM messages
+		WHERE room = ? AND event = '' AND created_at >= ? AND deleted_at IS NULL AND NOT `+storedAsJSON,
+		[]any{room, since.UnixNano()}, func(_ int64, data []byte) error {
+			sender := struct {
+				UserID *string `json:"user_id"`
+			}{}
+			if json.Unmarshal(data, &sender) == nil && sender.UserID != nil {
+				senders[*sender.UserID] = true
+			}
+			return nil
+		})
+	return counts, len(senders), err
+}
+
+// Stats is Snapshot with message counts and senders taken from store, when
+// given, so they cover the whole window.
+func (rs *roomStats) Stats(ctx context.Context, store *messageStore, room string, window, bucket time.Duration) (RoomStats, error) {
+	now := time.Now()
+	stats := rs.Snapshot(room, now, window, bucket)
+	if store == nil {
+		return stats, nil
+	}
+
+	counts, senders, err := store.RoomActivity(ctx, room, now.Add(-window), bucket)
+	if err != nil {
+		return RoomStats{}, err
+	}
+	stats.Source = "store"
+	stats.Messages, stats.UniqueSenders = 0, senders
+	for i := range stats.Buckets {
+		stats.Buckets[i].Messages = counts[stats.Buckets[i].Start.UnixNano()]
+		stats.Messages += stats.Buckets[i].Messages
+	}
+	return stats, nil
+}
+
+func parseStatsDuration(r *http.Request, name string, fallback time.Duration) (time.Duration, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%w: %s must be a positive duration like 1h", errInvalidRequest, name)
+	}
+	return d, nil
+}
+
+// roomStatsHandler reports the activity of a room over ?window= (24h by
+// default, at most 30 days) in ?bucket= sized buckets (1h by default, at
+// least a minute). Subscriber peaks and delivery latency are this node's,
+// from memory.
+func roomStatsHandler(rooms *roomRegistry, stats *roomStats, store *messageStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room := r.PathValue("room")
+		if !rooms.CanRead(room, userFromRequest(r)) {
+			writeError(w, r, errNotMember)
+			return
+		}
+
+		window, err := parseStatsDuration(r, "window", 24*time.Hour)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		bucket, err := parseStatsDuration(r, "bucket", time.Hour)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if window > maxStatsWindow {
+			writeError(w, r, fmt.Errorf("%w: window is at most %s", errInvalidRequest, maxStatsWindow))
+			return
+		}
+		if bucket < time.Minute || bucket%time.Minute != 0 {
+			writeError(w, r, fmt.Errorf("%w: bucket must be whole minutes", errInvalidRequest))
+			return
+		}
+		if window/bucket > maxStatsBuckets {
+			writeError(w, r, fmt.Errorf("%w: at most %d buckets per window", errInvalidRequest, maxStatsBuckets))
+			return
+		}
+
+		report, err := stats.Stats(r.Context(), store, room, window, bucket)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	selfTestRoom = "#selftest"
+	selfTestUser = "selftest"
+
+	// selfTestTick is how often the publisher publishes its share of the
+	// rate.
+	selfTestTick = 10 * time.Millisecond
+
+	// Latencies are counted in buckets growing by a quarter power of two
+	// from a microsecond, up to about half a minute.
+	latencyBuckets   = 100
+	latencyPerDouble = 4
+)
+
+var errSelfTestDisabled = errors.New("self-test not running; start the server with -selftest")
+
+type selfTestConfig struct {
+	Rate        float64
+	Subscribers int
+	Size        int
+	Duration    time.Duration
+	Report      time.Duration
+}
+
+// latencyHistogram counts delivery latencies in exponential buckets, which
+// keeps percentiles within a fifth of the true value at any rate.
+type latencyHistogram struct {
+	counts [latencyBuckets]atomic.Uint64
+	max    atomic.Int64
+}
+
+func (h *latencyHistogram) Observe(d time.Duration) {
+	bucket := 0
+	if us := float64(d.Microseconds()); us > 1 {
+		bucket = min(int(math.Log2(us)*latencyPerDouble)+1, latencyBuckets-1)
+	}
+	h.counts[bucket].Add(1)
+	for {
+		peak := h.max.Load()
+		if int64(d) <= peak || h.max.CompareAndSwap(peak, int64(d)) {
+			break
+		}
+	}
+}
+
+// snapshot returns the counts so far and resets the histogram.
+func (h *latencyHistogram) snapshot() ([latencyBuckets]uint64, time.Duration) {
+	var counts [latencyBuckets]uint64
+	for i := range h.counts {
+		counts[i] = h.counts[i].Swap(0)
+	}
+	return counts, time.Duration(h.max.Swap(0))
+}
+
+// quantile returns the upper bound of the bucket holding quantile q.
+func quantile(counts [latencyBuckets]uint64, q float64) time.Duration {
+	var total uint64
+	for _, n := range counts {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(total)))
+	var seen uint64
+	for i, n := range counts {
+		if seen += n; seen >= rank {
+			return time.Duration(math.Exp2(float64(i)/latencyPerDouble) * float64(time.Microsecond))
+		}
+	}
+	return 0
+}
+
+type LatencyReport struct {
+	P50 float64 `json:"p50_ms"`
+	P90 float64 `json:"p90_ms"`
+	P99 float64 `json:"p99_ms"`
+	Max float64 `json:"max_ms"`
+}
+
+// SelfTestReport is what the self-test measured over its last report
+// interval, with totals since it started.
+type SelfTestReport struct {
+	Running     bool          `json:"running"`
+	Started     time.Time     `json:"started"`
+	Elapsed     time.Duration `json:"elapsed_ns"`
+	TargetRate  float64       `json:"target_rate"`
+	Subscribers int           `json:"subscribers"`
+	Published   uint64        `json:"published"`
+	Delivered   uint64        `json:"delivered"`
+	Dropped     uint64        `json:"dropped"`
+	Errors      uint64        `json:"publish_errors"`
+	// PublishRate and DeliveryRate are per second over the last interval;
+	// DeliveryRate counts every subscriber's copy.
+	PublishRate  float64       `json:"publish_rate"`
+	DeliveryRate float64       `json:"delivery_rate"`
+	Latency      LatencyReport `json:"latency"`
+	HeapStart    uint64        `json:"heap_start_bytes"`
+	Heap         uint64        `json:"heap_bytes"`
+	HeapGrowth   int64         `json:"heap_growth_bytes"`
+	Goroutines   int           `json:"goroutines"`
+}
+
+// selfTest is a synthetic load built into the server for capacity and soak
+// testing: a publisher sends chat messages at a steady rate into
+// selfTestRoom, through the store like any other, and subscribers on the
+// broker time their delivery. It reports every interval in the log and at
+// /admin/selftest.
+type selfTest struct {
+	cfg    selfTestConfig
+	broker *Broker
+	stop   chan struct{}
+
+	published atomic.Uint64
+	delivered atomic.Uint64
+	errors    atomic.Uint64
+	latency   latencyHistogram
+
+	mu     sync.Mutex
+	report SelfTestReport
+}
+
+type selfTestMessage struct {
+	Room    string `json:"room"`
+	UserID  string `json:"user_id"`
+	Message string `json:"message"`
+	SentAt  int64  `json:"selftest_sent_at"`
+}
+
+// startSelfTest starts the self-test, after making its room disappear its
+// messages so a soak run doesn't fill the store.
+func startSelfTest(cfg selfTestConfig, broker *Broker, rooms *roomRegistry) (*selfTest, error) {
+	if cfg.Rate <= 0 || cfg.Subscribers < 1 || cfg.Size < 0 || cfg.Report <= 0 {
+		return nil, fmt.Errorf("-selftest needs a positive -selftest-rate, -selftest-report and -selftest-subscribers")
+	}
+	if _, err := rooms.Create(selfTestRoom, selfTestUser, roomSettings{Private: true}); err != nil && !errors.Is(err, errRoomExists) {
+		return nil, err
+	}
+	if _, err := rooms.SetMessageTTL(selfTestRoom, minMessageTTL); err != nil {
+		return nil, err
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	t := &selfTest{cfg: cfg, broker: broker, stop: make(chan struct{})}
+	t.report = SelfTestReport{Running: true, Started: time.Now().UTC(), TargetRate: cfg.Rate, Subscribers: cfg.Subscribers, HeapStart: mem.HeapAlloc}
+
+	subscribers := make([]*Subscriber, cfg.Subscribers)
+	for i := range subscribers {
+		subscribers[i] = broker.Subscribe(selfTestUser, fmt.Sprintf("selftest-%d", i), ConnOrigin{}, []string{selfTestRoom}, nil, nil)
+		go t.receive(subscribers[i])
+	}
+	go t.publish()
+	go t.run(subscribers)
+	log.Printf("Self-test: publishing %.0f messages/s of %d bytes into %s for %d subscribers", cfg.Rate, cfg.Size, selfTestRoom, cfg.Subscribers)
+	return t, nil
+}
+
+func (t *selfTest) publish() {
+	ticker := time.NewTicker(selfTestTick)
+	defer ticker.Stop()
+	filler := strings.Repeat("x", t.cfg.Size)
+	perTick := t.cfg.Rate * selfTestTick.Seconds()
+	owed := 0.0
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		}
+		for owed += perTick; owed >= 1; owed-- {
+			raw, _ := json.Marshal(selfTestMessage{Room: selfTestRoom, UserID: selfTestUser, Message: filler, SentAt: time.Now().UnixNano()})
+			if _, err := t.broker.Publish(selfTestRoom, raw); err != nil {
+				t.errors.Add(1)
+				continue
+			}
+			t.published.Add(1)
+		}
+	}
+}
+
+func (t *selfTest) receive(subscriber *Subscriber) {
+	for env := range subscriber.Channel {
+		msg := selfTestMessage{}
+		if env.Event != "" || json.Unmarshal(env.Data, &msg) != nil || msg.SentAt == 0 {
+			continue
+		}
+		t.latency.Observe(time.Since(time.Unix(0, msg.SentAt)))
+		t.delivered.Add(1)
+	}
+}
+
+// run reports every interval until the test's duration is up, if it has
+// one, then stops it.
+func (t *selfTest) run(subscribers []*Subscriber) {
+	ticker := time.NewTicker(t.cfg.Report)
+	defer ticker.Stop()
+	var end <-chan time.Time
+	if t.cfg.Duration > 0 {
+		end = time.After(t.cfg.Duration)
+	}
+	last := time.Now()
+	var lastPublished, lastDelivered uint64
+	for {
+		done := false
+		select {
+		case <-end:
+			done = true
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		counts, peak := t.latency.snapshot()
+		published, delivered := t.published.Load(), t.delivered.Load()
+		var dropped uint64
+		for _, s := range subscribers {
+			dropped += s.Dropped.Load()
+		}
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		seconds := now.Sub(last).Seconds()
+
+		t.mu.Lock()
+		r := &t.report
+		r.Running = !done
+		r.Elapsed = now.Sub(r.Started)
+		r.Published, r.Delivered, r.Dropped, r.Errors = published, delivered, dropped, t.errors.Load()
+		r.PublishRate = float64(published-lastPublished) / seconds
+		r.DeliveryRate = float64(delivered-lastDelivered) / seconds
+		r.Latency = LatencyReport{
+			P50: millis(quantile(counts, 0.5)),
+			P90: millis(quantile(counts, 0.9)),
+			P99: millis(quantile(counts, 0.99)),
+			Max: millis(peak),
+		}
+		r.Heap = mem.HeapAlloc
+		r.HeapGrowth = int64(mem.HeapAlloc) - int64(r.HeapStart)
+		r.Goroutines = runtime.NumGoroutine()
+		report := *r
+		t.mu.Unlock()
+
+		log.Printf("Self-test: %.0f published/s, %.0f delivered/s, latency p50 %.2fms p90 %.2fms p99 %.2fms max %.2fms, %d dropped, %d errors, heap %d bytes (%+d)",
+			report.PublishRate, report.DeliveryRate, report.Latency.P50, report.Latency.P90, report.Latency.P99, report.Latency.Max,
+			report.Dropped, report.Errors, report.Heap, report.HeapGrowth)
+		last, lastPublished, lastDelivered = now, published, delivered
+
+		if done {
+			close(t.stop)
+			for _, s := range subscribers {
+				t.broker.Unsubscribe(s.ID)
+			}
+			log.Printf("Self-test finished after %s: %d published, %d delivered", report.Elapsed.Round(time.Second), report.Published, report.Delivered)
+			return
+		}
+	}
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (t *selfTest) Report() SelfTestReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.report
+}
+
+// selfTestHandler serves the last self-test report; without -selftest there
+// is none.
+func selfTestHandler(t *selfTest) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if t == nil {
+			writeError(w, r, errSelfTestDisabled)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t.Report())
+	}
+}
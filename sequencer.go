@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	sequenceGapTimeout = 2 * time.Second
+	sequenceMaxPending = 1024
+)
+
+// roomSequencer releases envelopes strictly in sequence order per room. Early
+// arrivals are held until the gap fills; a gap that doesn't fill within
+// sequenceGapTimeout (a lost publish) is skipped so the room can't stall. A
+// room that wasn't seeded starts at sequence 1, so whatever arrives first
+// waits for the sequences before it rather than dropping them; a node that
+// first hears of a room mid-sequence skips the gap once it times out.
+type roomSequencer struct {
+	mu      sync.Mutex
+	rooms   map[string]*roomOrder
+	release func(Envelope)
+}
+
+// roomOrder is the sequencing state of one room. Its lock is held while the
+// room's envelopes are released, which keeps them in order, so a release
+// blocked on a slow shard only holds up the rooms waiting on it.
+type roomOrder struct {
+	mu      sync.Mutex
+	next    uint64
+	pending map[uint64]Envelope
+	timer   *time.Timer
+}
+
+func newRoomSequencer(release func(Envelope)) *roomSequencer {
+	return &roomSequencer{
+		rooms:   make(map[string]*roomOrder),
+		release: release,
+	}
+}
+
+// order returns the state of room, starting it at next if the room is new,
+// and whether it was.
+func (s *roomSequencer) order(room string, next uint64) (*roomOrder, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.rooms[room]
+	if !ok {
+		order = &roomOrder{next: next, pending: make(map[uint64]Envelope)}
+		s.rooms[room] = order
+	}
+	return order, !ok
+}
+
+// Seed makes seq+1 the starting point of room, so after a restart the room
+// carries on where the store left it rather than from whatever arrives
+// first. A room already past seq is left alone; one behind it, as after
+// taking over from another node, skips what that node already released.
+func (s *roomSequencer) Seed(room string, seq uint64) {
+	order, created := s.order(room, seq+1)
+	if created {
+		return
+	}
+	order.mu.Lock()
+	defer order.mu.Unlock()
+
+	if order.next <= seq {
+		order.next = seq + 1
+		for pending := range order.pending {
+			if pending <= seq {
+				delete(order.pending, pending)
+			}
+		}
+		s.drain(room, order)
+	}
+}
+
+func (s *roomSequencer) Accept(env Envelope) {
+	order, _ := s.order(env.Room, 1)
+	order.mu.Lock()
+	defer order.mu.Unlock()
+
+	if env.Seq < order.next {
+		return
+	}
+	order.pending[env.Seq] = env
+	s.drain(env.Room, order)
+
+	if len(order.pending) > sequenceMaxPending {
+		s.skipGap(env.Room, order)
+	}
+}
+
+// drain releases what is ready of room. order.mu must be held.
+func (s *roomSequencer) drain(room string, order *roomOrder) {
+	for {
+		env, ok := order.pending[order.next]
+		if !ok {
+			break
+		}
+		delete(order.pending, order.next)
+		order.next++
+		s.release(env)
+	}
+
+	if len(order.pending) == 0 {
+		if order.timer != nil {
+			order.timer.Stop()
+			order.timer = nil
+		}
+		return
+	}
+
+	if order.timer == nil {
+		order.timer = time.AfterFunc(sequenceGapTimeout, func() {
+			order.mu.Lock()
+			defer order.mu.Unlock()
+			order.timer = nil
+			s.skipGap(room, order)
+		})
+	}
+}
+
+func (s *roomSequencer) skipGap(room string, order *roomOrder) {
+	lowest := uint64(0)
+	for seq := range order.pending {
+		if lowest == 0 || seq < lowest {
+			lowest = seq
+		}
+	}
+	if lowest == 0 {
+		return
+	}
+	order.next = lowest
+	s.drain(room, order)
+}
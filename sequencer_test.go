@@ -0,0 +1,32 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSequencerOrdersFirstPublishesOfNewRoom(t *testing.T) {
+	var released []uint64
+	s := newRoomSequencer(func(env Envelope) { released = append(released, env.Seq) })
+
+	// Two concurrent first publishes reach the backend out of order.
+	for _, seq := range []uint64{2, 1, 3} {
+		s.Accept(Envelope{Room: "general", Seq: seq})
+	}
+	if want := []uint64{1, 2, 3}; !slices.Equal(released, want) {
+		t.Fatalf("released %v, want %v", released, want)
+	}
+}
+
+func TestSequencerSeededRoomSkipsReleased(t *testing.T) {
+	var released []uint64
+	s := newRoomSequencer(func(env Envelope) { released = append(released, env.Seq) })
+	s.Seed("general", 5)
+
+	for _, seq := range []uint64{7, 5, 6} {
+		s.Accept(Envelope{Room: "general", Seq: seq})
+	}
+	if want := []uint64{6, 7}; !slices.Equal(released, want) {
+		t.Fatalf("released %v, want %v", released, want)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// serverConfig selects the protocols the listener speaks. With a certificate
+// the server negotiates HTTP/2 over TLS; H2C additionally accepts cleartext
+// HTTP/2 with prior knowledge, for deployments behind a proxy that
+// terminates TLS and talks h2 to its backends.
+type serverConfig struct {
+	Addr    string
+	TLSCert string
+	TLSKey  string
+	H2C     bool
+	HTTP3   bool
+}
+
+func newHTTPServer(cfg serverConfig, handler http.Handler) *http.Server {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(cfg.H2C)
+
+	return &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           handler,
+		Protocols:         protocols,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		// Streaming handlers lift this deadline for their own response.
+		WriteTimeout: 30 * time.Second,
+	}
+}
+
+// newServer builds the server for cfg, starting the HTTP/3 listener if
+// asked for since its Alt-Svc headers wrap handler.
+func newServer(cfg serverConfig, handler http.Handler) (*http.Server, error) {
+	if cfg.HTTP3 {
+		if cfg.TLSCert == "" || cfg.TLSKey == "" {
+			return nil, errors.New("-h3 requires -tls-cert and -tls-key")
+		}
+		altSvc, err := serveHTTP3(cfg, handler)
+		if err != nil {
+			return nil, err
+		}
+		handler = altSvc(handler)
+	}
+	return newHTTPServer(cfg, handler), nil
+}
+
+// serve runs srv until it fails or is shut down.
+func serve(cfg serverConfig, srv *http.Server) error {
+	var err error
+	switch {
+	case cfg.TLSCert != "":
+		log.Printf("Server running on %s (HTTPS, h2)", cfg.Addr)
+		err = srv.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+	case cfg.H2C:
+		log.Printf("Server running on %s (HTTP/1.1, h2c)", cfg.Addr)
+		err = srv.ListenAndServe()
+	default:
+		log.Printf("Server running on %s", cfg.Addr)
+		err = srv.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// startStream prepares w for a long-lived event stream: headers that stop
+// intermediaries from buffering, no write deadline, and an initial flush so
+// the client sees the response open before the first event.
+func startStream(w http.ResponseWriter, r *http.Request, contentType string) (*http.ResponseController, error) {
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	if r.ProtoMajor == 1 {
+		// Connection-specific headers are illegal in HTTP/2 and HTTP/3.
+		w.Header().Set("Connection", "keep-alive")
+	}
+
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return nil, err
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return nil, fmt.Errorf("%w: %v", errStreamingUnsupported, err)
+	}
+	return rc, nil
+}
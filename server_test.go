@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flushTestHandler streams one event and holds the response open until the
+// client goes away, closing returned once it has.
+func flushTestHandler(returned chan<- struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer close(returned)
+		rc, err := startStream(w, r, "text/event-stream")
+		if err != nil {
+			return
+		}
+		writeEnvelope(w, Envelope{ID: "general:1", Room: "general", Seq: 1, Data: []byte(`{"text":"hello"}`)})
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		<-r.Context().Done()
+	}
+}
+
+func TestStreamFlushesPerProtocol(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   serverConfig
+		start func(*httptest.Server)
+		// client returns the client for the started server.
+		client    func(*httptest.Server) *http.Client
+		wantMajor int
+	}{
+		{
+			name:      "HTTP/1.1",
+			start:     (*httptest.Server).Start,
+			client:    (*httptest.Server).Client,
+			wantMajor: 1,
+		},
+		{
+			name: "h2",
+			start: func(s *httptest.Server) {
+				s.EnableHTTP2 = true
+				s.StartTLS()
+			},
+			client:    (*httptest.Server).Client,
+			wantMajor: 2,
+		},
+		{
+			name:  "h2c",
+			cfg:   serverConfig{H2C: true},
+			start: (*httptest.Server).Start,
+			client: func(*httptest.Server) *http.Client {
+				protocols := new(http.Protocols)
+				protocols.SetUnencryptedHTTP2(true)
+				return &http.Client{Transport: &http.Transport{Protocols: protocols}}
+			},
+			wantMajor: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			returned := make(chan struct{})
+			srv := httptest.NewUnstartedServer(nil)
+			srv.Config = newHTTPServer(tt.cfg, flushTestHandler(returned))
+			tt.start(srv)
+			defer srv.Close()
+
+			client := tt.client(srv)
+			defer client.CloseIdleConnections()
+			resp, err := client.Get(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.ProtoMajor != tt.wantMajor {
+				t.Fatalf("got %s, want HTTP/%d", resp.Proto, tt.wantMajor)
+			}
+			if got := resp.Header.Get("Connection"); (got != "") != (tt.wantMajor == 1) {
+				t.Errorf("Connection header %q over %s", got, resp.Proto)
+			}
+
+			frame := make(chan string, 1)
+			go func() {
+				lines := bufio.NewScanner(resp.Body)
+				for lines.Scan() {
+					if strings.HasPrefix(lines.Text(), "data: ") {
+						frame <- lines.Text()
+						return
+					}
+				}
+				close(frame)
+			}()
+			select {
+			case line, ok := <-frame:
+				if !ok {
+					t.Fatal("stream ended without a frame")
+				}
+				if !strings.Contains(line, "hello") {
+					t.Errorf("got frame %q", line)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no frame before the handler returned")
+			}
+			select {
+			case <-returned:
+				t.Fatal("handler returned before the client went away")
+			default:
+			}
+		})
+	}
+}
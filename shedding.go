@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"runtime/metrics"
+	"sync"
+	"time"
+)
+
+const (
+	// sheddingEvent tells #system that the node started or stopped shedding
+	// load, and why.
+	sheddingEvent = "shedding"
+
+	shedSampleInterval = time.Second
+	shedRetryAfter     = 5 * time.Second
+	// shedRecovery is the fraction of each threshold usage must fall below
+	// before shedding stops, so the node doesn't flap around a threshold.
+	shedRecovery = 0.8
+
+	heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+)
+
+var (
+	errShedding = errors.New("server is shedding load, retry later")
+
+	shedEvents          = newCounterVec("chat_shed_events_total", "Low-priority events not delivered while shedding load, by event.", "event")
+	shedRejectedStreams = newCounter("chat_shed_streams_rejected_total", "Streams turned away with 503 while shedding load.")
+	shedTransitions     = newCounterVec("chat_load_shedding_transitions_total", "Times load shedding started or stopped.", "state")
+
+	// lowPriorityEvents are what clients can do without for a while.
+	lowPriorityEvents = map[string]bool{presenceEvent: true, "preview": true, lifecycleEvent: true}
+)
+
+// BufferFill is how full subscriber buffers are on average, from 0 to 1.
+func (b *Broker) BufferFill() float64 {
+	subscribers := b.SubscriberCount()
+	if subscribers == 0 {
+		return 0
+	}
+	return float64(b.Buffered()) / float64(subscribers*(subscriberBufferSize+controlBufferSize))
+}
+
+// SetShedding makes delivery skip low-priority events while on. They are
+// still kept in history.
+func (b *Broker) SetShedding(on bool) {
+	b.shedding.Store(on)
+}
+
+// LoadReport is what the shedder last measured and whether it is shedding.
+type LoadReport struct {
+	Shedding    bool       `json:"shedding"`
+	Reasons     []string   `json:"reasons,omitempty"`
+	Since       *time.Time `json:"since,omitempty"`
+	HeapBytes   uint64     `json:"heap_bytes"`
+	HeapLimit   uint64     `json:"heap_limit,omitempty"`
+	BufferFill  float64    `json:"buffer_fill"`
+	BufferLimit float64    `json:"buffer_limit,omitempty"`
+}
+
+// loadShedder samples heap and subscriber buffer usage and, once either
+// crosses its threshold, sheds load until both are comfortably below again:
+// new streams are refused, rate limits tighten and low-priority events are
+// dropped from fan-out. Changes are announced in #system.
+type loadShedder struct {
+	broker      *Broker
+	spam        *spamDetector
+	anonymous   *anonymousLimiter
+	heapLimit   uint64
+	bufferLimit float64
+
+	mu     sync.RWMutex
+	report LoadReport
+}
+
+// newLoadShedder starts sampling. A zero limit leaves that measure out; with
+// both zero the shedder never sheds.
+func newLoadShedder(broker *Broker, spam *spamDetector, anonymous *anonymousLimiter, heapLimit uint64, bufferLimit float64) *loadShedder {
+	s := &loadShedder{broker: broker, spam: spam, anonymous: anonymous, heapLimit: heapLimit, bufferLimit: bufferLimit}
+	s.report = LoadReport{HeapLimit: heapLimit, BufferLimit: bufferLimit}
+	newGaugeFunc("chat_load_shedding", "1 while the node is shedding load.", func() float64 {
+		if s.Shedding() {
+			return 1
+		}
+		return 0
+	})
+	newGaugeFunc("chat_subscriber_buffer_fill", "Average fill ratio of subscriber buffers.", broker.BufferFill)
+	if heapLimit > 0 || bufferLimit > 0 {
+		go s.run()
+	}
+	return s
+}
+
+func (s *loadShedder) Shedding() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.report.Shedding
+}
+
+func (s *loadShedder) Report() LoadReport {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.report
+}
+
+func heapBytes() uint64 {
+	sample := []metrics.Sample{{Name: heapObjectsMetric}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
+
+func (s *loadShedder) run() {
+	ticker := time.NewTicker(shedSampleInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.sample(heapBytes(), s.broker.BufferFill())
+	}
+}
+
+// over lists the measures at or above fraction of their threshold.
+func (s *loadShedder) over(heap uint64, fill, fraction float64) []string {
+	var reasons []string
+	if s.heapLimit > 0 && float64(heap) >= float64(s.heapLimit)*fraction {
+		reasons = append(reasons, "heap")
+	}
+	if s.bufferLimit > 0 && fill >= s.bufferLimit*fraction {
+		reasons = append(reasons, "subscriber_buffers")
+	}
+	return reasons
+}
+
+func (s *loadShedder) sample(heap uint64, fill float64) {
+	s.mu.Lock()
+	report := &s.report
+	report.HeapBytes, report.BufferFill = heap, fill
+	changed := false
+	if !report.Shedding {
+		if reasons := s.over(heap, fill, 1); len(reasons) > 0 {
+			now := time.Now().UTC()
+			report.Shedding, report.Reasons, report.Since, changed = true, reasons, &now, true
+		}
+	} else if len(s.over(heap, fill, shedRecovery)) == 0 {
+		report.Shedding, report.Reasons, report.Since, changed = false, nil, nil, true
+	}
+	snapshot := *report
+	s.mu.Unlock()
+
+	if changed {
+		s.apply(snapshot)
+	}
+}
+
+func (s *loadShedder) apply(report LoadReport) {
+	s.broker.SetShedding(report.Shedding)
+	s.spam.Tighten(report.Shedding)
+	s.anonymous.Tighten(report.Shedding)
+
+	state := "stopped"
+	if report.Shedding {
+		state = "started"
+	}
+	shedTransitions.With(state).Add(1)
+	log.Printf("Load shedding %s: heap %d bytes, subscriber buffers %.0f%% full %v", state, report.HeapBytes, report.BufferFill*100, report.Reasons)
+
+	raw, err := json.Marshal(report)
+	if err != nil {
+		return
+	}
+	if _, err := s.broker.PublishEvent(lifecycleRoom, sheddingEvent, raw); err != nil {
+		log.Printf("Load shedding: announcing in %s: %v", lifecycleRoom, err)
+	}
+}
+
+// shedGuard refuses new streams while the node sheds load, so clients go
+// elsewhere or come back later.
+func shedGuard(s *loadShedder, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.Shedding() {
+			shedRejectedStreams.Inc()
+			writeError(w, r, withRetryAfter(errShedding, shedRetryAfter))
+			return
+		}
+		next(w, r)
+	}
+}
+
+func loadReportHandler(s *loadShedder) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Report())
+	}
+}
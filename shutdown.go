@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	shutdownEvent = "shutdown"
+	// flushPoll is how often the drain checks whether queues have emptied.
+	flushPoll = 20 * time.Millisecond
+)
+
+var errShuttingDown = errors.New("server is shutting down, reconnect elsewhere")
+
+// drainPhase is a step of a graceful shutdown. The phases run in order and
+// never go back.
+type drainPhase int
+
+const (
+	phaseServing drainPhase = iota
+	phaseRefusingSends
+	phaseFlushing
+	phaseNotifying
+	phaseClosing
+	phaseStopped
+)
+
+var drainPhaseNames = [...]string{"serving", "refusing_sends", "flushing", "notifying", "closing", "stopped"}
+
+func (p drainPhase) String() string { return drainPhaseNames[p] }
+
+func (p drainPhase) MarshalText() ([]byte, error) { return []byte(p.String()), nil }
+
+type phaseTiming struct {
+	Phase    drainPhase `json:"phase"`
+	Duration string     `json:"duration"`
+}
+
+// DrainStatus is what the health endpoint reports.
+type DrainStatus struct {
+	Status        string        `json:"status"`
+	Phase         drainPhase    `json:"phase"`
+	StartedAt     time.Time     `json:"started_at,omitzero"`
+	Streams       int           `json:"streams"`
+	QueuedEvents  int           `json:"queued_events"`
+	OutboxPending int           `json:"outbox_pending,omitempty"`
+	HandoffTarget string        `json:"handoff_target,omitempty"`
+	Notified      int           `json:"notified,omitempty"`
+	Completed     []phaseTiming `json:"completed,omitempty"`
+}
+
+type shutdownNotice struct {
+	Reason           string `json:"reason"`
+	ReconnectAfterMS int64  `json:"reconnect_after_ms"`
+}
+
+// drainer shuts the server down in a fixed order so nothing accepted is
+// lost: new sends are refused first, then what was accepted is flushed to
+// subscribers, then every stream is told to reconnect, and only then are
+// the streams closed. A handoff drains the same way, but refuses new
+// streams from the start and tells streams to resume on its target.
+type drainer struct {
+	broker         *Broker
+	store          *messageStore
+	kv             *boltStore
+	async          *asyncPublisher
+	handoffs       *handoffs
+	timeout        time.Duration
+	reconnectDelay time.Duration
+	handoffStart   chan struct{}
+
+	mu         sync.Mutex
+	phase      drainPhase
+	target     string
+	started    time.Time
+	phaseStart time.Time
+	notified   int
+	completed  []phaseTiming
+	done       chan struct{}
+}
+
+func newDrainer(broker *Broker, store *messageStore, kv *boltStore, async *asyncPublisher, handoffs *handoffs, timeout, reconnectDelay time.Duration) *drainer {
+	return &drainer{broker: broker, store: store, kv: kv, async: async, handoffs: handoffs, timeout: timeout, reconnectDelay: reconnectDelay, handoffStart: make(chan struct{}, 1), done: make(chan struct{})}
+}
+
+// Handoff starts handing the server off to target, unless it is draining
+// already.
+func (d *drainer) Handoff(target string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.phase != phaseServing || d.target != "" {
+		return false
+	}
+	d.target = target
+	d.handoffStart <- struct{}{}
+	return true
+}
+
+// Target is where a handoff sends streams, "" for a plain shutdown.
+func (d *drainer) Target() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.target
+}
+
+func (d *drainer) Phase() drainPhase {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.phase
+}
+
+// Done is closed once the drain has finished.
+func (d *drainer) Done() <-chan struct{} {
+	return d.done
+}
+
+func (d *drainer) enter(phase drainPhase) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	if d.phase == phaseServing {
+		d.started = now
+	} else {
+		d.completed = append(d.completed, phaseTiming{Phase: d.phase, Duration: now.Sub(d.phaseStart).Round(time.Millisecond).String()})
+	}
+	d.phase, d.phaseStart = phase, now
+	log.Printf("Shutdown: %s", phase)
+}
+
+func (d *drainer) Status() DrainStatus {
+	d.mu.Lock()
+	status := DrainStatus{
+		Status:        "ok",
+		Phase:         d.phase,
+		StartedAt:     d.started,
+		Notified:      d.notified,
+		Completed:     d.completed,
+		HandoffTarget: d.target,
+	}
+	d.mu.Unlock()
+
+	if status.Phase != phaseServing {
+		status.Status = "draining"
+	}
+	status.Streams = d.broker.SubscriberCount()
+	status.QueuedEvents = d.async.Pending() + d.broker.QueueDepth() + d.broker.Buffered()
+	if d.store != nil && status.Phase < phaseStopped {
+		status.OutboxPending = int(d.store.pendingCount())
+	}
+	return status
+}
+
+// awaitEmpty waits until empty reports true or deadline passes.
+func awaitEmpty(deadline time.Time, empty func() bool) bool {
+	for !empty() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(flushPoll)
+	}
+	return true
+}
+
+// Drain runs the shutdown phases against srv. Each phase gets whatever is
+// left of the timeout; one that runs out moves on rather than holding up
+// the process.
+func (d *drainer) Drain(srv *http.Server) {
+	deadline := time.Now().Add(d.timeout)
+
+	d.enter(phaseRefusingSends)
+	d.broker.StopAdmitting(d.reconnectDelay)
+
+	d.enter(phaseFlushing)
+	if !awaitEmpty(deadline, func() bool { return d.async.Pending() == 0 }) {
+		log.Printf("Shutdown: %d accepted messages still unpublished", d.async.Pending())
+	}
+	if d.store != nil {
+		if err := d.store.drainOutbox(); err != nil {
+			log.Printf("Shutdown: flushing outbox: %v", err)
+		}
+	}
+	if !awaitEmpty(deadline, func() bool { return d.broker.QueueDepth() == 0 }) {
+		log.Printf("Shutdown: %d events still queued for delivery", d.broker.QueueDepth())
+	}
+
+	d.enter(phaseNotifying)
+	target := d.Target()
+	if target != "" {
+		if err := d.handoffs.Begin(target); err != nil {
+			log.Printf("Shutdown: recording handoff to %s: %v", target, err)
+			target = ""
+		}
+	}
+	notified := d.broker.NotifyAll(func() Envelope {
+		// Spread reconnects over up to twice the delay so clients don't all
+		// land on the remaining nodes at once.
+		after := d.reconnectDelay + rand.N(d.reconnectDelay+1)
+		if target != "" {
+			return handoffEnvelope(target, after, "")
+		}
+		return shutdownEnvelope(after)
+	})
+	d.mu.Lock()
+	d.notified = notified
+	d.mu.Unlock()
+	if !awaitEmpty(deadline, func() bool { return d.broker.Buffered() == 0 }) {
+		log.Printf("Shutdown: %d events unsent to subscribers", d.broker.Buffered())
+	}
+
+	d.enter(phaseClosing)
+	d.broker.CloseAll()
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown: %v", err)
+		srv.Close()
+	}
+	if target != "" {
+		if err := d.handoffs.Complete(); err != nil {
+			log.Printf("Shutdown: completing handoff to %s: %v", target, err)
+		}
+	}
+	d.broker.Close()
+	if d.store != nil {
+		d.store.db.Close()
+	}
+	if d.kv != nil {
+		d.kv.Close()
+	}
+
+	d.enter(phaseStopped)
+	close(d.done)
+}
+
+// shutdownEnvelope asks the client to reconnect after the given delay, both
+// in the event data and as the SSE retry field, which EventSource honours
+// on its own.
+func shutdownEnvelope(after time.Duration) Envelope {
+	data, _ := json.Marshal(shutdownNotice{Reason: "server shutting down", ReconnectAfterMS: after.Milliseconds()})
+	return withRetryField(Envelope{
+		ID:    "shutdown:" + strconv.FormatInt(time.Now().UnixNano(), 10),
+		Event: shutdownEvent,
+		Time:  time.Now().UTC(),
+		Data:  data,
+	}, after)
+}
+
+// watchShutdown drains the server on SIGTERM or SIGINT, or hands it off
+// when asked to. A second signal exits straight away.
+func (d *drainer) watchShutdown(srv *http.Server) {
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	select {
+	case <-stop:
+	case <-d.handoffStart:
+		log.Printf("Shutdown: handing off to %s", d.Target())
+	}
+	go func() {
+		<-stop
+		log.Fatal("Shutdown: interrupted")
+	}()
+	d.Drain(srv)
+}
+
+// drainGuard turns new streams away once subscribers are being told to
+// reconnect, since they would miss the notice, and for a handoff as soon as
+// it starts, pointing them at its target.
+func drainGuard(d *drainer, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if target := d.Target(); target != "" {
+			writeError(w, r, withRetryAfter(withDetails(errShuttingDown, map[string]string{"handoff_target": target}), d.reconnectDelay))
+			return
+		}
+		if d.Phase() >= phaseNotifying {
+			writeError(w, r, withRetryAfter(errShuttingDown, d.reconnectDelay))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// healthHandler reports the drain progress. It answers 503 as soon as the
+// drain starts, so load balancers stop routing here.
+func healthHandler(d *drainer) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := d.Status()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if status.Phase != phaseServing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	spamFlagLogSize = 1000
+	spamIdleExpiry  = time.Hour
+)
+
+var (
+	urlPattern      = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+	spamFlagsTotal  = newCounterVec("chat_spam_flags_total", "Messages flagged by the spam detector.", "reason")
+	shadowMutedSent = newCounter("chat_spam_shadow_muted_messages_total", "Messages swallowed because their sender is shadow-muted.")
+)
+
+type spamConfig struct {
+	DuplicateWindow time.Duration
+	BurstLimit      int
+	BurstWindow     time.Duration
+	MaxURLDensity   float64
+	Penalty         float64
+	Recovery        float64
+	MuteThreshold   float64
+}
+
+var defaultSpamConfig = spamConfig{
+	DuplicateWindow: 30 * time.Second,
+	BurstLimit:      8,
+	BurstWindow:     5 * time.Second,
+	MaxURLDensity:   0.5,
+	Penalty:         0.2,
+	Recovery:        0.01,
+	MuteThreshold:   0.3,
+}
+
+type SpamFlag struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	UserID  string    `json:"user_id"`
+	Room    string    `json:"room"`
+	Reasons []string  `json:"reasons"`
+	Score   float64   `json:"score"`
+	Muted   bool      `json:"muted"`
+}
+
+type TrustScore struct {
+	UserID string  `json:"user_id"`
+	Score  float64 `json:"score"`
+	Muted  bool    `json:"muted"`
+}
+
+type spamVerdict struct {
+	Reasons []string
+	Muted   bool
+}
+
+type userTrust struct {
+	score    float64
+	muted    bool
+	recent   []time.Time
+	messages map[[32]byte]time.Time
+	lastSeen time.Time
+}
+
+// spamDetector scores senders with a few cheap heuristics. Every offence costs
+// trust and every clean message slowly earns it back; senders whose trust
+// drops under the mute threshold are shadow-muted until a moderator lifts it.
+type spamDetector struct {
+	cfg       spamConfig
+	onFlag    func(SpamFlag)
+	tightened atomic.Bool
+
+	mu        sync.Mutex
+	users     map[string]*userTrust
+	flags     []SpamFlag
+	lastSweep time.Time
+}
+
+func newSpamDetector(cfg spamConfig, onFlag func(SpamFlag)) *spamDetector {
+	return &spamDetector{cfg: cfg, onFlag: onFlag, users: make(map[string]*userTrust)}
+}
+
+// SetConfig replaces the thresholds. Trust scores are kept.
+func (d *spamDetector) SetConfig(cfg spamConfig) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cfg = cfg
+}
+
+// Tighten halves the burst limit while on, without touching the configured
+// one.
+func (d *spamDetector) Tighten(on bool) {
+	d.tightened.Store(on)
+}
+
+// spamKey is who the detector scores the sender of r as: the verified user,
+// or the client's address for a caller who isn't signed in. A name the caller
+// picks is never a key, so nobody can spend another user's trust or start
+// over with a fresh name.
+func spamKey(r *http.Request) string {
+	if user := userFromRequest(r); user != "" {
+		return user
+	}
+	return "addr:" + clientAddress(r)
+}
+
+func (d *spamDetector) Check(user, room, message string) spamVerdict {
+	return d.CheckBatch(user, room, []string{message})
+}
+
+// CheckBatch checks messages sent together in one request. Each is checked
+// for duplicates and links, but the batch counts once towards the burst
+// limit, so relaying a burst in a single request isn't an offence.
+func (d *spamDetector) CheckBatch(user, room string, messages []string) spamVerdict {
+	now := time.Now()
+
+	d.mu.Lock()
+	d.sweep(now)
+
+	trust, ok := d.users[user]
+	if !ok {
+		trust = &userTrust{score: 1, messages: make(map[[32]byte]time.Time)}
+		d.users[user] = trust
+	}
+	trust.lastSeen = now
+
+	var reasons []string
+	flagged := func(reason string) {
+		if !slices.Contains(reasons, reason) {
+			reasons = append(reasons, reason)
+		}
+	}
+
+	for key, at := range trust.messages {
+		if now.Sub(at) > d.cfg.DuplicateWindow {
+			delete(trust.messages, key)
+		}
+	}
+	// Repeats within a batch, like an import of a conversation, are fine;
+	// repeating what came before isn't.
+	digests := make([][32]byte, len(messages))
+	for i, message := range messages {
+		digests[i] = sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(message))))
+		if _, dup := trust.messages[digests[i]]; dup {
+			flagged("duplicate")
+		}
+	}
+	for _, digest := range digests {
+		trust.messages[digest] = now
+	}
+
+	recent := trust.recent[:0]
+	for _, at := range trust.recent {
+		if now.Sub(at) <= d.cfg.BurstWindow {
+			recent = append(recent, at)
+		}
+	}
+	trust.recent = append(recent, now)
+	burstLimit := d.cfg.BurstLimit
+	if d.tightened.Load() {
+		burstLimit = max(burstLimit/2, 1)
+	}
+	if len(trust.recent) > burstLimit {
+		reasons = append(reasons, "burst")
+	}
+
+	for _, message := range messages {
+		if urls := len(urlPattern.FindAllString(message, -1)); urls > 1 {
+			if words := len(strings.Fields(message)); float64(urls)/float64(words) >= d.cfg.MaxURLDensity {
+				flagged("url_density")
+			}
+		}
+	}
+
+	if len(reasons) == 0 {
+		trust.score = min(1, trust.score+d.cfg.Recovery)
+	} else {
+		trust.score = max(0, trust.score-d.cfg.Penalty*float64(len(reasons)))
+		if trust.score < d.cfg.MuteThreshold {
+			trust.muted = true
+		}
+	}
+
+	verdict := spamVerdict{Reasons: reasons, Muted: trust.muted}
+	var flag SpamFlag
+	if len(reasons) > 0 {
+		flag = SpamFlag{
+			Type:    "spam_flag",
+			Time:    now.UTC(),
+			UserID:  user,
+			Room:    room,
+			Reasons: reasons,
+			Score:   trust.score,
+			Muted:   trust.muted,
+		}
+		d.flags = append(d.flags, flag)
+		if len(d.flags) > spamFlagLogSize {
+			d.flags = d.flags[len(d.flags)-spamFlagLogSize:]
+		}
+	}
+	d.mu.Unlock()
+
+	for _, reason := range reasons {
+		spamFlagsTotal.With(reason).Add(1)
+	}
+	if len(reasons) > 0 && d.onFlag != nil {
+		d.onFlag(flag)
+	}
+	return verdict
+}
+
+// sweep forgets senders that went idle with a clean record, at most once a
+// minute. Callers hold d.mu.
+func (d *spamDetector) sweep(now time.Time) {
+	if now.Sub(d.lastSweep) < time.Minute {
+		return
+	}
+	d.lastSweep = now
+	for user, trust := range d.users {
+		if !trust.muted && trust.score >= 1 && now.Sub(trust.lastSeen) > spamIdleExpiry {
+			delete(d.users, user)
+		}
+	}
+}
+
+// Score returns the trust score of user, 1 for senders with a clean record.
+func (d *spamDetector) Score(user string) float64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if trust, ok := d.users[user]; ok {
+		return trust.score
+	}
+	return 1
+}
+
+// Mute shadow-mutes user until a moderator lifts it, whatever their trust.
+func (d *spamDetector) Mute(user string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	trust, ok := d.users[user]
+	if !ok {
+		trust = &userTrust{score: 1, messages: make(map[[32]byte]time.Time), lastSeen: time.Now()}
+		d.users[user] = trust
+	}
+	trust.muted = true
+}
+
+func (d *spamDetector) Unmute(user string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.users, user)
+}
+
+func (d *spamDetector) Report() ([]TrustScore, []SpamFlag) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	scores := make([]TrustScore, 0, len(d.users))
+	for user, trust := range d.users {
+		if trust.score < 1 || trust.muted {
+			scores = append(scores, TrustScore{UserID: user, Score: trust.score, Muted: trust.muted})
+		}
+	}
+	return scores, append([]SpamFlag(nil), d.flags...)
+}
+
+type spamReport struct {
+	Users []TrustScore `json:"users"`
+	Flags []SpamFlag   `json:"flags"`
+}
+
+func spamReportHandler(spam *spamDetector) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		users, flags := spam.Report()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(spamReport{Users: users, Flags: flags})
+	}
+}
+
+func spamUnmuteHandler(spam *spamDetector, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.PathValue("user")
+		spam.Unmute(user)
+		audit.Record(auditActor(r), "spam.unmute", "", "user="+user)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func spamMuteHandler(spam *spamDetector, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.PathValue("user")
+		spam.Mute(user)
+		audit.Record(auditActor(r), "spam.mute", "", "user="+user)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
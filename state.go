@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Room state events. Every change to the room registry is recorded as one
+// of these and made only by applying it, so applying the same events in the
+// same order, from nothing or from a snapshot, always gives the same rooms.
+//
+// Only the registry is event-sourced: rooms, their settings, members and
+// welcome pins. Messages are not. They are rows in the messages table that
+// deletes tombstone, and expiry, compaction, archiving and guest linking
+// change or remove in place, so they can't be rebuilt from events.
+const (
+	roomCreated          = "room.created"
+	roomModeSet          = "room.mode_set"
+	roomPublicStreamSet  = "room.public_stream_set"
+	roomCapacitySet      = "room.capacity_set"
+	roomModerationSet    = "room.moderation_set"
+	roomMessageTTLSet    = "room.message_ttl_set"
+	roomEncryptionSet    = "room.encryption_set"
+	roomTenantSet        = "room.tenant_set"
+	roomMemberAdded      = "room.member_added"
+	roomMemberReassigned = "room.member_reassigned"
+	roomChallengeSet     = "room.challenge_set"
+	roomWelcomeSet       = "room.welcome_set"
+)
+
+const (
+	// roomSnapshotEvery is how many events may follow the newest snapshot
+	// before the registry takes another.
+	roomSnapshotEvery = 500
+	maxRoomEvents     = 1000
+)
+
+// RoomEvent is a change to one room. Which fields are set depends on Type;
+// Enabled is the new public_stream or encryption setting and User the member
+// added or reassigned, to To. A reassignment without a Room covers every
+// room at once.
+type RoomEvent struct {
+	Seq  uint64    `json:"seq"`
+	Type string    `json:"type"`
+	Room string    `json:"room"`
+	Time time.Time `json:"time"`
+
+	Owner      string            `json:"owner,omitempty"`
+	Private    bool              `json:"private,omitempty"`
+	Mode       string            `json:"mode,omitempty"`
+	Presenters []string          `json:"presenters,omitempty"`
+	Capacity   int               `json:"capacity,omitempty"`
+	Moderation *ModerationPolicy `json:"moderation,omitempty"`
+	Challenge  *ChallengePolicy  `json:"challenge,omitempty"`
+	MessageTTL configDuration    `json:"message_ttl,omitempty"`
+	Welcome    string            `json:"welcome,omitempty"`
+	Enabled    bool              `json:"enabled,omitempty"`
+	Tenant     string            `json:"tenant,omitempty"`
+	User       string            `json:"user,omitempty"`
+	To         string            `json:"to,omitempty"`
+
+	// PublicStream and Encrypted are what a room is created with.
+	PublicStream bool `json:"public_stream,omitempty"`
+	Encrypted    bool `json:"encrypted,omitempty"`
+}
+
+// roomState is a room with its members, as snapshots and relays carry it.
+type roomState struct {
+	Room
+	Members []string `json:"members"`
+}
+
+// roomJournal persists the events of a registry and snapshots of it.
+type roomJournal interface {
+	AppendRoomEvent(e RoomEvent) (uint64, error)
+	SaveRoomSnapshot(seq uint64, rooms []roomState) error
+}
+
+// UseJournal records every change from now on in journal before making it.
+func (rr *roomRegistry) UseJournal(journal roomJournal) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.journal = journal
+}
+
+// record journals e and applies it. rr.mu must be held.
+func (rr *roomRegistry) record(e RoomEvent) error {
+	if rr.journal == nil {
+		return rr.recordWith(e, nil)
+	}
+	return rr.recordWith(e, rr.journal.AppendRoomEvent)
+}
+
+// recordWith is record with commit journalling e in place of the registry's
+// journal. rr.mu must be held.
+func (rr *roomRegistry) recordWith(e RoomEvent, commit func(RoomEvent) (uint64, error)) error {
+	e.Time = time.Now().UTC()
+	e.Seq = rr.seq + 1
+	if commit != nil {
+		seq, err := commit(e)
+		if err != nil {
+			return fmt.Errorf("recording %s of %s: %w", e.Type, e.Room, err)
+		}
+		e.Seq = seq
+	}
+	rr.apply(e)
+
+	if rr.journal != nil && rr.seq-rr.snapshotSeq >= roomSnapshotEvery {
+		if err := rr.journal.SaveRoomSnapshot(rr.seq, rr.states()); err != nil {
+			log.Printf("Rooms: snapshot at event %d: %v", rr.seq, err)
+		} else {
+			rr.snapshotSeq = rr.seq
+		}
+	}
+	return nil
+}
+
+// apply makes the change e describes. It is the only place rooms change.
+// rr.mu must be held.
+func (rr *roomRegistry) apply(e RoomEvent) {
+	rr.seq = max(rr.seq, e.Seq)
+	room, ok := rr.rooms[e.Room]
+	switch {
+	case e.Type == roomMemberReassigned && e.Room == "":
+		for _, room := range rr.rooms {
+			room.reassign(e.User, e.To)
+		}
+		return
+	case e.Type == roomCreated:
+		mode := e.Mode
+		if mode == "" {
+			mode = roomModeChat
+		}
+		rr.rooms[e.Room] = &Room{
+			Name:         e.Room,
+			Owner:        e.Owner,
+			Private:      e.Private,
+			Mode:         mode,
+			Presenters:   slices.Clone(e.Presenters),
+			Capacity:     e.Capacity,
+			PublicStream: e.PublicStream,
+			Encrypted:    e.Encrypted,
+			CreatedAt:    e.Time,
+			Members:      map[string]bool{e.Owner: true},
+		}
+		return
+	case (e.Type == roomModerationSet || e.Type == roomChallengeSet) && !ok:
+		// Admins may moderate a room nobody created yet; it is registered
+		// as a public, ownerless room.
+		room = &Room{Name: e.Room, Mode: roomModeChat, CreatedAt: e.Time, Members: map[string]bool{}}
+		rr.rooms[e.Room] = room
+	case !ok:
+		return
+	}
+
+	switch e.Type {
+	case roomModeSet:
+		room.Mode = e.Mode
+		room.Presenters = slices.Clone(e.Presenters)
+	case roomPublicStreamSet:
+		room.PublicStream = e.Enabled
+	case roomCapacitySet:
+		room.Capacity = e.Capacity
+	case roomModerationSet:
+		room.Moderation = e.Moderation
+	case roomChallengeSet:
+		room.Challenge = e.Challenge
+	case roomMessageTTLSet:
+		room.MessageTTL = e.MessageTTL
+	case roomWelcomeSet:
+		room.Welcome = e.Welcome
+	case roomEncryptionSet:
+		room.Encrypted = e.Enabled
+	case roomTenantSet:
+		room.Tenant = e.Tenant
+	case roomMemberAdded:
+		room.Members[e.User] = true
+	case roomMemberReassigned:
+		room.reassign(e.User, e.To)
+	}
+}
+
+// holds reports whether user is a member, the owner or a presenter of room.
+func (room *Room) holds(user string) bool {
+	return room.Members[user] || room.Owner == user || slices.Contains(room.Presenters, user)
+}
+
+// reassign passes the membership, ownership and presenter seat of from in
+// room to to. Only apply calls it.
+func (room *Room) reassign(from, to string) {
+	if room.Members[from] {
+		delete(room.Members, from)
+		room.Members[to] = true
+	}
+	if room.Owner == from {
+		room.Owner = to
+	}
+	if i := slices.Index(room.Presenters, from); i >= 0 {
+		if slices.Contains(room.Presenters, to) {
+			room.Presenters = slices.Delete(room.Presenters, i, i+1)
+		} else {
+			room.Presenters[i] = to
+		}
+	}
+}
+
+// states returns every room with its members, by name. rr.mu must be held.
+func (rr *roomRegistry) states() []roomState {
+	rooms := make([]roomState, 0, len(rr.rooms))
+	for _, room := range rr.rooms {
+		members := make([]string, 0, len(room.Members))
+		for member, ok := range room.Members {
+			if ok {
+				members = append(members, member)
+			}
+		}
+		slices.Sort(members)
+		rooms = append(rooms, roomState{Room: *room, Members: members})
+	}
+	slices.SortFunc(rooms, func(a, b roomState) int { return strings.Compare(a.Name, b.Name) })
+	return rooms
+}
+
+// Snapshot returns every room with its members.
+func (rr *roomRegistry) Snapshot() []roomState {
+	rr.mu.RLock()
+	defer rr.mu.RUnlock()
+	return rr.states()
+}
+
+// restore replaces every room with those in states. rr.mu must be held.
+func (rr *roomRegistry) restore(states []roomState) {
+	rr.rooms = make(map[string]*Room, len(states))
+	for _, state := range states {
+		room := state.Room
+		room.Members = make(map[string]bool, len(state.Members))
+		for _, member := range state.Members {
+			room.Members[member] = true
+		}
+		if room.Moderation != nil {
+			if err := room.Moderation.compile(); err != nil {
+				log.Printf("Rooms: moderation policy of %s: %v", room.Name, err)
+				room.Moderation = nil
+			}
+		}
+		rr.rooms[room.Name] = &room
+	}
+}
+
+// Replace swaps every room for the ones in states without recording an
+// event, for edges mirroring their upstream.
+func (rr *roomRegistry) Replace(states []roomState) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.restore(states)
+}
+
+// Rebuild replaces every room with a snapshot, taken after event seq, and
+// the events that followed it, in order.
+func (rr *roomRegistry) Rebuild(snapshot []roomState, seq uint64, events []RoomEvent) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	rr.restore(snapshot)
+	rr.seq, rr.snapshotSeq = seq, seq
+	for _, e := range events {
+		if e.Moderation != nil {
+			if err := e.Moderation.compile(); err != nil {
+				log.Printf("Rooms: moderation policy in event %d: %v", e.Seq, err)
+				e.Moderation = nil
+			}
+		}
+		rr.apply(e)
+	}
+}
+
+// AppendRoomEvent stores e and returns its sequence.
+func (s *messageStore) AppendRoomEvent(e RoomEvent) (uint64, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+	res, err := s.db.Exec(`INSERT INTO room_events (room, type, data, created_at) VALUES (?, ?, ?, ?)`, e.Room, e.Type, data, e.Time.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	seq, err := res.LastInsertId()
+	return uint64(seq), err
+}
+
+// SaveRoomSnapshot stores rooms as the state after event seq, in place of
+// older snapshots. The events stay.
+func (s *messageStore) SaveRoomSnapshot(seq uint64, rooms []roomState) error {
+	data, err := json.Marshal(rooms)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO room_snapshots (seq, data, created_at) VALUES (?, ?, ?)`, seq, data, time.Now().UnixNano()); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM room_snapshots WHERE seq < ?`, seq); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RecoverRooms rebuilds rooms from the newest snapshot and the events after
+// it, and returns how many events that replayed.
+func (s *messageStore) RecoverRooms(ctx context.Context, rooms *roomRegistry) (int, error) {
+	var seq uint64
+	var data []byte
+	snapshot := []roomState{}
+	err := s.db.QueryRowContext(ctx, `SELECT seq, data FROM room_snapshots ORDER BY seq DESC LIMIT 1`).Scan(&seq, &data)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return 0, err
+	default:
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return 0, fmt.Errorf("room snapshot %d: %w", seq, err)
+		}
+	}
+
+	events, err := s.roomEvents(ctx, `SELECT seq, data FROM room_events WHERE seq > ? ORDER BY seq`, seq)
+	if err != nil {
+		return 0, err
+	}
+	rooms.Rebuild(snapshot, seq, events)
+	return len(events), nil
+}
+
+// RoomEvents returns up to limit events of room after seq.
+func (s *messageStore) RoomEvents(ctx context.Context, room string, after uint64, limit int) ([]RoomEvent, error) {
+	return s.roomEvents(ctx, `SELECT seq, data FROM room_events WHERE room = ? AND seq > ? ORDER BY seq LIMIT ?`, room, after, limit)
+}
+
+func (s *messageStore) roomEvents(ctx context.Context, query string, args ...any) ([]RoomEvent, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []RoomEvent
+	for rows.Next() {
+		var seq uint64
+		var data []byte
+		if err := rows.Scan(&seq, &data); err != nil {
+			return nil, err
+		}
+		e := RoomEvent{}
+		if err := json.Unmarshal(data, &e); err != nil {
+			return nil, fmt.Errorf("room event %d: %w", seq, err)
+		}
+		e.Seq = seq
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// roomEventsHandler lists the state events of a room after the after
+// sequence, oldest first.
+func roomEventsHandler(store *messageStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if store == nil {
+			writeError(w, r, errStoreDisabled)
+			return
+		}
+		after := uint64(0)
+		if raw := r.URL.Query().Get("after"); raw != "" {
+			var err error
+			if after, err = strconv.ParseUint(raw, 10, 64); err != nil {
+				writeError(w, r, fmt.Errorf("%w: after must be a sequence number", errInvalidRequest))
+				return
+			}
+		}
+		events, err := store.RoomEvents(r.Context(), r.PathValue("room"), after, maxRoomEvents)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if events == nil {
+			events = []RoomEvent{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(events)
+	}
+}
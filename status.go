@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Availabilities a user can set. Unlike the presence status, which follows
+// connections and heartbeats, these only change when the user says so or
+// the status runs out.
+const (
+	availabilityAvailable = "available"
+	availabilityAway      = "away"
+	availabilityDND       = "dnd"
+
+	maxStatusText = 100
+)
+
+type UserStatus struct {
+	Availability string     `json:"availability"`
+	Text         string     `json:"text,omitempty"`
+	Until        *time.Time `json:"until,omitempty"`
+	UpdatedAt    time.Time  `json:"updated_at,omitzero"`
+}
+
+func (s UserStatus) expired(now time.Time) bool {
+	return s.Until != nil && !now.Before(*s.Until)
+}
+
+// userStatuses stores the status each user set. Users without one are
+// available.
+type userStatuses struct {
+	mu       sync.RWMutex
+	statuses map[string]UserStatus
+}
+
+func newUserStatuses() *userStatuses {
+	return &userStatuses{statuses: make(map[string]UserStatus)}
+}
+
+func (us *userStatuses) Get(user string) UserStatus {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	status, ok := us.statuses[user]
+	if !ok || status.expired(time.Now()) {
+		return UserStatus{Availability: availabilityAvailable}
+	}
+	return status
+}
+
+func (us *userStatuses) Set(user string, status UserStatus) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	us.statuses[user] = status
+}
+
+func (us *userStatuses) Clear(user string) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	delete(us.statuses, user)
+}
+
+// DoNotDisturb reports whether user asked not to be notified right now.
+func (us *userStatuses) DoNotDisturb(user string) bool {
+	return us.Get(user).Availability == availabilityDND
+}
+
+// Expire forgets the statuses that ran out by now and returns their users.
+func (us *userStatuses) Expire(now time.Time) []string {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	var expired []string
+	for user, status := range us.statuses {
+		if status.expired(now) {
+			delete(us.statuses, user)
+			expired = append(expired, user)
+		}
+	}
+	return expired
+}
+
+func getStatusHandler(statuses *userStatuses) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.PathValue("user")
+		if user == "" {
+			if user = userFromRequest(r); user == "" {
+				writeError(w, r, errUnauthenticated)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(statuses.Get(user))
+	}
+}
+
+// setStatusHandler sets the caller's status and announces it in every room
+// they are present in.
+func setStatusHandler(statuses *userStatuses, presence *presenceTracker) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromRequest(r)
+		if user == "" {
+			writeError(w, r, errUnauthenticated)
+			return
+		}
+
+		status := UserStatus{}
+		if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+		switch status.Availability {
+		case availabilityAvailable, availabilityAway, availabilityDND:
+		default:
+			writeError(w, r, fmt.Errorf("%w: availability must be %q, %q or %q", errInvalidRequest, availabilityAvailable, availabilityAway, availabilityDND))
+			return
+		}
+		if utf8.RuneCountInString(status.Text) > maxStatusText {
+			writeError(w, r, fmt.Errorf("%w: text is at most %d characters", errInvalidRequest, maxStatusText))
+			return
+		}
+		if status.Until != nil && !status.Until.After(time.Now()) {
+			writeError(w, r, fmt.Errorf("%w: until must be in the future", errInvalidRequest))
+			return
+		}
+		status.UpdatedAt = time.Now().UTC()
+
+		statuses.Set(user, status)
+		presence.StatusChanged(user)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+func clearStatusHandler(statuses *userStatuses, presence *presenceTracker) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromRequest(r)
+		if user == "" {
+			writeError(w, r, errUnauthenticated)
+			return
+		}
+		statuses.Clear(user)
+		presence.StatusChanged(user)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
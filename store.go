@@ -0,0 +1,491 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const outboxRetryInterval = time.Second
+
+var errBrokenSequence = errors.New("store: broken room sequence")
+
+var (
+	outboxDispatched = newCounter("chat_outbox_dispatched_total", "Outbox entries published to the backend.")
+	outboxFailures   = newCounter("chat_outbox_failures_total", "Outbox dispatch attempts that failed and will be retried.")
+)
+
+// messageStore persists room messages in SQLite. A message and its outbox row
+// are written in one transaction. Before the message goes to the backend its
+// envelope, sequence included, is recorded on it; the outbox row is deleted
+// once the backend has accepted it. Whatever is left in the outbox after a
+// crash is published again on the next start as the envelope recorded for
+// it, so every stored message keeps one sequence per store, a repeat of it is
+// dropped as already seen, and nothing is broadcast without being stored.
+// Messages are kept as mutable rows, not as events like the room registry.
+type messageStore struct {
+	db *sql.DB
+
+	// dispatchMu serialises dispatching so the eager path and the retry loop
+	// never publish the same outbox row twice.
+	dispatchMu sync.Mutex
+	sequence   func(room, event string, data []byte, sentAt *time.Time, origin string) (Envelope, error)
+	publish    func(env Envelope) error
+
+	// codec encodes the data of new messages; rows are decoded by the codec
+	// named in their header, so it can change between runs.
+	codec storeCodec
+	// compressAbove, if positive, is the size above which encoded data is
+	// stored compressed.
+	compressAbove int
+
+	purgeHooks []func(room string, data []byte)
+}
+
+// openMessageStore opens the SQLite store at path. migrate is migrateAuto to
+// apply pending schema migrations or migrateCheck to refuse a store that has
+// any.
+func openMessageStore(path, migrate string) (*messageStore, error) {
+	// auto_vacuum only takes effect on a new database; it lets Compact free
+	// pages incrementally instead of rewriting the file.
+	db, err := sql.Open("sqlite", path+"?_pragma=auto_vacuum(incremental)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; one connection avoids SQLITE_BUSY churn.
+	db.SetMaxOpenConns(1)
+
+	store := &messageStore{db: db, codec: jsonCodec{}}
+	if err := store.prepareSchema(migrate); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// applyDataDir points -store, a file of engine, and -blob-dir into dir,
+// creating it, unless they were given.
+func applyDataDir(fs *flag.FlagSet, dir, engine string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if !set["store"] {
+		name := "chat.db"
+		if engine == storeEngineBolt {
+			name = "chat.bolt"
+		}
+		fs.Set("store", filepath.Join(dir, name))
+	}
+	if !set["blob-dir"] {
+		fs.Set("blob-dir", filepath.Join(dir, "blobs"))
+	}
+	return nil
+}
+
+// prepareSchema brings the schema up to date, or with migrateCheck only
+// verifies that it is.
+func (s *messageStore) prepareSchema(migrate string) error {
+	ctx := context.Background()
+	if err := ensureMigrationTable(ctx, s.db); err != nil {
+		return fmt.Errorf("store: %w", err)
+	}
+	if migrate == migrateCheck {
+		pending, err := s.Pending(ctx)
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("%w: %d, starting with %d_%s; run with -migrate only", errPendingMigrations, len(pending), pending[0].Version, pending[0].Name)
+		}
+		return nil
+	}
+
+	applied, err := s.Migrate(ctx)
+	for _, m := range applied {
+		log.Printf("Store: applied migration %d_%s", m.Version, m.Name)
+	}
+	return err
+}
+
+// UseCodec stores the data of messages published from now on with c.
+func (s *messageStore) UseCodec(c storeCodec) {
+	s.codec = c
+}
+
+// Publish stores the message together with its outbox row and then tries to
+// dispatch it right away.
+func (s *messageStore) Publish(room, event string, data []byte, sentAt *time.Time, origin string) (Envelope, error) {
+	stored, err := s.encode(data)
+	if err != nil {
+		return Envelope{}, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Envelope{}, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO messages (room, event, data, created_at, sent_at, origin) VALUES (?, ?, ?, ?, ?, NULLIF(?, ''))`,
+		room, event, stored, time.Now().UnixNano(), unixNanos(sentAt), origin)
+	if err != nil {
+		return Envelope{}, err
+	}
+	ID, err := res.LastInsertId()
+	if err != nil {
+		return Envelope{}, err
+	}
+	if _, err := tx.Exec(`INSERT INTO outbox (message_id) VALUES (?)`, ID); err != nil {
+		return Envelope{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Envelope{}, err
+	}
+
+	s.dispatchMu.Lock()
+	defer s.dispatchMu.Unlock()
+	env, err := s.dispatch(ID, room, event, data, sentAt, origin)
+	if err != nil {
+		// The message is stored, the retry loop will publish it.
+		log.Printf("Outbox: dispatching message %d: %v", ID, err)
+		return Envelope{}, nil
+	}
+	return env, nil
+}
+
+// dispatch publishes one outbox entry and retires it. dispatchMu must be held.
+func (s *messageStore) dispatch(ID int64, room, event string, data []byte, sentAt *time.Time, origin string) (Envelope, error) {
+	var envelopeID *string
+	var seq, publishedAt *int64
+	err := s.db.QueryRow(`SELECT m.envelope_id, m.seq, m.published_at FROM outbox o JOIN messages m ON m.id = o.message_id WHERE o.message_id = ?`, ID).Scan(&envelopeID, &seq, &publishedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Envelope{}, nil
+	}
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	// The envelope is recorded before it is published, and an entry that
+	// already has one is published as that envelope again.
+	var env Envelope
+	if envelopeID != nil {
+		env = Envelope{ID: *envelopeID, Room: room, Seq: uint64(*seq), Event: event, Data: data, SentAt: sentAt, Origin: origin}
+		env.stamp(time.Unix(0, *publishedAt).UTC())
+	} else {
+		if env, err = s.sequence(room, event, data, sentAt, origin); err != nil {
+			return Envelope{}, s.dispatchFailed(ID, err)
+		}
+		if _, err := s.db.Exec(`UPDATE messages SET envelope_id = ?, seq = ?, published_at = ? WHERE id = ?`, env.ID, env.Seq, env.Time.UnixNano(), ID); err != nil {
+			return Envelope{}, s.dispatchFailed(ID, err)
+		}
+	}
+
+	if err := s.publish(env); err != nil {
+		return Envelope{}, s.dispatchFailed(ID, err)
+	}
+	if _, err := s.db.Exec(`DELETE FROM outbox WHERE message_id = ?`, ID); err != nil {
+		return env, err
+	}
+	outboxDispatched.Inc()
+	return env, nil
+}
+
+// dispatchFailed counts a failed attempt at outbox entry ID and returns err.
+func (s *messageStore) dispatchFailed(ID int64, err error) error {
+	outboxFailures.Inc()
+	s.db.Exec(`UPDATE outbox SET attempts = attempts + 1, last_error = ? WHERE message_id = ?`, err.Error(), ID)
+	return err
+}
+
+// drainOutbox publishes every pending outbox entry in insertion order.
+func (s *messageStore) drainOutbox() error {
+	s.dispatchMu.Lock()
+	defer s.dispatchMu.Unlock()
+
+	rows, err := s.db.Query(`SELECT m.id, m.room, m.event, m.data, m.sent_at, COALESCE(m.origin, '') FROM outbox o JOIN messages m ON m.id = o.message_id ORDER BY m.id`)
+	if err != nil {
+		return err
+	}
+	type pending struct {
+		ID          int64
+		room, event string
+		data        []byte
+		origin      string
+		sentAt      *time.Time
+	}
+	var entries []pending
+	for rows.Next() {
+		e := pending{}
+		var sentAt *int64
+		if err := rows.Scan(&e.ID, &e.room, &e.event, &e.data, &sentAt, &e.origin); err != nil {
+			rows.Close()
+			return err
+		}
+		e.sentAt = fromUnixNanos(sentAt)
+		if e.data, err = decodeStored(e.data); err != nil {
+			rows.Close()
+			return fmt.Errorf("message %d: %w", e.ID, err)
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if _, err := s.dispatch(e.ID, e.room, e.event, e.data, e.sentAt, e.origin); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *messageStore) runDispatcher() {
+	ticker := time.NewTicker(outboxRetryInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.drainOutbox(); err != nil {
+			log.Printf("Outbox: %v", err)
+		}
+	}
+}
+
+// Export calls fn with every published, undeleted message of room in server
+// time order, then sequence. Rows from before publish times were recorded
+// fall back to when they were stored.
+func (s *messageStore) Export(ctx context.Context, room string, fn func(Envelope) error) error {
+	rows, err := s.db.QueryContext(ctx, `SELECT envelope_id, seq, event, COALESCE(published_at, created_at) AS server_time, sent_at, COALESCE(origin, ''), data FROM messages
+		WHERE room = ? AND envelope_id IS NOT NULL AND deleted_at IS NULL ORDER BY server_time, seq`, room)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		env := Envelope{Room: room}
+		var serverTime int64
+		var sentAt *int64
+		var data []byte
+		if err := rows.Scan(&env.ID, &env.Seq, &env.Event, &serverTime, &sentAt, &env.Origin, &data); err != nil {
+			return err
+		}
+		env.SentAt = fromUnixNanos(sentAt)
+		env.stamp(time.Unix(0, serverTime).UTC())
+		if env.Data, err = decodeStored(data); err != nil {
+			return fmt.Errorf("message %s: %w", env.ID, err)
+		}
+		if err := fn(env); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Recover calls fn with the highest sequence published in every stored or
+// archived room and its newest historySize undeleted envelopes, oldest
+// first, so a restart continues sequences and resumes streams where the last
+// run stopped. It refuses a store whose sequences don't add up, since
+// resuming from it would skip or repeat messages.
+func (s *messageStore) Recover(ctx context.Context, fn func(room string, seq uint64, recent []Envelope)) (int, error) {
+	if err := s.checkSequences(ctx); err != nil {
+		return 0, err
+	}
+	seqs := make(map[string]uint64)
+	rows, err := s.db.QueryContext(ctx, `SELECT room, MAX(seq) FROM (
+			SELECT room, seq FROM messages WHERE seq IS NOT NULL
+			UNION ALL SELECT room, last_seq FROM archive_segments)
+		GROUP BY room`)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var room string
+		var seq uint64
+		if err := rows.Scan(&room, &seq); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		seqs[room] = seq
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	recent := make(map[string][]Envelope)
+	rows, err = s.db.QueryContext(ctx, `SELECT room, envelope_id, seq, event, server_time, sent_at, COALESCE(origin, ''), data FROM (
+			SELECT *, COALESCE(published_at, created_at) AS server_time, ROW_NUMBER() OVER (PARTITION BY room ORDER BY seq DESC) AS age
+			FROM messages WHERE envelope_id IS NOT NULL AND deleted_at IS NULL)
+		WHERE age <= ? ORDER BY room, seq`, historySize)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		env := Envelope{}
+		var serverTime int64
+		var sentAt *int64
+		var data []byte
+		if err := rows.Scan(&env.Room, &env.ID, &env.Seq, &env.Event, &serverTime, &sentAt, &env.Origin, &data); err != nil {
+			return 0, err
+		}
+		if env.Data, err = decodeStored(data); err != nil {
+			return 0, fmt.Errorf("message %s: %w", env.ID, err)
+		}
+		env.SentAt = fromUnixNanos(sentAt)
+		env.stamp(time.Unix(0, serverTime).UTC())
+		recent[env.Room] = append(recent[env.Room], env)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for room, seq := range seqs {
+		fn(room, seq, recent[room])
+	}
+	return len(seqs), nil
+}
+
+// checkSequences verifies that every published message has a sequence of its
+// own, that its envelope ID names, and that no archive segment overlaps
+// another.
+func (s *messageStore) checkSequences(ctx context.Context) error {
+	var room string
+	var seq uint64
+	err := s.db.QueryRowContext(ctx, `SELECT room, seq FROM messages WHERE envelope_id IS NOT NULL
+		GROUP BY room, seq HAVING COUNT(*) > 1 LIMIT 1`).Scan(&room, &seq)
+	switch {
+	case err == nil:
+		return fmt.Errorf("%w: %s has more than one message at %d", errBrokenSequence, room, seq)
+	case !errors.Is(err, sql.ErrNoRows):
+		return err
+	}
+	var ID string
+	err = s.db.QueryRowContext(ctx, `SELECT envelope_id FROM messages WHERE envelope_id IS NOT NULL
+		AND (seq IS NULL OR envelope_id != room || ':' || seq) LIMIT 1`).Scan(&ID)
+	switch {
+	case err == nil:
+		return fmt.Errorf("%w: message %s is stored under another sequence", errBrokenSequence, ID)
+	case !errors.Is(err, sql.ErrNoRows):
+		return err
+	}
+	err = s.db.QueryRowContext(ctx, `SELECT a.room, b.first_seq FROM archive_segments a JOIN archive_segments b
+		ON a.room = b.room AND a.first_seq < b.first_seq AND b.first_seq <= a.last_seq LIMIT 1`).Scan(&room, &seq)
+	switch {
+	case err == nil:
+		return fmt.Errorf("%w: archive segments of %s overlap at %d", errBrokenSequence, room, seq)
+	case !errors.Is(err, sql.ErrNoRows):
+		return err
+	}
+	return nil
+}
+
+// reassignAuthor attributes every stored chat message of from to to in tx
+// and returns how many it changed.
+func (s *messageStore) reassignAuthor(ctx context.Context, tx *sql.Tx, from, to string) (int, error) {
+	// data is a BLOB, which SQLite's JSON functions would read as JSONB.
+	res, err := tx.ExecContext(ctx, `UPDATE messages
+		SET data = CAST(json_set(CAST(data AS TEXT), '$.user_id', ?) AS BLOB)
+		WHERE event = '' AND `+storedAsJSON+` AND json_extract(CAST(data AS TEXT), '$.user_id') = ?`, to, from)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	// Rows another codec wrote are opaque to SQLite; rewrite them here.
+	type row struct {
+		ID   int64
+		data []byte
+	}
+	var changed []row
+	err = s.eachEncoded(ctx, tx, `SELECT id, data FROM messages WHERE event = '' AND NOT `+storedAsJSON, nil, func(ID int64, data []byte) error {
+		fields := map[string]json.RawMessage{}
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return err
+		}
+		var author string
+		if json.Unmarshal(fields["user_id"], &author); author != from {
+			return nil
+		}
+		fields["user_id"], _ = json.Marshal(to)
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		stored, err := s.encode(data)
+		if err != nil {
+			return err
+		}
+		changed = append(changed, row{ID, stored})
+		return nil
+	})
+	if err != nil {
+		return int(n), err
+	}
+	for _, r := range changed {
+		if _, err := tx.ExecContext(ctx, `UPDATE messages SET data = ? WHERE id = ?`, r.data, r.ID); err != nil {
+			return int(n), err
+		}
+		n++
+	}
+	return int(n), nil
+}
+
+// storedAsJSON is the SQL condition for rows stored as plain JSON, without a
+// codec header.
+const storedAsJSON = `substr(data, 1, 1) <> X'00'`
+
+// sqlQuerier is what eachEncoded reads through: the store's database, or a
+// transaction open on it.
+type sqlQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// eachEncoded calls fn with the ID and decoded data of every row query
+// returns through q. query selects id and data.
+func (s *messageStore) eachEncoded(ctx context.Context, q sqlQuerier, query string, args []any, fn func(ID int64, data []byte) error) error {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ID int64
+		var stored []byte
+		if err := rows.Scan(&ID, &stored); err != nil {
+			return err
+		}
+		data, err := decodeStored(stored)
+		if err != nil {
+			return fmt.Errorf("message %d: %w", ID, err)
+		}
+		if err := fn(ID, data); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *messageStore) pendingCount() float64 {
+	var count int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM outbox`).Scan(&count); err != nil {
+		return 0
+	}
+	return float64(count)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressed rows carry their own header, with codecZstdID, in front of a
+// zstd frame of what the codec wrote, header and all, so compression works
+// with any codec and rows decode the same whether or not they were
+// compressed.
+const (
+	codecZstdID      = 0x7f
+	codecZstdVersion = 1
+)
+
+var (
+	storeCompressed      = newCounter("chat_store_compressed_total", "Messages stored zstd-compressed because they exceeded -store-compress-above.")
+	storeCompressedSaved = newCounter("chat_store_compression_saved_bytes_total", "Bytes compression saved on messages written to the store.")
+
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(64<<20))
+)
+
+// UseCompression stores messages whose encoded data is larger than
+// threshold bytes compressed from now on; 0 turns it off.
+func (s *messageStore) UseCompression(threshold int) {
+	s.compressAbove = threshold
+}
+
+// encode encodes data with the store's codec and compresses it if it is
+// above the threshold and that makes it smaller.
+func (s *messageStore) encode(data []byte) ([]byte, error) {
+	stored, err := encodeStored(s.codec, data)
+	if err != nil || s.compressAbove <= 0 || len(stored) <= s.compressAbove {
+		return stored, err
+	}
+	compressed := zstdEncoder.EncodeAll(stored, []byte{codecMagic, codecZstdID, codecZstdVersion})
+	if len(compressed) >= len(stored) {
+		return stored, nil
+	}
+	storeCompressed.Inc()
+	storeCompressedSaved.Add(uint64(len(stored) - len(compressed)))
+	return compressed, nil
+}
+
+func decompressStored(version byte, frame []byte) ([]byte, error) {
+	if version > codecZstdVersion {
+		return nil, fmt.Errorf("store: zstd version %d is newer than this server's %d", version, codecZstdVersion)
+	}
+	stored, err := zstdDecoder.DecodeAll(frame, nil)
+	if err != nil {
+		return nil, fmt.Errorf("store: zstd: %w", err)
+	}
+	if isCompressed(stored) {
+		return nil, fmt.Errorf("store: zstd: compressed twice")
+	}
+	return decodeStored(stored)
+}
+
+func isCompressed(stored []byte) bool {
+	return len(stored) >= codecHeaderSize && stored[0] == codecMagic && stored[1] == codecZstdID
+}
+
+// CompressionStats is how much room takes in the store, and would without
+// compression. Raw sizes of compressed rows come from their frame headers,
+// so reading them decompresses nothing.
+type CompressionStats struct {
+	Room        string  `json:"room"`
+	Messages    int     `json:"messages"`
+	Compressed  int     `json:"compressed"`
+	StoredBytes int64   `json:"stored_bytes"`
+	RawBytes    int64   `json:"raw_bytes"`
+	Ratio       float64 `json:"ratio"`
+}
+
+// CompressionStats reports every room with stored messages, or just room if
+// it isn't empty, largest first.
+func (s *messageStore) CompressionStats(ctx context.Context, room string) ([]CompressionStats, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT room, COUNT(*), SUM(length(data)) FROM messages
+		WHERE (? = '' OR room = ?) GROUP BY room`, room, room)
+	if err != nil {
+		return nil, err
+	}
+	byRoom := make(map[string]*CompressionStats)
+	for rows.Next() {
+		stats := &CompressionStats{}
+		if err := rows.Scan(&stats.Room, &stats.Messages, &stats.StoredBytes); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stats.RawBytes = stats.StoredBytes
+		byRoom[stats.Room] = stats
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.QueryContext(ctx, `SELECT room, length(data), substr(data, 1, 32) FROM messages
+		WHERE (? = '' OR room = ?) AND substr(data, 1, 2) = ?`, room, room, []byte{codecMagic, codecZstdID})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var size int64
+		var head []byte
+		if err := rows.Scan(&name, &size, &head); err != nil {
+			return nil, err
+		}
+		stats := byRoom[name]
+		if stats == nil {
+			continue
+		}
+		stats.Compressed++
+		header := zstd.Header{}
+		if header.Decode(head[codecHeaderSize:]) == nil && header.HasFCS {
+			stats.RawBytes += int64(header.FrameContentSize) - size
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	all := make([]CompressionStats, 0, len(byRoom))
+	for _, stats := range byRoom {
+		if stats.StoredBytes > 0 {
+			stats.Ratio = float64(stats.RawBytes) / float64(stats.StoredBytes)
+		}
+		all = append(all, *stats)
+	}
+	slices.SortFunc(all, func(a, b CompressionStats) int {
+		return cmp.Or(cmp.Compare(b.StoredBytes, a.StoredBytes), strings.Compare(a.Room, b.Room))
+	})
+	return all, nil
+}
+
+func compressionStatsHandler(store *messageStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if store == nil {
+			writeError(w, r, errStoreDisabled)
+			return
+		}
+		stats, err := store.CompressionStats(r.Context(), r.URL.Query().Get("room"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	authEvent = "auth"
+	// authWarning is how long before expiry a stream is asked to refresh.
+	authWarning = 30 * time.Second
+)
+
+var (
+	errAuthExpired = errors.New("credentials expired")
+
+	streamAuthEvents = newCounterVec("chat_stream_auth_total", "Stream credential refreshes and expiries by result.", "result")
+)
+
+// authExpiryFrom is when the credential r was verified with runs out, or zero
+// if it doesn't. Only user tokens expire.
+func authExpiryFrom(r *http.Request) time.Time {
+	id, _ := r.Context().Value(identityKey{}).(identity)
+	return id.expires
+}
+
+// AuthExpires is when the credentials of the stream run out, or zero if they
+// don't.
+func (s *Subscriber) AuthExpires() time.Time {
+	unix := s.authExpires.Load()
+	if unix == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, unix)
+}
+
+func (s *Subscriber) setAuthExpires(expires time.Time) {
+	if expires.IsZero() {
+		s.authExpires.Store(0)
+	} else {
+		s.authExpires.Store(expires.UnixNano())
+	}
+}
+
+// reauthenticate replaces the credential expiry of a running stream.
+func (s *Subscriber) reauthenticate(expires time.Time) {
+	s.setAuthExpires(expires)
+	select {
+	case s.reauth <- struct{}{}:
+	default:
+	}
+}
+
+// Reauthed receives whenever the stream's credentials are replaced.
+func (s *Subscriber) Reauthed() <-chan struct{} {
+	return s.reauth
+}
+
+type authNotice struct {
+	Status       string    `json:"status"`
+	ExpiresAt    time.Time `json:"expires_at,omitzero"`
+	RevokedRooms []string  `json:"revoked_rooms,omitempty"`
+}
+
+func authEnvelope(subscriber *Subscriber, status string, revoked []string) Envelope {
+	data, _ := json.Marshal(authNotice{Status: status, ExpiresAt: subscriber.AuthExpires().UTC(), RevokedRooms: revoked})
+	return Envelope{ID: subscriber.ID, Event: authEvent, Time: time.Now().UTC(), Data: data}
+}
+
+// authTimers fire ahead of and at the credential expiry of a stream.
+type authTimers struct {
+	warn, expire *time.Timer
+}
+
+func newAuthTimers(expires time.Time) *authTimers {
+	t := &authTimers{warn: time.NewTimer(time.Hour), expire: time.NewTimer(time.Hour)}
+	t.Reset(expires)
+	return t
+}
+
+// Reset rearms the timers for expires; a zero expires stops them.
+func (t *authTimers) Reset(expires time.Time) {
+	t.Stop()
+	if expires.IsZero() {
+		return
+	}
+	t.warn.Reset(max(time.Until(expires)-authWarning, 0))
+	t.expire.Reset(time.Until(expires))
+}
+
+func (t *authTimers) Stop() {
+	t.warn.Stop()
+	t.expire.Stop()
+}
+
+type authRefreshResponse struct {
+	SubscriberID string    `json:"subscriber_id"`
+	ExpiresAt    time.Time `json:"expires_at,omitzero"`
+	RevokedRooms []string  `json:"revoked_rooms"`
+}
+
+// refreshAuthHandler replaces the credentials of a running stream. It takes
+// the same identity and expiry as opening a stream, must be the same user
+// who opened it, and re-checks every room the stream is in: rooms the user
+// may no longer read are left, the rest keep streaming. The stream is told
+// through an auth event either way.
+func refreshAuthHandler(adminToken string, broker *Broker, rooms *roomRegistry, waiting *waitingRoom, presence *presenceTracker, bindings *streamBindings) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromRequest(r)
+		if user == "" {
+			writeError(w, r, errUnauthenticated)
+			return
+		}
+		subscriber, ok := broker.Lookup(r.PathValue("id"))
+		if !ok || subscriber.User != user {
+			writeError(w, r, errSubscriberNotFound)
+			return
+		}
+		if err := bindings.Verify(r, subscriber); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		expires := authExpiryFrom(r)
+
+		revoked := []string{}
+		admin := isAdmin(adminToken, r)
+		for _, room := range broker.RoomsOf(subscriber.ID) {
+			allowed := rooms.CanRead(room, user)
+			if isSystemRoom(room) {
+				allowed = admin
+			}
+			if allowed {
+				continue
+			}
+			if left, _ := broker.Leave(subscriber.ID, room); left {
+				presence.Disconnect(room, user, subscriber.ClientID)
+			}
+			waiting.Release(room, subscriber.ID)
+			revoked = append(revoked, room)
+		}
+		subscriber.reauthenticate(expires)
+		broker.Notify(subscriber.ID, authEnvelope(subscriber, "refreshed", revoked))
+		streamAuthEvents.With("refreshed").Add(1)
+		if len(revoked) > 0 {
+			log.Printf("Subscriber %s lost access to %v on refresh", subscriber.ID, revoked)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(authRefreshResponse{SubscriberID: subscriber.ID, ExpiresAt: expires.UTC(), RevokedRooms: revoked})
+	}
+}
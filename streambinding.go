@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	bindingOff     = "off"
+	bindingLog     = "log"
+	bindingEnforce = "enforce"
+
+	bindClientID  = "client_id"
+	bindIP        = "ip"
+	bindNetwork   = "network"
+	bindUserAgent = "user_agent"
+
+	// streamNonceHeader carries the nonce a stream was handed in its
+	// subscribed event on requests that act on its subscription.
+	streamNonceHeader = "X-Stream-Nonce"
+
+	bindingViolationEvent = "stream_binding_violation"
+
+	// urlBindingTTL is how long a credential carried in a stream URL stays
+	// bound to the client that last streamed with it.
+	urlBindingTTL  = 24 * time.Hour
+	maxURLBindings = 100000
+	// bindingAlertInterval spaces out the #system alerts about one user.
+	bindingAlertInterval = time.Minute
+)
+
+var (
+	errStreamBinding = errors.New("request doesn't match the client the stream is bound to")
+
+	bindingViolations = newCounterVec("chat_stream_binding_violations_total", "Requests that didn't match the client their stream or stream URL is bound to, by what differed.", "reason")
+)
+
+// connBinding is what a stream is bound to besides its user. ClientID is the
+// client ID cookie, never one the client passed some other way. The user
+// agent is kept hashed.
+type connBinding struct {
+	ClientID  string
+	IP        string
+	Network   string
+	UserAgent [32]byte
+}
+
+func bindingFromRequest(r *http.Request, clientID string) connBinding {
+	ip := clientAddress(r)
+	b := connBinding{ClientID: clientID, IP: ip, Network: ip, UserAgent: sha256.Sum256([]byte(r.UserAgent()))}
+	if addr, err := netip.ParseAddr(ip); err == nil {
+		bits := 48
+		if addr.Unmap().Is4() {
+			addr, bits = addr.Unmap(), 24
+		}
+		b.Network = netip.PrefixFrom(addr, bits).Masked().String()
+	}
+	return b
+}
+
+type subscriberBinding struct {
+	nonce string
+	conn  connBinding
+}
+
+type urlBinding struct {
+	conn    connBinding
+	expires time.Time
+}
+
+// streamBindings ties each stream to the user and client that opened it.
+// Every stream gets a nonce in its subscribed event that requests acting on
+// its subscription must send back from the same client, and a credential
+// carried in a stream URL (access_token), which leaks with the URL, stays
+// bound to the client that last streamed with it. What has to match is the
+// policy's match list; in log mode violations are only logged, counted and
+// announced in #system, in enforce mode they're also refused.
+type streamBindings struct {
+	mode   string
+	match  []string
+	broker *Broker
+
+	mu      sync.Mutex
+	urls    map[[32]byte]urlBinding
+	alerted map[string]time.Time
+}
+
+func newStreamBindings(broker *Broker, mode, match string) (*streamBindings, error) {
+	if !slices.Contains([]string{bindingOff, bindingLog, bindingEnforce}, mode) {
+		return nil, fmt.Errorf("-stream-binding must be off, log or enforce, not %q", mode)
+	}
+	b := &streamBindings{mode: mode, broker: broker, urls: make(map[[32]byte]urlBinding), alerted: make(map[string]time.Time)}
+	for _, attr := range strings.Split(match, ",") {
+		attr = strings.TrimSpace(attr)
+		if attr == "" {
+			continue
+		}
+		if !slices.Contains([]string{bindClientID, bindIP, bindNetwork, bindUserAgent}, attr) {
+			return nil, fmt.Errorf("-stream-binding-match: unknown attribute %q", attr)
+		}
+		b.match = append(b.match, attr)
+	}
+	return b, nil
+}
+
+// mismatches lists the attributes of the policy that differ between had and
+// got.
+func (b *streamBindings) mismatches(had, got connBinding) []string {
+	var reasons []string
+	for _, attr := range b.match {
+		differs := false
+		switch attr {
+		case bindClientID:
+			differs = had.ClientID != got.ClientID
+		case bindIP:
+			differs = had.IP != got.IP
+		case bindNetwork:
+			differs = had.Network != got.Network
+		case bindUserAgent:
+			differs = had.UserAgent != got.UserAgent
+		}
+		if differs {
+			reasons = append(reasons, attr)
+		}
+	}
+	return reasons
+}
+
+// urlCredential returns a key for the credential the stream URL carries, if
+// it carries one.
+func urlCredential(r *http.Request) ([32]byte, bool) {
+	query := r.URL.Query()
+	if token := query.Get("access_token"); token != "" && !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return sha256.Sum256([]byte("access_token\x00" + token)), true
+	}
+	return [32]byte{}, false
+}
+
+// CheckURL checks a stream opened with credentials in its URL against the
+// client that last streamed with them, and binds them to this one when it
+// passes. clientID is the one in the caller's cookie.
+func (b *streamBindings) CheckURL(r *http.Request, user, clientID string) error {
+	key, ok := urlCredential(r)
+	if b.mode == bindingOff || !ok {
+		return nil
+	}
+	conn := bindingFromRequest(r, clientID)
+	now := time.Now()
+
+	b.mu.Lock()
+	bound, found := b.urls[key]
+	var reasons []string
+	if found && now.Before(bound.expires) {
+		reasons = b.mismatches(bound.conn, conn)
+	}
+	if len(reasons) == 0 || b.mode != bindingEnforce {
+		if !found && len(b.urls) >= maxURLBindings {
+			maps.DeleteFunc(b.urls, func(_ [32]byte, u urlBinding) bool { return now.After(u.expires) })
+		}
+		if found || len(b.urls) < maxURLBindings {
+			b.urls[key] = urlBinding{conn: conn, expires: now.Add(urlBindingTTL)}
+		}
+	}
+	b.mu.Unlock()
+
+	if len(reasons) == 0 {
+		return nil
+	}
+	return b.violation(r, user, "", reasons)
+}
+
+// Bind binds a new stream to the client opening it, whose cookie holds
+// clientID, and returns the nonce for its subscribed event, or "" with
+// binding off.
+func (b *streamBindings) Bind(r *http.Request, subscriber *Subscriber, clientID string) string {
+	if b.mode == bindingOff {
+		return ""
+	}
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	nonce := hex.EncodeToString(raw)
+	subscriber.binding.Store(&subscriberBinding{nonce: nonce, conn: bindingFromRequest(r, clientID)})
+	return nonce
+}
+
+// Verify checks that a request acting on subscriber's subscription carries
+// its nonce and comes from the client it's bound to.
+func (b *streamBindings) Verify(r *http.Request, subscriber *Subscriber) error {
+	bound := subscriber.binding.Load()
+	if b.mode == bindingOff || bound == nil {
+		return nil
+	}
+	var reasons []string
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(streamNonceHeader)), []byte(bound.nonce)) != 1 {
+		reasons = append(reasons, "nonce")
+	}
+	reasons = append(reasons, b.mismatches(bound.conn, bindingFromRequest(r, cookieClientID(r)))...)
+	if len(reasons) == 0 {
+		return nil
+	}
+	return b.violation(r, subscriber.User, subscriber.ID, reasons)
+}
+
+// violation logs, counts and announces a binding violation, and returns the
+// error to refuse the request with in enforce mode.
+func (b *streamBindings) violation(r *http.Request, user, subscriberID string, reasons []string) error {
+	for _, reason := range reasons {
+		bindingViolations.With(reason).Add(1)
+	}
+	enforced := b.mode == bindingEnforce
+	target := "stream URL"
+	if subscriberID != "" {
+		target = "subscription " + subscriberID
+	}
+	log.Printf("Stream binding violation on %s of user %s from %s (%s): %v, enforced %t", target, user, clientAddress(r), r.UserAgent(), reasons, enforced)
+
+	now := time.Now()
+	b.mu.Lock()
+	alert := now.Sub(b.alerted[user]) >= bindingAlertInterval
+	if alert {
+		maps.DeleteFunc(b.alerted, func(_ string, at time.Time) bool { return now.Sub(at) >= bindingAlertInterval })
+		b.alerted[user] = now
+	}
+	b.mu.Unlock()
+	if alert {
+		raw, _ := json.Marshal(map[string]any{
+			"user_id":       user,
+			"subscriber_id": subscriberID,
+			"ip":            clientAddress(r),
+			"reasons":       reasons,
+			"enforced":      enforced,
+		})
+		if _, err := b.broker.PublishEvent(lifecycleRoom, bindingViolationEvent, raw); err != nil {
+			log.Printf("Stream binding: announcing in %s: %v", lifecycleRoom, err)
+		}
+	}
+
+	if !enforced {
+		return nil
+	}
+	return withDetails(errStreamBinding, map[string][]string{"mismatched": reasons})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// policyEvent tells a stream that an operator changed what it is sent.
+	policyEvent = "policy"
+
+	maxPolicyEntries = 50
+	maxPolicyReason  = 200
+)
+
+// StreamPolicy narrows what a stream is sent on top of the user's own
+// preferences: nothing from MutedRooms and, when Events is set, only those
+// events ("message" for chat messages). It stops applying at Until.
+type StreamPolicy struct {
+	MutedRooms []string   `json:"muted_rooms,omitempty"`
+	Events     []string   `json:"events,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
+	Until      *time.Time `json:"until,omitempty"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// allows reports whether env may go out under p. A nil policy allows
+// everything.
+func (p *StreamPolicy) allows(env Envelope) bool {
+	if p == nil || (p.Until != nil && !time.Now().Before(*p.Until)) {
+		return true
+	}
+	if slices.Contains(p.MutedRooms, env.Room) {
+		return false
+	}
+	event := env.Event
+	if event == "" {
+		event = "message"
+	}
+	return len(p.Events) == 0 || slices.Contains(p.Events, event)
+}
+
+// Policy is the operator policy of the stream, or nil.
+func (s *Subscriber) Policy() *StreamPolicy {
+	return s.policy.Load()
+}
+
+func (s *Subscriber) setPolicy(p *StreamPolicy) {
+	s.policy.Store(p)
+}
+
+// SetUserPolicy applies p, or no policy if nil, to every stream of user on
+// this node and returns their IDs.
+func (b *Broker) SetUserPolicy(user string, p *StreamPolicy) []string {
+	var IDs []string
+	for _, s := range b.shards {
+		s.mu.RLock()
+		for _, subscriber := range s.subscribers {
+			if subscriber.User == user {
+				subscriber.setPolicy(p)
+				IDs = append(IDs, subscriber.ID)
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return IDs
+}
+
+// streamPolicies remembers the policies set for users, so streams they open
+// later start under them too.
+type streamPolicies struct {
+	mu    sync.RWMutex
+	users map[string]*StreamPolicy
+}
+
+func newStreamPolicies() *streamPolicies {
+	return &streamPolicies{users: make(map[string]*StreamPolicy)}
+}
+
+func (sp *streamPolicies) ForUser(user string) *StreamPolicy {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return sp.users[user]
+}
+
+func (sp *streamPolicies) Set(user string, p *StreamPolicy) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if p == nil {
+		delete(sp.users, user)
+	} else {
+		sp.users[user] = p
+	}
+}
+
+type policyNotice struct {
+	Scope  string        `json:"scope"`
+	Policy *StreamPolicy `json:"policy"`
+}
+
+// policyEnvelope acknowledges a policy change to the stream it applies to.
+// A null policy means the stream is back to what the user chose.
+func policyEnvelope(ID, scope string, p *StreamPolicy) Envelope {
+	data, _ := json.Marshal(policyNotice{Scope: scope, Policy: p})
+	return Envelope{ID: ID, Event: policyEvent, Time: time.Now().UTC(), Data: data}
+}
+
+func decodeStreamPolicy(r *http.Request) (*StreamPolicy, error) {
+	p := &StreamPolicy{}
+	if err := json.NewDecoder(r.Body).Decode(p); err != nil {
+		return nil, invalidJSON(err)
+	}
+	if len(p.MutedRooms) > maxPolicyEntries || len(p.Events) > maxPolicyEntries {
+		return nil, fmt.Errorf("%w: at most %d muted rooms and %d events", errInvalidRequest, maxPolicyEntries, maxPolicyEntries)
+	}
+	if slices.Contains(p.MutedRooms, "") || slices.Contains(p.Events, "") {
+		return nil, fmt.Errorf("%w: room and event names can't be empty", errInvalidRequest)
+	}
+	if utf8.RuneCountInString(p.Reason) > maxPolicyReason {
+		return nil, fmt.Errorf("%w: reason is at most %d characters", errInvalidRequest, maxPolicyReason)
+	}
+	if p.Until != nil && !p.Until.After(time.Now()) {
+		return nil, fmt.Errorf("%w: until must be in the future", errInvalidRequest)
+	}
+	p.UpdatedAt = time.Now().UTC()
+	return p, nil
+}
+
+// streamPolicyHandler sets (or with set false, clears) the policy of one
+// stream. The stream is told through a policy event.
+func streamPolicyHandler(broker *Broker, audit *auditLog, set bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		subscriber, ok := broker.Lookup(r.PathValue("id"))
+		if !ok {
+			writeError(w, r, errSubscriberNotFound)
+			return
+		}
+		var p *StreamPolicy
+		if set {
+			var err error
+			if p, err = decodeStreamPolicy(r); err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+		subscriber.setPolicy(p)
+		broker.Notify(subscriber.ID, policyEnvelope(subscriber.ID, "stream", p))
+		audit.Record("admin", "stream.policy", "", "subscriber="+subscriber.ID+" set="+strconv.FormatBool(set))
+
+		if !set {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p)
+	}
+}
+
+// userStreamPolicyHandler sets (or clears) the policy of every stream of a
+// user, replacing what was set on any of them alone, and of the streams the
+// user opens from now on.
+func userStreamPolicyHandler(broker *Broker, policies *streamPolicies, audit *auditLog, set bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.PathValue("user")
+		var p *StreamPolicy
+		if set {
+			var err error
+			if p, err = decodeStreamPolicy(r); err != nil {
+				writeError(w, r, err)
+				return
+			}
+		}
+		policies.Set(user, p)
+		streams := broker.SetUserPolicy(user, p)
+		for _, ID := range streams {
+			broker.Notify(ID, policyEnvelope(ID, "user", p))
+		}
+		audit.Record("admin", "user.stream_policy", "", "user="+user+" set="+strconv.FormatBool(set)+" streams="+strconv.Itoa(len(streams)))
+
+		if !set {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p)
+	}
+}
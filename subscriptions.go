@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const maxStreamRooms = 16
+
+// roomsFromRequest returns the rooms a stream subscribes to: the
+// comma-separated rooms query parameter if given, the single room otherwise.
+func roomsFromRequest(r *http.Request) ([]string, error) {
+	raw := r.URL.Query().Get("rooms")
+	if raw == "" {
+		return []string{roomFromRequest(r)}, nil
+	}
+
+	var rooms []string
+	for _, room := range strings.Split(raw, ",") {
+		if room == "" {
+			return nil, fmt.Errorf("%w: empty room name in rooms", errInvalidRequest)
+		}
+		if !slices.Contains(rooms, room) {
+			rooms = append(rooms, room)
+		}
+	}
+	if len(rooms) > maxStreamRooms {
+		return nil, fmt.Errorf("%w: at most %d rooms per stream", errInvalidRequest, maxStreamRooms)
+	}
+	return rooms, nil
+}
+
+type subscriptionResponse struct {
+	SubscriberID string `json:"subscriber_id"`
+	Room         string `json:"room"`
+	Joined       bool   `json:"joined"`
+}
+
+// subscriptionHandler joins (join true) or leaves a room on a running stream.
+// Only the user who opened the stream can change it, so anonymous streams
+// can't be changed at all.
+func subscriptionHandler(adminToken string, broker *Broker, rooms *roomRegistry, waiting *waitingRoom, presence *presenceTracker, bindings *streamBindings, join bool) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromRequest(r)
+		if user == "" {
+			writeError(w, r, errUnauthenticated)
+			return
+		}
+		subscriber, ok := broker.Lookup(r.PathValue("id"))
+		if !ok || subscriber.User != user {
+			writeError(w, r, errSubscriberNotFound)
+			return
+		}
+		if err := bindings.Verify(r, subscriber); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		room := r.PathValue("room")
+		changed := false
+		var err error
+		if join {
+			if isSystemRoom(room) && !isAdmin(adminToken, r) {
+				writeError(w, r, fmt.Errorf("%w: subscriptions require the admin token", errSystemRoom))
+				return
+			}
+			if !rooms.CanRead(room, user) {
+				writeError(w, r, errNotMember)
+				return
+			}
+			// Streams already open don't queue; a full room is refused.
+			if !waiting.TryAcquire(room, subscriber.ID) {
+				writeError(w, r, withDetails(errRoomFull, map[string]int{"capacity": rooms.Capacity(room)}))
+				return
+			}
+			if changed, err = broker.Join(subscriber.ID, room, maxStreamRooms); changed {
+				presence.Connect(room, user, subscriber.ClientID)
+			} else if err != nil {
+				waiting.Release(room, subscriber.ID)
+			}
+		} else {
+			if changed, err = broker.Leave(subscriber.ID, room); changed {
+				presence.Disconnect(room, user, subscriber.ClientID)
+			}
+			waiting.Release(room, subscriber.ID)
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(subscriptionResponse{SubscriberID: subscriber.ID, Room: room, Joined: join})
+	}
+}
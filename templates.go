@@ -0,0 +1,481 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxProvisionRooms = 1000
+	maxProvisionBody  = 4 << 20
+	maxWelcomeLength  = 4000
+
+	welcomeEvent = "welcome"
+)
+
+var (
+	errRoomTemplateNotFound = errors.New("room template not found")
+
+	roomsProvisioned = newCounterVec("chat_rooms_provisioned_total", "Rooms through /admin/rooms/provision by result.", "result")
+)
+
+// RoomTemplate is the policy a platform gives the rooms it provisions:
+// who can read and publish, how long messages last, the moderation and
+// challenge policies, and the welcome message pinned to the top of every
+// stream of the room.
+type RoomTemplate struct {
+	Name         string            `json:"name"`
+	Private      bool              `json:"private,omitempty"`
+	Mode         string            `json:"mode,omitempty"`
+	Presenters   []string          `json:"presenters,omitempty"`
+	PublicStream bool              `json:"public_stream,omitempty"`
+	Capacity     int               `json:"capacity,omitempty"`
+	Encrypted    bool              `json:"encrypted,omitempty"`
+	MessageTTL   configDuration    `json:"message_ttl,omitempty"`
+	Moderation   *ModerationPolicy `json:"moderation,omitempty"`
+	Challenge    *ChallengePolicy  `json:"challenge,omitempty"`
+	Tenant       string            `json:"tenant,omitempty"`
+	Welcome      string            `json:"welcome,omitempty"`
+	UpdatedAt    time.Time         `json:"updated_at"`
+}
+
+// validate checks t the way the endpoints setting each of its policies on a
+// room would, so provisioning from it only fails if the room does.
+func (t *RoomTemplate) validate(challenge *sendChallenge) error {
+	if !tenantPattern.MatchString(t.Name) {
+		return fmt.Errorf("%w: template names are 1-64 letters, digits, '.', '_' or '-'", errInvalidRequest)
+	}
+	if t.Mode != "" && t.Mode != roomModeChat && t.Mode != roomModeBroadcast && t.Mode != roomModeFeedback {
+		return errRoomMode
+	}
+	if t.Capacity < 0 {
+		return fmt.Errorf("%w: capacity must not be negative", errInvalidRequest)
+	}
+	if ttl := time.Duration(t.MessageTTL); ttl != 0 && (ttl < minMessageTTL || ttl > maxMessageTTL) {
+		return fmt.Errorf("%w: message_ttl must be between %s and %s, or 0s", errInvalidRequest, minMessageTTL, maxMessageTTL)
+	}
+	if t.Moderation != nil {
+		if t.Encrypted {
+			return fmt.Errorf("%w: its messages can't be moderated", errRoomEncrypted)
+		}
+		if err := t.Moderation.compile(); err != nil {
+			return err
+		}
+	}
+	if t.Challenge != nil {
+		if err := t.Challenge.validate(); err != nil {
+			return err
+		}
+		if t.Challenge.empty() {
+			t.Challenge = nil
+		} else if challenge.verifier == nil {
+			return fmt.Errorf("%w: start the server with -captcha-provider or -captcha-verify-url first", errInvalidRequest)
+		}
+	}
+	if t.Tenant != "" && !tenantPattern.MatchString(t.Tenant) {
+		return fmt.Errorf("%w: tenant must be 1-64 letters, digits, '.', '_' or '-'", errInvalidRequest)
+	}
+	return validateWelcome(t.Welcome)
+}
+
+func validateWelcome(message string) error {
+	if utf8.RuneCountInString(message) > maxWelcomeLength {
+		return fmt.Errorf("%w: the welcome message is longer than %d characters", errInvalidRequest, maxWelcomeLength)
+	}
+	return nil
+}
+
+// roomTemplates holds the room templates by name, saving them in a store
+// when it has one.
+type roomTemplates struct {
+	mu        sync.RWMutex
+	templates map[string]RoomTemplate
+	store     roomTemplateStore
+}
+
+// roomTemplateStore persists room templates as they change.
+type roomTemplateStore interface {
+	SaveRoomTemplate(t RoomTemplate) error
+	DeleteRoomTemplate(name string) error
+}
+
+func newRoomTemplates() *roomTemplates {
+	return &roomTemplates{templates: make(map[string]RoomTemplate)}
+}
+
+// UseStore saves every template from now on in store before making it.
+func (rt *roomTemplates) UseStore(store roomTemplateStore) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.store = store
+}
+
+func (rt *roomTemplates) Put(t RoomTemplate) (RoomTemplate, error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	t.UpdatedAt = time.Now().UTC()
+	if rt.store != nil {
+		if err := rt.store.SaveRoomTemplate(t); err != nil {
+			return RoomTemplate{}, err
+		}
+	}
+	rt.templates[t.Name] = t
+	return t, nil
+}
+
+func (rt *roomTemplates) Get(name string) (RoomTemplate, bool) {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	t, ok := rt.templates[name]
+	return t, ok
+}
+
+func (rt *roomTemplates) Delete(name string) (bool, error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if _, ok := rt.templates[name]; !ok {
+		return false, nil
+	}
+	if rt.store != nil {
+		if err := rt.store.DeleteRoomTemplate(name); err != nil {
+			return false, err
+		}
+	}
+	delete(rt.templates, name)
+	return true, nil
+}
+
+func (rt *roomTemplates) List() []RoomTemplate {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	list := make([]RoomTemplate, 0, len(rt.templates))
+	for _, t := range rt.templates {
+		list = append(list, t)
+	}
+	slices.SortFunc(list, func(a, b RoomTemplate) int { return cmp.Compare(a.Name, b.Name) })
+	return list
+}
+
+// Replace swaps every template for templates without saving them.
+func (rt *roomTemplates) Replace(templates []RoomTemplate) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	rt.templates = make(map[string]RoomTemplate, len(templates))
+	for _, t := range templates {
+		rt.templates[t.Name] = t
+	}
+}
+
+// SetWelcome pins message to the top of every stream of room; an empty one
+// unpins it.
+func (rr *roomRegistry) SetWelcome(name, message string) (Room, error) {
+	if err := validateWelcome(message); err != nil {
+		return Room{}, err
+	}
+
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	room, ok := rr.rooms[name]
+	if !ok {
+		return Room{}, errRoomNotFound
+	}
+	if err := rr.record(RoomEvent{Type: roomWelcomeSet, Room: name, Welcome: message}); err != nil {
+		return Room{}, err
+	}
+	return *room, nil
+}
+
+// Welcome returns the welcome event streams of room start with, if it has a
+// welcome message. It carries no sequence, so it is never replayed.
+func (rr *roomRegistry) Welcome(name string) (Envelope, bool) {
+	room, ok := rr.Get(name)
+	if !ok || room.Welcome == "" {
+		return Envelope{}, false
+	}
+	data, _ := json.Marshal(map[string]string{"room": name, "message": room.Welcome})
+	return Envelope{ID: welcomeEvent + ":" + name, Room: name, Event: welcomeEvent, Time: time.Now().UTC(), Data: data}, true
+}
+
+// Provision creates room, owned by owner, with the policies of t. Settings
+// a room is created with anyway aren't recorded again.
+func (t *RoomTemplate) Provision(rooms *roomRegistry, room, owner, tenant string, members []string) (Room, error) {
+	settings := roomSettings{Private: t.Private, Mode: t.Mode, Presenters: t.Presenters, Capacity: t.Capacity, PublicStream: t.PublicStream, Encrypted: t.Encrypted}
+	if _, err := rooms.Create(room, owner, settings); err != nil {
+		return Room{}, err
+	}
+	var err error
+	if t.MessageTTL != 0 {
+		_, err = rooms.SetMessageTTL(room, time.Duration(t.MessageTTL))
+	}
+	if tenant = cmp.Or(tenant, t.Tenant); err == nil && tenant != "" {
+		_, err = rooms.SetTenant(room, tenant)
+	}
+	if err == nil && t.Welcome != "" {
+		_, err = rooms.SetWelcome(room, t.Welcome)
+	}
+	if err == nil && t.Moderation != nil {
+		err = rooms.SetModeration(room, t.Moderation)
+	}
+	if err == nil && t.Challenge != nil {
+		err = rooms.SetChallenge(room, t.Challenge)
+	}
+	for _, member := range members {
+		if err == nil && member != "" && member != owner {
+			err = rooms.AddMember(room, member)
+		}
+	}
+	if err != nil {
+		return Room{}, err
+	}
+	provisioned, _ := rooms.Get(room)
+	return provisioned, nil
+}
+
+func (s *messageStore) SaveRoomTemplate(t RoomTemplate) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO room_templates (name, data, updated_at) VALUES (?, ?, ?)`, t.Name, data, t.UpdatedAt.UnixNano())
+	return err
+}
+
+func (s *messageStore) DeleteRoomTemplate(name string) error {
+	_, err := s.db.Exec(`DELETE FROM room_templates WHERE name = ?`, name)
+	return err
+}
+
+// RecoverRoomTemplates puts the stored templates back in templates and
+// returns how many there were. A template whose moderation policy no longer
+// compiles loses it, as rooms do.
+func (s *messageStore) RecoverRoomTemplates(ctx context.Context, templates *roomTemplates) (int, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT name, data FROM room_templates`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	stored := []RoomTemplate{}
+	for rows.Next() {
+		var name string
+		var data []byte
+		if err := rows.Scan(&name, &data); err != nil {
+			return 0, err
+		}
+		t := RoomTemplate{}
+		if err := json.Unmarshal(data, &t); err != nil {
+			return 0, fmt.Errorf("room template %s: %w", name, err)
+		}
+		if t.Moderation != nil {
+			if err := t.Moderation.compile(); err != nil {
+				log.Printf("Rooms: moderation policy of template %s: %v", name, err)
+				t.Moderation = nil
+			}
+		}
+		stored = append(stored, t)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	templates.Replace(stored)
+	return len(stored), nil
+}
+
+func listRoomTemplatesHandler(templates *roomTemplates) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(templates.List())
+	}
+}
+
+func getRoomTemplateHandler(templates *roomTemplates) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, ok := templates.Get(r.PathValue("name"))
+		if !ok {
+			writeError(w, r, errRoomTemplateNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t)
+	}
+}
+
+// putRoomTemplateHandler creates or replaces a template. Rooms provisioned
+// from it before keep the policies they were given.
+func putRoomTemplateHandler(templates *roomTemplates, challenge *sendChallenge, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := RoomTemplate{}
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+		t.Name = r.PathValue("name")
+		if err := t.validate(challenge); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		t, err := templates.Put(t)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record(auditActor(r), "room_template.put", "", t.Name)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t)
+	}
+}
+
+func deleteRoomTemplateHandler(templates *roomTemplates, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		deleted, err := templates.Delete(name)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if !deleted {
+			writeError(w, r, errRoomTemplateNotFound)
+			return
+		}
+		audit.Record(auditActor(r), "room_template.delete", "", name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type provisionRoom struct {
+	Name    string   `json:"name"`
+	Owner   string   `json:"owner"`
+	Tenant  string   `json:"tenant"`
+	Members []string `json:"members"`
+}
+
+// provisionRequest names the rooms to create from Template. Owner is the
+// owner of those that don't name their own.
+type provisionRequest struct {
+	Template string          `json:"template"`
+	Owner    string          `json:"owner"`
+	Rooms    []provisionRoom `json:"rooms"`
+}
+
+// provisionResult is the outcome of one room: created, existing if a room
+// of that name was there already, which is left as it is, or failed.
+type provisionResult struct {
+	Name   string         `json:"name"`
+	Status string         `json:"status"`
+	Room   *Room          `json:"room,omitempty"`
+	Error  *ErrorResponse `json:"error,omitempty"`
+}
+
+type provisionResponse struct {
+	Template string            `json:"template"`
+	Created  int               `json:"created"`
+	Results  []provisionResult `json:"results"`
+}
+
+// provisionRoomsHandler creates up to maxProvisionRooms rooms from a
+// template. Rooms that exist already are reported rather than changed, so a
+// platform can retry a provisioning run until every room is created.
+func provisionRoomsHandler(rooms *roomRegistry, templates *roomTemplates, lifecycle *lifecycleMirror, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := provisionRequest{}
+		r.Body = http.MaxBytesReader(w, r.Body, maxProvisionBody)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+		t, ok := templates.Get(req.Template)
+		if !ok {
+			writeError(w, r, errRoomTemplateNotFound)
+			return
+		}
+		if len(req.Rooms) == 0 || len(req.Rooms) > maxProvisionRooms {
+			writeError(w, r, fmt.Errorf("%w: provision 1 to %d rooms at a time", errInvalidRequest, maxProvisionRooms))
+			return
+		}
+
+		resp := provisionResponse{Template: t.Name, Results: make([]provisionResult, len(req.Rooms))}
+		for i, spec := range req.Rooms {
+			result := &resp.Results[i]
+			result.Name = spec.Name
+			owner := cmp.Or(spec.Owner, req.Owner)
+			var err error
+			switch {
+			case spec.Name == "":
+				err = fmt.Errorf("%w: room name required", errInvalidRequest)
+			case isSystemRoom(spec.Name):
+				err = fmt.Errorf("%w: room name is reserved", errInvalidRequest)
+			case owner == "":
+				err = fmt.Errorf("%w: owner required", errInvalidRequest)
+			case spec.Tenant != "" && !tenantPattern.MatchString(spec.Tenant):
+				err = fmt.Errorf("%w: tenant must be 1-64 letters, digits, '.', '_' or '-'", errInvalidRequest)
+			}
+			if err == nil {
+				var room Room
+				if room, err = t.Provision(rooms, spec.Name, owner, spec.Tenant, spec.Members); err == nil {
+					result.Status, result.Room = "created", &room
+					resp.Created++
+					audit.Record(auditActor(r), "room.create", room.Name, "template="+t.Name)
+					lifecycle.Record(LifecycleEvent{Type: lifecycleRoomCreated, Room: room.Name, User: owner})
+				}
+			}
+			switch {
+			case errors.Is(err, errRoomExists):
+				result.Status = "existing"
+			case err != nil:
+				_, body := errorResponse(r, err)
+				body.RequestID = ""
+				result.Status, result.Error = "failed", &body
+			}
+			roomsProvisioned.With(result.Status).Add(1)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+type welcomeRequest struct {
+	Message string `json:"message"`
+}
+
+// setWelcomeHandler lets the owner of a room change its welcome message.
+func setWelcomeHandler(rooms *roomRegistry, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("room")
+		user := userFromRequest(r)
+		if !rooms.IsOwner(name, user) {
+			writeError(w, r, fmt.Errorf("%w: only the room owner can change its welcome message", errForbidden))
+			return
+		}
+
+		req := welcomeRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+		room, err := rooms.SetWelcome(name, req.Message)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record(user, "room.welcome", name, "")
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(room)
+	}
+}
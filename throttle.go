@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	throttledWrites = newCounter("chat_sse_throttled_writes_total", "SSE writes delayed by the per-subscriber bandwidth limit.")
+	throttleWait    = newCounter("chat_sse_throttle_wait_milliseconds_total", "Time SSE writes spent waiting on the bandwidth limit.")
+)
+
+// tokenBucket refills at rate tokens per second up to burst.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// SetRate changes the refill rate and burst, keeping the current balance.
+func (b *tokenBucket) SetRate(rate float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.rate, b.burst = rate, rate
+	b.tokens = min(b.tokens, b.burst)
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Reserve takes n tokens, going into debt if needed, and returns how long the
+// caller has to wait before the debt is paid off.
+func (b *tokenBucket) Reserve(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// throttledWriter holds an SSE connection to the bandwidth limit by waiting
+// before writes that would exceed it, giving up when the client leaves.
+// Subscribers that fall behind this way start dropping events at the broker
+// like any other slow consumer. The limit is re-read on every write so a
+// config reload applies to open streams too.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx    context.Context
+	limit  *atomic.Int64
+	rate   int64
+	bucket *tokenBucket
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	rate := w.limit.Load()
+	if rate <= 0 {
+		return w.ResponseWriter.Write(p)
+	}
+	if w.bucket == nil {
+		w.bucket = newTokenBucket(float64(rate), float64(rate))
+	} else if rate != w.rate {
+		w.bucket.SetRate(float64(rate))
+	}
+	w.rate = rate
+
+	if wait := w.bucket.Reserve(float64(len(p))); wait > 0 {
+		throttledWrites.Inc()
+		throttleWait.Add(uint64(wait.Milliseconds()))
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-w.ctx.Done():
+			timer.Stop()
+			return 0, w.ctx.Err()
+		}
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *throttledWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// throttleMiddleware limits every SSE connection to limit bytes per second;
+// zero or less disables it.
+func throttleMiddleware(limit *atomic.Int64, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(&throttledWriter{ResponseWriter: w, ctx: r.Context(), limit: limit}, r)
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	tierHot  = "hot"
+	tierWarm = "warm"
+	tierCold = "cold"
+
+	archiveInterval    = 10 * time.Minute
+	archiveSegmentSize = 1000
+	maxReplayPage      = 1000
+)
+
+var (
+	historyTierReads = newCounterVec("chat_history_tier_reads_total", "History reads by tier, and whether the tier served any of the envelopes returned.", "tier", "result")
+	archivedMessages = newCounter("chat_history_archived_total", "Messages moved from the store into archive segments.")
+)
+
+// tieredHistory serves room history from three tiers, newest to oldest: the
+// broker's in-memory history of recent envelopes, the message store, and
+// segments archived from the store into the blob store. Reads span the tiers
+// transparently; only as many are consulted as a read needs.
+type tieredHistory struct {
+	broker *Broker
+	store  *messageStore
+	blobs  BlobStore
+}
+
+func newTieredHistory(broker *Broker, store *messageStore, blobs BlobStore) *tieredHistory {
+	return &tieredHistory{broker: broker, store: store, blobs: blobs}
+}
+
+// covers reports whether envs start right after seq, so nothing older is
+// needed.
+func covers(envs []Envelope, seq uint64) bool {
+	return len(envs) > 0 && envs[0].Seq <= seq+1
+}
+
+// Since returns up to limit envelopes of room with a sequence greater than
+// seq, oldest first, in server time order like Broker.Replay.
+func (t *tieredHistory) Since(ctx context.Context, room string, seq uint64, limit int) ([]Envelope, error) {
+	hot := t.broker.history.Since(room, seq)
+	if t.store == nil || covers(hot, seq) {
+		historyTierReads.With(tierHot, tierResult(len(hot) > 0)).Add(1)
+		hot = hot[:min(len(hot), limit)]
+		slices.SortStableFunc(hot, compareServerTime)
+		return hot, nil
+	}
+
+	warm, err := t.store.Since(ctx, room, seq, limit)
+	if err != nil {
+		return nil, err
+	}
+	var cold []Envelope
+	if !covers(warm, seq) {
+		if cold, err = t.cold(ctx, room, seq, limit); err != nil {
+			return nil, err
+		}
+	}
+
+	// Each tier only adds what comes after the newest envelope taken from
+	// the tiers before it.
+	var envs []Envelope
+	next := seq
+	take := func(tier string, part []Envelope) {
+		taken := 0
+		for _, env := range part {
+			if env.Seq > next && len(envs) < limit {
+				envs = append(envs, env)
+				next = env.Seq
+				taken++
+			}
+		}
+		historyTierReads.With(tier, tierResult(taken > 0)).Add(1)
+	}
+	if cold != nil {
+		take(tierCold, cold)
+	}
+	take(tierWarm, warm)
+	take(tierHot, hot)
+	slices.SortStableFunc(envs, compareServerTime)
+	return envs, nil
+}
+
+func tierResult(hit bool) string {
+	if hit {
+		return "hit"
+	}
+	return "miss"
+}
+
+// cold reads archive segments of room after seq until it has limit
+// envelopes. It returns nil if no segment holds any.
+func (t *tieredHistory) cold(ctx context.Context, room string, seq uint64, limit int) ([]Envelope, error) {
+	segments, err := t.store.segmentsAfter(ctx, room, seq)
+	if err != nil {
+		return nil, err
+	}
+	var envs []Envelope
+	for _, segment := range segments {
+		if len(envs) >= limit {
+			break
+		}
+		part, err := readSegment(ctx, t.blobs, segment)
+		if err != nil {
+			return nil, err
+		}
+		for _, env := range part {
+			if env.Seq > seq {
+				envs = append(envs, env)
+			}
+		}
+	}
+	return envs, nil
+}
+
+// Export calls fn with the whole history of room: archived segments, then
+// what is still in the store, or the in-memory history without a store.
+func (t *tieredHistory) Export(ctx context.Context, room string, fn func(Envelope) error) error {
+	if t.store == nil {
+		for _, env := range t.broker.Replay(room, 0) {
+			if err := fn(env); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	segments, err := t.store.segmentsAfter(ctx, room, 0)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		envs, err := readSegment(ctx, t.blobs, segment)
+		if err != nil {
+			return err
+		}
+		for _, env := range envs {
+			if err := fn(env); err != nil {
+				return err
+			}
+		}
+	}
+	return t.store.Export(ctx, room, fn)
+}
+
+// Since returns up to limit published, undeleted envelopes of room with a
+// sequence greater than seq, in sequence order.
+func (s *messageStore) Since(ctx context.Context, room string, seq uint64, limit int) ([]Envelope, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, envelope_id, seq, event, COALESCE(published_at, created_at), sent_at, data FROM messages
+		WHERE room = ? AND seq > ? AND envelope_id IS NOT NULL AND deleted_at IS NULL ORDER BY seq LIMIT ?`, room, seq, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var envs []Envelope
+	for rows.Next() {
+		env, _, err := scanStoredEnvelope(rows, room)
+		if err != nil {
+			return nil, err
+		}
+		envs = append(envs, env)
+	}
+	return envs, rows.Err()
+}
+
+// scanStoredEnvelope reads a row of id, envelope_id, seq, event, server
+// time, sent_at and data.
+func scanStoredEnvelope(rows *sql.Rows, room string) (Envelope, int64, error) {
+	env := Envelope{Room: room}
+	var ID, serverTime int64
+	var sentAt *int64
+	var data []byte
+	if err := rows.Scan(&ID, &env.ID, &env.Seq, &env.Event, &serverTime, &sentAt, &data); err != nil {
+		return Envelope{}, 0, err
+	}
+	var err error
+	if env.Data, err = decodeStored(data); err != nil {
+		return Envelope{}, 0, fmt.Errorf("message %s: %w", env.ID, err)
+	}
+	env.SentAt = fromUnixNanos(sentAt)
+	env.stamp(time.Unix(0, serverTime).UTC())
+	return env, ID, nil
+}
+
+type archiveSegment struct {
+	Room     string
+	FirstSeq uint64
+	LastSeq  uint64
+	BlobKey  string
+}
+
+// segmentsAfter lists the archive segments of room holding sequences
+// greater than seq, oldest first.
+func (s *messageStore) segmentsAfter(ctx context.Context, room string, seq uint64) ([]archiveSegment, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT first_seq, last_seq, blob_key FROM archive_segments
+		WHERE room = ? AND last_seq > ? ORDER BY first_seq`, room, seq)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var segments []archiveSegment
+	for rows.Next() {
+		segment := archiveSegment{Room: room}
+		if err := rows.Scan(&segment.FirstSeq, &segment.LastSeq, &segment.BlobKey); err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+	return segments, rows.Err()
+}
+
+// readSegment reads the envelopes of an archive segment, gzipped NDJSON in
+// sequence order.
+func readSegment(ctx context.Context, blobs BlobStore, segment archiveSegment) ([]Envelope, error) {
+	body, _, err := blobs.Get(ctx, segment.BlobKey)
+	if err != nil {
+		return nil, fmt.Errorf("archive segment %s: %w", segment.BlobKey, err)
+	}
+	defer body.Close()
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, fmt.Errorf("archive segment %s: %w", segment.BlobKey, err)
+	}
+
+	var envs []Envelope
+	dec := json.NewDecoder(gz)
+	for dec.More() {
+		env := Envelope{}
+		if err := dec.Decode(&env); err != nil {
+			return nil, fmt.Errorf("archive segment %s: %w", segment.BlobKey, err)
+		}
+		envs = append(envs, env)
+	}
+	return envs, nil
+}
+
+// archiveKey names the blob of a segment. Room names can hold anything, so
+// they are hex encoded.
+func archiveKey(room string, first, last uint64) string {
+	return fmt.Sprintf("archive/%s/%020d-%020d.ndjson.gz", hex.EncodeToString([]byte(room)), first, last)
+}
+
+// archiveBatch moves up to archiveSegmentSize published messages of room
+// stored before cutoff into one blob and returns how many it moved. The
+// blob is written first; rows are only deleted, with the segment recorded
+// in the same transaction, if none of them changed in the meantime.
+func (s *messageStore) archiveBatch(ctx context.Context, blobs BlobStore, room string, cutoff time.Time) (int, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, envelope_id, seq, event, COALESCE(published_at, created_at), sent_at, data FROM messages
+		WHERE room = ? AND created_at < ? AND envelope_id IS NOT NULL AND deleted_at IS NULL
+			AND id NOT IN (SELECT message_id FROM outbox)
+		ORDER BY seq LIMIT ?`, room, cutoff.UnixNano(), archiveSegmentSize)
+	if err != nil {
+		return 0, err
+	}
+	var IDs []int64
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	enc := json.NewEncoder(gz)
+	var first, last uint64
+	for rows.Next() {
+		env, ID, err := scanStoredEnvelope(rows, room)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if err := enc.Encode(env); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if len(IDs) == 0 {
+			first = env.Seq
+		}
+		last = env.Seq
+		IDs = append(IDs, ID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(IDs) == 0 {
+		return 0, err
+	}
+	if err := gz.Close(); err != nil {
+		return 0, err
+	}
+
+	key := archiveKey(room, first, last)
+	if err := blobs.Put(ctx, key, "application/gzip", buf); err != nil {
+		return 0, err
+	}
+
+	rawIDs, _ := json.Marshal(IDs)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`DELETE FROM messages WHERE id IN (SELECT value FROM json_each(?)) AND deleted_at IS NULL`, string(rawIDs))
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n != int64(len(IDs)) {
+		blobs.Delete(ctx, key)
+		return 0, fmt.Errorf("archive of %s: messages %d-%d changed while archiving, retrying later", room, first, last)
+	}
+	if _, err := tx.Exec(`INSERT INTO archive_segments (room, first_seq, last_seq, blob_key, messages, archived_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		room, first, last, key, len(IDs), time.Now().UnixNano()); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	archivedMessages.Add(uint64(len(IDs)))
+	return len(IDs), nil
+}
+
+// Archive moves the messages of every room with any older than age into
+// archive segments. Rooms in skip, like those whose messages disappear, are
+// left alone. Archived messages can still be read and exported but no
+// longer deleted or edited.
+func (s *messageStore) Archive(ctx context.Context, blobs BlobStore, age time.Duration, skip map[string]time.Duration) (int, error) {
+	cutoff := time.Now().Add(-age)
+	rows, err := s.db.QueryContext(ctx, `SELECT DISTINCT room FROM messages WHERE created_at < ? AND envelope_id IS NOT NULL AND deleted_at IS NULL`, cutoff.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	var rooms []string
+	for rows.Next() {
+		var room string
+		if err := rows.Scan(&room); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if _, ok := skip[room]; !ok {
+			rooms = append(rooms, room)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	archived := 0
+	for _, room := range rooms {
+		for {
+			n, err := s.archiveBatch(ctx, blobs, room, cutoff)
+			if err != nil {
+				return archived, err
+			}
+			archived += n
+			if n < archiveSegmentSize {
+				break
+			}
+		}
+	}
+	return archived, nil
+}
+
+// runArchiver archives messages older than age every archiveInterval.
+func runArchiver(store *messageStore, blobs BlobStore, rooms *roomRegistry, retention *retentionPolicies, age time.Duration) {
+	ticker := time.NewTicker(archiveInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		n, err := store.Archive(context.Background(), blobs, age, rooms.MessageTTLs())
+		if err != nil {
+			log.Printf("Archive: %v", err)
+		}
+		if n > 0 {
+			log.Printf("Archive: moved %d messages to the blob store", n)
+		}
+
+		held := retention.UserHolds()
+		for room, ttl := range retention.Expiries(rooms) {
+			n, err := store.ExpireSegments(context.Background(), blobs, room, time.Now().Add(-ttl), held)
+			if err != nil {
+				log.Printf("Retention: expiring archive segments of %s: %v", room, err)
+			}
+			if n > 0 {
+				log.Printf("Retention: deleted %d archived messages of %s", n, room)
+			}
+		}
+	}
+}
+
+// replayLimit reads the limit query parameter of a history read.
+func replayLimit(raw string) (int, error) {
+	if raw == "" {
+		return maxReplayPage, nil
+	}
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit < 1 || limit > maxReplayPage {
+		return 0, fmt.Errorf("%w: limit must be between 1 and %d", errInvalidRequest, maxReplayPage)
+	}
+	return limit, nil
+}
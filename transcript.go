@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// transcriptFlushEvery is how many entries a transcript writes between
+// flushes, so long ones arrive as they render.
+const transcriptFlushEvery = 100
+
+var errTranscriptEnd = errors.New("past the end of the transcript")
+
+var transcriptTemplates = template.Must(template.New("").Funcs(template.FuncMap{
+	"stamp": func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04:05 MST") },
+	"iso":   func(t time.Time) string { return t.UTC().Format(time.RFC3339Nano) },
+}).Parse(`
+{{define "head"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="UTF-8">
+<title>Transcript of {{.Room}}</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 0 auto; max-width: 48rem; padding: 1rem; color: #222; }
+header { border-bottom: 1px solid #ddd; margin-bottom: 1rem; }
+h1 { font-size: 1.3rem; }
+header p, footer, .meta, .note { color: #666; font-size: .85rem; }
+ol { list-style: none; padding: 0; }
+li { margin: 0 0 .9rem; }
+.user { font-weight: 600; color: #222; }
+.text, pre { margin: .2rem 0 0; white-space: pre-wrap; overflow-wrap: anywhere; }
+pre { background: #f6f6f6; padding: .5rem; }
+img { display: block; max-width: 100%; max-height: 24rem; margin-top: .3rem; }
+.notice { border-left: 3px solid #2962ff; padding-left: .5rem; }
+</style>
+</head>
+<body>
+<header>
+<h1>Transcript of {{.Room}}</h1>
+<p>Exported {{stamp .Exported}}{{if not .From.IsZero}} · from {{stamp .From}}{{end}}{{if not .To.IsZero}} · until {{stamp .To}}{{end}}</p>
+</header>
+<ol>
+{{end}}
+
+{{define "message"}}<li id="{{.ID}}">
+<div class="meta"><span class="user">{{.Chat.UserID}}</span> <time datetime="{{iso .Time}}">{{stamp .Time}}</time>{{with .Chat.ForwardedFrom}} · forwarded from {{.UserID}} in {{.Room}}{{end}}{{if .Chat.Via}} · via {{.Chat.Via}}{{end}}</div>
+{{if .Chat.Ciphertext}}<p class="note">Encrypted message</p>
+{{else if eq .Chat.ContentType "code"}}<pre><code>{{.Chat.Message}}</code></pre>
+{{else if .Chat.Message}}<p class="text">{{.Chat.Message}}</p>
+{{end}}{{with .Chat.Attachment}}{{if $.Image}}<img src="{{$.Image}}" alt="{{.Kind}} attachment">
+{{else}}<p class="note">Attachment: <a href="{{.URL}}">{{.Kind}}</a> ({{.ContentType}}, {{.Size}} bytes)</p>
+{{end}}{{end}}</li>
+{{end}}
+
+{{define "announcement"}}<li id="{{.ID}}" class="notice">
+<div class="meta">Announcement <time datetime="{{iso .Time}}">{{stamp .Time}}</time></div>
+<p class="text">{{.Message}}</p>
+</li>
+{{end}}
+
+{{define "foot"}}</ol>
+<footer>{{.Messages}} messages{{if .Incomplete}} · the transcript is incomplete: {{.Incomplete}}{{end}}</footer>
+</body>
+</html>
+{{end}}
+`))
+
+type transcriptHead struct {
+	Room     string
+	Exported time.Time
+	From, To time.Time
+}
+
+type transcriptMessage struct {
+	ID    string
+	Time  time.Time
+	Chat  Chat
+	Image template.URL
+}
+
+type transcriptAnnouncement struct {
+	ID      string
+	Time    time.Time
+	Message string
+}
+
+type transcriptFoot struct {
+	Messages   int
+	Incomplete string
+}
+
+// transcriptRange reads the from and until query parameters, RFC 3339 times
+// either of which may be left out.
+func transcriptRange(r *http.Request) (time.Time, time.Time, error) {
+	var bounds [2]time.Time
+	for i, name := range []string{"from", "until"} {
+		raw := r.URL.Query().Get(name)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("%w: %s must be an RFC 3339 time", errInvalidRequest, name)
+		}
+		bounds[i] = t
+	}
+	if !bounds[0].IsZero() && !bounds[1].IsZero() && !bounds[0].Before(bounds[1]) {
+		return time.Time{}, time.Time{}, fmt.Errorf("%w: from must be before until", errInvalidRequest)
+	}
+	return bounds[0], bounds[1], nil
+}
+
+// embeddedImage returns an image attachment as a data URL, so the
+// transcript shows it without the server, or "" if it can't be read.
+func embeddedImage(ctx context.Context, blobs BlobStore, attachment *Attachment) template.URL {
+	if attachment == nil || attachment.Kind != "image" || attachment.Size > maxImageSize {
+		return ""
+	}
+	body, contentType, err := blobs.Get(ctx, attachment.ID)
+	if err != nil {
+		return ""
+	}
+	defer body.Close()
+	raw, err := io.ReadAll(io.LimitReader(body, maxImageSize+1))
+	if err != nil || len(raw) > maxImageSize || !strings.HasPrefix(contentType, "image/") {
+		return ""
+	}
+	return template.URL("data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(raw))
+}
+
+// transcriptHandler renders the history of a room, or the part of it
+// between from and until, as a standalone HTML page for archiving. Chat
+// messages and announcements go in, with image attachments embedded; it is
+// written as it's read, so a failure partway ends the page with a note
+// rather than an error.
+func transcriptHandler(tiers *tieredHistory, blobs BlobStore, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room := r.PathValue("room")
+		from, until, err := transcriptRange(r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		detail := r.URL.Query()
+		audit.Record(auditActor(r), "room.transcript", room, strings.TrimSpace("from="+detail.Get("from")+" until="+detail.Get("until")))
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", room+".html"))
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src data:; style-src 'unsafe-inline'")
+		rc := http.NewResponseController(w)
+		transcriptTemplates.ExecuteTemplate(w, "head", transcriptHead{Room: room, Exported: time.Now(), From: from, To: until})
+
+		foot := transcriptFoot{}
+		entries := 0
+		err = tiers.Export(r.Context(), room, func(env Envelope) error {
+			if !from.IsZero() && env.Time.Before(from) {
+				return nil
+			}
+			if !until.IsZero() && !env.Time.Before(until) {
+				return errTranscriptEnd
+			}
+			var err error
+			switch env.Event {
+			case "":
+				msg := transcriptMessage{ID: env.ID, Time: env.Time}
+				if json.Unmarshal(env.Data, &msg.Chat) != nil {
+					return nil
+				}
+				msg.Image = embeddedImage(r.Context(), blobs, msg.Chat.Attachment)
+				err = transcriptTemplates.ExecuteTemplate(w, "message", msg)
+				foot.Messages++
+			case "announcement":
+				announcement := Announcement{}
+				if json.Unmarshal(env.Data, &announcement) != nil {
+					return nil
+				}
+				err = transcriptTemplates.ExecuteTemplate(w, "announcement", transcriptAnnouncement{ID: env.ID, Time: env.Time, Message: announcement.Message})
+			default:
+				return nil
+			}
+			if entries++; entries%transcriptFlushEvery == 0 {
+				rc.Flush()
+			}
+			return err
+		})
+		if err != nil && !errors.Is(err, errTranscriptEnd) {
+			log.Printf("Transcript of %s: %v", room, err)
+			foot.Incomplete = "reading the history failed"
+		}
+		transcriptTemplates.ExecuteTemplate(w, "foot", foot)
+	}
+}
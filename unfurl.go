@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	unfurlQueueSize    = 256
+	unfurlWorkers      = 4
+	unfurlTimeout      = 5 * time.Second
+	unfurlMaxBody      = 512 << 10
+	unfurlMaxURLs      = 3
+	unfurlCacheSize    = 1024
+	unfurlCacheTTL     = time.Hour
+	unfurlMaxRedirects = 3
+)
+
+var (
+	errUnfurlBlocked = errors.New("unfurl: destination not allowed")
+
+	metaTagPattern  = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	attrPattern     = regexp.MustCompile(`(?is)([a-z:_-]+)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	titleTagPattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+	unfurlFetches = newCounterVec("chat_unfurl_fetches_total", "Link preview fetches by outcome.", "outcome")
+)
+
+// Preview is the payload of an `event: preview` enrichment.
+type Preview struct {
+	MessageID   string `json:"message_id"`
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+	SiteName    string `json:"site_name,omitempty"`
+}
+
+type unfurlJob struct {
+	messageID string
+	room      string
+	urls      []string
+}
+
+type cachedPreview struct {
+	preview   Preview
+	err       error
+	fetchedAt time.Time
+}
+
+// unfurler fetches OpenGraph metadata for URLs in published messages off the
+// request path and broadcasts the results into the message's room.
+type unfurler struct {
+	broker *Broker
+	client *http.Client
+	jobs   chan unfurlJob
+
+	mu    sync.Mutex
+	cache map[string]cachedPreview
+}
+
+func newUnfurler(broker *Broker) *unfurler {
+	dialer := &net.Dialer{Timeout: unfurlTimeout, Control: denyPrivateAddrs}
+	u := &unfurler{
+		broker: broker,
+		jobs:   make(chan unfurlJob, unfurlQueueSize),
+		cache:  make(map[string]cachedPreview),
+		client: &http.Client{
+			Timeout: unfurlTimeout,
+			Transport: &http.Transport{
+				Proxy:               nil,
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: unfurlTimeout,
+				MaxIdleConns:        16,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= unfurlMaxRedirects {
+					return errors.New("unfurl: too many redirects")
+				}
+				return checkUnfurlURL(req.URL)
+			},
+		},
+	}
+	for range unfurlWorkers {
+		go u.work()
+	}
+	return u
+}
+
+// denyPrivateAddrs runs after DNS resolution, so it also catches public names
+// that resolve to internal addresses.
+func denyPrivateAddrs(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() || sharedAddressSpace.Contains(addr) {
+		return errUnfurlBlocked
+	}
+	return nil
+}
+
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+func checkUnfurlURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errUnfurlBlocked
+	}
+	if port := u.Port(); port != "" && port != "80" && port != "443" {
+		return errUnfurlBlocked
+	}
+	if u.User != nil {
+		return errUnfurlBlocked
+	}
+	return nil
+}
+
+// Enqueue schedules the URLs in message for unfurling. It never blocks; when
+// the queue is full the previews are simply skipped.
+func (u *unfurler) Enqueue(messageID, room, message string) {
+	var urls []string
+	for _, raw := range urlPattern.FindAllString(message, unfurlMaxURLs) {
+		if !strings.Contains(raw, "://") {
+			raw = "https://" + raw
+		}
+		urls = append(urls, strings.TrimRight(raw, ".,;:!?)]}'\""))
+	}
+	if len(urls) == 0 {
+		return
+	}
+
+	select {
+	case u.jobs <- unfurlJob{messageID: messageID, room: room, urls: urls}:
+	default:
+		unfurlFetches.With("queue_full").Add(1)
+	}
+}
+
+func (u *unfurler) work() {
+	for job := range u.jobs {
+		for _, raw := range job.urls {
+			preview, err := u.lookup(raw)
+			if err != nil {
+				continue
+			}
+			preview.MessageID = job.messageID
+
+			payload, err := json.Marshal(preview)
+			if err != nil {
+				continue
+			}
+			if _, err := u.broker.PublishEvent(job.room, "preview", payload); err != nil {
+				log.Printf("Unfurl: publishing preview for %s: %v", job.messageID, err)
+			}
+		}
+	}
+}
+
+func (u *unfurler) lookup(raw string) (Preview, error) {
+	u.mu.Lock()
+	cached, ok := u.cache[raw]
+	u.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < unfurlCacheTTL {
+		unfurlFetches.With("cached").Add(1)
+		return cached.preview, cached.err
+	}
+
+	preview, err := u.fetch(raw)
+	if err != nil {
+		unfurlFetches.With("error").Add(1)
+	} else {
+		unfurlFetches.With("ok").Add(1)
+	}
+
+	u.mu.Lock()
+	if len(u.cache) >= unfurlCacheSize {
+		for key, entry := range u.cache {
+			if time.Since(entry.fetchedAt) >= unfurlCacheTTL || len(u.cache) >= unfurlCacheSize {
+				delete(u.cache, key)
+			}
+		}
+	}
+	u.cache[raw] = cachedPreview{preview: preview, err: err, fetchedAt: time.Now()}
+	u.mu.Unlock()
+	return preview, err
+}
+
+func (u *unfurler) fetch(raw string) (Preview, error) {
+	target, err := url.Parse(raw)
+	if err != nil {
+		return Preview{}, err
+	}
+	if err := checkUnfurlURL(target); err != nil {
+		return Preview{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), unfurlTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return Preview{}, err
+	}
+	req.Header.Set("User-Agent", "go-event-stream-chat-unfurl/1.0")
+	req.Header.Set("Accept", "text/html")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return Preview{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Preview{}, fmt.Errorf("unfurl: %s returned %d", raw, resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.Contains(ct, "text/html") {
+		return Preview{}, fmt.Errorf("unfurl: %s is %q, not html", raw, ct)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, unfurlMaxBody))
+	if err != nil {
+		return Preview{}, err
+	}
+
+	preview := parseOpenGraph(string(body))
+	preview.URL = resp.Request.URL.String()
+	if preview.Title == "" && preview.Description == "" {
+		return Preview{}, fmt.Errorf("unfurl: %s has no metadata", raw)
+	}
+	return preview, nil
+}
+
+func parseOpenGraph(doc string) Preview {
+	preview := Preview{}
+	var fallbackDescription string
+
+	for _, tag := range metaTagPattern.FindAllString(doc, -1) {
+		attrs := map[string]string{}
+		for _, m := range attrPattern.FindAllStringSubmatch(tag, -1) {
+			attrs[strings.ToLower(m[1])] = html.UnescapeString(m[2] + m[3])
+		}
+
+		key := attrs["property"]
+		if key == "" {
+			key = attrs["name"]
+		}
+		content := strings.TrimSpace(attrs["content"])
+
+		switch strings.ToLower(key) {
+		case "og:title":
+			preview.Title = content
+		case "og:description":
+			preview.Description = content
+		case "og:image":
+			preview.Image = content
+		case "og:site_name":
+			preview.SiteName = content
+		case "description":
+			fallbackDescription = content
+		}
+	}
+
+	if preview.Title == "" {
+		if m := titleTagPattern.FindStringSubmatch(doc); m != nil {
+			preview.Title = strings.TrimSpace(html.UnescapeString(m[1]))
+		}
+	}
+	if preview.Description == "" {
+		preview.Description = fallbackDescription
+	}
+	return preview
+}
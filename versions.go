@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiVersionHeader lets a client pick an API version without changing its
+// paths; /v{version}/ prefixes do the same and win when both agree.
+const apiVersionHeader = "X-API-Version"
+
+var (
+	errUnsupportedVersion = errors.New("unsupported API version")
+
+	apiRequests = newCounterVec("chat_api_requests_total", "Requests by negotiated API version; unversioned ones asked for none.", "version")
+)
+
+// APIVersion is one version of the wire format. A deprecated version keeps
+// working until its sunset; its responses and streams say so.
+type APIVersion struct {
+	Version    string     `json:"version"`
+	Deprecated bool       `json:"deprecated"`
+	Sunset     *time.Time `json:"sunset,omitempty"`
+	Successor  string     `json:"successor,omitempty"`
+}
+
+// apiVersions are the versions served side by side, oldest first. Requests
+// that ask for none get the latest.
+var apiVersions = []APIVersion{
+	{Version: "1"},
+	// 2 answers /chat/send with the message's envelope ID, sequence and
+	// server time as JSON.
+	{Version: "2"},
+}
+
+func latestAPIVersion() APIVersion {
+	return apiVersions[len(apiVersions)-1]
+}
+
+func lookupAPIVersion(name string) (APIVersion, bool) {
+	for _, v := range apiVersions {
+		if v.Version == name {
+			return v, true
+		}
+	}
+	return APIVersion{}, false
+}
+
+func unsupportedVersion(name string) error {
+	supported := make([]string, len(apiVersions))
+	for i, v := range apiVersions {
+		supported[i] = v.Version
+	}
+	return withDetails(fmt.Errorf("%w %q", errUnsupportedVersion, name), map[string]any{"supported": supported})
+}
+
+type apiVersionKey struct{}
+
+// apiVersionFrom returns the API version negotiated for r.
+func apiVersionFrom(r *http.Request) APIVersion {
+	if v, ok := r.Context().Value(apiVersionKey{}).(APIVersion); ok {
+		return v
+	}
+	return latestAPIVersion()
+}
+
+// versionPrefix splits a /v{version}/ prefix off path.
+func versionPrefix(path string) (version, rest string, ok bool) {
+	trimmed, found := strings.CutPrefix(path, "/v")
+	if !found {
+		return "", path, false
+	}
+	version, rest, _ = strings.Cut(trimmed, "/")
+	if version == "" || strings.Trim(version, "0123456789") != "" {
+		return "", path, false
+	}
+	return version, "/" + rest, true
+}
+
+// versionMiddleware negotiates the API version of every request from its
+// path prefix or the X-API-Version header, routes versioned paths to the same
+// handlers as unversioned ones and announces deprecations in the Deprecation
+// and Sunset headers. Handlers that differ between versions branch on
+// apiVersionFrom.
+func versionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested := r.Header.Get(apiVersionHeader)
+		prefixed, rest, ok := versionPrefix(r.URL.Path)
+		if ok {
+			if requested != "" && requested != prefixed {
+				writeError(w, r, fmt.Errorf("%w: %s %s contradicts the path's version %s", errInvalidRequest, apiVersionHeader, requested, prefixed))
+				return
+			}
+			requested = prefixed
+		}
+
+		version, label := latestAPIVersion(), "unversioned"
+		if requested != "" {
+			if version, ok = lookupAPIVersion(requested); !ok {
+				writeError(w, r, unsupportedVersion(requested))
+				return
+			}
+			label = version.Version
+		}
+		apiRequests.With(label).Add(1)
+
+		w.Header().Set(apiVersionHeader, version.Version)
+		if version.Deprecated {
+			w.Header().Set("Deprecation", "true")
+			if version.Sunset != nil {
+				w.Header().Set("Sunset", version.Sunset.UTC().Format(http.TimeFormat))
+			}
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version))
+		if prefixed != "" {
+			u := *r.URL
+			u.Path, u.RawPath = rest, ""
+			r.URL = &u
+		}
+		next.ServeHTTP(w, r)
+	})
+}
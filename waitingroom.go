@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const queuePositionInterval = 5 * time.Second
+
+var (
+	errRoomFull = errors.New("room is at capacity")
+
+	waitingRoomAdmissions = newCounterVec("chat_waiting_room_admissions_total", "Streams that got a room slot, by whether they queued for it.", "queued")
+)
+
+// QueuePosition is the data of a queue-position event: where a stream waits
+// for a slot in a room at capacity. Position 1 is next in line.
+type QueuePosition struct {
+	Room     string `json:"room"`
+	Position int    `json:"position"`
+	Waiting  int    `json:"waiting"`
+	Capacity int    `json:"capacity"`
+}
+
+type queueTicket struct {
+	room     string
+	ID       string
+	admitted chan struct{}
+}
+
+func (t *queueTicket) Admitted() <-chan struct{} {
+	return t.admitted
+}
+
+type roomSlots struct {
+	holders map[string]bool
+	queue   []*queueTicket
+}
+
+// waitingRoom hands out the slots of rooms with a capacity. Streams that find
+// a room full queue for it in arrival order and get the next free slot.
+// Slots are held by subscriber ID until released.
+type waitingRoom struct {
+	capacity func(room string) int
+
+	mu    sync.Mutex
+	rooms map[string]*roomSlots
+}
+
+func newWaitingRoom(capacity func(room string) int) *waitingRoom {
+	wr := &waitingRoom{capacity: capacity, rooms: make(map[string]*roomSlots)}
+	newGaugeFunc("chat_waiting_room_queued", "Streams waiting for a slot in a room at capacity.", func() float64 {
+		wr.mu.Lock()
+		defer wr.mu.Unlock()
+		queued := 0
+		for _, slots := range wr.rooms {
+			queued += len(slots.queue)
+		}
+		return float64(queued)
+	})
+	return wr
+}
+
+func (wr *waitingRoom) slotsLocked(room string) *roomSlots {
+	slots, ok := wr.rooms[room]
+	if !ok {
+		slots = &roomSlots{holders: make(map[string]bool)}
+		wr.rooms[room] = slots
+	}
+	return slots
+}
+
+func (wr *waitingRoom) hasRoomLocked(room string, slots *roomSlots) bool {
+	capacity := wr.capacity(room)
+	return capacity <= 0 || len(slots.holders) < capacity
+}
+
+// TryAcquire takes a slot in room for ID without queueing. It fails if the
+// room is full or others are already waiting for it.
+func (wr *waitingRoom) TryAcquire(room, ID string) bool {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	slots := wr.slotsLocked(room)
+	if !slots.holders[ID] && (len(slots.queue) > 0 || !wr.hasRoomLocked(room, slots)) {
+		return false
+	}
+	slots.holders[ID] = true
+	return true
+}
+
+// Enqueue takes a slot in room for ID if one is free and returns nil.
+// Otherwise it returns a ticket that is admitted once a slot frees up; the
+// caller must Cancel it if it stops waiting.
+func (wr *waitingRoom) Enqueue(room, ID string) *queueTicket {
+	if wr.TryAcquire(room, ID) {
+		waitingRoomAdmissions.With("false").Add(1)
+		return nil
+	}
+
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	ticket := &queueTicket{room: room, ID: ID, admitted: make(chan struct{})}
+	slots := wr.slotsLocked(room)
+	slots.queue = append(slots.queue, ticket)
+	wr.admitLocked(room, slots)
+	return ticket
+}
+
+// Position reports where ticket is in its queue, 0 once it was admitted.
+func (wr *waitingRoom) Position(ticket *queueTicket) QueuePosition {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	pos := QueuePosition{Room: ticket.room, Capacity: wr.capacity(ticket.room)}
+	if slots, ok := wr.rooms[ticket.room]; ok {
+		pos.Waiting = len(slots.queue)
+		pos.Position = slices.Index(slots.queue, ticket) + 1
+	}
+	return pos
+}
+
+// Cancel takes ticket out of its queue, or gives the slot back if it was
+// admitted in the meantime.
+func (wr *waitingRoom) Cancel(ticket *queueTicket) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	slots, ok := wr.rooms[ticket.room]
+	if !ok {
+		return
+	}
+	if i := slices.Index(slots.queue, ticket); i >= 0 {
+		slots.queue = slices.Delete(slots.queue, i, i+1)
+	}
+	wr.releaseLocked(ticket.room, ticket.ID)
+}
+
+// Release gives the slot ID holds in room to the next stream in line.
+func (wr *waitingRoom) Release(room, ID string) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.releaseLocked(room, ID)
+}
+
+// ReleaseAll gives up every slot ID holds.
+func (wr *waitingRoom) ReleaseAll(ID string) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	for room, slots := range wr.rooms {
+		if slots.holders[ID] {
+			wr.releaseLocked(room, ID)
+		}
+	}
+}
+
+// Resized admits waiting streams after the capacity of room went up.
+func (wr *waitingRoom) Resized(room string) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	if slots, ok := wr.rooms[room]; ok {
+		wr.admitLocked(room, slots)
+	}
+}
+
+func (wr *waitingRoom) releaseLocked(room, ID string) {
+	slots, ok := wr.rooms[room]
+	if !ok {
+		return
+	}
+	delete(slots.holders, ID)
+	wr.admitLocked(room, slots)
+	if len(slots.holders) == 0 && len(slots.queue) == 0 {
+		delete(wr.rooms, room)
+	}
+}
+
+func (wr *waitingRoom) admitLocked(room string, slots *roomSlots) {
+	for len(slots.queue) > 0 && wr.hasRoomLocked(room, slots) {
+		ticket := slots.queue[0]
+		slots.queue = slots.queue[1:]
+		slots.holders[ticket.ID] = true
+		close(ticket.admitted)
+		waitingRoomAdmissions.With("true").Add(1)
+	}
+}
+
+// awaitSlot queues subscriber for room and streams queue-position events
+// until it gets a slot. It reports false if the stream ended first.
+func awaitSlot(w http.ResponseWriter, r *http.Request, rc *http.ResponseController, waiting *waitingRoom, subscriber *Subscriber, room string) bool {
+	ticket := waiting.Enqueue(room, subscriber.ID)
+	if ticket == nil {
+		return true
+	}
+
+	ticker := time.NewTicker(queuePositionInterval)
+	defer ticker.Stop()
+
+	for {
+		pos := waiting.Position(ticket)
+		positionRaw, _ := json.Marshal(pos)
+		writeEnvelope(w, Envelope{ID: subscriber.ID, Event: "queue-position", Room: room, Time: time.Now().UTC(), Data: positionRaw})
+		rc.Flush()
+		if pos.Position == 0 {
+			return true
+		}
+
+		select {
+		case <-ticket.Admitted():
+		case <-ticker.C:
+		case <-subscriber.Kicked():
+			waiting.Cancel(ticket)
+			return false
+		case <-r.Context().Done():
+			waiting.Cancel(ticket)
+			return false
+		}
+	}
+}
+
+type roomCapacityRequest struct {
+	Capacity int `json:"capacity"`
+}
+
+func setRoomCapacityHandler(rooms *roomRegistry, waiting *waitingRoom, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("room")
+		user := userFromRequest(r)
+		if !rooms.IsOwner(name, user) {
+			writeError(w, r, fmt.Errorf("%w: only the room owner can change its capacity", errForbidden))
+			return
+		}
+
+		req := roomCapacityRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+
+		room, err := rooms.SetCapacity(name, req.Capacity)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		waiting.Resized(name)
+		audit.Record(user, "room.capacity", name, strconv.Itoa(room.Capacity))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(room)
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	webhookVia        = "webhook"
+	webhookMaxBody    = 256 << 10
+	webhookMaxMessage = 4000
+
+	webhookFormatText         = "text"
+	webhookFormatGitHub       = "github"
+	webhookFormatAlertmanager = "alertmanager"
+	webhookFormatTemplate     = "template"
+)
+
+var (
+	errWebhookNotFound = errors.New("webhook not found")
+	errWebhookPayload  = errors.New("webhook payload not understood")
+
+	webhookNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9 _.-]{0,63}$`)
+	webhookMessages    = newCounterVec("chat_webhook_messages_total", "Inbound webhook deliveries by format and outcome.", "format", "outcome")
+)
+
+// Webhook is an inbound URL external systems post to. Its token is only shown
+// once, when it is created.
+type Webhook struct {
+	ID        string    `json:"id"`
+	Room      string    `json:"room"`
+	Name      string    `json:"name"`
+	Format    string    `json:"format"`
+	Template  string    `json:"template,omitempty"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+
+	tokenHash [32]byte
+	tmpl      *template.Template
+}
+
+type webhookRegistry struct {
+	mu    sync.RWMutex
+	hooks map[string]*Webhook
+}
+
+func newWebhookRegistry() *webhookRegistry {
+	return &webhookRegistry{hooks: make(map[string]*Webhook)}
+}
+
+func (wr *webhookRegistry) Add(hook *Webhook) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+	hook.tokenHash = sha256.Sum256([]byte(token))
+
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.hooks[hook.ID] = hook
+	return token, nil
+}
+
+func (wr *webhookRegistry) List(room string) []Webhook {
+	wr.mu.RLock()
+	defer wr.mu.RUnlock()
+
+	hooks := make([]Webhook, 0)
+	for _, hook := range wr.hooks {
+		if hook.Room == room {
+			hooks = append(hooks, *hook)
+		}
+	}
+	slices.SortFunc(hooks, func(a, b Webhook) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return hooks
+}
+
+func (wr *webhookRegistry) Remove(room, ID string) bool {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	hook, ok := wr.hooks[ID]
+	if !ok || hook.Room != room {
+		return false
+	}
+	delete(wr.hooks, ID)
+	return true
+}
+
+// Authenticate returns the webhook with ID if token is its token.
+func (wr *webhookRegistry) Authenticate(ID, token string) (*Webhook, bool) {
+	wr.mu.RLock()
+	hook, ok := wr.hooks[ID]
+	wr.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hook, subtle.ConstantTimeCompare(sum[:], hook.tokenHash[:]) == 1
+}
+
+// render turns a delivery into the text of a chat message.
+func (hook *Webhook) render(r *http.Request, body []byte) (string, error) {
+	switch hook.Format {
+	case webhookFormatGitHub:
+		return renderGitHub(r.Header.Get("X-GitHub-Event"), body)
+	case webhookFormatAlertmanager:
+		return renderAlertmanager(body)
+	case webhookFormatTemplate:
+		payload := map[string]any{}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			return "", fmt.Errorf("%w: %v", errWebhookPayload, err)
+		}
+		var out strings.Builder
+		if err := hook.tmpl.Execute(&out, payload); err != nil {
+			return "", fmt.Errorf("%w: %v", errWebhookPayload, err)
+		}
+		return out.String(), nil
+	}
+
+	// Plain text, or JSON with a "text" (Slack style) or "message" field.
+	payload := struct {
+		Text    string `json:"text"`
+		Message string `json:"message"`
+	}{}
+	if json.Unmarshal(body, &payload) == nil {
+		return cmp.Or(payload.Text, payload.Message), nil
+	}
+	return string(body), nil
+}
+
+type githubPayload struct {
+	Action     string `json:"action"`
+	Ref        string `json:"ref"`
+	Compare    string `json:"compare"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	Sender struct {
+		Login string `json:"login"`
+	} `json:"sender"`
+	Commits []struct {
+		Message string `json:"message"`
+	} `json:"commits"`
+	PullRequest *struct {
+		Number  int    `json:"number"`
+		Title   string `json:"title"`
+		HTMLURL string `json:"html_url"`
+		Merged  bool   `json:"merged"`
+	} `json:"pull_request"`
+	Issue *struct {
+		Number  int    `json:"number"`
+		Title   string `json:"title"`
+		HTMLURL string `json:"html_url"`
+	} `json:"issue"`
+	Comment *struct {
+		HTMLURL string `json:"html_url"`
+	} `json:"comment"`
+	Release *struct {
+		TagName string `json:"tag_name"`
+		HTMLURL string `json:"html_url"`
+	} `json:"release"`
+	WorkflowRun *struct {
+		Name       string `json:"name"`
+		Conclusion string `json:"conclusion"`
+		HTMLURL    string `json:"html_url"`
+	} `json:"workflow_run"`
+}
+
+func renderGitHub(event string, body []byte) (string, error) {
+	p := githubPayload{}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return "", fmt.Errorf("%w: %v", errWebhookPayload, err)
+	}
+	repo, who := p.Repository.FullName, p.Sender.Login
+
+	switch {
+	case event == "ping":
+		return fmt.Sprintf("[%s] webhook connected", repo), nil
+	case event == "push":
+		branch := strings.TrimPrefix(p.Ref, "refs/heads/")
+		msg := fmt.Sprintf("[%s] %s pushed %d commit(s) to %s", repo, who, len(p.Commits), branch)
+		if len(p.Commits) > 0 {
+			first, _, _ := strings.Cut(p.Commits[len(p.Commits)-1].Message, "\n")
+			msg += ": " + first
+		}
+		return strings.TrimSpace(msg + " " + p.Compare), nil
+	case event == "pull_request" && p.PullRequest != nil:
+		action := p.Action
+		if action == "closed" && p.PullRequest.Merged {
+			action = "merged"
+		}
+		return fmt.Sprintf("[%s] %s %s pull request #%d: %s %s", repo, who, action, p.PullRequest.Number, p.PullRequest.Title, p.PullRequest.HTMLURL), nil
+	case event == "issue_comment" && p.Issue != nil && p.Comment != nil:
+		return fmt.Sprintf("[%s] %s commented on #%d: %s %s", repo, who, p.Issue.Number, p.Issue.Title, p.Comment.HTMLURL), nil
+	case event == "issues" && p.Issue != nil:
+		return fmt.Sprintf("[%s] %s %s issue #%d: %s %s", repo, who, p.Action, p.Issue.Number, p.Issue.Title, p.Issue.HTMLURL), nil
+	case event == "release" && p.Release != nil:
+		return fmt.Sprintf("[%s] %s %s release %s %s", repo, who, p.Action, p.Release.TagName, p.Release.HTMLURL), nil
+	case event == "workflow_run" && p.WorkflowRun != nil:
+		if p.Action != "completed" {
+			return "", nil
+		}
+		return fmt.Sprintf("[%s] workflow %s %s %s", repo, p.WorkflowRun.Name, p.WorkflowRun.Conclusion, p.WorkflowRun.HTMLURL), nil
+	}
+	return "", fmt.Errorf("%w: unsupported GitHub event %q", errWebhookPayload, event)
+}
+
+type alertmanagerPayload struct {
+	Status string `json:"status"`
+	Alerts []struct {
+		Status      string            `json:"status"`
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"alerts"`
+}
+
+func renderAlertmanager(body []byte) (string, error) {
+	p := alertmanagerPayload{}
+	if err := json.Unmarshal(body, &p); err != nil || len(p.Alerts) == 0 {
+		return "", fmt.Errorf("%w: expected an Alertmanager notification", errWebhookPayload)
+	}
+	lines := make([]string, 0, len(p.Alerts))
+	for _, alert := range p.Alerts {
+		summary := cmp.Or(alert.Annotations["summary"], alert.Annotations["description"])
+		line := fmt.Sprintf("[%s] %s", strings.ToUpper(alert.Status), alert.Labels["alertname"])
+		if summary != "" {
+			line += ": " + summary
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+type createWebhookRequest struct {
+	Name     string `json:"name"`
+	Format   string `json:"format"`
+	Template string `json:"template"`
+}
+
+type createWebhookResponse struct {
+	Webhook
+	Token      string `json:"token"`
+	URL        string `json:"url"`
+	SlackURL   string `json:"slack_url"`
+	DiscordURL string `json:"discord_url"`
+}
+
+func createWebhookHandler(rooms *roomRegistry, webhooks *webhookRegistry, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room := r.PathValue("room")
+		user := userFromRequest(r)
+		if !rooms.IsOwner(room, user) {
+			writeError(w, r, fmt.Errorf("%w: only the room owner can manage webhooks", errForbidden))
+			return
+		}
+		// Webhooks post plaintext the server formats.
+		if rooms.Encrypted(room) {
+			writeError(w, r, fmt.Errorf("%w: webhooks can't post to encrypted rooms", errRoomEncrypted))
+			return
+		}
+
+		req := createWebhookRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, invalidJSON(err))
+			return
+		}
+		if !webhookNamePattern.MatchString(req.Name) {
+			writeError(w, r, fmt.Errorf("%w: name must be 1-64 letters, digits, spaces, '_', '.' or '-'", errInvalidRequest))
+			return
+		}
+
+		hook := &Webhook{Room: room, Name: req.Name, Format: cmp.Or(req.Format, webhookFormatText), CreatedBy: user, CreatedAt: time.Now().UTC()}
+		switch hook.Format {
+		case webhookFormatText, webhookFormatGitHub, webhookFormatAlertmanager:
+		case webhookFormatTemplate:
+			tmpl, err := template.New(req.Name).Option("missingkey=zero").Parse(req.Template)
+			if err != nil || req.Template == "" {
+				writeError(w, r, withDetails(fmt.Errorf("%w: invalid template", errInvalidRequest), fmt.Sprint(err)))
+				return
+			}
+			hook.Template, hook.tmpl = req.Template, tmpl
+		default:
+			writeError(w, r, fmt.Errorf("%w: format must be text, github, alertmanager or template", errInvalidRequest))
+			return
+		}
+
+		ID, err := newAttachmentID()
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		hook.ID = ID
+		token, err := webhooks.Add(hook)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		audit.Record(user, "webhook.create", room, "id="+hook.ID+" name="+hook.Name)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		url := absoluteURL(r, "/hooks/"+hook.ID+"/"+token)
+		json.NewEncoder(w).Encode(createWebhookResponse{
+			Webhook:    *hook,
+			Token:      token,
+			URL:        url,
+			SlackURL:   url + "/" + webhookDialectSlack,
+			DiscordURL: url + "/" + webhookDialectDiscord,
+		})
+	}
+}
+
+func listWebhooksHandler(rooms *roomRegistry, webhooks *webhookRegistry) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room := r.PathValue("room")
+		if !rooms.IsOwner(room, userFromRequest(r)) {
+			writeError(w, r, fmt.Errorf("%w: only the room owner can manage webhooks", errForbidden))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(webhooks.List(room))
+	}
+}
+
+func deleteWebhookHandler(rooms *roomRegistry, webhooks *webhookRegistry, audit *auditLog) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room := r.PathValue("room")
+		user := userFromRequest(r)
+		if !rooms.IsOwner(room, user) {
+			writeError(w, r, fmt.Errorf("%w: only the room owner can manage webhooks", errForbidden))
+			return
+		}
+		if !webhooks.Remove(room, r.PathValue("id")) {
+			writeError(w, r, errWebhookNotFound)
+			return
+		}
+		audit.Record(user, "webhook.delete", room, "id="+r.PathValue("id"))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// receiveWebhookHandler posts a delivery into the webhook's room as a chat
+// message from "webhook:<name>". Deliveries that render to nothing, like a
+// GitHub workflow that only started, are accepted and dropped. A dialect of
+// slack or discord reads and answers like those services' incoming webhooks,
+// whatever the webhook's own format, so existing integrations work unchanged.
+func receiveWebhookHandler(broker *Broker, rooms *roomRegistry, webhooks *webhookRegistry, dialect string) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hook, ok := webhooks.Authenticate(r.PathValue("id"), r.PathValue("token"))
+		if !ok {
+			writeError(w, r, errWebhookNotFound)
+			return
+		}
+		if err := broker.Admit(); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, webhookMaxBody))
+		if err != nil {
+			writeError(w, r, fmt.Errorf("%w: body is limited to %d bytes", errInvalidRequest, webhookMaxBody))
+			return
+		}
+		format := cmp.Or(dialect, hook.Format)
+		var username, message string
+		switch dialect {
+		case webhookDialectSlack:
+			username, message, err = renderSlack(r, bytes.TrimSpace(body))
+		case webhookDialectDiscord:
+			username, message, err = renderDiscord(bytes.TrimSpace(body))
+		default:
+			message, err = hook.render(r, bytes.TrimSpace(body))
+		}
+		if err != nil {
+			webhookMessages.With(format, "rejected").Add(1)
+			writeError(w, r, err)
+			return
+		}
+		message = strings.TrimSpace(message)
+		if message == "" {
+			webhookMessages.With(format, "ignored").Add(1)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		if len(message) > webhookMaxMessage {
+			message = strings.ToValidUTF8(message[:webhookMaxMessage], "")
+		}
+		chat := Chat{Room: hook.Room, UserID: webhookSender(hook, username), Message: message, Via: webhookVia}
+		if err := rooms.Moderate(hook.Room, &chat); err != nil {
+			webhookMessages.With(format, "rejected").Add(1)
+			writeError(w, r, err)
+			return
+		}
+
+		chatRaw, err := json.Marshal(chat)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		env, err := broker.Publish(hook.Room, chatRaw)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		webhookMessages.With(format, "published").Add(1)
+
+		switch dialect {
+		case webhookDialectSlack:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("ok"))
+			return
+		case webhookDialectDiscord:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"id": env.ID})
+	}
+}
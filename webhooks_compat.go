@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	webhookDialectSlack   = "slack"
+	webhookDialectDiscord = "discord"
+
+	maxWebhookUsername = 64
+)
+
+// slackPayload is the subset of Slack's incoming webhook format that maps to
+// a chat message. Block Kit and attachments are flattened to their text.
+type slackPayload struct {
+	Text     string `json:"text"`
+	Username string `json:"username"`
+	Blocks   []struct {
+		Text *struct {
+			Text string `json:"text"`
+		} `json:"text"`
+	} `json:"blocks"`
+	Attachments []struct {
+		Pretext  string `json:"pretext"`
+		Title    string `json:"title"`
+		Text     string `json:"text"`
+		Fallback string `json:"fallback"`
+	} `json:"attachments"`
+}
+
+// renderSlack accepts a JSON body or, like Slack, a form with the JSON in its
+// "payload" field. Many scripts post JSON with curl's default form content
+// type, so a form without that field is read as JSON.
+func renderSlack(r *http.Request, body []byte) (string, string, error) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if form, err := url.ParseQuery(string(body)); err == nil && form.Has("payload") {
+			body = []byte(form.Get("payload"))
+		}
+	}
+
+	p := slackPayload{}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return "", "", fmt.Errorf("%w: invalid_payload", errWebhookPayload)
+	}
+	lines := []string{p.Text}
+	for _, block := range p.Blocks {
+		if block.Text != nil {
+			lines = append(lines, block.Text.Text)
+		}
+	}
+	for _, a := range p.Attachments {
+		if a.Text == "" && a.Title == "" && a.Pretext == "" {
+			lines = append(lines, a.Fallback)
+			continue
+		}
+		lines = append(lines, a.Pretext, a.Title, a.Text)
+	}
+	message := joinNonEmpty(lines)
+	if message == "" {
+		return "", "", fmt.Errorf("%w: no_text", errWebhookPayload)
+	}
+	return p.Username, message, nil
+}
+
+type discordPayload struct {
+	Content  string `json:"content"`
+	Username string `json:"username"`
+	Embeds   []struct {
+		Title       string `json:"title"`
+		Description string `json:"description"`
+		URL         string `json:"url"`
+	} `json:"embeds"`
+}
+
+func renderDiscord(body []byte) (string, string, error) {
+	p := discordPayload{}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return "", "", fmt.Errorf("%w: %v", errWebhookPayload, err)
+	}
+	lines := []string{p.Content}
+	for _, embed := range p.Embeds {
+		lines = append(lines, joinNonEmpty([]string{embed.Title, embed.URL}), embed.Description)
+	}
+	message := joinNonEmpty(lines)
+	if message == "" {
+		return "", "", fmt.Errorf("%w: content or embeds required", errWebhookPayload)
+	}
+	return p.Username, message, nil
+}
+
+func joinNonEmpty(parts []string) string {
+	kept := parts[:0:0]
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			kept = append(kept, part)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+// webhookSender names the author of a delivery. Integrations may pick their
+// display name, but always under the webhook: prefix so they can't pass for
+// a user.
+func webhookSender(hook *Webhook, username string) string {
+	username = strings.TrimSpace(username)
+	if username == "" || len(username) > maxWebhookUsername {
+		username = hook.Name
+	}
+	return "webhook:" + username
+}